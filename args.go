@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// argumentError reports a tool argument that is missing or has the wrong type.
+type argumentError struct {
+	// name is the name of the argument
+	name string
+
+	// reason describes what is wrong, empty for a missing required argument
+	reason string
+}
+
+func (e *argumentError) Error() string {
+	if e.reason == "" {
+		return fmt.Sprintf("missing required argument %s", e.name)
+	}
+	return fmt.Sprintf("invalid argument %s: %s", e.name, e.reason)
+}
+
+// bindArguments decodes tool arguments into the struct pointed to by dst.
+// Each field is bound to the argument named by its arg tag, followed by ",required" for mandatory arguments:
+//
+//	type textArguments struct {
+//		Content   string   `arg:"content,required"`
+//		AtMobiles []string `arg:"at_mobiles"`
+//	}
+//
+// Strings, booleans, numbers, string lists and arrays of structs are supported.
+// Fields of embedded structs are bound as if they belonged to dst.
+// Missing and null arguments leave the field unchanged, so defaults can be set before binding.
+func bindArguments(args map[string]interface{}, dst interface{}) error {
+	v := reflect.ValueOf(dst)
+	if v.Kind() != reflect.Pointer || v.Elem().Kind() != reflect.Struct {
+		return fmt.Errorf("arguments must be bound to a pointer to a struct, got %T", dst)
+	}
+
+	return bindStruct(args, v.Elem())
+}
+
+// bindStruct binds the tagged fields of the struct v.
+func bindStruct(args map[string]interface{}, v reflect.Value) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			if err := bindStruct(args, v.Field(i)); err != nil {
+				return err
+			}
+			continue
+		}
+
+		tag := field.Tag.Get("arg")
+		if tag == "" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+
+		value := args[name]
+		if value == nil {
+			if options == "required" {
+				return &argumentError{name: name}
+			}
+			continue
+		}
+
+		if err := bindValue(value, v.Field(i)); err != nil {
+			return &argumentError{name: name, reason: err.Error()}
+		}
+	}
+
+	return nil
+}
+
+// argumentNames returns the names of the arguments bound to the struct pointed to by dst,
+// including the fields of embedded structs, in declaration order.
+func argumentNames(dst interface{}) []string {
+	var names []string
+	var collect func(t reflect.Type)
+	collect = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if field.Anonymous && field.Type.Kind() == reflect.Struct {
+				collect(field.Type)
+				continue
+			}
+			if tag := field.Tag.Get("arg"); tag != "" {
+				name, _, _ := strings.Cut(tag, ",")
+				names = append(names, name)
+			}
+		}
+	}
+	collect(reflect.TypeOf(dst).Elem())
+
+	return names
+}
+
+// bindValue stores a decoded JSON value into the field.
+func bindValue(value interface{}, field reflect.Value) error {
+	switch field.Kind() {
+	case reflect.String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %s", jsonType(value))
+		}
+		field.SetString(s)
+
+	case reflect.Bool:
+		switch b := value.(type) {
+		case bool:
+			field.SetBool(b)
+		case string:
+			parsed, err := strconv.ParseBool(b)
+			if err != nil {
+				return fmt.Errorf("expected a boolean, got %q", b)
+			}
+			field.SetBool(parsed)
+		default:
+			return fmt.Errorf("expected a boolean, got %s", jsonType(value))
+		}
+
+	case reflect.Int, reflect.Int64:
+		n, err := numberValue(value)
+		if err != nil {
+			return err
+		}
+		if n != math.Trunc(n) {
+			return fmt.Errorf("expected an integer, got %v", n)
+		}
+		field.SetInt(int64(n))
+
+	case reflect.Float64:
+		n, err := numberValue(value)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(n)
+
+	case reflect.Slice:
+		if field.Type().Elem().Kind() == reflect.String {
+			list, err := stringList(value)
+			if err != nil {
+				return err
+			}
+			field.Set(reflect.ValueOf(list).Convert(field.Type()))
+			return nil
+		}
+		if err := decodeArrayArgument(value, field.Addr().Interface()); err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unsupported argument type %s", field.Type())
+	}
+
+	return nil
+}
+
+// numberValue converts a JSON number, or a string holding one, to float64.
+func numberValue(value interface{}) (float64, error) {
+	switch n := value.(type) {
+	case float64:
+		return n, nil
+	case int:
+		return float64(n), nil
+	case json.Number:
+		return n.Float64()
+	case string:
+		parsed, err := strconv.ParseFloat(strings.TrimSpace(n), 64)
+		if err != nil {
+			return 0, fmt.Errorf("expected a number, got %q", n)
+		}
+		return parsed, nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %s", jsonType(value))
+	}
+}
+
+// stringList decodes a list of strings given either as a comma separated string or a JSON array.
+// Entries are trimmed and empty entries are dropped, so "" and "a, ,b" become [] and [a b].
+// Numbers are accepted in arrays since clients often send mobile numbers unquoted.
+func stringList(value interface{}) ([]string, error) {
+	var items []string
+
+	switch v := value.(type) {
+	case string:
+		// A JSON array may also be sent as a string
+		if trimmed := strings.TrimSpace(v); strings.HasPrefix(trimmed, "[") {
+			var decoded []interface{}
+			if err := json.Unmarshal([]byte(trimmed), &decoded); err != nil {
+				return nil, fmt.Errorf("invalid JSON array: %v", err)
+			}
+			return stringList(decoded)
+		}
+		items = strings.Split(v, ",")
+	case []string:
+		items = v
+	case []interface{}:
+		for i, item := range v {
+			switch item := item.(type) {
+			case string:
+				items = append(items, item)
+			case float64:
+				items = append(items, strconv.FormatFloat(item, 'f', -1, 64))
+			default:
+				return nil, fmt.Errorf("item %d: expected a string, got %s", i, jsonType(item))
+			}
+		}
+	default:
+		return nil, fmt.Errorf("expected a comma separated string or an array of strings, got %s", jsonType(value))
+	}
+
+	list := make([]string, 0, len(items))
+	for _, item := range items {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list, nil
+}
+
+// jsonType names the JSON type of a decoded value for error messages.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64, int, json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// decodeArrayArgument decodes an array tool argument into dst.
+// Clients either send a JSON array or a string holding one, both are accepted.
+func decodeArrayArgument(value interface{}, dst interface{}) error {
+	if value == nil {
+		return fmt.Errorf("value is required")
+	}
+
+	raw, ok := value.(string)
+	if !ok {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		raw = string(data)
+	}
+
+	return json.Unmarshal([]byte(raw), dst)
+}
+
+// withArray adds an array property to the tool input schema.
+// mcp-go only ships helpers for scalar properties, so the items schema is passed through as is.
+func withArray(name string, items map[string]interface{}, opts ...mcp.PropertyOption) mcp.ToolOption {
+	return func(t *mcp.Tool) {
+		schema := map[string]interface{}{
+			"type":  "array",
+			"items": items,
+		}
+
+		for _, opt := range opts {
+			opt(schema)
+		}
+
+		// Required is recorded on the property by mcp.Required, move it to the tool
+		if required, ok := schema["required"].(bool); ok && required {
+			t.InputSchema.Required = append(t.InputSchema.Required, name)
+			delete(schema, "required")
+		}
+
+		t.InputSchema.Properties[name] = schema
+	}
+}
+
+// withStringList adds a property accepting a comma separated string or an array of strings.
+func withStringList(name string, opts ...mcp.PropertyOption) mcp.ToolOption {
+	return func(t *mcp.Tool) {
+		schema := map[string]interface{}{
+			"type":  []string{"string", "array"},
+			"items": map[string]interface{}{"type": "string"},
+		}
+
+		for _, opt := range opts {
+			opt(schema)
+		}
+
+		t.InputSchema.Properties[name] = schema
+	}
+}
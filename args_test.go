@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// TestBindArguments tests decoding arguments into a struct, including embedded structs and defaults.
+func TestBindArguments(t *testing.T) {
+	args := markdownArguments{}
+	err := bindArguments(map[string]interface{}{
+		"bot":        "ops",
+		"title":      "title",
+		"content":    "content",
+		"at_mobiles": []interface{}{" 13800138000 ", "", 13800138001.0},
+		"is_at_all":  "true",
+		"unknown":    42.0,
+	}, &args)
+	if err != nil {
+		t.Fatalf("bindArguments failed: %v", err)
+	}
+
+	expected := markdownArguments{
+		botArguments: botArguments{Bot: "ops"},
+		mentionArguments: mentionArguments{
+			AtMobiles: []string{"13800138000", "13800138001"},
+			IsAtAll:   true,
+		},
+		Title:   "title",
+		Content: "content",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("unexpected arguments: %+v", args)
+	}
+
+	card := templateCardArguments{BtnOrientation: "0"}
+	err = bindArguments(map[string]interface{}{
+		"title":   "title",
+		"text":    "text",
+		"buttons": `[{"title":"Approve","actionURL":"https://example.com/approve"}]`,
+	}, &card)
+	if err != nil {
+		t.Fatalf("bindArguments failed: %v", err)
+	}
+	if card.BtnOrientation != "0" || len(card.Buttons) != 1 || card.Buttons[0].Title != "Approve" {
+		t.Errorf("unexpected card arguments: %+v", card)
+	}
+}
+
+// TestBindArgumentsErrors tests the validation errors for missing and mistyped arguments.
+func TestBindArgumentsErrors(t *testing.T) {
+	tests := []struct {
+		args     map[string]interface{}
+		dst      interface{}
+		expected string
+	}{
+		{map[string]interface{}{}, &textArguments{}, "missing required argument content"},
+		{map[string]interface{}{"content": nil}, &textArguments{}, "missing required argument content"},
+		{map[string]interface{}{"content": 42.0}, &textArguments{}, "invalid argument content: expected a string, got number"},
+		{map[string]interface{}{"content": "hi", "is_at_all": "maybe"}, &textArguments{}, `invalid argument is_at_all: expected a boolean, got "maybe"`},
+		{map[string]interface{}{"content": "hi", "at_mobiles": true}, &textArguments{}, "invalid argument at_mobiles: expected a comma separated string or an array of strings, got boolean"},
+		{map[string]interface{}{"content": "hi", "at_user_ids": []interface{}{"a", map[string]interface{}{}}}, &textArguments{}, "invalid argument at_user_ids: item 1: expected a string, got object"},
+		{map[string]interface{}{"msg_type": "text", "max_parallel": 1.5}, &broadcastArguments{}, "invalid argument max_parallel: expected an integer, got 1.5"},
+		{map[string]interface{}{"links": "not json"}, &feedCardArguments{}, "invalid argument links:"},
+	}
+
+	for _, tt := range tests {
+		err := bindArguments(tt.args, tt.dst)
+		if err == nil || !strings.HasPrefix(err.Error(), tt.expected) {
+			t.Errorf("%v: expected %q, got %v", tt.args, tt.expected, err)
+		}
+	}
+}
+
+// TestStringList tests the accepted forms of string list arguments.
+func TestStringList(t *testing.T) {
+	tests := []struct {
+		value    interface{}
+		expected []string
+	}{
+		{"", []string{}},
+		{"a", []string{"a"}},
+		{" a, ,b ,", []string{"a", "b"}},
+		{[]interface{}{"a", " b "}, []string{"a", "b"}},
+		{[]interface{}{}, []string{}},
+		{`["a", "b"]`, []string{"a", "b"}},
+		{[]string{"a", ""}, []string{"a"}},
+	}
+
+	for _, tt := range tests {
+		list, err := stringList(tt.value)
+		if err != nil || !reflect.DeepEqual(list, tt.expected) {
+			t.Errorf("%#v: expected %v, got %v (%v)", tt.value, tt.expected, list, err)
+		}
+	}
+}
+
+// TestHandlerInvalidArguments tests that malformed arguments give tool errors instead of panics.
+func TestHandlerInvalidArguments(t *testing.T) {
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(sender))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+
+	handlers := map[string]func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error){
+		"send_text":          sendTextHandler(NewDispatcher(bots, nil, nil, nil)),
+		"send_markdown":      sendMarkdownHandler(NewDispatcher(bots, nil, nil, nil)),
+		"send_image":         sendImageHandler(NewDispatcher(bots, nil, nil, nil), FileAccess{}),
+		"send_news":          sendNewsHandler(NewDispatcher(bots, nil, nil, nil)),
+		"send_template_card": sendTemplateCardHandler(NewDispatcher(bots, nil, nil, nil)),
+		"send_feed_card":     sendFeedCardHandler(NewDispatcher(bots, nil, nil, nil)),
+		"upload_file":        uploadFileHandler(bots, FileAccess{}),
+		"broadcast":          broadcastHandler(bots),
+	}
+	for name, handler := range handlers {
+		for _, args := range []map[string]interface{}{nil, {"title": 1.0, "content": []interface{}{"a"}, "bot": false}} {
+			result, err := handler(context.Background(), newToolRequest(name, args))
+			if err != nil || !result.IsError {
+				t.Errorf("%s %v: expected a tool error, got %+v (%v)", name, args, result, err)
+			}
+		}
+	}
+
+	// Empty mention lists are sent as [] instead of [""]
+	result, _ := handlers["send_text"](context.Background(), newToolRequest("send_text", map[string]interface{}{
+		"content":     "hello",
+		"at_mobiles":  "",
+		"at_user_ids": []interface{}{"user1", " "},
+	}))
+	if result.IsError {
+		t.Fatalf("send_text failed: %+v", result.Content)
+	}
+
+	var payload struct {
+		At struct {
+			AtMobiles []string `json:"atMobiles"`
+			AtUserIds []string `json:"atUserIds"`
+		} `json:"at"`
+	}
+	records := sender.Records()
+	if err := json.Unmarshal([]byte(records[len(records)-1].Body), &payload); err != nil {
+		t.Fatalf("failed to decode payload: %v", err)
+	}
+	if payload.At.AtMobiles == nil || len(payload.At.AtMobiles) != 0 || !reflect.DeepEqual(payload.At.AtUserIds, []string{"user1"}) {
+		t.Errorf("unexpected mentions: %+v", payload.At)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	// BreakerClosed lets requests through, counting consecutive failures
+	BreakerClosed = "closed"
+
+	// BreakerOpen fails requests fast until the cooldown elapses
+	BreakerOpen = "open"
+
+	// BreakerHalfOpen lets a single probe request through, closing the circuit when it succeeds
+	BreakerHalfOpen = "half-open"
+)
+
+// DefaultBreakerPolicy opens the circuit after 5 consecutive failures and probes again after a minute.
+var DefaultBreakerPolicy = BreakerPolicy{Failures: 5, Cooldown: Duration(time.Minute)}
+
+// BreakerPolicy configures the circuit breaker of a bot.
+type BreakerPolicy struct {
+	// Failures is the number of consecutive failed requests opening the circuit, 0 disables the breaker
+	Failures int `json:"failures"`
+
+	// Cooldown is how long the circuit stays open before a probe request is let through
+	Cooldown Duration `json:"cooldown"`
+}
+
+// CircuitOpenError is returned without making a request while the circuit breaker of a bot is open.
+type CircuitOpenError struct {
+	// Bot is the name of the bot
+	Bot string
+
+	// Failures is the number of consecutive failures that opened the circuit
+	Failures int
+
+	// RetryAfter is how long until a probe request is let through
+	RetryAfter time.Duration
+
+	// LastError describes the failure that opened the circuit
+	LastError string
+
+	// lastHint is the hint of the last failure
+	lastHint string
+}
+
+func (e *CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker of bot %s is open after %d consecutive failures, retry after %ds (last error: %s)",
+		e.Bot, e.Failures, int(math.Ceil(e.RetryAfter.Seconds())), e.LastError)
+}
+
+// Hint tells the user why the request was not made and how to fix the last failure.
+func (e *CircuitOpenError) Hint() string {
+	hint := "Requests with this bot fail fast while its circuit breaker is open, see bot_status."
+	if e.lastHint != "" {
+		hint += " " + e.lastHint
+	}
+	return hint
+}
+
+// BreakerStatus describes the circuit breaker of a bot, as reported by bot_status and the metrics.
+type BreakerStatus struct {
+	// State is BreakerClosed, BreakerOpen or BreakerHalfOpen, BreakerClosed when the breaker is disabled
+	State string `json:"state"`
+
+	// Enabled reports whether the breaker is enabled
+	Enabled bool `json:"enabled"`
+
+	// ConsecutiveFailures is the number of failed requests since the last success
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// OpenedAt is when the circuit last opened
+	OpenedAt time.Time `json:"opened_at,omitempty"`
+
+	// RetryAt is when a probe request is let through, while the circuit is open
+	RetryAt time.Time `json:"retry_at,omitempty"`
+
+	// LastError describes the last failed request
+	LastError string `json:"last_error,omitempty"`
+
+	// LastErrorAt is when the last request failed
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+
+	// LastSuccessAt is when the last request succeeded
+	LastSuccessAt time.Time `json:"last_success_at,omitempty"`
+
+	// Successes and Failures count the requests made
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+
+	// Rejected counts the requests failed fast while the circuit was open
+	Rejected int64 `json:"rejected"`
+
+	// Opens counts how often the circuit opened
+	Opens int64 `json:"opens"`
+}
+
+// circuitBreaker stops requests to a webhook failing repeatedly, such as after its token was revoked.
+// Every request counts, whether its failure is transient or permanent; retries of a request count once.
+type circuitBreaker struct {
+	mu     sync.Mutex
+	policy BreakerPolicy
+	clock  clock
+	status BreakerStatus
+
+	// probing reports whether the probe request of the half-open circuit is in flight
+	probing bool
+
+	// lastHint is the hint of the last failure
+	lastHint string
+}
+
+// newCircuitBreaker creates a closed circuit breaker, which lets every request through when policy is disabled.
+func newCircuitBreaker(policy BreakerPolicy, clk clock) *circuitBreaker {
+	return &circuitBreaker{
+		policy: policy,
+		clock:  clk,
+		status: BreakerStatus{State: BreakerClosed, Enabled: policy.Failures > 0},
+	}
+}
+
+// allow reports whether a request may be made, returning a *CircuitOpenError when it may not.
+// A request allowed by allow must be reported to record.
+func (b *circuitBreaker) allow(bot string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.status.Enabled {
+		return nil
+	}
+
+	now := b.clock.Now()
+	switch b.status.State {
+	case BreakerOpen:
+		if now.Before(b.status.RetryAt) {
+			return b.reject(bot, b.status.RetryAt.Sub(now))
+		}
+		b.status.State = BreakerHalfOpen
+		b.status.RetryAt = time.Time{}
+		b.probing = true
+		return nil
+	case BreakerHalfOpen:
+		if b.probing {
+			return b.reject(bot, time.Duration(b.policy.Cooldown))
+		}
+		b.probing = true
+		return nil
+	default:
+		return nil
+	}
+}
+
+// reject counts a request failed fast and builds its error. The caller must hold mu.
+func (b *circuitBreaker) reject(bot string, retryAfter time.Duration) error {
+	b.status.Rejected++
+	return &CircuitOpenError{
+		Bot:        bot,
+		Failures:   b.status.ConsecutiveFailures,
+		RetryAfter: retryAfter,
+		LastError:  b.status.LastError,
+		lastHint:   b.lastHint,
+	}
+}
+
+// record reports the outcome of a request allowed by allow, opening or closing the circuit.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	b.probing = false
+
+	if err == nil {
+		b.status.Successes++
+		b.status.LastSuccessAt = now
+		b.status.ConsecutiveFailures = 0
+		b.status.State = BreakerClosed
+		b.status.RetryAt = time.Time{}
+		return
+	}
+
+	b.status.Failures++
+	b.status.ConsecutiveFailures++
+	b.status.LastError = err.Error()
+	b.status.LastErrorAt = now
+	b.lastHint = ErrorHint(err)
+
+	if !b.status.Enabled {
+		return
+	}
+	if b.status.State == BreakerHalfOpen || b.status.ConsecutiveFailures >= b.policy.Failures {
+		if b.status.State != BreakerOpen {
+			b.status.Opens++
+			b.status.OpenedAt = now
+		}
+		b.status.State = BreakerOpen
+		b.status.RetryAt = now.Add(time.Duration(b.policy.Cooldown))
+	}
+}
+
+// release ends a request allowed by allow without recording an outcome, such as when it was canceled.
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.probing = false
+}
+
+// Status returns a copy of the breaker status, showing an open circuit whose cooldown elapsed as half-open.
+func (b *circuitBreaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	status := b.status
+	if status.State == BreakerOpen && !b.clock.Now().Before(status.RetryAt) {
+		status.State = BreakerHalfOpen
+	}
+	return status
+}
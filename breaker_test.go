@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newBreakerBot creates a bot against baseURL without retries, opening its circuit after 3 failures for a minute.
+func newBreakerBot(baseURL string) (*DingDingBot, *fakeClock) {
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "", WithName("ops"), WithBaseURL(baseURL), withClock(clk),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithCircuitBreaker(BreakerPolicy{Failures: 3, Cooldown: Duration(time.Minute)}))
+	return bot, clk
+}
+
+// TestCircuitBreakerOpens tests that the circuit opens after consecutive failures, fails fast and closes after a successful probe.
+func TestCircuitBreakerOpens(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001), http.StatusBadGateway, int64(300001), int64(300001))
+	defer server.Close()
+
+	bot, clk := newBreakerBot(server.URL)
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+
+	// Transient and permanent failures both count
+	for i := 0; i < 3; i++ {
+		if _, err := bot.Send(context.Background(), msg); err == nil {
+			t.Fatalf("send %d should fail", i)
+		}
+	}
+
+	_, err := bot.Send(context.Background(), msg)
+	var circuitOpen *CircuitOpenError
+	if !errors.As(err, &circuitOpen) || calls != 3 {
+		t.Fatalf("expected the send to fail fast, got %v after %d calls", err, calls)
+	}
+	if circuitOpen.Bot != "ops" || circuitOpen.Failures != 3 || circuitOpen.RetryAfter != time.Minute || !strings.Contains(circuitOpen.LastError, "300001") {
+		t.Errorf("unexpected error: %+v", circuitOpen)
+	}
+	if hint := ErrorHint(err); !strings.Contains(hint, "bot_status") || !strings.Contains(hint, "access token") {
+		t.Errorf("expected the hint of the last failure, got %q", hint)
+	}
+	if !transient(err) {
+		t.Errorf("an open circuit should be retried later")
+	}
+
+	status := bot.BreakerStatus()
+	if status.State != BreakerOpen || status.Opens != 1 || status.Rejected != 1 || status.Failures != 3 || !status.RetryAt.Equal(clk.Now().Add(time.Minute)) {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	// The probe fails, the circuit opens again
+	clk.Advance(time.Minute)
+	if state := bot.BreakerStatus().State; state != BreakerHalfOpen {
+		t.Errorf("expected the circuit to be half-open after the cooldown, got %s", state)
+	}
+	if _, err := bot.Send(context.Background(), msg); errors.As(err, &circuitOpen) || calls != 4 {
+		t.Fatalf("expected a probe request, got %v after %d calls", err, calls)
+	}
+	if status := bot.BreakerStatus(); status.State != BreakerOpen || status.Opens != 2 {
+		t.Errorf("expected the circuit to open again, got %+v", status)
+	}
+
+	// The next probe succeeds, the circuit closes
+	clk.Advance(time.Minute)
+	if _, err := bot.Send(context.Background(), msg); err != nil {
+		t.Fatalf("the probe should succeed: %v", err)
+	}
+	if status := bot.BreakerStatus(); status.State != BreakerClosed || status.ConsecutiveFailures != 0 || status.Successes != 1 {
+		t.Errorf("expected the circuit to close, got %+v", status)
+	}
+}
+
+// TestCircuitBreakerRateLimit tests that sends rejected by the open circuit do not use up the rate limit budget.
+func TestCircuitBreakerRateLimit(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), withClock(clk),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithRateLimit(RateLimit{PerMinute: 2}),
+		WithCircuitBreaker(BreakerPolicy{Failures: 1, Cooldown: Duration(10 * time.Second)}))
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+
+	if _, err := bot.Send(context.Background(), msg); err == nil {
+		t.Fatalf("the first send should fail")
+	}
+	for i := 0; i < 3; i++ {
+		var circuitOpen *CircuitOpenError
+		if _, err := bot.Send(context.Background(), msg); !errors.As(err, &circuitOpen) {
+			t.Fatalf("send %d: expected the open circuit to reject the send, got %v", i, err)
+		}
+	}
+
+	// The remaining token is still there for the probe
+	clk.Advance(10 * time.Second)
+	if _, err := bot.Send(context.Background(), msg); err != nil || calls != 2 {
+		t.Errorf("expected the probe to be sent, got %v after %d calls", err, calls)
+	}
+}
+
+// TestCircuitBreakerHalfOpen tests that a half-open circuit lets a single probe through.
+func TestCircuitBreakerHalfOpen(t *testing.T) {
+	clk := newFakeClock()
+	breaker := newCircuitBreaker(BreakerPolicy{Failures: 1, Cooldown: Duration(time.Minute)}, clk)
+
+	breaker.allow("ops")
+	breaker.record(errors.New("connection refused"))
+	clk.Advance(time.Minute)
+
+	if err := breaker.allow("ops"); err != nil {
+		t.Fatalf("the probe should be allowed: %v", err)
+	}
+	if err := breaker.allow("ops"); err == nil {
+		t.Errorf("a second request should be rejected while the probe is in flight")
+	}
+
+	// A success in between resets the consecutive failures
+	breaker.record(nil)
+	disabled := newCircuitBreaker(BreakerPolicy{}, clk)
+	for i := 0; i < 10; i++ {
+		disabled.record(errors.New("connection refused"))
+	}
+	if err := disabled.allow("ops"); err != nil || disabled.Status().State != BreakerClosed || disabled.Status().Failures != 10 {
+		t.Errorf("a disabled breaker should count failures without opening, got %+v", disabled.Status())
+	}
+}
+
+// TestBotStatusTool tests the bot_status tool and the tool error of an open circuit.
+func TestBotStatusTool(t *testing.T) {
+	server := newErrorServer(300001, "token is not exist")
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}),
+		WithCircuitBreaker(BreakerPolicy{Failures: 2, Cooldown: Duration(time.Minute)}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	handler := sendTextHandler(NewDispatcher(bots, nil, nil, nil))
+	ctx := context.Background()
+
+	var result *mcp.CallToolResult
+	for i := 0; i < 3; i++ {
+		result, _ = handler(ctx, newToolRequest("send_text", map[string]interface{}{"content": "hello"}))
+	}
+	text := result.Content[0].(mcp.TextContent).Text
+	if !result.IsError || !strings.Contains(text, "circuit breaker of bot default is open after 2 consecutive failures") || !strings.Contains(text, "Hint:") {
+		t.Errorf("unexpected tool error: %q", text)
+	}
+
+	result, _ = botStatusHandler(bots)(ctx, newToolRequest("bot_status", nil))
+	text = result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "default: circuit open, 0 requests succeeded, 2 failed, 1 rejected") {
+		t.Errorf("unexpected status: %q", text)
+	}
+
+	var statuses []BotStatus
+	resultJSON(t, result, &statuses)
+	if len(statuses) != 1 || statuses[0].CircuitBreaker.State != BreakerOpen || statuses[0].CircuitBreaker.ConsecutiveFailures != 2 {
+		t.Errorf("unexpected structured status: %+v", statuses)
+	}
+
+	if result, _ := botStatusHandler(bots)(ctx, newToolRequest("bot_status", map[string]interface{}{"bot": "unknown"})); !result.IsError {
+		t.Errorf("an unknown bot should be rejected")
+	}
+}
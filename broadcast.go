@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// defaultBroadcastConcurrency bounds how many targets a broadcast sends to at once
+const defaultBroadcastConcurrency = 5
+
+// BroadcastTarget is a bot receiving a broadcast message.
+type BroadcastTarget struct {
+	// Name identifies the target in the results
+	Name string
+
+	// Bot sends the message to the target group
+	Bot *DingDingBot
+}
+
+// BroadcastResult is the outcome of a broadcast for a single target.
+type BroadcastResult struct {
+	// Target is the name of the target
+	Target string `json:"target"`
+
+	// Success reports whether the message was delivered to the target
+	Success bool `json:"success"`
+
+	// Error describes why the delivery failed
+	Error string `json:"error,omitempty"`
+
+	// Hint tells how to fix the failure, when it is a known DingDing error
+	Hint string `json:"hint,omitempty"`
+
+	// Result describes the request made for the target
+	Result *SendResult `json:"result,omitempty"`
+}
+
+// Broadcast sends the same message to several DingDing groups concurrently.
+// A failure for one target does not stop the delivery to the others.
+// Parameters:
+//   - ctx: Aborts the sends when done
+//   - msg: The message built by one of the New*Message functions
+//   - targets: The bots to send the message with
+//   - concurrency: The maximum number of concurrent sends, defaultBroadcastConcurrency when not positive
+// Returns:
+//   - One result per target, in the order of targets
+func Broadcast(ctx context.Context, msg Message, targets []BroadcastTarget, concurrency int) []BroadcastResult {
+	if concurrency <= 0 {
+		concurrency = defaultBroadcastConcurrency
+	}
+
+	results := make([]BroadcastResult, len(targets))
+	semaphore := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for i, target := range targets {
+		wg.Add(1)
+		go func(i int, target BroadcastTarget) {
+			defer wg.Done()
+
+			semaphore <- struct{}{}
+			defer func() { <-semaphore }()
+
+			results[i] = BroadcastResult{Target: target.Name}
+			result, err := target.Bot.Send(ctx, msg)
+			if err != nil {
+				results[i].Error = err.Error()
+				results[i].Hint = ErrorHint(err)
+				return
+			}
+
+			results[i].Success = true
+			results[i].Result = result
+		}(i, target)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// maskToken shortens an access token so it can identify an ad-hoc target without leaking it.
+func maskToken(token string) string {
+	if len(token) <= 8 {
+		return "webhook:***"
+	}
+	return "webhook:" + token[:4] + "***" + token[len(token)-4:]
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newBroadcastServer creates a DingDing server rejecting the "bad-token" access token
+// and recording the highest number of requests handled at once.
+func newBroadcastServer(inFlight, maxInFlight *int64) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt64(inFlight, 1)
+		defer atomic.AddInt64(inFlight, -1)
+		for {
+			seen := atomic.LoadInt64(maxInFlight)
+			if current <= seen || atomic.CompareAndSwapInt64(maxInFlight, seen, current) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+
+		result := map[string]interface{}{"errcode": 0, "errmsg": "ok"}
+		if r.URL.Query().Get("access_token") == "bad-token" {
+			result = map[string]interface{}{"errcode": 300001, "errmsg": "token is not exist"}
+		}
+		json.NewEncoder(w).Encode(result)
+	}))
+}
+
+// TestBroadcast tests per-target results and the concurrency bound.
+func TestBroadcast(t *testing.T) {
+	var inFlight, maxInFlight int64
+	server := newBroadcastServer(&inFlight, &maxInFlight)
+	defer server.Close()
+
+	var targets []BroadcastTarget
+	for _, token := range []string{"ops", "release", "bad-token", "product-a", "product-b", "product-c"} {
+		targets = append(targets, BroadcastTarget{Name: token, Bot: NewDingDingBot(token, "", WithBaseURL(server.URL))})
+	}
+
+	msg, err := NewMarkdownMessage("Release", "## Release 1.2 is out", nil, nil, false)
+	if err != nil {
+		t.Fatalf("NewMarkdownMessage failed: %v", err)
+	}
+
+	results := Broadcast(context.Background(), msg, targets, 2)
+	if len(results) != len(targets) {
+		t.Fatalf("expected %d results, got %d", len(targets), len(results))
+	}
+	for i, result := range results {
+		if result.Target != targets[i].Name {
+			t.Errorf("result %d is for %s, expected %s", i, result.Target, targets[i].Name)
+		}
+		if result.Success == (result.Target == "bad-token") {
+			t.Errorf("unexpected result for %s: %+v", result.Target, result)
+		}
+	}
+	if maxInFlight > 2 {
+		t.Errorf("expected at most 2 concurrent sends, got %d", maxInFlight)
+	}
+}
+
+// TestBroadcastHandler tests the broadcast tool with named bots and ad-hoc webhooks.
+func TestBroadcastHandler(t *testing.T) {
+	var inFlight, maxInFlight int64
+	server := newBroadcastServer(&inFlight, &maxInFlight)
+	defer server.Close()
+
+	bots := NewBotRegistry(WithBaseURL(server.URL))
+	bots.Add("ops", "", bots.NewBot("ops-token", ""))
+
+	handler := broadcastHandler(bots)
+	result, _ := handler(context.Background(), newToolRequest("broadcast", map[string]interface{}{
+		"msg_type": "text",
+		"content":  "Deploy finished",
+		"bots":     []interface{}{"ops"},
+		"webhooks": []interface{}{
+			map[string]interface{}{"webhook_key": "bad-token"},
+			map[string]interface{}{"webhook_key": "release-token", "sign_key": "SECrelease"},
+		},
+	}))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "2 succeeded, 1 failed") {
+		t.Errorf("unexpected broadcast result: %s", text)
+	}
+	if strings.Contains(text, "release-token") {
+		t.Errorf("broadcast result should not leak webhook keys: %s", text)
+	}
+
+	result, _ = handler(context.Background(), newToolRequest("broadcast", map[string]interface{}{
+		"msg_type": "text",
+		"content":  "Deploy finished",
+	}))
+	if !result.IsError {
+		t.Errorf("broadcast should fail without targets")
+	}
+}
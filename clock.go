@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// clock abstracts the passing of time so that time-based behavior,
+// such as rate limiting and retry backoff, can be tested with a fake clock.
+type clock interface {
+	// Now returns the current time
+	Now() time.Time
+
+	// Sleep blocks for the given duration or until ctx is done, returning ctx.Err() when interrupted
+	Sleep(ctx context.Context, d time.Duration) error
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// DefaultBotName is the name of the bot configured through DINGDING_BOT_WEBHOOK_KEY
+const DefaultBotName = "default"
+
+// Config is the content of the configuration file listing named bots.
+type Config struct {
+	// Default is the name of the bot used when a tool call does not name one
+	Default string `json:"default"`
+
+	// Bots lists the DingDing group robots available to tool calls
+	Bots []BotConfig `json:"bots"`
+
+	// Jobs lists recurring messages, run when a schedule directory is configured
+	Jobs []JobConfig `json:"jobs,omitempty"`
+
+	// HTTP overrides the settings of the HTTP client given by the environment (optional)
+	HTTP *HTTPClientConfig `json:"http,omitempty"`
+}
+
+// BotConfig configures a single named DingDing group robot.
+// Secrets may reference environment variables, such as "${OPS_WEBHOOK_KEY}".
+type BotConfig struct {
+	// Name identifies the bot in tool calls
+	Name string `json:"name"`
+
+	// Description tells the caller which group the bot posts to
+	Description string `json:"description,omitempty"`
+
+	// WebhookKey is the access token of the robot webhook, optional for enterprise robots
+	WebhookKey string `json:"webhook_key"`
+
+	// SignKey is the secret used for signature verification (optional)
+	SignKey string `json:"sign_key,omitempty"`
+
+	// RateLimit overrides the default rate limit of the bot (optional)
+	RateLimit *RateLimit `json:"rate_limit,omitempty"`
+
+	// CircuitBreaker overrides the default circuit breaker of the bot (optional)
+	CircuitBreaker *BreakerPolicy `json:"circuit_breaker,omitempty"`
+
+	// Digest overrides the default message aggregation of the bot (optional)
+	Digest *DigestPolicy `json:"digest,omitempty"`
+
+	// Enterprise sends the messages through the robot of an enterprise internal app instead of the webhook (optional)
+	Enterprise *EnterpriseConfig `json:"enterprise,omitempty"`
+}
+
+// Duration is a time.Duration written in JSON as a string such as "30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string such as "1m30s".
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON formats the duration as a string such as "1m30s".
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// LoadConfig reads and validates a configuration file.
+// Parameters:
+//   - path: The path to the JSON configuration file
+// Returns:
+//   - The parsed configuration
+//   - An error if the file cannot be read or is invalid
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %v", err)
+	}
+
+	var cfg Config
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse config file: %v", err)
+	}
+
+	for i := range cfg.Bots {
+		bot := &cfg.Bots[i]
+		bot.WebhookKey = os.ExpandEnv(bot.WebhookKey)
+		bot.SignKey = os.ExpandEnv(bot.SignKey)
+
+		if bot.Name == "" {
+			return nil, fmt.Errorf("bot %d: name cannot be empty", i)
+		}
+		if bot.Enterprise != nil {
+			enterprise := bot.Enterprise
+			enterprise.AppKey = os.ExpandEnv(enterprise.AppKey)
+			enterprise.AppSecret = os.ExpandEnv(enterprise.AppSecret)
+			enterprise.RobotCode = os.ExpandEnv(enterprise.RobotCode)
+			enterprise.OpenConversationID = os.ExpandEnv(enterprise.OpenConversationID)
+			if err := enterprise.validate(); err != nil {
+				return nil, fmt.Errorf("bot %s: invalid enterprise settings: %v", bot.Name, err)
+			}
+		} else if bot.WebhookKey == "" {
+			return nil, fmt.Errorf("bot %s: webhook_key cannot be empty", bot.Name)
+		}
+		if bot.Digest != nil && bot.Digest.FlushSeverity != "" {
+			if err := validSeverity(bot.Digest.FlushSeverity); err != nil {
+				return nil, fmt.Errorf("bot %s: invalid digest flush_severity: %v", bot.Name, err)
+			}
+		}
+	}
+
+	if cfg.HTTP != nil {
+		cfg.HTTP.ProxyURL = os.ExpandEnv(cfg.HTTP.ProxyURL)
+	}
+
+	return &cfg, nil
+}
+
+// BotInfo describes a registered bot without exposing its secrets.
+type BotInfo struct {
+	// Name identifies the bot in tool calls
+	Name string `json:"name"`
+
+	// Description tells the caller which group the bot posts to
+	Description string `json:"description,omitempty"`
+
+	// Default reports whether the bot is used when a tool call does not name one
+	Default bool `json:"default"`
+
+	// Signed reports whether requests are signed with a sign key
+	Signed bool `json:"signed"`
+
+	// Enterprise reports whether messages are sent through the robot of an enterprise internal app
+	Enterprise bool `json:"enterprise,omitempty"`
+}
+
+// BotStatus describes the health of a registered bot.
+type BotStatus struct {
+	// Name identifies the bot in tool calls
+	Name string `json:"name"`
+
+	// CircuitBreaker is the state of the circuit breaker of the bot and its request counters
+	CircuitBreaker BreakerStatus `json:"circuit_breaker"`
+}
+
+// botEntry is a bot registered under a name.
+type botEntry struct {
+	bot         *DingDingBot
+	description string
+}
+
+// BotRegistry holds the named bots available to tool calls.
+// It is populated at startup and only read afterwards, so it is safe for concurrent lookups.
+type BotRegistry struct {
+	bots        map[string]botEntry
+	defaultName string
+	opts        []BotOption
+}
+
+// NewBotRegistry creates an empty BotRegistry.
+// The options are applied to bots created through NewBot.
+func NewBotRegistry(opts ...BotOption) *BotRegistry {
+	return &BotRegistry{bots: make(map[string]botEntry), opts: opts}
+}
+
+// NewBotRegistryFromConfig builds the registry from the configuration file and the environment bot.
+// Parameters:
+//   - cfg: The configuration file content, nil when no file is used
+//   - webhookKey: The access token from DINGDING_BOT_WEBHOOK_KEY, registered as DefaultBotName when set
+//   - signKey: The sign key from DINGDING_BOT_SIGN_KEY
+//   - opts: Options applied to every bot
+// Returns:
+//   - The populated registry
+//   - An error if no bot is configured or the configuration is inconsistent
+func NewBotRegistryFromConfig(cfg *Config, webhookKey, signKey string, opts ...BotOption) (*BotRegistry, error) {
+	registry := NewBotRegistry(opts...)
+
+	if webhookKey != "" {
+		if err := registry.Add(DefaultBotName, "", registry.NewBot(webhookKey, signKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg != nil {
+		// Bots of the same app share it, and so its access token
+		apps := make(map[EnterpriseConfig]*EnterpriseApp)
+
+		for _, botConfig := range cfg.Bots {
+			var botOpts []BotOption
+			if botConfig.RateLimit != nil {
+				botOpts = append(botOpts, WithRateLimit(*botConfig.RateLimit))
+			}
+			if botConfig.CircuitBreaker != nil {
+				botOpts = append(botOpts, WithCircuitBreaker(*botConfig.CircuitBreaker))
+			}
+			if botConfig.Digest != nil {
+				botOpts = append(botOpts, WithDigest(*botConfig.Digest))
+			}
+			if botConfig.Enterprise != nil {
+				key := *botConfig.Enterprise
+				key.OpenConversationID = ""
+				app, ok := apps[key]
+				if !ok {
+					var err error
+					if app, err = NewEnterpriseApp(key); err != nil {
+						return nil, fmt.Errorf("bot %s: %v", botConfig.Name, err)
+					}
+					apps[key] = app
+				}
+				botOpts = append(botOpts, WithEnterprise(app, botConfig.Enterprise.OpenConversationID))
+			}
+
+			bot := registry.NewBot(botConfig.WebhookKey, botConfig.SignKey, botOpts...)
+			if err := registry.Add(botConfig.Name, botConfig.Description, bot); err != nil {
+				return nil, err
+			}
+		}
+
+		if cfg.Default != "" {
+			if err := registry.SetDefault(cfg.Default); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if len(registry.bots) == 0 {
+		return nil, fmt.Errorf("no bot configured, set DINGDING_BOT_WEBHOOK_KEY or DINGDING_BOT_APP_KEY, or provide a config file")
+	}
+
+	return registry, nil
+}
+
+// NewBot creates a bot with the registry options without registering it.
+// It is used for ad-hoc webhook targets given directly in a tool call.
+// The extra options are applied after the registry options.
+func (r *BotRegistry) NewBot(webhookKey, signKey string, extra ...BotOption) *DingDingBot {
+	opts := append(append([]BotOption(nil), r.opts...), extra...)
+	return NewDingDingBot(webhookKey, signKey, opts...)
+}
+
+// Add registers a bot under name. The first bot added becomes the default.
+// A bot created without WithName is named after name, so Add must be called before the bot is used.
+func (r *BotRegistry) Add(name string, description string, bot *DingDingBot) error {
+	if name == "" {
+		return fmt.Errorf("bot name cannot be empty")
+	}
+	if _, ok := r.bots[name]; ok {
+		return fmt.Errorf("bot %s is configured twice", name)
+	}
+
+	if bot.name == "" {
+		bot.name = name
+	}
+
+	r.bots[name] = botEntry{bot: bot, description: description}
+	if r.defaultName == "" {
+		r.defaultName = name
+	}
+
+	return nil
+}
+
+// SetDefault selects the bot used when a tool call does not name one.
+func (r *BotRegistry) SetDefault(name string) error {
+	if _, ok := r.bots[name]; !ok {
+		return fmt.Errorf("default bot %s is not configured", name)
+	}
+
+	r.defaultName = name
+	return nil
+}
+
+// Get returns the bot registered under name, or the default bot when name is empty.
+func (r *BotRegistry) Get(name string) (*DingDingBot, error) {
+	if name == "" {
+		name = r.defaultName
+	}
+
+	entry, ok := r.bots[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown bot %q, use list_bots to see the configured bots", name)
+	}
+
+	return entry.bot, nil
+}
+
+// List describes the registered bots sorted by name.
+func (r *BotRegistry) List() []BotInfo {
+	infos := make([]BotInfo, 0, len(r.bots))
+	for name, entry := range r.bots {
+		infos = append(infos, BotInfo{
+			Name:        name,
+			Description: entry.description,
+			Default:     name == r.defaultName,
+			Signed:      entry.bot.signKey != "",
+			Enterprise:  entry.bot.app != nil,
+		})
+	}
+
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+
+	return infos
+}
+
+// Status describes the health of the registered bots sorted by name.
+func (r *BotRegistry) Status() []BotStatus {
+	statuses := make([]BotStatus, 0, len(r.bots))
+	for name, entry := range r.bots {
+		statuses = append(statuses, BotStatus{Name: name, CircuitBreaker: entry.bot.BreakerStatus()})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+
+	return statuses
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// writeConfig writes a config file into a temporary directory and returns its path.
+func writeConfig(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "bots.json")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write config: %v", err)
+	}
+	return path
+}
+
+// TestLoadConfig tests parsing and validation of the config file.
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("RELEASE_WEBHOOK_KEY", "release-token")
+	t.Setenv("PROXY_HOST", "proxy.corp")
+
+	cfg, err := LoadConfig(writeConfig(t, `{
+		"default": "ops",
+		"bots": [
+			{"name": "ops", "description": "Ops alerts", "webhook_key": "ops-token", "sign_key": "SECops"},
+			{"name": "release", "webhook_key": "${RELEASE_WEBHOOK_KEY}"}
+		],
+		"http": {"timeout": "15s", "proxy_url": "http://${PROXY_HOST}:3128"}
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if len(cfg.Bots) != 2 || cfg.Bots[1].WebhookKey != "release-token" {
+		t.Errorf("unexpected config: %+v", cfg)
+	}
+	if cfg.HTTP == nil || cfg.HTTP.Timeout != Duration(15*time.Second) || cfg.HTTP.ProxyURL != "http://proxy.corp:3128" {
+		t.Errorf("unexpected HTTP config: %+v", cfg.HTTP)
+	}
+
+	if _, err := LoadConfig(writeConfig(t, `{"bots": [{"name": "ops"}]}`)); err == nil {
+		t.Errorf("LoadConfig should require a webhook key")
+	}
+	if _, err := LoadConfig(writeConfig(t, `{"bots": [{"webhook_key": "token"}]}`)); err == nil {
+		t.Errorf("LoadConfig should require a name")
+	}
+	if _, err := LoadConfig(writeConfig(t, `{"bots": [{"name": "ops", "webhook_key": "token", "digest": {"window": "1m", "flush_severity": "urgent"}}]}`)); err == nil {
+		t.Errorf("LoadConfig should reject an unknown flush severity")
+	}
+}
+
+// TestBotRegistry tests bot lookup and the default bot selection.
+func TestBotRegistry(t *testing.T) {
+	cfg := &Config{
+		Default: "ops",
+		Bots: []BotConfig{
+			{Name: "ops", Description: "Ops alerts", WebhookKey: "ops-token"},
+			{Name: "release", WebhookKey: "release-token", SignKey: "SECrelease", Digest: &DigestPolicy{Window: Duration(time.Minute), MaxItems: 5}},
+		},
+	}
+
+	bots, err := NewBotRegistryFromConfig(cfg, "env-token", "")
+	if err != nil {
+		t.Fatalf("NewBotRegistryFromConfig failed: %v", err)
+	}
+
+	bot, err := bots.Get("")
+	if err != nil || bot.webhookKey != "ops-token" {
+		t.Errorf("expected the ops bot as default, got %v, %v", bot, err)
+	}
+	if bot, _ := bots.Get(DefaultBotName); bot == nil || bot.webhookKey != "env-token" {
+		t.Errorf("expected the environment bot under %s", DefaultBotName)
+	}
+	if bot, _ := bots.Get("release"); time.Duration(bot.digest.Window) != time.Minute || bot.digest.MaxItems != 5 {
+		t.Errorf("expected the digest policy of the release bot, got %+v", bot.digest)
+	}
+	if _, err := bots.Get("unknown"); err == nil {
+		t.Errorf("Get should fail for unknown bots")
+	}
+
+	infos := bots.List()
+	if len(infos) != 3 || infos[1].Name != "ops" || !infos[1].Default || !infos[2].Signed {
+		t.Errorf("unexpected bot list: %+v", infos)
+	}
+
+	if _, err := NewBotRegistryFromConfig(nil, "", ""); err == nil {
+		t.Errorf("NewBotRegistryFromConfig should fail without any bot")
+	}
+	if _, err := NewBotRegistryFromConfig(&Config{Default: "missing"}, "env-token", ""); err == nil {
+		t.Errorf("NewBotRegistryFromConfig should fail with an unknown default bot")
+	}
+}
+
+// TestBotArgument tests that the bot argument selects the target bot of a tool call.
+func TestBotArgument(t *testing.T) {
+	opsSender := NewDryRunSender()
+	releaseSender := NewDryRunSender()
+
+	bots := NewBotRegistry()
+	bots.Add("ops", "", NewDingDingBot("ops-token", "", WithSender(opsSender)))
+	bots.Add("release", "", NewDingDingBot("release-token", "", WithSender(releaseSender)))
+
+	handler := sendTextHandler(NewDispatcher(bots, nil, nil, nil))
+	request := newToolRequest("send_text", map[string]interface{}{"content": "hello", "bot": "release"})
+	if result, _ := handler(context.Background(), request); result.IsError {
+		t.Fatalf("send_text failed: %+v", result.Content)
+	}
+	request = newToolRequest("send_text", map[string]interface{}{"content": "hello"})
+	if result, _ := handler(context.Background(), request); result.IsError {
+		t.Fatalf("send_text failed: %+v", result.Content)
+	}
+	if len(opsSender.Records()) != 1 || len(releaseSender.Records()) != 1 {
+		t.Errorf("expected one message per bot, got ops=%d release=%d", len(opsSender.Records()), len(releaseSender.Records()))
+	}
+
+	request = newToolRequest("send_text", map[string]interface{}{"content": "hello", "bot": "unknown"})
+	if result, _ := handler(context.Background(), request); !result.IsError {
+		t.Errorf("send_text should fail for unknown bots")
+	}
+
+	result, _ := listBotsHandler(bots)(context.Background(), newToolRequest("list_bots", nil))
+	text := result.Content[0].(mcp.TextContent).Text
+	if !strings.Contains(text, "ops (default)") || !strings.Contains(text, "release") {
+		t.Errorf("unexpected list_bots result: %s", text)
+	}
+}
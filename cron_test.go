@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestCronNext tests the next run of cron expressions.
+func TestCronNext(t *testing.T) {
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	tests := []struct {
+		expr     string
+		from     time.Time
+		expected time.Time
+	}{
+		{"30 9 * * 1-5", at(5, 10, 0), at(8, 9, 30)},
+		{"30 9 * * mon-fri", at(8, 9, 29), at(8, 9, 30)},
+		{"*/15 * * * *", at(1, 9, 7), at(1, 9, 15)},
+		{"*/15 * * * *", at(1, 9, 15), at(1, 9, 30)},
+		{"5/20 * * * *", at(1, 9, 5), at(1, 9, 25)},
+		{"0 9-17/4 * * *", at(1, 13, 0), at(1, 17, 0)},
+		{"0 0,12 * * *", at(1, 9, 0), at(1, 12, 0)},
+		{"@daily", at(1, 9, 0), at(2, 0, 0)},
+		{"@hourly", at(1, 9, 59), at(1, 10, 0)},
+		{"@monthly", at(1, 9, 0), time.Date(2024, 2, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 9 * * 7", at(1, 9, 0), at(7, 9, 0)},
+		{"0 9 * jan,jul sun", at(1, 9, 0), at(7, 9, 0)},
+		{"0 0 29 2 *", at(1, 9, 0), time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// Both day fields restricted: either matches
+		{"0 12 15 * mon", at(1, 13, 0), at(8, 12, 0)},
+		{"0 12 15 * mon", at(9, 0, 0), at(15, 12, 0)},
+	}
+
+	for _, tt := range tests {
+		schedule, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", tt.expr, err)
+			continue
+		}
+		if next := schedule.next(tt.from); !next.Equal(tt.expected) {
+			t.Errorf("%q from %v: expected %v, got %v", tt.expr, tt.from, tt.expected, next)
+		}
+	}
+
+	// The next run is computed in the time zone of the given time
+	shanghai, _ := time.LoadLocation("Asia/Shanghai")
+	schedule, _ := parseCron("0 9 * * *")
+	if next := schedule.next(at(1, 9, 0).In(shanghai)); !next.Equal(at(2, 1, 0)) {
+		t.Errorf("expected 09:00 in Shanghai, got %v", next)
+	}
+
+	// February 30 never comes
+	schedule, _ = parseCron("0 0 30 2 *")
+	if next := schedule.next(at(1, 9, 0)); !next.IsZero() {
+		t.Errorf("expected no next run, got %v", next)
+	}
+}
+
+// TestParseCronErrors tests the rejection of invalid cron expressions.
+func TestParseCronErrors(t *testing.T) {
+	tests := []struct {
+		expr     string
+		expected string
+	}{
+		{"* * * *", "expected 5 fields"},
+		{"@weekdays", "expected 5 fields"},
+		{"60 * * * *", "minute field: value 60 out of range 0-59"},
+		{"* 24 * * *", "hour field"},
+		{"* * 0 * *", "day of month field"},
+		{"* * * 13 *", "month field"},
+		{"* * * * 8", "day of week field"},
+		{"*/0 * * * *", "invalid step"},
+		{"30-10 * * * *", "invalid range"},
+		{"x * * * *", "invalid value \"x\""},
+	}
+
+	for _, tt := range tests {
+		if _, err := parseCron(tt.expr); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%q: expected %q, got %v", tt.expr, tt.expected, err)
+		}
+	}
+}
@@ -0,0 +1,698 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Severities of the messages sent with send_text and send_markdown, in increasing order
+const (
+	SeverityInfo     = "info"
+	SeverityWarning  = "warning"
+	SeverityCritical = "critical"
+)
+
+// severityLevels orders the severities.
+var severityLevels = map[string]int{
+	SeverityInfo:     0,
+	SeverityWarning:  1,
+	SeverityCritical: 2,
+}
+
+// DefaultDigestPolicy leaves aggregation disabled until a window is configured.
+var DefaultDigestPolicy = DigestPolicy{MaxItems: 10, FlushSeverity: SeverityCritical}
+
+const (
+	// maxDigestItemLength bounds the length of a message summary in a digest, in characters
+	maxDigestItemLength = 200
+
+	// digestIdleWait is how long the worker sleeps when no digest is pending
+	digestIdleWait = time.Minute
+
+	// digestJournalName is the name of the journal file in the state directory
+	digestJournalName = "digest.jsonl"
+)
+
+// DigestPolicy configures the aggregation of the text and markdown messages sent by a bot.
+// Messages arriving within the window after a first one are merged into a single markdown digest.
+type DigestPolicy struct {
+	// Window is how long messages are collected before the digest is sent, 0 disables aggregation
+	Window Duration `json:"window"`
+
+	// MaxItems is the number of distinct messages listed in a digest, 10 when 0
+	MaxItems int `json:"max_items,omitempty"`
+
+	// FlushSeverity is the severity from which messages are sent right away and flush
+	// the pending digest of their group, SeverityCritical when empty
+	FlushSeverity string `json:"flush_severity,omitempty"`
+}
+
+// validSeverity checks that severity is one of the known severities.
+func validSeverity(severity string) error {
+	if _, ok := severityLevels[severity]; !ok {
+		return fmt.Errorf("unknown severity %q, expected %s, %s or %s", severity, SeverityInfo, SeverityWarning, SeverityCritical)
+	}
+	return nil
+}
+
+// flushes reports whether messages of the given severity bypass the digest.
+func (p DigestPolicy) flushes(severity string) bool {
+	flushSeverity := p.FlushSeverity
+	if flushSeverity == "" {
+		flushSeverity = SeverityCritical
+	}
+	return severityLevels[severity] >= severityLevels[flushSeverity]
+}
+
+// DigestStatus describes the pending digest a message was added to.
+type DigestStatus struct {
+	// Bot is the name of the bot the digest is sent with
+	Bot string `json:"bot"`
+
+	// GroupKey is the group the message was aggregated in, empty for the bot-wide group
+	GroupKey string `json:"group_key,omitempty"`
+
+	// Pending is the number of messages in the digest
+	Pending int `json:"pending"`
+
+	// FlushAt is when the digest is sent
+	FlushAt time.Time `json:"flush_at"`
+
+	// Duplicate reports whether the message was not added because a message
+	// with the same idempotency key is already in the digest
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// digestItem is a distinct message of a digest.
+type digestItem struct {
+	summary  string
+	severity string
+	first    time.Time
+	count    int
+}
+
+// digestGroup collects the messages of a bot and group key until the window closes.
+type digestGroup struct {
+	id       string
+	bot      string
+	groupKey string
+	policy   DigestPolicy
+	flushAt  time.Time
+
+	// attempts counts the failed sends of a digest retried after a transient failure,
+	// until retryUntil. A retried digest takes no new messages.
+	attempts   int
+	retryUntil time.Time
+
+	// sending reports whether the digest is being sent
+	sending bool
+
+	// first is the first message, sent as is when it stays alone
+	first    Message
+	firstKey string
+
+	items      []*digestItem
+	total      int
+	severities map[string]int
+	keys       map[string]bool
+
+	atMobiles []string
+	atUserIds []string
+	isAtAll   bool
+}
+
+// digestRecord is the journal record of a pending digest. A record marked sent removes the digest.
+type digestRecord struct {
+	ID         string             `json:"id"`
+	Sent       bool               `json:"sent,omitempty"`
+	Bot        string             `json:"bot,omitempty"`
+	GroupKey   string             `json:"group_key,omitempty"`
+	Policy     DigestPolicy       `json:"policy"`
+	FlushAt    time.Time          `json:"flush_at"`
+	Attempts   int                `json:"attempts,omitempty"`
+	RetryUntil time.Time          `json:"retry_until"`
+	First      Message            `json:"first,omitempty"`
+	FirstKey   string             `json:"first_key,omitempty"`
+	Items      []digestItemRecord `json:"items,omitempty"`
+	Total      int                `json:"total"`
+	Severities map[string]int     `json:"severities,omitempty"`
+	Keys       []string           `json:"keys,omitempty"`
+	AtMobiles  []string           `json:"at_mobiles,omitempty"`
+	AtUserIds  []string           `json:"at_user_ids,omitempty"`
+	IsAtAll    bool               `json:"is_at_all,omitempty"`
+}
+
+// digestItemRecord is the journal record of a distinct message of a digest.
+type digestItemRecord struct {
+	Summary  string    `json:"summary"`
+	Severity string    `json:"severity"`
+	First    time.Time `json:"first"`
+	Count    int       `json:"count"`
+}
+
+// Digester aggregates bursts of text and markdown messages into markdown digests,
+// one per bot and group key, sent when the aggregation window of the bot closes.
+// Opened with OpenDigester, pending digests are journaled in the state directory and survive restarts.
+// Created with NewDigester, they are kept in memory and sent on shutdown by FlushAll.
+type Digester struct {
+	bots     *BotRegistry
+	outbox   *Outbox
+	location *time.Location
+	clock    clock
+
+	// mu guards groups and the journal
+	mu     sync.Mutex
+	groups map[string]*digestGroup
+
+	// journal records the pending digests, nil when they are kept in memory
+	journal *journal
+
+	// sendMu serializes the sends of digests, so that Flush waits for a digest in flight
+	sendMu sync.Mutex
+
+	// wake interrupts the worker wait when the digests change
+	wake chan struct{}
+}
+
+// NewDigester creates a Digester.
+// Parameters:
+//   - bots: The bots digests are sent with, whose DigestPolicy enables aggregation
+//   - outbox: The outbox digests are queued in, nil to send them right away
+//   - location: The time zone of the times listed in digests
+// Returns:
+//   - A pointer to a new Digester, whose worker must be started with Run
+func NewDigester(bots *BotRegistry, outbox *Outbox, location *time.Location) *Digester {
+	return &Digester{
+		bots:     bots,
+		outbox:   outbox,
+		location: location,
+		clock:    realClock{},
+		groups:   make(map[string]*digestGroup),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+// OpenDigester opens the digests stored in dir, creating it when needed, and replays their journal.
+// Parameters:
+//   - dir: The state directory holding the journal
+//   - bots: The bots digests are sent with, whose DigestPolicy enables aggregation
+//   - outbox: The outbox digests are queued in, nil to send them right away
+//   - location: The time zone of the times listed in digests
+// Returns:
+//   - A pointer to a Digester holding the pending digests, whose worker must be started with Run
+//   - An error if the directory or journal cannot be used
+func OpenDigester(dir string, bots *BotRegistry, outbox *Outbox, location *time.Location) (*Digester, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	d := NewDigester(bots, outbox, location)
+	d.journal = &journal{path: filepath.Join(dir, digestJournalName), what: "digest journal"}
+
+	err := replayJournal(d.journal.path, d.journal.what, func(record *digestRecord) {
+		if record.Sent {
+			delete(d.groups, record.ID)
+		} else {
+			d.groups[record.ID] = record.group()
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := d.compact(); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Close closes the journal. The worker must be stopped first.
+func (d *Digester) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.journal == nil {
+		return nil
+	}
+	return d.journal.close()
+}
+
+// journaled reports whether the pending digests survive restarts.
+func (d *Digester) journaled() bool {
+	return d.journal != nil
+}
+
+// Policy returns the digest policy of the named bot.
+func (d *Digester) Policy(botName string) (DigestPolicy, error) {
+	bot, err := d.bots.Get(botName)
+	if err != nil {
+		return DigestPolicy{}, err
+	}
+	return bot.digest, nil
+}
+
+// Add adds msg to the pending digest of the bot and group key, opening one when needed.
+// Parameters:
+//   - botName: The name of the bot, empty for the default bot
+//   - groupKey: The group the message is aggregated in, empty for the bot-wide group
+//   - severity: The severity of the message
+//   - key: The idempotency key of the message, repeated keys are added once
+//   - msg: A text or markdown message
+// Returns:
+//   - The status of the digest
+//   - An error if the bot is unknown, does not aggregate messages or the digest cannot be journaled
+func (d *Digester) Add(botName, groupKey, severity, key string, msg Message) (*DigestStatus, error) {
+	bot, err := d.bots.Get(botName)
+	if err != nil {
+		return nil, err
+	}
+	if bot.digest.Window <= 0 {
+		return nil, fmt.Errorf("bot %s does not aggregate messages", bot.name)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.clock.Now()
+	group := d.open(bot.name, groupKey)
+	if group != nil && key != "" && group.keys[key] {
+		return &DigestStatus{Bot: group.bot, GroupKey: groupKey, Pending: group.total, FlushAt: group.flushAt, Duplicate: true}, nil
+	}
+
+	// The digest is changed on a copy, made current once journaled
+	var updated *digestGroup
+	if group != nil {
+		updated = group.record().group()
+	} else {
+		updated = &digestGroup{
+			id:         uuid.New().String(),
+			bot:        bot.name,
+			groupKey:   groupKey,
+			policy:     bot.digest,
+			flushAt:    now.Add(time.Duration(bot.digest.Window)),
+			first:      msg,
+			firstKey:   key,
+			severities: make(map[string]int),
+			keys:       make(map[string]bool),
+		}
+	}
+	updated.add(msg, severity, key, now)
+	if err := d.update(updated); err != nil {
+		return nil, err
+	}
+	if group == nil {
+		d.notify()
+	}
+
+	return &DigestStatus{Bot: updated.bot, GroupKey: groupKey, Pending: updated.total, FlushAt: updated.flushAt}, nil
+}
+
+// open returns the digest of the bot and group key taking new messages, nil when none. The caller must hold mu.
+func (d *Digester) open(botName, groupKey string) *digestGroup {
+	for _, group := range d.groups {
+		if group.bot == botName && group.groupKey == groupKey && !group.sending && group.attempts == 0 {
+			return group
+		}
+	}
+	return nil
+}
+
+// add records a message in the group.
+func (g *digestGroup) add(msg Message, severity, key string, now time.Time) {
+	g.total++
+	g.severities[severity]++
+	if key != "" {
+		g.keys[key] = true
+	}
+
+	summary := summarizeMessage(msg)
+	found := false
+	for _, item := range g.items {
+		if item.summary == summary {
+			item.count++
+			if severityLevels[severity] > severityLevels[item.severity] {
+				item.severity = severity
+			}
+			found = true
+			break
+		}
+	}
+	if !found {
+		g.items = append(g.items, &digestItem{summary: summary, severity: severity, first: now, count: 1})
+	}
+
+	if at, ok := msg["at"].(map[string]interface{}); ok {
+		g.atMobiles = appendMissing(g.atMobiles, at["atMobiles"])
+		g.atUserIds = appendMissing(g.atUserIds, at["atUserIds"])
+		if isAtAll, _ := at["isAtAll"].(bool); isAtAll {
+			g.isAtAll = true
+		}
+	}
+}
+
+// appendMissing appends the strings of list that are not in values yet.
+func appendMissing(values []string, list interface{}) []string {
+	strs, _ := list.([]string)
+	for _, s := range strs {
+		found := false
+		for _, value := range values {
+			if value == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// summarizeMessage returns the text of a text or markdown message on one line, shortened to maxDigestItemLength.
+func summarizeMessage(msg Message) string {
+	var text string
+	switch msg.MsgType() {
+	case "text":
+		content, _ := msg["text"].(map[string]interface{})
+		text, _ = content["content"].(string)
+	case "markdown":
+		content, _ := msg["markdown"].(map[string]interface{})
+		title, _ := content["title"].(string)
+		body, _ := content["text"].(string)
+		text = title + ": " + body
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+	if runes := []rune(text); len(runes) > maxDigestItemLength {
+		text = string(runes[:maxDigestItemLength-1]) + "…"
+	}
+	return text
+}
+
+// Flush sends the pending digests of the bot and group key right away, after the digest in flight if any,
+// so that a message dispatched next follows them. ctx aborts the sends, leaving the digests pending.
+func (d *Digester) Flush(ctx context.Context, botName, groupKey string) {
+	bot, err := d.bots.Get(botName)
+	if err != nil {
+		return
+	}
+
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	for _, group := range d.claim(func(group *digestGroup) bool {
+		return group.bot == bot.name && group.groupKey == groupKey
+	}) {
+		d.send(ctx, group)
+	}
+}
+
+// FlushAll sends every pending digest, used on shutdown when the digests are kept in memory.
+func (d *Digester) FlushAll(ctx context.Context) {
+	d.sendMu.Lock()
+	defer d.sendMu.Unlock()
+
+	for _, group := range d.claim(func(*digestGroup) bool { return true }) {
+		d.send(ctx, group)
+	}
+}
+
+// Run sends digests as their windows close until ctx is done.
+func (d *Digester) Run(ctx context.Context) {
+	for {
+		wait := digestIdleWait
+		if next := d.sendDue(ctx); !next.IsZero() {
+			wait = min(max(next.Sub(d.clock.Now()), 0), digestIdleWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-d.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue sends the digests whose window closed or whose next attempt is due,
+// and returns when the next one is due, zero when none is pending.
+func (d *Digester) sendDue(ctx context.Context) time.Time {
+	d.sendMu.Lock()
+	now := d.clock.Now()
+	for _, group := range d.claim(func(group *digestGroup) bool { return !group.flushAt.After(now) }) {
+		d.send(ctx, group)
+	}
+	d.sendMu.Unlock()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var next time.Time
+	for _, group := range d.groups {
+		if !group.sending && (next.IsZero() || group.flushAt.Before(next)) {
+			next = group.flushAt
+		}
+	}
+
+	return next
+}
+
+// claim marks the pending digests matching match as being sent, so that they take no new messages,
+// and returns them earliest first. The caller must hold sendMu.
+func (d *Digester) claim(match func(group *digestGroup) bool) []*digestGroup {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var claimed []*digestGroup
+	for _, group := range d.groups {
+		if !group.sending && match(group) {
+			group.sending = true
+			claimed = append(claimed, group)
+		}
+	}
+	sort.Slice(claimed, func(i, j int) bool {
+		return claimed[i].flushAt.Before(claimed[j].flushAt)
+	})
+
+	return claimed
+}
+
+// send sends the digest of a claimed group, or its only message as is, and forgets it once sent.
+// A digest interrupted by ctx stays pending. Without an outbox, transient failures are retried
+// until scheduleRetryWindow after the first failure.
+func (d *Digester) send(ctx context.Context, group *digestGroup) {
+	msg, key := group.first, group.firstKey
+	var err error
+	if group.total > 1 {
+		if msg, err = group.render(d.location); err != nil {
+			err = fmt.Errorf("failed to build the digest: %v", err)
+		}
+		key = ""
+	}
+	if err == nil {
+		_, _, err = sendOrQueue(ctx, d.bots, d.outbox, group.bot, key, msg)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	group.sending = false
+	if err == nil {
+		d.remove(group)
+		return
+	}
+	if ctx.Err() != nil {
+		// Interrupted by shutdown, the digest is sent later
+		return
+	}
+
+	now := d.clock.Now()
+	retryUntil := group.retryUntil
+	if group.attempts == 0 {
+		retryUntil = now.Add(scheduleRetryWindow)
+	}
+	retryAt := now.Add(scheduleRetryPolicy.backoff(group.attempts + 1))
+	if !transient(err) || !retryAt.Before(retryUntil) {
+		d.remove(group)
+		log.Printf("Failed to send the digest of %d messages with bot %s, it is dropped: %v\n", group.total, group.bot, err)
+		return
+	}
+
+	updated := group.record().group()
+	updated.attempts++
+	updated.retryUntil = retryUntil
+	updated.flushAt = retryAt
+	if err := d.update(updated); err != nil {
+		// Keep retrying from memory
+		d.groups[updated.id] = updated
+		log.Printf("Failed to journal the digest of bot %s: %v\n", group.bot, err)
+	}
+	log.Printf("Failed to send the digest of %d messages with bot %s, retrying at %s: %v\n", group.total, group.bot, retryAt.Format(time.RFC3339), err)
+}
+
+// update journals a digest and makes it current. The caller must hold mu.
+func (d *Digester) update(group *digestGroup) error {
+	if d.journal != nil {
+		if err := d.journal.append(group.record()); err != nil {
+			return err
+		}
+	}
+
+	d.groups[group.id] = group
+	d.compactIfNeeded()
+	return nil
+}
+
+// remove forgets a digest that was sent or dropped and journals it. The caller must hold mu.
+func (d *Digester) remove(group *digestGroup) {
+	delete(d.groups, group.id)
+	if d.journal == nil {
+		return
+	}
+
+	if err := d.journal.append(&digestRecord{ID: group.id, Sent: true}); err != nil {
+		log.Printf("Failed to journal the digest of bot %s: %v\n", group.bot, err)
+	}
+	d.compactIfNeeded()
+}
+
+// compactIfNeeded compacts the journal once it holds much more records than digests. The caller must hold mu.
+func (d *Digester) compactIfNeeded() {
+	if d.journal == nil || !d.journal.needsRewrite(len(d.groups)) {
+		return
+	}
+	if err := d.compact(); err != nil {
+		log.Printf("Failed to compact the digest journal: %v\n", err)
+	}
+}
+
+// compact rewrites the journal with one record per pending digest. The caller must hold mu.
+func (d *Digester) compact() error {
+	records := make([]interface{}, 0, len(d.groups))
+	for _, group := range d.groups {
+		records = append(records, group.record())
+	}
+
+	return d.journal.rewrite(records)
+}
+
+// record returns the journal record of the group, which shares none of its state.
+func (g *digestGroup) record() *digestRecord {
+	record := &digestRecord{
+		ID:         g.id,
+		Bot:        g.bot,
+		GroupKey:   g.groupKey,
+		Policy:     g.policy,
+		FlushAt:    g.flushAt,
+		Attempts:   g.attempts,
+		RetryUntil: g.retryUntil,
+		First:      g.first,
+		FirstKey:   g.firstKey,
+		Total:      g.total,
+		Severities: make(map[string]int, len(g.severities)),
+		AtMobiles:  append([]string(nil), g.atMobiles...),
+		AtUserIds:  append([]string(nil), g.atUserIds...),
+		IsAtAll:    g.isAtAll,
+	}
+	for _, item := range g.items {
+		record.Items = append(record.Items, digestItemRecord{Summary: item.summary, Severity: item.severity, First: item.first, Count: item.count})
+	}
+	for severity, n := range g.severities {
+		record.Severities[severity] = n
+	}
+	for key := range g.keys {
+		record.Keys = append(record.Keys, key)
+	}
+	sort.Strings(record.Keys)
+
+	return record
+}
+
+// group rebuilds the digest of a journal record.
+func (r *digestRecord) group() *digestGroup {
+	group := &digestGroup{
+		id:         r.ID,
+		bot:        r.Bot,
+		groupKey:   r.GroupKey,
+		policy:     r.Policy,
+		flushAt:    r.FlushAt,
+		attempts:   r.Attempts,
+		retryUntil: r.RetryUntil,
+		first:      r.First,
+		firstKey:   r.FirstKey,
+		total:      r.Total,
+		severities: make(map[string]int, len(r.Severities)),
+		keys:       make(map[string]bool, len(r.Keys)),
+		atMobiles:  append([]string(nil), r.AtMobiles...),
+		atUserIds:  append([]string(nil), r.AtUserIds...),
+		isAtAll:    r.IsAtAll,
+	}
+	for _, item := range r.Items {
+		group.items = append(group.items, &digestItem{summary: item.Summary, severity: item.Severity, first: item.First, count: item.Count})
+	}
+	for severity, n := range r.Severities {
+		group.severities[severity] = n
+	}
+	for _, key := range r.Keys {
+		group.keys[key] = true
+	}
+
+	return group
+}
+
+// render builds the markdown digest of a group, listing counts per severity and the first distinct messages.
+func (g *digestGroup) render(location *time.Location) (Message, error) {
+	title := fmt.Sprintf("Digest: %d messages", g.total)
+	if g.groupKey != "" {
+		title = fmt.Sprintf("Digest %s: %d messages", g.groupKey, g.total)
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "### %s\n\n", title)
+
+	var counts []string
+	for _, severity := range []string{SeverityCritical, SeverityWarning, SeverityInfo} {
+		if n := g.severities[severity]; n > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", n, severity))
+		}
+	}
+	fmt.Fprintf(&b, "%s, %d distinct, collected over %s\n\n", strings.Join(counts, ", "), len(g.items), time.Duration(g.policy.Window))
+
+	maxItems := g.policy.MaxItems
+	if maxItems <= 0 {
+		maxItems = DefaultDigestPolicy.MaxItems
+	}
+	for i, item := range g.items {
+		if i == maxItems {
+			fmt.Fprintf(&b, "- … and %d more\n", len(g.items)-maxItems)
+			break
+		}
+		fmt.Fprintf(&b, "- %s **%s** %s", item.first.In(location).Format("15:04:05"), item.severity, item.summary)
+		if item.count > 1 {
+			fmt.Fprintf(&b, " (×%d)", item.count)
+		}
+		b.WriteString("\n")
+	}
+
+	return NewMarkdownMessage(title, strings.TrimSuffix(b.String(), "\n"), g.atMobiles, g.atUserIds, g.isAtAll)
+}
+
+// notify wakes the worker up without blocking.
+func (d *Digester) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newTestDigester creates a digester with a fake clock for a default bot aggregating with policy.
+func newTestDigester(t *testing.T, policy DigestPolicy) (*Digester, *DryRunSender, *fakeClock) {
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(sender), WithDigest(policy))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+
+	digester := NewDigester(bots, nil, time.UTC)
+	clk := newFakeClock()
+	digester.clock = clk
+
+	return digester, sender, clk
+}
+
+// TestDigestAggregatesBurst tests that messages arriving within the window are sent as one digest.
+func TestDigestAggregatesBurst(t *testing.T) {
+	digester, sender, clk := newTestDigester(t, DigestPolicy{Window: Duration(time.Minute), MaxItems: 2})
+
+	disk, _ := NewTextMessage("disk full on db-1", nil, nil, false)
+	cpu, _ := NewMarkdownMessage("CPU", "load   above\n90%", nil, nil, false)
+	memory, _ := NewTextMessage("memory low on web-2", []string{"13800138000"}, nil, false)
+
+	status, err := digester.Add("", "", SeverityInfo, "", disk)
+	if err != nil || status.Pending != 1 || !status.FlushAt.Equal(clk.Now().Add(time.Minute)) {
+		t.Fatalf("unexpected status: %+v (%v)", status, err)
+	}
+	clk.Advance(10 * time.Second)
+	digester.Add("", "", SeverityInfo, "", disk)
+	digester.Add("", "", SeverityWarning, "", cpu)
+	digester.Add("", "", SeverityInfo, "", disk)
+	digester.Add("", "", SeverityInfo, "", memory)
+
+	if next := digester.sendDue(context.Background()); !next.Equal(status.FlushAt) || len(sender.Records()) != 0 {
+		t.Fatalf("nothing should be sent before the window closes, next flush at %v", next)
+	}
+
+	clk.Advance(50 * time.Second)
+	if next := digester.sendDue(context.Background()); !next.IsZero() {
+		t.Errorf("no digest should be pending, next flush at %v", next)
+	}
+
+	records := sender.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected a single digest, got %d requests", len(records))
+	}
+	for _, expected := range []string{
+		`"msgtype":"markdown"`,
+		"Digest: 5 messages",
+		"1 warning, 4 info, 3 distinct, collected over 1m0s",
+		"09:00:00 **info** disk full on db-1 (×3)",
+		"09:00:10 **warning** CPU: load above 90%",
+		"… and 1 more",
+		"13800138000",
+	} {
+		if !strings.Contains(records[0].Body, expected) {
+			t.Errorf("expected the digest to contain %q, got %s", expected, records[0].Body)
+		}
+	}
+}
+
+// TestDigestSingleMessage tests that a message alone in its window is sent as is.
+func TestDigestSingleMessage(t *testing.T) {
+	digester, sender, clk := newTestDigester(t, DigestPolicy{Window: Duration(time.Minute)})
+
+	msg, _ := NewTextMessage("deploy finished", nil, nil, false)
+	digester.Add("", "", SeverityInfo, "", msg)
+	clk.Advance(time.Minute)
+	digester.sendDue(context.Background())
+
+	records := sender.Records()
+	if len(records) != 1 || !strings.Contains(records[0].Body, `"content":"deploy finished"`) {
+		t.Errorf("expected the original message, got %+v", records)
+	}
+
+	// Shutdown sends pending digests
+	digester.Add("", "", SeverityInfo, "", msg)
+	digester.FlushAll(context.Background())
+	if len(sender.Records()) != 2 {
+		t.Errorf("expected FlushAll to send the pending digest")
+	}
+}
+
+// TestDigestTools tests aggregation through send_text, with group keys, idempotency keys and flush-on-severity.
+func TestDigestTools(t *testing.T) {
+	digester, sender, clk := newTestDigester(t, DigestPolicy{Window: Duration(time.Minute)})
+	handler := sendTextHandler(NewDispatcher(digester.bots, nil, nil, digester))
+	ctx := context.Background()
+
+	send := func(args map[string]interface{}) *mcp.CallToolResult {
+		result, _ := handler(ctx, newToolRequest("send_text", args))
+		return result
+	}
+
+	result := send(map[string]interface{}{"content": "db-1 down", "group_key": "inc-1"})
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "added to the digest of bot default, 1 messages are sent at 2024-01-01T09:01:00Z") {
+		t.Fatalf("unexpected result: %q", text)
+	}
+	var status DigestStatus
+	resultJSON(t, result, &status)
+	if status.GroupKey != "inc-1" || status.Pending != 1 {
+		t.Errorf("unexpected status: %+v", status)
+	}
+
+	send(map[string]interface{}{"content": "db-1 still down", "group_key": "inc-1", "idempotency_key": "a1"})
+	result = send(map[string]interface{}{"content": "db-1 still down", "group_key": "inc-1", "idempotency_key": "a1"})
+	if text := result.Content[0].(mcp.TextContent).Text; !strings.Contains(text, "not added again") {
+		t.Errorf("expected the repeated key to be ignored, got %q", text)
+	}
+	send(map[string]interface{}{"content": "web-2 slow", "group_key": "inc-2"})
+
+	if result := send(map[string]interface{}{"content": "db-1", "severity": "fatal"}); !result.IsError {
+		t.Errorf("an unknown severity should be rejected")
+	}
+
+	// A critical message goes out right away, after the digest of its group
+	result = send(map[string]interface{}{"content": "db cluster lost", "group_key": "inc-1", "severity": "critical"})
+	if text := result.Content[0].(mcp.TextContent).Text; result.IsError || !strings.Contains(text, "sent successfully") {
+		t.Fatalf("expected the critical message to be sent, got %q", text)
+	}
+	records := sender.Records()
+	if len(records) != 2 || !strings.Contains(records[0].Body, "Digest inc-1: 2 messages") || !strings.Contains(records[1].Body, "db cluster lost") {
+		t.Fatalf("expected the digest of inc-1 to be flushed before the critical message, got %+v", records)
+	}
+	digester.sendDue(context.Background())
+
+	clk.Advance(time.Minute)
+	digester.sendDue(context.Background())
+	if records := sender.Records(); len(records) != 3 || !strings.Contains(records[2].Body, "web-2 slow") {
+		t.Errorf("expected the message of inc-2 after the window, got %+v", records)
+	}
+}
+
+// TestDigestJournal tests that pending digests survive a restart and are forgotten once sent.
+func TestDigestJournal(t *testing.T) {
+	dir := t.TempDir()
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(sender), WithDigest(DigestPolicy{Window: Duration(time.Minute)}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	clk := newFakeClock()
+	open := func() *Digester {
+		digester, err := OpenDigester(dir, bots, nil, time.UTC)
+		if err != nil {
+			t.Fatalf("OpenDigester failed: %v", err)
+		}
+		digester.clock = clk
+		return digester
+	}
+
+	digester := open()
+	disk, _ := NewTextMessage("disk full on db-1", []string{"13800138000"}, nil, false)
+	digester.Add("", "inc-1", SeverityWarning, "a1", disk)
+	digester.Add("", "inc-1", SeverityInfo, "", disk)
+	digester.Close()
+
+	reopened := open()
+	if status, _ := reopened.Add("", "inc-1", SeverityInfo, "a1", disk); !status.Duplicate || status.Pending != 2 {
+		t.Errorf("expected the digest to be replayed with its keys, got %+v", status)
+	}
+	clk.Advance(time.Minute)
+	if next := reopened.sendDue(context.Background()); !next.IsZero() {
+		t.Errorf("no digest should be pending, next flush at %v", next)
+	}
+	records := sender.Records()
+	if len(records) != 1 || !strings.Contains(records[0].Body, "Digest inc-1: 2 messages") || !strings.Contains(records[0].Body, "1 warning, 1 info") || !strings.Contains(records[0].Body, "13800138000") {
+		t.Fatalf("expected the replayed digest, got %+v", records)
+	}
+	reopened.Close()
+
+	if next := open().sendDue(context.Background()); !next.IsZero() || len(sender.Records()) != 1 {
+		t.Errorf("a sent digest should not be replayed, next flush at %v", next)
+	}
+}
+
+// TestDigestRetry tests that a digest failing transiently is retried, and kept pending when interrupted.
+func TestDigestRetry(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}), WithDigest(DigestPolicy{Window: Duration(time.Minute)}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	digester, err := OpenDigester(t.TempDir(), bots, nil, time.UTC)
+	if err != nil {
+		t.Fatalf("OpenDigester failed: %v", err)
+	}
+	defer digester.Close()
+	clk := newFakeClock()
+	digester.clock = clk
+	ctx := context.Background()
+
+	msg, _ := NewTextMessage("disk full on db-1", nil, nil, false)
+	digester.Add("", "", SeverityInfo, "", msg)
+	clk.Advance(time.Minute)
+
+	// A send interrupted by shutdown leaves the digest due
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if next := digester.sendDue(canceled); !next.Equal(clk.Now()) {
+		t.Errorf("expected the interrupted digest to stay due, next flush at %v", next)
+	}
+
+	next := digester.sendDue(ctx)
+	if calls != 1 || !next.After(clk.Now()) {
+		t.Fatalf("expected the digest to be retried, next flush at %v after %d calls", next, calls)
+	}
+
+	// New messages open a new digest while the failed one is retried
+	if status, _ := digester.Add("", "", SeverityInfo, "", msg); status.Pending != 1 {
+		t.Errorf("expected a new digest, got %+v", status)
+	}
+
+	// The retry window closes an hour after the first failure
+	clk.Advance(time.Hour)
+	next = digester.sendDue(ctx)
+	if calls != 3 || len(digester.groups) != 1 {
+		t.Fatalf("expected the first digest to be dropped and the second retried, got %d digests after %d calls", len(digester.groups), calls)
+	}
+
+	clk.Advance(next.Sub(clk.Now()))
+	if next := digester.sendDue(ctx); !next.IsZero() || calls != 4 {
+		t.Errorf("expected the second digest to be sent, next flush at %v after %d calls", next, calls)
+	}
+}
@@ -3,6 +3,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
@@ -14,6 +15,8 @@ import (
 	"net/url"
 	"os"
 	"time"
+
+	"github.com/google/uuid"
 )
 
 // DingDing API endpoints
@@ -28,32 +31,267 @@ const (
 	DINGDING_BOT_UPLOAD_URL = DINGDING_BOT_BASE_URL + "/upload_media?access_token="
 )
 
-// DingDingBot represents a DingDing Bot instance with configuration for API access
+// DingDingBot represents a DingDing Bot instance with configuration for API access.
+// The configuration is fixed at construction time, so a single instance is
+// safe for concurrent use as long as its Sender is.
 type DingDingBot struct {
-	// WebhookURL is the base URL for the DingDing Bot API
-	WebhookURL string
-	
-	// WebhookKey is the access token for the DingDing Bot
-	WebhookKey string
-	
-	// SignKey is the secret key used for signature verification
+	// name identifies the bot in results, such as its name in the BotRegistry
+	name string
+
+	// sendURL is the endpoint for sending messages, the access token is appended to it
+	sendURL string
+
+	// uploadURL is the endpoint for uploading media files, the access token is appended to it
+	uploadURL string
+
+	// webhookKey is the access token for the DingDing Bot
+	webhookKey string
+
+	// signKey is the secret key used for signature verification
 	// This is optional but recommended for enhanced security
-	SignKey string
+	signKey string
+
+	// app sends the messages through the open API of an enterprise internal app instead of the webhook, nil when not configured
+	app *EnterpriseApp
+
+	// openConversationID is the group the messages are sent to through app
+	openConversationID string
+
+	// messageLog records the sent messages so that they can be recalled, nil when not kept
+	messageLog *MessageLog
+
+	// sender delivers requests to the DingDing API
+	sender Sender
+
+	// httpClient makes the requests of the HTTP sender
+	httpClient *http.Client
+
+	// downloadClient downloads the images given by URL, refusing non-public addresses unless replaced
+	downloadClient *http.Client
+
+	// retryPolicy controls how transient failures are retried
+	retryPolicy RetryPolicy
+
+	// rateLimit configures limiter, which is nil when rate limiting is disabled
+	rateLimit RateLimit
+	limiter   *rateLimiter
+
+	// idempotency configures dedup, which is nil when deduplication is disabled
+	idempotency Idempotency
+	dedup       *idempotencyCache
+
+	// breakerPolicy configures breaker, which fails requests fast after repeated failures
+	breakerPolicy BreakerPolicy
+	breaker       *circuitBreaker
+
+	// digest configures the aggregation of text and markdown messages by the Digester
+	digest DigestPolicy
+
+	// sessionWebhookHosts lists the hosts Reply posts to
+	sessionWebhookHosts []string
+
+	// clock measures time for the limiter and retry backoff, replaced in tests
+	clock clock
+}
+
+// SendResult describes a request made to the DingDing API.
+type SendResult struct {
+	// MessageID is generated by the client to identify the message
+	MessageID string `json:"message_id"`
+
+	// Bot is the name of the bot the request was made with
+	Bot string `json:"bot,omitempty"`
+
+	// URL is the request URL with the access token and signature redacted
+	URL string `json:"url"`
+
+	// DryRun reports whether the request was captured instead of delivered
+	DryRun bool `json:"dry_run"`
+
+	// Payload is the JSON message that was posted with image data summarized, empty for uploads
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// MediaID is the media ID returned by uploads
+	MediaID string `json:"media_id,omitempty"`
+
+	// ProcessQueryKey identifies a message sent through an enterprise app, used to recall it
+	ProcessQueryKey string `json:"process_query_key,omitempty"`
+
+	// ErrCode is the errcode answered by DingDing
+	ErrCode int `json:"errcode"`
+
+	// ErrMsg is the errmsg answered by DingDing
+	ErrMsg string `json:"errmsg"`
+
+	// Latency is the time spent on the request, including retries
+	Latency Duration `json:"latency"`
+
+	// Attempts is the number of HTTP requests made, including retries
+	Attempts int `json:"attempts"`
+
+	// Retries is the number of attempts after the first one
+	Retries int `json:"retries"`
+
+	// IdempotencyKey is the key the message was deduplicated with, see SendOnce
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Duplicate reports whether the message was not sent again because a message
+	// with the same idempotency key was already sent, the result is the original one
+	Duplicate bool `json:"duplicate,omitempty"`
+}
+
+// BotOption configures a DingDingBot at construction time.
+type BotOption func(*DingDingBot)
+
+// WithName names the bot in results. Bots added to a BotRegistry are named after their registry name.
+func WithName(name string) BotOption {
+	return func(bot *DingDingBot) {
+		bot.name = name
+	}
+}
+
+// WithBaseURL points the bot at another DingDing Bot API base URL, such as a local test server.
+// The send and upload endpoints are derived from it the same way as from DINGDING_BOT_BASE_URL.
+func WithBaseURL(baseURL string) BotOption {
+	return func(bot *DingDingBot) {
+		bot.sendURL = baseURL + "/send?access_token="
+		bot.uploadURL = baseURL + "/upload_media?access_token="
+	}
+}
+
+// WithSender replaces the HTTP delivery of requests, for example with a DryRunSender or FileSender.
+func WithSender(sender Sender) BotOption {
+	return func(bot *DingDingBot) {
+		if sender != nil {
+			bot.sender = sender
+		}
+	}
+}
+
+// WithEnterprise sends the messages of the bot to a group through the open API of an enterprise internal app
+// instead of the robot webhook. The webhook access token, if any, is still used for uploads.
+// Parameters:
+//   - app: The app, shared by the bots of the same app so that they share its access token
+//   - openConversationID: The group the messages are sent to
+func WithEnterprise(app *EnterpriseApp, openConversationID string) BotOption {
+	return func(bot *DingDingBot) {
+		bot.app = app
+		bot.openConversationID = openConversationID
+	}
+}
+
+// WithMessageLog records the messages sent with the bot in log, so that they can be recalled with Recall.
+func WithMessageLog(log *MessageLog) BotOption {
+	return func(bot *DingDingBot) {
+		bot.messageLog = log
+	}
+}
+
+// WithHTTPClient sets the HTTP client the bot makes requests with, such as one built by NewHTTPClient.
+// Images are downloaded with NewDownloadClient of it unless WithDownloadClient is given.
+// It has no effect on the requests of a custom Sender.
+func WithHTTPClient(client *http.Client) BotOption {
+	return func(bot *DingDingBot) {
+		if client != nil {
+			bot.httpClient = client
+		}
+	}
+}
+
+// WithDownloadClient sets the HTTP client the bot downloads images given by URL with, such as the client
+// of WithHTTPClient itself to allow downloads from the private network.
+func WithDownloadClient(client *http.Client) BotOption {
+	return func(bot *DingDingBot) {
+		if client != nil {
+			bot.downloadClient = client
+		}
+	}
+}
+
+// WithRetryPolicy replaces DefaultRetryPolicy for requests made by the bot.
+func WithRetryPolicy(policy RetryPolicy) BotOption {
+	return func(bot *DingDingBot) {
+		bot.retryPolicy = policy
+	}
+}
+
+// WithRateLimit limits the messages sent by the bot, see DefaultRateLimit.
+// Uploads are not counted.
+func WithRateLimit(limit RateLimit) BotOption {
+	return func(bot *DingDingBot) {
+		bot.rateLimit = limit
+	}
+}
+
+// WithIdempotency configures how the bot suppresses duplicate sends, see SendOnce and DefaultIdempotency.
+func WithIdempotency(idempotency Idempotency) BotOption {
+	return func(bot *DingDingBot) {
+		bot.idempotency = idempotency
+	}
+}
+
+// WithCircuitBreaker sets the circuit breaker policy, a zero Failures disables the breaker.
+func WithCircuitBreaker(policy BreakerPolicy) BotOption {
+	return func(bot *DingDingBot) {
+		bot.breakerPolicy = policy
+	}
+}
+
+// WithDigest sets the aggregation of the text and markdown messages sent through the Digester.
+func WithDigest(policy DigestPolicy) BotOption {
+	return func(bot *DingDingBot) {
+		bot.digest = policy
+	}
+}
+
+// withClock replaces the real clock, used by tests.
+func withClock(clk clock) BotOption {
+	return func(bot *DingDingBot) {
+		bot.clock = clk
+	}
 }
 
 // NewDingDingBot creates a new DingDingBot instance with the provided configuration
 // Parameters:
-//   - webhookURL: The base URL for the DingDing Bot API
 //   - webhookKey: The access token for the DingDing Bot
 //   - signKey: The secret key for signature verification (optional)
+//   - opts: Options overriding the default endpoints and delivery
 // Returns:
 //   - A pointer to a new DingDingBot instance
-func NewDingDingBot(webhookURL, webhookKey, signKey string) *DingDingBot {
-	return &DingDingBot{
-		WebhookURL: webhookURL,
-		WebhookKey: webhookKey,
-		SignKey:    signKey,
+func NewDingDingBot(webhookKey, signKey string, opts ...BotOption) *DingDingBot {
+	bot := &DingDingBot{
+		sendURL:       DINGDING_BOT_SEND_URL,
+		uploadURL:     DINGDING_BOT_UPLOAD_URL,
+		webhookKey:    webhookKey,
+		signKey:       signKey,
+		sender:        &HTTPSender{},
+		httpClient:    &http.Client{Timeout: DefaultHTTPTimeout},
+		retryPolicy:   DefaultRetryPolicy,
+		idempotency:   DefaultIdempotency,
+		breakerPolicy: DefaultBreakerPolicy,
+		digest:        DefaultDigestPolicy,
+		clock:         realClock{},
+
+		sessionWebhookHosts: DefaultSessionWebhookHosts,
+	}
+
+	for _, opt := range opts {
+		opt(bot)
+	}
+
+	// Make the requests of the HTTP sender with the client of the bot
+	if sender, ok := bot.sender.(*HTTPSender); ok && sender.Client == nil {
+		bot.sender = &HTTPSender{Client: bot.httpClient}
 	}
+	if bot.downloadClient == nil {
+		bot.downloadClient = NewDownloadClient(bot.httpClient)
+	}
+
+	bot.limiter = newRateLimiter(bot.rateLimit, bot.clock)
+	bot.dedup = newIdempotencyCache(bot.idempotency.TTL, bot.clock)
+	bot.breaker = newCircuitBreaker(bot.breakerPolicy, bot.clock)
+
+	return bot
 }
 
 // generateSignature creates a signature for DingDing API requests using HMAC-SHA256
@@ -64,18 +302,29 @@ func NewDingDingBot(webhookURL, webhookKey, signKey string) *DingDingBot {
 //   - The Base64-encoded HMAC-SHA256 signature
 //   - An error if signature generation fails
 // Note:
-//   - Returns an empty string and nil error if SignKey is not provided
+//   - Returns an empty string and nil error if signKey is not provided
 func (bot *DingDingBot) generateSignature(timestamp int64) (string, error) {
 	// If no sign key is provided, return empty signature
-	if bot.SignKey == "" {
+	if bot.signKey == "" {
 		return "", nil
 	}
 	
+	return sign(bot.signKey, timestamp)
+}
+
+// sign computes the DingDing signature of a timestamp, as used by webhook requests and outgoing robot callbacks
+// Parameters:
+//   - secret: The sign key of the webhook or the app secret of the outgoing robot
+//   - timestamp: The timestamp in milliseconds
+// Returns:
+//   - The Base64-encoded HMAC-SHA256 signature
+//   - An error if signature generation fails
+func sign(secret string, timestamp int64) (string, error) {
 	// Format the string to sign: timestamp + newline + secret
-	stringToSign := fmt.Sprintf("%d\n%s", timestamp, bot.SignKey)
+	stringToSign := fmt.Sprintf("%d\n%s", timestamp, secret)
 	
 	// Create HMAC-SHA256 signature
-	h := hmac.New(sha256.New, []byte(bot.SignKey))
+	h := hmac.New(sha256.New, []byte(secret))
 	if _, err := h.Write([]byte(stringToSign)); err != nil {
 		return "", fmt.Errorf("failed to create signature: %v", err)
 	}
@@ -85,35 +334,139 @@ func (bot *DingDingBot) generateSignature(timestamp int64) (string, error) {
 	
 	return signature, nil
 }
-// SendText sends a text message to the DingDing group.
+
+// Message is a DingDing robot message payload, as built by the New*Message functions.
+type Message map[string]interface{}
+
+// MsgType returns the DingDing message type, such as "text" or "markdown".
+func (m Message) MsgType() string {
+	msgType, _ := m["msgtype"].(string)
+	return msgType
+}
+
+// Send sends a prebuilt message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - msg: The message built by one of the New*Message functions
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) Send(ctx context.Context, msg Message) (*SendResult, error) {
+	if msg.MsgType() == "" {
+		return nil, fmt.Errorf("message type cannot be empty")
+	}
+
+	return bot.sendRequest(ctx, msg)
+}
+
+// SendOnce sends a prebuilt message unless a message with the same idempotency key
+// was sent successfully by the bot within the idempotency TTL. Callers retrying after
+// a timeout pass the same key, so the message lands in the group only once.
+// Parameters:
+//   - ctx: Aborts the request, or the wait for a request in flight with the same key, when done
+//   - key: The idempotency key, empty to derive one from the content when content dedup is enabled
+//   - msg: The message built by one of the New*Message functions
+// Returns:
+//   - The result of the request, or a copy of the original result with Duplicate set
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendOnce(ctx context.Context, key string, msg Message) (*SendResult, error) {
+	key = bot.idempotencyKey(key, msg)
+	if key == "" || bot.dedup == nil {
+		return bot.Send(ctx, msg)
+	}
+
+	return bot.dedup.do(ctx, key, func() (*SendResult, error) {
+		result, err := bot.Send(withIdempotentSend(ctx), msg)
+		if err != nil {
+			return nil, err
+		}
+
+		result.IdempotencyKey = key
+		return result, nil
+	})
+}
+
+// idempotentSendKey is the context key marking a send with an idempotency key.
+type idempotentSendKey struct{}
+
+// withIdempotentSend marks the send of ctx as having an idempotency key, which allows
+// retrying requests that may already have reached DingDing.
+func withIdempotentSend(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentSendKey{}, true)
+}
+
+// idempotentSend reports whether the send of ctx has an idempotency key.
+func idempotentSend(ctx context.Context) bool {
+	idempotent, _ := ctx.Value(idempotentSendKey{}).(bool)
+	return idempotent
+}
+
+// idempotencyKey returns the key msg is deduplicated with: key when given, the content key
+// when content dedup is enabled, empty otherwise.
+func (bot *DingDingBot) idempotencyKey(key string, msg Message) string {
+	if key == "" && bot.idempotency.ContentDedup {
+		return contentKey(msg)
+	}
+	return key
+}
+
+// nonNilList returns an empty list for nil so that it is sent as [] rather than null.
+func nonNilList(list []string) []string {
+	if list == nil {
+		return []string{}
+	}
+	return list
+}
+
+// NewTextMessage builds a text message.
 // Parameters:
 //   - content: The text content of the message
 //   - atMobiles: Array of mobile numbers to @mention
 //   - atUserIds: Array of user IDs to @mention
 //   - isAtAll: Whether to @mention all members in the group
 // Returns:
-//   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) SendText(content string, atMobiles []string, atUserIds []string, isAtAll bool) error {
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewTextMessage(content string, atMobiles []string, atUserIds []string, isAtAll bool) (Message, error) {
 	if content == "" {
-		return fmt.Errorf("content cannot be empty")
+		return nil, fmt.Errorf("content cannot be empty")
 	}
 	
-	payload := map[string]interface{}{
+	payload := Message{
 		"msgtype": "text",
 		"text": map[string]interface{}{
 			"content": content,
 		},
 		"at": map[string]interface{}{
-			"atMobiles": atMobiles,
-			"atUserIds": atUserIds,
+			"atMobiles": nonNilList(atMobiles),
+			"atUserIds": nonNilList(atUserIds),
 			"isAtAll":   isAtAll,
 		},
 	}
 
-	return bot.sendRequest(payload)
+	return payload, nil
 }
 
-// SendMarkdown sends a markdown message to the DingDing group.
+// SendText sends a text message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - content: The text content of the message
+//   - atMobiles: Array of mobile numbers to @mention
+//   - atUserIds: Array of user IDs to @mention
+//   - isAtAll: Whether to @mention all members in the group
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendText(ctx context.Context, content string, atMobiles []string, atUserIds []string, isAtAll bool) (*SendResult, error) {
+	msg, err := NewTextMessage(content, atMobiles, atUserIds, isAtAll)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// NewMarkdownMessage builds a markdown message.
 // Parameters:
 //   - title: The title of the markdown message
 //   - content: The markdown content of the message
@@ -121,46 +474,68 @@ func (bot *DingDingBot) SendText(content string, atMobiles []string, atUserIds [
 //   - atUserIds: Array of user IDs to @mention
 //   - isAtAll: Whether to @mention all members in the group
 // Returns:
-//   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) SendMarkdown(title string, content string, atMobiles []string, atUserIds []string, isAtAll bool) error {
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewMarkdownMessage(title string, content string, atMobiles []string, atUserIds []string, isAtAll bool) (Message, error) {
 	if title == "" {
-		return fmt.Errorf("title cannot be empty")
+		return nil, fmt.Errorf("title cannot be empty")
 	}
 	if content == "" {
-		return fmt.Errorf("content cannot be empty")
+		return nil, fmt.Errorf("content cannot be empty")
 	}
 	
-	payload := map[string]interface{}{
+	payload := Message{
 		"msgtype": "markdown",
 		"markdown": map[string]interface{}{
 			"title": title,
 			"text":  content,
 		},
 		"at": map[string]interface{}{
-			"atMobiles": atMobiles,
-			"atUserIds": atUserIds,
+			"atMobiles": nonNilList(atMobiles),
+			"atUserIds": nonNilList(atUserIds),
 			"isAtAll":   isAtAll,
 		},
 	}
 
-	return bot.sendRequest(payload)
+	return payload, nil
 }
 
-// SendImage sends an image message to the DingDing group.
+// SendMarkdown sends a markdown message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - title: The title of the markdown message
+//   - content: The markdown content of the message
+//   - atMobiles: Array of mobile numbers to @mention
+//   - atUserIds: Array of user IDs to @mention
+//   - isAtAll: Whether to @mention all members in the group
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendMarkdown(ctx context.Context, title string, content string, atMobiles []string, atUserIds []string, isAtAll bool) (*SendResult, error) {
+	msg, err := NewMarkdownMessage(title, content, atMobiles, atUserIds, isAtAll)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// NewImageMessage builds an image message.
 // Parameters:
 //   - base64Data: The Base64-encoded image data
 //   - md5: The MD5 hash of the image
 // Returns:
-//   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) SendImage(base64Data string, md5 string) error {
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewImageMessage(base64Data string, md5 string) (Message, error) {
 	if base64Data == "" {
-		return fmt.Errorf("base64Data cannot be empty")
+		return nil, fmt.Errorf("base64Data cannot be empty")
 	}
 	if md5 == "" {
-		return fmt.Errorf("md5 cannot be empty")
+		return nil, fmt.Errorf("md5 cannot be empty")
 	}
 	
-	payload := map[string]interface{}{
+	payload := Message{
 		"msgtype": "image",
 		"image": map[string]interface{}{
 			"base64": base64Data,
@@ -168,26 +543,44 @@ func (bot *DingDingBot) SendImage(base64Data string, md5 string) error {
 		},
 	}
 
-	return bot.sendRequest(payload)
+	return payload, nil
 }
 
-// SendNews sends a link message to the DingDing group.
+// SendImage sends an image message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - base64Data: The Base64-encoded image data
+//   - md5: The MD5 hash of the image
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendImage(ctx context.Context, base64Data string, md5 string) (*SendResult, error) {
+	msg, err := NewImageMessage(base64Data, md5)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// NewLinkMessage builds a link message.
 // Parameters:
 //   - title: The title of the news message
 //   - text: The text description of the news
 //   - messageUrl: The URL to open when clicking on the news
 //   - picUrl: The URL of the image to display in the news
 // Returns:
-//   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) SendNews(title string, text string, messageUrl string, picUrl string) error {
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewLinkMessage(title string, text string, messageUrl string, picUrl string) (Message, error) {
 	if title == "" {
-		return fmt.Errorf("title cannot be empty")
+		return nil, fmt.Errorf("title cannot be empty")
 	}
 	if messageUrl == "" {
-		return fmt.Errorf("messageUrl cannot be empty")
+		return nil, fmt.Errorf("messageUrl cannot be empty")
 	}
 	
-	payload := map[string]interface{}{
+	payload := Message{
 		"msgtype": "link",
 		"link": map[string]interface{}{
 			"title":      title,
@@ -197,27 +590,97 @@ func (bot *DingDingBot) SendNews(title string, text string, messageUrl string, p
 		},
 	}
 
-	return bot.sendRequest(payload)
+	return payload, nil
 }
 
-// NewsArticle represents a news article in a news message.
-// This struct is used to define the structure of a news article
-// when sending news messages to DingDing.
+// SendNews sends a link message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - title: The title of the news message
+//   - text: The text description of the news
+//   - messageUrl: The URL to open when clicking on the news
+//   - picUrl: The URL of the image to display in the news
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendNews(ctx context.Context, title string, text string, messageUrl string, picUrl string) (*SendResult, error) {
+	msg, err := NewLinkMessage(title, text, messageUrl, picUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// maxFeedCardLinks is the maximum number of links accepted in a single feed card message.
+const maxFeedCardLinks = 10
+
+// NewsArticle represents a news article in a feed card message.
+// This struct is used to define the structure of a single link
+// when sending feed card messages to DingDing.
 type NewsArticle struct {
 	// Title is the title of the news article
 	Title string `json:"title"`
-	
-	// Description is the text description of the news article
-	Description string `json:"description"`
-	
-	// URL is the link that will be opened when clicking on the news article
-	URL string `json:"url"`
-	
+
+	// MessageURL is the link that will be opened when clicking on the news article
+	MessageURL string `json:"messageURL"`
+
 	// PicURL is the URL of the image to display in the news article
-	PicURL string `json:"picurl"`
+	PicURL string `json:"picURL"`
 }
 
-// SendTemplateCard sends an action card message to the DingDing group.
+// NewFeedCardMessage builds a feed card message containing several links.
+// Parameters:
+//   - articles: The news articles to display, between 1 and maxFeedCardLinks entries
+// Returns:
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewFeedCardMessage(articles []NewsArticle) (Message, error) {
+	if len(articles) == 0 {
+		return nil, fmt.Errorf("articles cannot be empty")
+	}
+	if len(articles) > maxFeedCardLinks {
+		return nil, fmt.Errorf("too many articles: %d (maximum is %d)", len(articles), maxFeedCardLinks)
+	}
+	for i, article := range articles {
+		if article.Title == "" {
+			return nil, fmt.Errorf("article %d: title cannot be empty", i)
+		}
+		if article.MessageURL == "" {
+			return nil, fmt.Errorf("article %d: messageURL cannot be empty", i)
+		}
+		if article.PicURL == "" {
+			return nil, fmt.Errorf("article %d: picURL cannot be empty", i)
+		}
+	}
+
+	payload := Message{
+		"msgtype": "feedCard",
+		"feedCard": map[string]interface{}{
+			"links": articles,
+		},
+	}
+
+	return payload, nil
+}
+
+// SendFeedCard sends a feed card message containing several links to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - articles: The news articles to display, between 1 and maxFeedCardLinks entries
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendFeedCard(ctx context.Context, articles []NewsArticle) (*SendResult, error) {
+	msg, err := NewFeedCardMessage(articles)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// NewTemplateCardMessage builds an action card message with a single button.
 // Parameters:
 //   - title: The title of the template card
 //   - text: The text content of the template card
@@ -225,22 +688,23 @@ type NewsArticle struct {
 //   - singleURL: The URL to open when clicking the button
 //   - btnOrientation: The orientation of buttons ("0" for vertical, "1" for horizontal)
 // Returns:
-//   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) SendTemplateCard(title string, text string, singleTitle string, singleURL string, btnOrientation string) error {
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewTemplateCardMessage(title string, text string, singleTitle string, singleURL string, btnOrientation string) (Message, error) {
 	if title == "" {
-		return fmt.Errorf("title cannot be empty")
+		return nil, fmt.Errorf("title cannot be empty")
 	}
 	if text == "" {
-		return fmt.Errorf("text cannot be empty")
+		return nil, fmt.Errorf("text cannot be empty")
 	}
 	if singleTitle == "" {
-		return fmt.Errorf("singleTitle cannot be empty")
+		return nil, fmt.Errorf("singleTitle cannot be empty")
 	}
 	if singleURL == "" {
-		return fmt.Errorf("singleURL cannot be empty")
+		return nil, fmt.Errorf("singleURL cannot be empty")
 	}
 	
-	payload := map[string]interface{}{
+	payload := Message{
 		"msgtype": "actionCard",
 		"actionCard": map[string]interface{}{
 			"title":          title,
@@ -251,30 +715,117 @@ func (bot *DingDingBot) SendTemplateCard(title string, text string, singleTitle
 		},
 	}
 
-	return bot.sendRequest(payload)
+	return payload, nil
+}
+
+// SendTemplateCard sends an action card message to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - title: The title of the template card
+//   - text: The text content of the template card
+//   - singleTitle: The title of the single button
+//   - singleURL: The URL to open when clicking the button
+//   - btnOrientation: The orientation of buttons ("0" for vertical, "1" for horizontal)
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendTemplateCard(ctx context.Context, title string, text string, singleTitle string, singleURL string, btnOrientation string) (*SendResult, error) {
+	msg, err := NewTemplateCardMessage(title, text, singleTitle, singleURL, btnOrientation)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// ActionCardButton represents a button in an independent-jump action card message.
+type ActionCardButton struct {
+	// Title is the text displayed on the button
+	Title string `json:"title"`
+
+	// ActionURL is the URL to open when clicking the button
+	ActionURL string `json:"actionURL"`
+}
+
+// NewActionCardMessage builds an action card message with several independent buttons.
+// Parameters:
+//   - title: The title of the action card
+//   - text: The text content of the action card
+//   - buttons: The buttons to display, each opening its own URL
+//   - btnOrientation: The orientation of buttons ("0" for vertical, "1" for horizontal)
+// Returns:
+//   - The message payload
+//   - An error if a required field is missing or invalid
+func NewActionCardMessage(title string, text string, buttons []ActionCardButton, btnOrientation string) (Message, error) {
+	if title == "" {
+		return nil, fmt.Errorf("title cannot be empty")
+	}
+	if text == "" {
+		return nil, fmt.Errorf("text cannot be empty")
+	}
+	if len(buttons) == 0 {
+		return nil, fmt.Errorf("buttons cannot be empty")
+	}
+	for i, button := range buttons {
+		if button.Title == "" {
+			return nil, fmt.Errorf("button %d: title cannot be empty", i)
+		}
+		if button.ActionURL == "" {
+			return nil, fmt.Errorf("button %d: actionURL cannot be empty", i)
+		}
+	}
+
+	payload := Message{
+		"msgtype": "actionCard",
+		"actionCard": map[string]interface{}{
+			"title":          title,
+			"text":           text,
+			"btns":           buttons,
+			"btnOrientation": btnOrientation,
+		},
+	}
+
+	return payload, nil
+}
+
+// SendActionCard sends an action card message with several independent buttons to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - title: The title of the action card
+//   - text: The text content of the action card
+//   - buttons: The buttons to display, each opening its own URL
+//   - btnOrientation: The orientation of buttons ("0" for vertical, "1" for horizontal)
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendActionCard(ctx context.Context, title string, text string, buttons []ActionCardButton, btnOrientation string) (*SendResult, error) {
+	msg, err := NewActionCardMessage(title, text, buttons, btnOrientation)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
 }
 
 // UploadFile uploads a file to DingDing and returns the media ID.
 // Parameters:
+//   - ctx: Aborts the upload when done
 //   - filePath: The path to the file to upload
 // Returns:
-//   - The media ID of the uploaded file, which can be used in other API calls
+//   - The result of the upload, whose MediaID can be used in other API calls
 //   - An error if the upload fails, nil otherwise
-func (bot *DingDingBot) UploadFile(filePath string) (string, error) {
+func (bot *DingDingBot) UploadFile(ctx context.Context, filePath string) (*SendResult, error) {
 	if filePath == "" {
-		return "", fmt.Errorf("filePath cannot be empty")
+		return nil, fmt.Errorf("filePath cannot be empty")
 	}
-	
-	// Check if we're in test mode (webhook key starts with "test-")
-	if len(bot.WebhookKey) >= 5 && bot.WebhookKey[:5] == "test-" {
-		fmt.Printf("TEST MODE: Would upload file %s to DingDing API\n", filePath)
-		return "test-media-id-12345", nil
+	if bot.webhookKey == "" {
+		return nil, fmt.Errorf("uploads need the webhook access token of a robot, bot %s has none", bot.name)
 	}
 
 	// Open the file for reading
 	file, err := os.Open(filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to open file: %v", err)
+		return nil, fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
 
@@ -285,119 +836,120 @@ func (bot *DingDingBot) UploadFile(filePath string) (string, error) {
 	// Add the file to the form
 	part, err := writer.CreateFormFile("media", filePath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create form file: %v", err)
+		return nil, fmt.Errorf("failed to create form file: %v", err)
 	}
 
 	// Copy the file content to the form
 	_, err = io.Copy(part, file)
 	if err != nil {
-		return "", fmt.Errorf("failed to copy file content: %v", err)
+		return nil, fmt.Errorf("failed to copy file content: %v", err)
 	}
 
 	// Close the multipart writer
 	err = writer.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to close multipart writer: %v", err)
-	}
-
-	// Construct the request URL
-	requestURL := fmt.Sprintf("%s%s&type=file", bot.WebhookURL, bot.WebhookKey)
-	
-	// Add signature if sign key is provided
-	if bot.SignKey != "" {
-		timestamp := time.Now().UnixNano() / 1e6
-		signature, err := bot.generateSignature(timestamp)
-		if err != nil {
-			return "", fmt.Errorf("failed to generate signature: %v", err)
-		}
-		requestURL = fmt.Sprintf("%s&timestamp=%d&sign=%s", requestURL, timestamp, url.QueryEscape(signature))
+		return nil, fmt.Errorf("failed to close multipart writer: %v", err)
 	}
 
-	// Send the HTTP POST request
-	resp, err := http.Post(requestURL, writer.FormDataContentType(), body)
+	// Send the HTTP POST request, retrying transient failures
+	uploadURL := fmt.Sprintf("%s%s&type=file", bot.uploadURL, bot.webhookKey)
+	resp, err := bot.post(ctx, uploadURL, authSignature, writer.FormDataContentType(), body.Bytes())
 	if err != nil {
-		return "", fmt.Errorf("failed to send HTTP request: %v", err)
-	}
-	defer resp.Body.Close()
-
-	// Parse the response
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		return "", fmt.Errorf("failed to decode response: %v", err)
-	}
-
-	// Check for API errors
-	if errcode, ok := result["errcode"].(float64); ok && errcode != 0 {
-		errmsg, _ := result["errmsg"].(string)
-		return "", fmt.Errorf("DingDing API error: %s", errmsg)
+		return nil, err
 	}
 
 	// Extract and return the media ID
-	mediaID, ok := result["media_id"].(string)
+	mediaID, ok := resp.result["media_id"].(string)
 	if !ok {
-		return "", fmt.Errorf("media_id not found in response")
+		return nil, fmt.Errorf("media_id not found in response")
 	}
-	
-	return mediaID, nil
+
+	result := bot.newSendResult(uploadURL, resp)
+	result.MediaID = mediaID
+	return result, nil
 }
 
 // sendRequest sends a request to the DingDing API with the given payload.
 // This is an internal helper method used by the public message sending methods.
+// Bots of an enterprise app send through the open API of the app instead of the webhook.
 // Parameters:
-//   - payload: A map containing the message payload to send to the DingDing API
+//   - ctx: Aborts the wait for the rate limiter and the request when done
+//   - payload: The message payload to send to the DingDing API
 // Returns:
+//   - The result of the request
 //   - An error if the request fails, nil otherwise
-func (bot *DingDingBot) sendRequest(payload map[string]interface{}) error {
+func (bot *DingDingBot) sendRequest(ctx context.Context, payload Message) (*SendResult, error) {
+	if bot.app != nil {
+		return bot.sendGroupMessage(ctx, payload)
+	}
+
 	// Convert the payload to JSON
 	jsonPayload, err := json.Marshal(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal JSON payload: %v", err)
-	}
-
-	// Check if we're in test mode (webhook key starts with "test-")
-	if len(bot.WebhookKey) >= 5 && bot.WebhookKey[:5] == "test-" {
-		fmt.Printf("TEST MODE: Would send to DingDing API: %s\n", string(jsonPayload))
-		return nil
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
 	}
 
-	// Construct the request URL
-	requestURL := bot.WebhookURL + bot.WebhookKey
-	
-	// Add signature if sign key is provided
-	if bot.SignKey != "" {
-		timestamp := time.Now().UnixNano() / 1e6
-		signature, err := bot.generateSignature(timestamp)
-		if err != nil {
-			return fmt.Errorf("failed to generate signature: %v", err)
-		}
-		requestURL = fmt.Sprintf("%s&timestamp=%d&sign=%s", requestURL, timestamp, url.QueryEscape(signature))
-	}
-	
-	// Send the HTTP POST request
-	resp, err := http.Post(requestURL, "application/json", bytes.NewBuffer(jsonPayload))
+	// Send the HTTP POST request, retrying transient failures
+	resp, err := bot.postMessage(ctx, bot.sendURL+bot.webhookKey, authSignature, "application/json", jsonPayload)
 	if err != nil {
-		return fmt.Errorf("failed to send HTTP request: %v", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
 
-	// Check the HTTP status code
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("unexpected HTTP status code: %d", resp.StatusCode)
+	result := bot.newSendResult(bot.sendURL+bot.webhookKey, resp)
+	result.Payload = redactPayload(jsonPayload)
+	bot.logMessage(result.MessageID, ChannelWebhook, nil, result.DryRun)
+	return result, nil
+}
+
+// newSendResult describes a successful request to endpoint.
+func (bot *DingDingBot) newSendResult(endpoint string, resp *apiResponse) *SendResult {
+	errcode, _ := resp.result["errcode"].(float64)
+	errmsg, _ := resp.result["errmsg"].(string)
+
+	return &SendResult{
+		MessageID: uuid.New().String(),
+		Bot:       bot.name,
+		URL:       redactURL(endpoint),
+		DryRun:    resp.dryRun,
+		ErrCode:   int(errcode),
+		ErrMsg:    errmsg,
+		Latency:   Duration(resp.latency),
+		Attempts:  resp.attempts,
+		Retries:   resp.attempts - 1,
 	}
+}
 
-	// Parse the response
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
-	if err != nil {
-		return fmt.Errorf("failed to decode response: %v", err)
+// Name returns the name of the bot, empty when it was not named.
+func (bot *DingDingBot) Name() string {
+	return bot.name
+}
+
+// HTTPClient returns the HTTP client the bot makes requests with.
+func (bot *DingDingBot) HTTPClient() *http.Client {
+	return bot.httpClient
+}
+
+// DownloadClient returns the HTTP client the bot downloads images given by URL with.
+func (bot *DingDingBot) DownloadClient() *http.Client {
+	return bot.downloadClient
+}
+
+// BreakerStatus returns the state of the circuit breaker of the bot and its request counters.
+func (bot *DingDingBot) BreakerStatus() BreakerStatus {
+	return bot.breaker.Status()
+}
+
+// signURL appends the timestamp and signature to a request URL when a sign key is configured.
+func (bot *DingDingBot) signURL(requestURL string) (string, error) {
+	if bot.signKey == "" {
+		return requestURL, nil
 	}
 
-	// Check for API errors
-	if errcode, ok := result["errcode"].(float64); ok && errcode != 0 {
-		errmsg, _ := result["errmsg"].(string)
-		return fmt.Errorf("DingDing API error: %s", errmsg)
+	timestamp := time.Now().UnixNano() / 1e6
+	signature, err := bot.generateSignature(timestamp)
+	if err != nil {
+		return "", fmt.Errorf("failed to generate signature: %v", err)
 	}
 
-	return nil
+	return fmt.Sprintf("%s&timestamp=%d&sign=%s", requestURL, timestamp, url.QueryEscape(signature)), nil
 }
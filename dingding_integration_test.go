@@ -1,52 +1,103 @@
 package main
 
 import (
+	"context"
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
-func TestDingDingBotInTestMode(t *testing.T) {
-	// Create a new DingDing bot with test webhook key
-	bot := NewDingDingBot(DINGDING_BOT_SEND_URL, "test-webhook-key", "")
+func TestDingDingBotInDryRunMode(t *testing.T) {
+	// Create a new DingDing bot that records requests instead of sending them
+	dryRun := NewDryRunSender()
+	bot := NewDingDingBot("dry-run-webhook-key", "SECdryrun", WithSender(dryRun))
 
 	// Test sending a text message
-	err := bot.SendText("Test message", []string{}, []string{}, false)
+	result, err := bot.SendText(context.Background(), "Test message", []string{}, []string{}, false)
 	if err != nil {
 		t.Errorf("Failed to send text message: %v", err)
 	}
+	if !result.DryRun || !strings.Contains(string(result.Payload), "Test message") {
+		t.Errorf("Expected dry-run result with payload, got: %+v", result)
+	}
 
 	// Test sending a markdown message
-	err = bot.SendMarkdown("Test Title", "# Test markdown message", []string{}, []string{}, false)
+	_, err = bot.SendMarkdown(context.Background(), "Test Title", "# Test markdown message", []string{}, []string{}, false)
 	if err != nil {
 		t.Errorf("Failed to send markdown message: %v", err)
 	}
 
 	// Test sending an image message
-	err = bot.SendImage("SGVsbG8sIERpbmdEaW5nIQ==", "d41d8cd98f00b204e9800998ecf8427e")
+	_, err = bot.SendImage(context.Background(), "SGVsbG8sIERpbmdEaW5nIQ==", "d41d8cd98f00b204e9800998ecf8427e")
 	if err != nil {
 		t.Errorf("Failed to send image message: %v", err)
 	}
 
 	// Test sending a news message
-	err = bot.SendNews("Test News", "Test Description", "https://github.com/HundunOnline", "https://example.com/image.jpg")
+	_, err = bot.SendNews(context.Background(), "Test News", "Test Description", "https://github.com/HundunOnline", "https://example.com/image.jpg")
 	if err != nil {
 		t.Errorf("Failed to send news message: %v", err)
 	}
 
 	// Test sending a template card message
-	err = bot.SendTemplateCard("Test Card", "Test Card Content", "View Details", "https://github.com/HundunOnline", "0")
+	_, err = bot.SendTemplateCard(context.Background(), "Test Card", "Test Card Content", "View Details", "https://github.com/HundunOnline", "0")
 	if err != nil {
 		t.Errorf("Failed to send template card message: %v", err)
 	}
 
-	// Test uploading a file (this will return a test media ID in test mode)
-	mediaID, err := bot.UploadFile("test_file.txt")
+	// Test uploading a file (this will return a dry-run media ID)
+	filePath := filepath.Join(t.TempDir(), "test_file.txt")
+	if err := os.WriteFile(filePath, []byte("test file"), 0o600); err != nil {
+		t.Fatalf("Failed to create test file: %v", err)
+	}
+	result, err = bot.UploadFile(context.Background(), filePath)
 	if err != nil {
 		t.Errorf("Failed to upload file: %v", err)
 	}
-	if mediaID != "test-media-id-12345" {
-		t.Errorf("Expected test media ID, got: %s", mediaID)
+	if result.MediaID != "dry-run-media-id" {
+		t.Errorf("Expected dry-run media ID, got: %s", result.MediaID)
+	}
+
+	// Every request is recorded with its secrets redacted
+	records := dryRun.Records()
+	if len(records) != 6 {
+		t.Fatalf("Expected 6 recorded requests, got: %d", len(records))
+	}
+	for _, record := range records {
+		if strings.Contains(record.URL, "dry-run-webhook-key") {
+			t.Errorf("Access token should be redacted, got: %s", record.URL)
+		}
+	}
+
+	fmt.Println("All DingDing bot tests passed in dry-run mode!")
+}
+
+func TestFileSender(t *testing.T) {
+	capturePath := filepath.Join(t.TempDir(), "capture.jsonl")
+	sender, err := NewSender(SendModeFile, capturePath)
+	if err != nil {
+		t.Fatalf("NewSender failed: %v", err)
+	}
+
+	bot := NewDingDingBot("file-webhook-key", "", WithSender(sender))
+	if _, err := bot.SendText(context.Background(), "Captured message", nil, nil, false); err != nil {
+		t.Fatalf("Failed to send text message: %v", err)
 	}
 
-	fmt.Println("All DingDing bot tests passed in test mode!")
+	data, err := os.ReadFile(capturePath)
+	if err != nil {
+		t.Fatalf("Failed to read capture file: %v", err)
+	}
+	if !strings.Contains(string(data), "Captured message") {
+		t.Errorf("Capture file should contain the payload, got: %s", data)
+	}
+
+	if _, err := NewSender(SendModeFile, ""); err == nil {
+		t.Errorf("NewSender should require a capture file in file mode")
+	}
+	if _, err := NewSender("carrier-pigeon", ""); err == nil {
+		t.Errorf("NewSender should reject unknown modes")
+	}
 }
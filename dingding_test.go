@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -41,8 +42,8 @@ func TestSendText(t *testing.T) {
 	mockServer := NewMockDingDingServer()
 	defer mockServer.Close()
 
-	bot := NewDingDingBot(mockServer.URL, "", "")
-	err := bot.SendText("Hello, DingDing!", []string{}, []string{}, false)
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendText(context.Background(), "Hello, DingDing!", []string{}, []string{}, false)
 	if err != nil {
 		t.Errorf("SendText failed: %v", err)
 	}
@@ -53,8 +54,8 @@ func TestSendMarkdown(t *testing.T) {
 	mockServer := NewMockDingDingServer()
 	defer mockServer.Close()
 
-	bot := NewDingDingBot(mockServer.URL, "", "")
-	err := bot.SendMarkdown("Hello", "## Hello, DingDing!\nThis is a markdown message.", []string{}, []string{}, false)
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendMarkdown(context.Background(), "Hello", "## Hello, DingDing!\nThis is a markdown message.", []string{}, []string{}, false)
 	if err != nil {
 		t.Errorf("SendMarkdown failed: %v", err)
 	}
@@ -65,8 +66,8 @@ func TestSendImage(t *testing.T) {
 	mockServer := NewMockDingDingServer()
 	defer mockServer.Close()
 
-	bot := NewDingDingBot(mockServer.URL, "", "")
-	err := bot.SendImage("SGVsbG8sIERpbmdEaW5nIQ==", "d41d8cd98f00b204e9800998ecf8427e")
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendImage(context.Background(), "SGVsbG8sIERpbmdEaW5nIQ==", "d41d8cd98f00b204e9800998ecf8427e")
 	if err != nil {
 		t.Errorf("SendImage failed: %v", err)
 	}
@@ -77,8 +78,8 @@ func TestSendNews(t *testing.T) {
 	mockServer := NewMockDingDingServer()
 	defer mockServer.Close()
 
-	bot := NewDingDingBot(mockServer.URL, "", "")
-	err := bot.SendNews("News Title", "News Description", "https://example.com", "https://example.com/image.jpg")
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendNews(context.Background(), "News Title", "News Description", "https://example.com", "https://example.com/image.jpg")
 	if err != nil {
 		t.Errorf("SendNews failed: %v", err)
 	}
@@ -89,13 +90,63 @@ func TestSendTemplateCard(t *testing.T) {
 	mockServer := NewMockDingDingServer()
 	defer mockServer.Close()
 
-	bot := NewDingDingBot(mockServer.URL, "", "")
-	err := bot.SendTemplateCard("Main Title", "Main Description", "View Details", "https://example.com", "0")
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendTemplateCard(context.Background(), "Main Title", "Main Description", "View Details", "https://example.com", "0")
 	if err != nil {
 		t.Errorf("SendTemplateCard failed: %v", err)
 	}
 }
 
+// TestSendActionCard tests the SendActionCard method.
+func TestSendActionCard(t *testing.T) {
+	mockServer := NewMockDingDingServer()
+	defer mockServer.Close()
+
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendActionCard(context.Background(), "Incident #42", "Disk usage above 90%", []ActionCardButton{
+		{Title: "Ack", ActionURL: "https://example.com/ack"},
+		{Title: "Runbook", ActionURL: "https://example.com/runbook"},
+		{Title: "Dashboard", ActionURL: "https://example.com/dashboard"},
+	}, "1")
+	if err != nil {
+		t.Errorf("SendActionCard failed: %v", err)
+	}
+
+	// Test validation of the button list
+	if _, err := bot.SendActionCard(context.Background(), "Title", "Text", nil, "0"); err == nil {
+		t.Errorf("SendActionCard should fail without buttons")
+	}
+	if _, err := bot.SendActionCard(context.Background(), "Title", "Text", []ActionCardButton{{Title: "Ack"}}, "0"); err == nil {
+		t.Errorf("SendActionCard should fail when actionURL is missing")
+	}
+}
+
+// TestSendFeedCard tests the SendFeedCard method.
+func TestSendFeedCard(t *testing.T) {
+	mockServer := NewMockDingDingServer()
+	defer mockServer.Close()
+
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	_, err := bot.SendFeedCard(context.Background(), []NewsArticle{
+		{Title: "Release 1.0", MessageURL: "https://example.com/1.0", PicURL: "https://example.com/1.0.jpg"},
+		{Title: "Release 1.1", MessageURL: "https://example.com/1.1", PicURL: "https://example.com/1.1.jpg"},
+	})
+	if err != nil {
+		t.Errorf("SendFeedCard failed: %v", err)
+	}
+
+	// Test validation of the article list
+	if _, err := bot.SendFeedCard(context.Background(), nil); err == nil {
+		t.Errorf("SendFeedCard should fail without articles")
+	}
+	if _, err := bot.SendFeedCard(context.Background(), []NewsArticle{{Title: "Missing URL"}}); err == nil {
+		t.Errorf("SendFeedCard should fail when messageURL is missing")
+	}
+	if _, err := bot.SendFeedCard(context.Background(), make([]NewsArticle, maxFeedCardLinks+1)); err == nil {
+		t.Errorf("SendFeedCard should fail with more than %d articles", maxFeedCardLinks)
+	}
+}
+
 // TestUploadFile tests the UploadFile method.
 func TestUploadFile(t *testing.T) {
 	// For this test, we'll just skip the actual upload since it requires a real API
@@ -109,7 +160,7 @@ func TestSignatureGeneration(t *testing.T) {
 	defer mockServer.Close()
 
 	// Test with sign key
-	bot := NewDingDingBot(mockServer.URL, "", "SECxxx")
+	bot := NewDingDingBot("", "SECxxx", WithBaseURL(mockServer.URL))
 	timestamp := int64(1609459200000) // 2021-01-01 00:00:00
 	signature, err := bot.generateSignature(timestamp)
 	if err != nil {
@@ -120,7 +171,7 @@ func TestSignatureGeneration(t *testing.T) {
 	}
 
 	// Test without sign key
-	bot = NewDingDingBot(mockServer.URL, "", "")
+	bot = NewDingDingBot("", "", WithBaseURL(mockServer.URL))
 	signature, err = bot.generateSignature(timestamp)
 	if err != nil {
 		t.Errorf("generateSignature failed: %v", err)
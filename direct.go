@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+// maxDirectRecipients bounds the recipients of a single direct message
+const maxDirectRecipients = 100
+
+// directMessageBatchSize is the number of users DingDing accepts in a single batch of one-to-one messages
+const directMessageBatchSize = 20
+
+// DirectRecipientResult is the outcome of a direct message for a single recipient.
+type DirectRecipientResult struct {
+	// UserID is the user ID of the recipient, resolved from Mobile when it was given instead
+	UserID string `json:"user_id,omitempty"`
+
+	// Mobile is the mobile number the recipient was given as, if any
+	Mobile string `json:"mobile,omitempty"`
+
+	// Success reports whether DingDing accepted the message for the recipient
+	Success bool `json:"success"`
+
+	// Error describes why the delivery failed
+	Error string `json:"error,omitempty"`
+
+	// Hint tells how to fix the failure, when it is a known DingDing error
+	Hint string `json:"hint,omitempty"`
+
+	// ProcessQueryKey identifies the batch the message was sent in, used to recall it
+	ProcessQueryKey string `json:"process_query_key,omitempty"`
+}
+
+// DirectMessageResult describes a message sent to users in one-to-one chats.
+type DirectMessageResult struct {
+	// MessageID is generated by the client to identify the message
+	MessageID string `json:"message_id"`
+
+	// Bot is the name of the bot the message was sent with
+	Bot string `json:"bot,omitempty"`
+
+	// DryRun reports whether the requests were captured instead of delivered
+	DryRun bool `json:"dry_run"`
+
+	// Payload is the robot message that was sent, its msgKey and msgParam
+	Payload json.RawMessage `json:"payload,omitempty"`
+
+	// Recipients lists the outcome per recipient, user IDs first, then mobiles
+	Recipients []DirectRecipientResult `json:"recipients"`
+
+	// Sent is the number of recipients the message was sent to
+	Sent int `json:"sent"`
+
+	// Failed is the number of recipients the message could not be sent to
+	Failed int `json:"failed"`
+}
+
+// SendDirectMessage sends a message to users in one-to-one chats with the robot of the enterprise app of the bot.
+// Mobile numbers are resolved to user IDs first. A failure for one recipient does not stop the delivery to the others.
+// Parameters:
+//   - ctx: Aborts the lookups and the requests when done
+//   - userIDs: The user IDs of the recipients
+//   - mobiles: The mobile numbers of further recipients
+//   - msg: The message built by NewTextMessage, NewMarkdownMessage or NewTemplateCardMessage, without mentions
+// Returns:
+//   - The outcome per recipient
+//   - An error if the bot has no enterprise app, there are no or too many recipients or the message is not supported, nil otherwise
+func (bot *DingDingBot) SendDirectMessage(ctx context.Context, userIDs []string, mobiles []string, msg Message) (*DirectMessageResult, error) {
+	if bot.app == nil {
+		return nil, fmt.Errorf("direct messages need the robot of an enterprise app, bot %s only has a group webhook", bot.name)
+	}
+	if len(userIDs)+len(mobiles) == 0 {
+		return nil, fmt.Errorf("at least one user ID or mobile is required")
+	}
+	if len(userIDs)+len(mobiles) > maxDirectRecipients {
+		return nil, fmt.Errorf("too many recipients: %d (maximum is %d)", len(userIDs)+len(mobiles), maxDirectRecipients)
+	}
+
+	msgKey, msgParam, err := robotMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(map[string]string{"msgKey": msgKey, "msgParam": msgParam})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	result := &DirectMessageResult{MessageID: uuid.New().String(), Bot: bot.name, Payload: payload}
+	for _, userID := range userIDs {
+		result.Recipients = append(result.Recipients, DirectRecipientResult{UserID: userID})
+	}
+	for _, mobile := range mobiles {
+		recipient := DirectRecipientResult{Mobile: mobile}
+		userID, dryRun, err := bot.lookupUserID(ctx, mobile)
+		if err != nil {
+			recipient.Error = fmt.Sprintf("failed to look up the user: %v", err)
+			recipient.Hint = ErrorHint(err)
+		}
+		recipient.UserID = userID
+		result.DryRun = result.DryRun || dryRun
+		result.Recipients = append(result.Recipients, recipient)
+	}
+
+	// Send once per user, a user given both by ID and mobile gets the outcome of the first entry
+	var batch []string
+	first := make(map[string]int)
+	for i, recipient := range result.Recipients {
+		if recipient.Error != "" {
+			continue
+		}
+		if _, ok := first[recipient.UserID]; !ok {
+			first[recipient.UserID] = i
+			batch = append(batch, recipient.UserID)
+		}
+	}
+
+	var keys []string
+	for start := 0; start < len(batch); start += directMessageBatchSize {
+		users := batch[start:min(start+directMessageBatchSize, len(batch))]
+		outcome, err := bot.sendDirectBatch(ctx, users, msgKey, msgParam)
+		delivered := false
+		for _, userID := range users {
+			recipient := &result.Recipients[first[userID]]
+			switch {
+			case err != nil:
+				recipient.Error = err.Error()
+				recipient.Hint = ErrorHint(err)
+			case outcome.invalid[userID]:
+				recipient.Error = "DingDing rejected the user ID as invalid"
+				recipient.Hint = "Check that the user belongs to the organization and can see the robot of the app."
+			case outcome.flowControlled[userID]:
+				recipient.Error = "the message was throttled by DingDing"
+				recipient.Hint = "The user received too many messages from the robot: wait before sending again."
+			default:
+				recipient.Success = true
+				recipient.ProcessQueryKey = outcome.processQueryKey
+				delivered = true
+			}
+		}
+		if err == nil {
+			result.DryRun = result.DryRun || outcome.dryRun
+		}
+		if delivered {
+			// Only batches that reached someone can be recalled
+			keys = append(keys, outcome.processQueryKey)
+		}
+	}
+
+	for i := range result.Recipients {
+		recipient := &result.Recipients[i]
+		if j, ok := first[recipient.UserID]; ok && j != i && recipient.Error == "" {
+			// A duplicate shares the outcome of the first entry of the user
+			recipient.Success = result.Recipients[j].Success
+			recipient.Error = result.Recipients[j].Error
+			recipient.Hint = result.Recipients[j].Hint
+			recipient.ProcessQueryKey = result.Recipients[j].ProcessQueryKey
+		}
+		if recipient.Success {
+			result.Sent++
+		} else {
+			result.Failed++
+		}
+	}
+
+	if result.Sent > 0 {
+		bot.logMessage(result.MessageID, ChannelDirect, keys, result.DryRun)
+	}
+	return result, nil
+}
+
+// directBatchOutcome is the answer of DingDing to a batch of one-to-one messages.
+type directBatchOutcome struct {
+	processQueryKey string
+	invalid         map[string]bool
+	flowControlled  map[string]bool
+	dryRun          bool
+}
+
+// sendDirectBatch sends a message to up to directMessageBatchSize users.
+func (bot *DingDingBot) sendDirectBatch(ctx context.Context, userIDs []string, msgKey string, msgParam string) (*directBatchOutcome, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"robotCode": bot.app.robotCode,
+		"userIds":   userIDs,
+		"msgKey":    msgKey,
+		"msgParam":  msgParam,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	resp, err := bot.postMessage(ctx, bot.app.baseURL+directMessagePath, authAccessToken, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+
+	outcome := &directBatchOutcome{
+		invalid:        stringSet(resp.result["invalidStaffIdList"]),
+		flowControlled: stringSet(resp.result["flowControlledStaffIdList"]),
+		dryRun:         resp.dryRun,
+	}
+	outcome.processQueryKey, _ = resp.result["processQueryKey"].(string)
+	return outcome, nil
+}
+
+// lookupUserID resolves a mobile number to the user ID of a member of the organization.
+// Lookups do not count against the circuit breaker, as an unknown number says nothing about the health of the app.
+func (bot *DingDingBot) lookupUserID(ctx context.Context, mobile string) (string, bool, error) {
+	body, err := json.Marshal(map[string]string{"mobile": mobile})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	resp, err := bot.postWithRetries(ctx, false, bot.app.oapiBaseURL+userByMobilePath, authAccessTokenQuery, "application/json", body)
+	if err != nil {
+		return "", false, err
+	}
+
+	user, _ := resp.result["result"].(map[string]interface{})
+	userID, _ := user["userid"].(string)
+	if userID == "" {
+		return "", resp.dryRun, fmt.Errorf("userid not found in response")
+	}
+	return userID, resp.dryRun, nil
+}
+
+// stringSet converts a decoded JSON array of strings into a set.
+func stringSet(value interface{}) map[string]bool {
+	list, _ := value.([]interface{})
+	set := make(map[string]bool, len(list))
+	for _, item := range list {
+		if s, ok := item.(string); ok {
+			set[s] = true
+		}
+	}
+	return set
+}
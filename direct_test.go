@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// TestSendDirectMessage tests direct messages to user IDs and mobiles and the per-recipient failures.
+func TestSendDirectMessage(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	bot := newEnterpriseBot(t, stub, newFakeClock())
+	msg, _ := NewMarkdownMessage("Page", "### Disk full on db-1", nil, nil, false)
+
+	userIDs := []string{"oncall1", "invalid-1", "busy-1", "manager1234"}
+	result, err := bot.SendDirectMessage(context.Background(), userIDs, []string{"13800000000", "13900000000"}, msg)
+	if err != nil {
+		t.Fatalf("SendDirectMessage failed: %v", err)
+	}
+	if result.Sent != 3 || result.Failed != 3 || len(result.Recipients) != 6 || !strings.Contains(string(result.Payload), "sampleMarkdown") {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	recipients := result.Recipients
+	if !recipients[0].Success || recipients[0].ProcessQueryKey != "batch-1" {
+		t.Errorf("unexpected recipient: %+v", recipients[0])
+	}
+	if recipients[1].Success || !strings.Contains(recipients[1].Error, "invalid") || recipients[2].Success || recipients[2].Hint == "" {
+		t.Errorf("expected the invalid and throttled users to fail: %+v", recipients[1:3])
+	}
+	// The mobile resolves to a user also given by ID, who gets the message once
+	if !recipients[4].Success || recipients[4].UserID != "manager1234" || recipients[4].ProcessQueryKey != "batch-1" {
+		t.Errorf("unexpected resolved recipient: %+v", recipients[4])
+	}
+	if recipients[5].Success || !strings.Contains(recipients[5].Error, "60121") || !strings.Contains(recipients[5].Hint, "mobile") {
+		t.Errorf("expected the unknown mobile to fail: %+v", recipients[5])
+	}
+
+	stub.mu.Lock()
+	batches := stub.batches
+	stub.mu.Unlock()
+	if len(batches) != 1 || len(batches[0]) != 4 {
+		t.Errorf("expected a single batch of distinct users, got %v", batches)
+	}
+
+	// Large recipient lists are split into batches
+	var many []string
+	for i := 0; i < 45; i++ {
+		many = append(many, fmt.Sprintf("user%d", i))
+	}
+	if result, err := bot.SendDirectMessage(context.Background(), many, nil, msg); err != nil || result.Sent != 45 {
+		t.Fatalf("unexpected result: %+v, %v", result, err)
+	}
+	stub.mu.Lock()
+	batches = stub.batches
+	stub.mu.Unlock()
+	if len(batches) != 4 || len(batches[1]) != directMessageBatchSize || len(batches[3]) != 5 {
+		t.Errorf("expected batches of %d users, got %d batches", directMessageBatchSize, len(batches)-1)
+	}
+
+	for name, send := range map[string]func() error{
+		"no recipients": func() error {
+			_, err := bot.SendDirectMessage(context.Background(), nil, nil, msg)
+			return err
+		},
+		"mentions": func() error {
+			mention, _ := NewTextMessage("hi", nil, []string{"oncall1"}, false)
+			_, err := bot.SendDirectMessage(context.Background(), []string{"oncall1"}, nil, mention)
+			return err
+		},
+		"webhook bot": func() error {
+			_, err := NewDingDingBot("token", "").SendDirectMessage(context.Background(), []string{"oncall1"}, nil, msg)
+			return err
+		},
+	} {
+		if err := send(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+// TestSendDirectMessageTool tests the send_direct_message tool.
+func TestSendDirectMessageTool(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	bots := NewBotRegistry()
+	bots.Add("oncall", "", newEnterpriseBot(t, stub, newFakeClock()))
+	handler := sendDirectMessageHandler(bots)
+	ctx := context.Background()
+
+	result, _ := handler(ctx, newToolRequest("send_direct_message", map[string]interface{}{
+		"user_ids": "oncall1,invalid-1",
+		"mobiles":  []interface{}{"13800000000"},
+		"msg_type": "text",
+		"content":  "Disk full on db-1",
+	}))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "sent to 2 of 3 recipients") || !strings.Contains(text, "- invalid-1: DingDing rejected the user ID") {
+		t.Errorf("unexpected result: %q", text)
+	}
+	var details DirectMessageResult
+	resultJSON(t, result, &details)
+	if details.Sent != 2 || details.Recipients[2].UserID != "manager1234" {
+		t.Errorf("unexpected structured result: %+v", details)
+	}
+
+	result, _ = handler(ctx, newToolRequest("send_direct_message", map[string]interface{}{"user_ids": "invalid-1", "msg_type": "text", "content": "hi"}))
+	if !result.IsError {
+		t.Errorf("a message reaching nobody should be a tool error")
+	}
+	result, _ = handler(ctx, newToolRequest("send_direct_message", map[string]interface{}{"user_ids": "oncall1", "msg_type": "feed_card"}))
+	if !result.IsError {
+		t.Errorf("feed cards should be rejected")
+	}
+}
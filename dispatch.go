@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// Dispatcher delivers the messages built by the send tools with the named bots,
+// right away or through the outbox when one is configured, or later through the scheduler or in a digest.
+type Dispatcher struct {
+	bots      *BotRegistry
+	outbox    *Outbox
+	scheduler *Scheduler
+	digester  *Digester
+}
+
+// NewDispatcher creates a Dispatcher.
+// Parameters:
+//   - bots: The bots messages are sent with
+//   - outbox: The outbox messages are queued in, nil to send them right away
+//   - scheduler: The scheduler holding messages with a send time, nil to reject them
+//   - digester: The digester aggregating the messages of bots with a digest window, nil to send them one by one
+// Returns:
+//   - A pointer to a new Dispatcher
+func NewDispatcher(bots *BotRegistry, outbox *Outbox, scheduler *Scheduler, digester *Digester) *Dispatcher {
+	return &Dispatcher{bots: bots, outbox: outbox, scheduler: scheduler, digester: digester}
+}
+
+// dispatchDigest delivers a text or markdown message like dispatch, unless the bot aggregates messages:
+// the message is then added to the digest of its group, or sent right away when its severity
+// reaches the flush severity of the bot, which also flushes the pending digest of the group.
+func (d *Dispatcher) dispatchDigest(ctx context.Context, botName string, delivery deliveryArguments, digest digestArguments, msg Message, what string) *mcp.CallToolResult {
+	if digest.Severity == "" {
+		digest.Severity = SeverityInfo
+	}
+	if err := validSeverity(digest.Severity); err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("invalid argument severity: %v", err))
+	}
+	if d.digester == nil || delivery.SendAt != "" {
+		return d.dispatch(ctx, botName, delivery, msg, what)
+	}
+
+	policy, err := d.digester.Policy(botName)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+	if policy.Window <= 0 {
+		return d.dispatch(ctx, botName, delivery, msg, what)
+	}
+	if delivery.Timezone != "" {
+		return mcp.NewToolResultError("timezone is only used with send_at")
+	}
+
+	if policy.flushes(digest.Severity) {
+		// The pending digest of the group goes out first, the message closing it follows
+		d.digester.Flush(ctx, botName, digest.GroupKey)
+		return d.dispatch(ctx, botName, delivery, msg, what)
+	}
+
+	status, err := d.digester.Add(botName, digest.GroupKey, digest.Severity, delivery.IdempotencyKey, msg)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to aggregate %s: %v", what, err))
+	}
+
+	text := fmt.Sprintf("%s added to the digest of bot %s, %d messages are sent at %s",
+		capitalize(what), status.Bot, status.Pending, status.FlushAt.Format(time.RFC3339))
+	if status.Duplicate {
+		text = fmt.Sprintf("%s already in the digest of bot %s with the same idempotency key, not added again", capitalize(what), status.Bot)
+	}
+	data, err := marshalJSON(status, "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to encode digest status: %v", err))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(text),
+			jsonResource("dingding://digest", data),
+		},
+	}
+}
+
+// dispatch delivers msg with the named bot as the delivery arguments ask and builds the tool result.
+// what names the message in the result text, such as "text message". ctx aborts a message sent right away.
+func (d *Dispatcher) dispatch(ctx context.Context, botName string, delivery deliveryArguments, msg Message, what string) *mcp.CallToolResult {
+	key := delivery.IdempotencyKey
+
+	if delivery.SendAt != "" {
+		return d.schedule(botName, delivery, msg, what)
+	}
+	if delivery.Timezone != "" {
+		return mcp.NewToolResultError("timezone is only used with send_at")
+	}
+
+	if d.outbox != nil {
+		entry, duplicate, err := d.outbox.Enqueue(botName, key, msg)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to queue %s: %v", what, err))
+		}
+		if duplicate {
+			return outboxToolResult(fmt.Sprintf("%s already queued with the same idempotency key, outbox ID: %s", capitalize(what), entry.ID), []OutboxEntry{*entry})
+		}
+
+		return outboxToolResult(fmt.Sprintf("%s queued for delivery, outbox ID: %s", capitalize(what), entry.ID), []OutboxEntry{*entry})
+	}
+
+	bot, err := d.bots.Get(botName)
+	if err != nil {
+		return mcp.NewToolResultError(err.Error())
+	}
+
+	result, err := bot.SendOnce(ctx, key, msg)
+	if err != nil {
+		return sendErrorResult("Failed to send "+what, bot, err)
+	}
+	if result.Duplicate {
+		return sendToolResult(capitalize(what)+" already sent with the same idempotency key, not sent again", result)
+	}
+
+	return sendToolResult(capitalize(what)+" sent successfully", result)
+}
+
+// schedule adds msg to the scheduler to be sent at delivery.SendAt and builds the tool result.
+func (d *Dispatcher) schedule(botName string, delivery deliveryArguments, msg Message, what string) *mcp.CallToolResult {
+	if d.scheduler == nil {
+		return mcp.NewToolResultError("send_at requires a schedule directory, set DINGDING_BOT_SCHEDULE_DIR")
+	}
+
+	sendAt, err := d.scheduler.ParseSendAt(delivery.SendAt, delivery.Timezone)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("invalid argument send_at: %v", err))
+	}
+
+	scheduled, duplicate, err := d.scheduler.Schedule(botName, delivery.IdempotencyKey, msg, sendAt)
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to schedule %s: %v", what, err))
+	}
+	if duplicate {
+		return scheduleToolResult(fmt.Sprintf("%s already scheduled with the same idempotency key for %s, schedule ID: %s",
+			capitalize(what), scheduled.SendAt.Format(time.RFC3339), scheduled.ID), []ScheduledMessage{*scheduled})
+	}
+
+	return scheduleToolResult(fmt.Sprintf("%s scheduled for %s, schedule ID: %s",
+		capitalize(what), scheduled.SendAt.Format(time.RFC3339), scheduled.ID), []ScheduledMessage{*scheduled})
+}
+
+// sendOrQueue sends msg with the named bot right away, or queues it when an outbox is given.
+// It backs the messages delivered in the background, such as scheduled messages.
+// ctx aborts a message sent right away.
+// Returns the send result or the outbox entry, and an error if the message could not be sent or queued.
+func sendOrQueue(ctx context.Context, bots *BotRegistry, outbox *Outbox, botName string, key string, msg Message) (*SendResult, *OutboxEntry, error) {
+	if outbox != nil {
+		entry, _, err := outbox.Enqueue(botName, key, msg)
+		return nil, entry, err
+	}
+
+	bot, err := bots.Get(botName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := bot.SendOnce(ctx, key, msg)
+	return result, nil, err
+}
+
+// capitalize upper-cases the first letter of an ASCII text.
+func capitalize(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
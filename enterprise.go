@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DingDing open API endpoints used by enterprise internal apps
+const (
+	// DINGDING_API_BASE_URL is the base URL of the DingDing open API
+	DINGDING_API_BASE_URL = "https://api.dingtalk.com"
+
+	// DINGDING_OAPI_BASE_URL is the base URL of the legacy DingDing API, which still serves the user lookup
+	DINGDING_OAPI_BASE_URL = "https://oapi.dingtalk.com"
+)
+
+// Paths of the DingDing open API, relative to the API base URL
+const (
+	// accessTokenPath is the endpoint exchanging the AppKey and AppSecret for an access token
+	accessTokenPath = "/v1.0/oauth2/accessToken"
+
+	// groupMessagePath is the endpoint for sending robot messages to a group
+	groupMessagePath = "/v1.0/robot/groupMessages/send"
+
+	// directMessagePath is the endpoint for sending robot messages to users in one-to-one chats
+	directMessagePath = "/v1.0/robot/oToMessages/batchSend"
+
+	// userByMobilePath is the legacy endpoint looking up the user ID of a mobile number
+	userByMobilePath = "/topapi/v2/user/getbymobile"
+)
+
+// accessTokenHeader carries the access token of the app in open API requests
+const accessTokenHeader = "x-acs-dingtalk-access-token"
+
+// tokenRefreshMargin is how long before its expiry an access token is fetched again
+const tokenRefreshMargin = 5 * time.Minute
+
+// defaultTokenLifetime is the lifetime of an access token issued without a valid expireIn, the 2 hours documented by DingDing
+const defaultTokenLifetime = 7200 * time.Second
+
+// EnterpriseConfig configures a robot of a DingDing enterprise internal app.
+// Unlike a custom group webhook, such a robot is authenticated with the AppKey and AppSecret of the app.
+type EnterpriseConfig struct {
+	// AppKey is the AppKey (client ID) of the app
+	AppKey string `json:"app_key"`
+
+	// AppSecret is the AppSecret (client secret) of the app
+	AppSecret string `json:"app_secret"`
+
+	// RobotCode identifies the robot of the app, defaults to the AppKey
+	RobotCode string `json:"robot_code,omitempty"`
+
+	// OpenConversationID is the group the send_* tools post to (optional)
+	OpenConversationID string `json:"open_conversation_id,omitempty"`
+
+	// BaseURL overrides the DingDing open API base URL, such as a local stub server (optional).
+	// A custom base URL also replaces the legacy API base URL, so that a single stub serves both
+	BaseURL string `json:"base_url,omitempty"`
+}
+
+// validate checks that the app credentials are set.
+func (c EnterpriseConfig) validate() error {
+	if c.AppKey == "" {
+		return fmt.Errorf("app_key cannot be empty")
+	}
+	if c.AppSecret == "" {
+		return fmt.Errorf("app_secret cannot be empty")
+	}
+	return nil
+}
+
+// EnterpriseApp is a DingDing enterprise internal app, holding its credentials and its access token.
+// Bots of the same app share an EnterpriseApp so that the access token is fetched once for all of them.
+// It is safe for concurrent use.
+type EnterpriseApp struct {
+	appKey    string
+	appSecret string
+	robotCode string
+	baseURL   string
+
+	// oapiBaseURL is the base URL of the legacy API
+	oapiBaseURL string
+
+	// tokens caches the access token of the app
+	tokens accessTokenCache
+}
+
+// NewEnterpriseApp creates an EnterpriseApp from the app settings of cfg.
+// Parameters:
+//   - cfg: The enterprise settings, OpenConversationID is ignored
+// Returns:
+//   - A pointer to a new EnterpriseApp
+//   - An error if the AppKey or AppSecret is missing
+func NewEnterpriseApp(cfg EnterpriseConfig) (*EnterpriseApp, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	app := &EnterpriseApp{
+		appKey:    cfg.AppKey,
+		appSecret: cfg.AppSecret,
+		robotCode: cfg.RobotCode,
+		baseURL:   strings.TrimSuffix(cfg.BaseURL, "/"),
+	}
+	if app.robotCode == "" {
+		app.robotCode = cfg.AppKey
+	}
+	if app.baseURL == "" {
+		app.baseURL = DINGDING_API_BASE_URL
+	}
+	app.oapiBaseURL = DINGDING_OAPI_BASE_URL
+	if app.baseURL != DINGDING_API_BASE_URL {
+		app.oapiBaseURL = app.baseURL
+	}
+
+	return app, nil
+}
+
+// RobotCode returns the code of the robot messages are sent with.
+func (app *EnterpriseApp) RobotCode() string {
+	return app.robotCode
+}
+
+// accessToken returns the cached access token of the app, fetching a new one with sender when needed.
+func (app *EnterpriseApp) accessToken(ctx context.Context, sender Sender, clk clock) (string, error) {
+	return app.tokens.get(ctx, clk, func(ctx context.Context) (string, time.Duration, error) {
+		return app.fetchAccessToken(ctx, sender)
+	})
+}
+
+// fetchAccessToken exchanges the AppKey and AppSecret for an access token and its lifetime.
+func (app *EnterpriseApp) fetchAccessToken(ctx context.Context, sender Sender) (string, time.Duration, error) {
+	body, err := json.Marshal(map[string]string{"appKey": app.appKey, "appSecret": app.appSecret})
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	resp, err := sender.Send(ctx, &OutgoingRequest{
+		URL:         app.baseURL + accessTokenPath,
+		ContentType: "application/json",
+		Body:        body,
+	})
+	if err != nil {
+		return "", 0, &retryableError{fmt.Errorf("failed to get access token: %v", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, classify(openAPIError(resp))
+	}
+
+	var result struct {
+		AccessToken string `json:"accessToken"`
+		ExpireIn    int64  `json:"expireIn"`
+	}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return "", 0, fmt.Errorf("failed to decode access token response: %v", err)
+	}
+	if result.AccessToken == "" {
+		return "", 0, fmt.Errorf("accessToken not found in response")
+	}
+
+	return result.AccessToken, time.Duration(result.ExpireIn) * time.Second, nil
+}
+
+// accessTokenCache caches an access token until shortly before it expires.
+// Concurrent callers share a single fetch, and the current token keeps being handed out while it is refreshed.
+type accessTokenCache struct {
+	mu        sync.Mutex
+	token     string
+	refreshAt time.Time
+	expiresAt time.Time
+
+	// fetching is closed when the fetch in flight completes, nil when there is none
+	fetching chan struct{}
+}
+
+// get returns the cached token, calling fetch when it is missing or due for a refresh.
+// fetch returns the new token and its lifetime, defaultTokenLifetime when not positive.
+func (c *accessTokenCache) get(ctx context.Context, clk clock, fetch func(ctx context.Context) (string, time.Duration, error)) (string, error) {
+	c.mu.Lock()
+	for {
+		now := clk.Now()
+		if c.token != "" && now.Before(c.refreshAt) {
+			token := c.token
+			c.mu.Unlock()
+			return token, nil
+		}
+		if c.fetching == nil {
+			break
+		}
+		if c.token != "" && now.Before(c.expiresAt) {
+			// Another caller is refreshing the token, which is still valid meanwhile
+			token := c.token
+			c.mu.Unlock()
+			return token, nil
+		}
+
+		fetching := c.fetching
+		c.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-fetching:
+		}
+		c.mu.Lock()
+	}
+
+	done := make(chan struct{})
+	c.fetching = done
+	c.mu.Unlock()
+
+	token, ttl, err := fetch(ctx)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.fetching = nil
+	close(done)
+	if err != nil {
+		return "", err
+	}
+
+	if ttl <= 0 {
+		ttl = defaultTokenLifetime
+	}
+	now := clk.Now()
+	margin := min(tokenRefreshMargin, ttl/2)
+	c.token = token
+	c.refreshAt = now.Add(ttl - margin)
+	c.expiresAt = now.Add(ttl)
+	return token, nil
+}
+
+// invalidate drops token when it is still the cached one, so that the next caller fetches a new token.
+func (c *accessTokenCache) invalidate(token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.token == token {
+		c.token = ""
+	}
+}
+
+// openAPIError converts an error response of the DingDing open API,
+// whose body has the form {"code": "...", "message": "...", "requestid": "..."}.
+func openAPIError(resp *OutgoingResponse) *APIError {
+	apiErr := &APIError{
+		ErrMsg:     http.StatusText(resp.StatusCode),
+		StatusCode: resp.StatusCode,
+		RequestID:  requestID(resp, nil),
+	}
+
+	var body struct {
+		Code      string `json:"code"`
+		Message   string `json:"message"`
+		RequestID string `json:"requestid"`
+	}
+	if err := json.Unmarshal(resp.Body, &body); err == nil && body.Code != "" {
+		apiErr.Code = body.Code
+		apiErr.ErrMsg = body.Message
+		if body.RequestID != "" {
+			apiErr.RequestID = body.RequestID
+		}
+	}
+
+	return apiErr
+}
+
+// robotMessage converts a webhook message into the msgKey and msgParam of the open API robot messages.
+// Text, markdown, link and action card messages with up to 5 buttons are supported.
+// Parameters:
+//   - msg: The message built by NewTextMessage, NewMarkdownMessage, NewLinkMessage, NewTemplateCardMessage or NewActionCardMessage
+// Returns:
+//   - The message template key, such as "sampleText"
+//   - The JSON-encoded template parameters
+//   - An error if the message type or its mentions are not supported
+func robotMessage(msg Message) (string, string, error) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	var payload struct {
+		MsgType string `json:"msgtype"`
+		Text    struct {
+			Content string `json:"content"`
+		} `json:"text"`
+		Markdown struct {
+			Title string `json:"title"`
+			Text  string `json:"text"`
+		} `json:"markdown"`
+		Link struct {
+			Title      string `json:"title"`
+			Text       string `json:"text"`
+			MessageURL string `json:"messageUrl"`
+			PicURL     string `json:"picUrl"`
+		} `json:"link"`
+		ActionCard struct {
+			Title       string             `json:"title"`
+			Text        string             `json:"text"`
+			SingleTitle string             `json:"singleTitle"`
+			SingleURL   string             `json:"singleURL"`
+			Buttons     []ActionCardButton `json:"btns"`
+		} `json:"actionCard"`
+		At struct {
+			AtMobiles []string `json:"atMobiles"`
+			AtUserIds []string `json:"atUserIds"`
+			IsAtAll   bool     `json:"isAtAll"`
+		} `json:"at"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return "", "", fmt.Errorf("failed to decode message: %v", err)
+	}
+
+	if len(payload.At.AtMobiles) > 0 || len(payload.At.AtUserIds) > 0 || payload.At.IsAtAll {
+		return "", "", fmt.Errorf("mentions are not supported by enterprise robots")
+	}
+
+	var msgKey string
+	params := map[string]string{}
+	switch payload.MsgType {
+	case "text":
+		msgKey = "sampleText"
+		params["content"] = payload.Text.Content
+	case "markdown":
+		msgKey = "sampleMarkdown"
+		params["title"] = payload.Markdown.Title
+		params["text"] = payload.Markdown.Text
+	case "link":
+		msgKey = "sampleLink"
+		params["title"] = payload.Link.Title
+		params["text"] = payload.Link.Text
+		params["messageUrl"] = payload.Link.MessageURL
+		params["picUrl"] = payload.Link.PicURL
+	case "actionCard":
+		card := payload.ActionCard
+		params["title"] = card.Title
+		params["text"] = card.Text
+		switch {
+		case len(card.Buttons) == 0:
+			msgKey = "sampleActionCard"
+			params["singleTitle"] = card.SingleTitle
+			params["singleURL"] = card.SingleURL
+		case len(card.Buttons) == 1:
+			msgKey = "sampleActionCard"
+			params["singleTitle"] = card.Buttons[0].Title
+			params["singleURL"] = card.Buttons[0].ActionURL
+		case len(card.Buttons) <= 5:
+			msgKey = fmt.Sprintf("sampleActionCard%d", len(card.Buttons))
+			for i, button := range card.Buttons {
+				params[fmt.Sprintf("actionTitle%d", i+1)] = button.Title
+				params[fmt.Sprintf("actionURL%d", i+1)] = button.ActionURL
+			}
+		default:
+			return "", "", fmt.Errorf("enterprise robots support at most 5 action card buttons, got %d", len(card.Buttons))
+		}
+	default:
+		return "", "", fmt.Errorf("%s messages are not supported by enterprise robots, use a text, markdown, link or action card message", payload.MsgType)
+	}
+
+	msgParam, err := json.Marshal(params)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to marshal message parameters: %v", err)
+	}
+
+	return msgKey, string(msgParam), nil
+}
+
+// sendGroupMessage sends msg to the group of the bot through the open API of its enterprise app.
+func (bot *DingDingBot) sendGroupMessage(ctx context.Context, msg Message) (*SendResult, error) {
+	if bot.openConversationID == "" {
+		return nil, fmt.Errorf("no open_conversation_id configured, bot %s cannot send to a group", bot.name)
+	}
+
+	msgKey, msgParam, err := robotMessage(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	jsonPayload, err := json.Marshal(map[string]string{
+		"msgKey":             msgKey,
+		"msgParam":           msgParam,
+		"openConversationId": bot.openConversationID,
+		"robotCode":          bot.app.robotCode,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	endpoint := bot.app.baseURL + groupMessagePath
+	resp, err := bot.postMessage(ctx, endpoint, authAccessToken, "application/json", jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	result := bot.newSendResult(endpoint, resp)
+	result.Payload = jsonPayload
+	result.ProcessQueryKey, _ = resp.result["processQueryKey"].(string)
+	bot.logMessage(result.MessageID, ChannelGroup, []string{result.ProcessQueryKey}, result.DryRun)
+	return result, nil
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// enterpriseStub is a stub of the DingDing open API issuing access tokens, accepting robot messages and looking up users.
+type enterpriseStub struct {
+	*httptest.Server
+
+	// tokens counts the access tokens issued, the n-th token is "token-n"
+	tokens atomic.Int32
+
+	// revoked lists the tokens rejected by the send endpoint
+	revoked sync.Map
+
+	mu       sync.Mutex
+	messages []map[string]string
+	headers  []string
+
+	// batches lists the user IDs of the one-to-one message batches received
+	batches [][]string
+
+	// recalls lists the paths and bodies of the recall requests received
+	recalls []recallRequest
+}
+
+// recallRequest is a recall request received by the enterpriseStub.
+type recallRequest struct {
+	path               string
+	RobotCode          string   `json:"robotCode"`
+	OpenConversationID string   `json:"openConversationId"`
+	ProcessQueryKeys   []string `json:"processQueryKeys"`
+}
+
+// newEnterpriseStub starts a stub of the DingDing open API.
+func newEnterpriseStub(t *testing.T) *enterpriseStub {
+	stub := &enterpriseStub{}
+	stub.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case accessTokenPath:
+			var credentials map[string]string
+			json.NewDecoder(r.Body).Decode(&credentials)
+			if credentials["appKey"] != "ding-app" || credentials["appSecret"] != "app-secret" {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"code": "invalidClientSecret", "message": "bad secret", "requestid": "req-1"})
+				return
+			}
+			n := stub.tokens.Add(1)
+			json.NewEncoder(w).Encode(map[string]interface{}{"accessToken": fmt.Sprintf("token-%d", n), "expireIn": 7200})
+		case groupMessagePath:
+			token := r.Header.Get(accessTokenHeader)
+			if _, revoked := stub.revoked.Load(token); revoked || token == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				json.NewEncoder(w).Encode(map[string]string{"code": "InvalidAuthentication", "message": "token is invalid"})
+				return
+			}
+			var message map[string]string
+			json.NewDecoder(r.Body).Decode(&message)
+
+			stub.mu.Lock()
+			stub.messages = append(stub.messages, message)
+			stub.headers = append(stub.headers, token)
+			n := len(stub.messages)
+			stub.mu.Unlock()
+			json.NewEncoder(w).Encode(map[string]string{"processQueryKey": fmt.Sprintf("key-%d", n)})
+		case directMessagePath:
+			var batch struct {
+				RobotCode string   `json:"robotCode"`
+				UserIDs   []string `json:"userIds"`
+				MsgKey    string   `json:"msgKey"`
+			}
+			json.NewDecoder(r.Body).Decode(&batch)
+
+			stub.mu.Lock()
+			stub.batches = append(stub.batches, batch.UserIDs)
+			n := len(stub.batches)
+			stub.mu.Unlock()
+
+			// Users named invalid-* are unknown to DingDing and busy-* are throttled
+			invalid, flowControlled := []string{}, []string{}
+			for _, userID := range batch.UserIDs {
+				if strings.HasPrefix(userID, "invalid-") {
+					invalid = append(invalid, userID)
+				}
+				if strings.HasPrefix(userID, "busy-") {
+					flowControlled = append(flowControlled, userID)
+				}
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"processQueryKey":           fmt.Sprintf("batch-%d", n),
+				"invalidStaffIdList":        invalid,
+				"flowControlledStaffIdList": flowControlled,
+			})
+		case userByMobilePath:
+			if r.URL.Query().Get("access_token") == "" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 40014, "errmsg": "invalid access_token"})
+				return
+			}
+			var lookup map[string]string
+			json.NewDecoder(r.Body).Decode(&lookup)
+			if lookup["mobile"] != "13800000000" {
+				json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 60121, "errmsg": "user not found"})
+				return
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok", "result": map[string]string{"userid": "manager1234"}})
+		case groupRecallPath, directRecallPath:
+			recall := recallRequest{path: r.URL.Path}
+			json.NewDecoder(r.Body).Decode(&recall)
+
+			stub.mu.Lock()
+			stub.recalls = append(stub.recalls, recall)
+			stub.mu.Unlock()
+
+			// Keys named expired-* are too old to be recalled
+			succeeded, failed := []string{}, map[string]string{}
+			for _, key := range recall.ProcessQueryKeys {
+				if strings.HasPrefix(key, "expired-") {
+					failed[key] = "message is older than 24 hours"
+					continue
+				}
+				succeeded = append(succeeded, key)
+			}
+			json.NewEncoder(w).Encode(map[string]interface{}{"successResult": succeeded, "failedResult": failed})
+		default:
+			t.Errorf("unexpected request to %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return stub
+}
+
+// sent returns the group messages received and the access tokens they were sent with.
+func (s *enterpriseStub) sent() ([]map[string]string, []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]string(nil), s.messages...), append([]string(nil), s.headers...)
+}
+
+// newEnterpriseBot creates a bot sending to cid-ops through the app of the stub.
+func newEnterpriseBot(t *testing.T, stub *enterpriseStub, clk clock, opts ...BotOption) *DingDingBot {
+	app, err := NewEnterpriseApp(EnterpriseConfig{AppKey: "ding-app", AppSecret: "app-secret", BaseURL: stub.URL + "/"})
+	if err != nil {
+		t.Fatalf("NewEnterpriseApp failed: %v", err)
+	}
+	opts = append([]BotOption{WithEnterprise(app, "cid-ops"), withClock(clk), WithName("ops")}, opts...)
+	return NewDingDingBot("", "", opts...)
+}
+
+// TestEnterpriseSend tests that messages are sent through the open API with a cached access token.
+func TestEnterpriseSend(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	clk := newFakeClock()
+	bot := newEnterpriseBot(t, stub, clk)
+
+	result, err := bot.SendMarkdown(context.Background(), "Deploy", "### Deploy\n\nAll green", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendMarkdown failed: %v", err)
+	}
+	if result.ProcessQueryKey != "key-1" || !strings.HasSuffix(result.URL, groupMessagePath) || !strings.Contains(string(result.Payload), "sampleMarkdown") {
+		t.Errorf("unexpected result: %+v", result)
+	}
+
+	messages, tokens := stub.sent()
+	if len(messages) != 1 || messages[0]["msgKey"] != "sampleMarkdown" || messages[0]["openConversationId"] != "cid-ops" ||
+		messages[0]["robotCode"] != "ding-app" || messages[0]["msgParam"] != `{"text":"### Deploy\n\nAll green","title":"Deploy"}` {
+		t.Errorf("unexpected message: %+v", messages)
+	}
+	if tokens[0] != "token-1" {
+		t.Errorf("expected the access token in the header, got %q", tokens[0])
+	}
+
+	// Concurrent sends share the cached token
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := bot.SendText(context.Background(), fmt.Sprintf("message %d", i), nil, nil, false); err != nil {
+				t.Errorf("SendText failed: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := stub.tokens.Load(); n != 1 {
+		t.Errorf("expected a single access token, got %d", n)
+	}
+
+	// The token is refreshed shortly before it expires
+	clk.Advance(2*time.Hour - tokenRefreshMargin)
+	if _, err := bot.SendText(context.Background(), "after refresh", nil, nil, false); err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	if _, tokens := stub.sent(); stub.tokens.Load() != 2 || tokens[len(tokens)-1] != "token-2" {
+		t.Errorf("expected the token to be refreshed, got %d tokens", stub.tokens.Load())
+	}
+
+	// A revoked token is dropped and the send is retried with a new one
+	stub.revoked.Store("token-2", true)
+	result, err = bot.SendText(context.Background(), "after revocation", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	if _, tokens := stub.sent(); result.Attempts != 2 || tokens[len(tokens)-1] != "token-3" {
+		t.Errorf("expected a retry with a new token, got %+v", result)
+	}
+}
+
+// TestAccessTokenDefaultLifetime tests that a token issued without a lifetime is cached for the default one.
+func TestAccessTokenDefaultLifetime(t *testing.T) {
+	var cache accessTokenCache
+	clk := newFakeClock()
+	fetches := 0
+	fetch := func(ctx context.Context) (string, time.Duration, error) {
+		fetches++
+		return fmt.Sprintf("token-%d", fetches), 0, nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if token, err := cache.get(context.Background(), clk, fetch); err != nil || token != "token-1" {
+			t.Fatalf("expected the cached token, got %q (%v)", token, err)
+		}
+	}
+
+	clk.Advance(defaultTokenLifetime - tokenRefreshMargin)
+	if token, _ := cache.get(context.Background(), clk, fetch); token != "token-2" || fetches != 2 {
+		t.Errorf("expected the token to be refreshed before the default lifetime ends, got %q after %d fetches", token, fetches)
+	}
+}
+
+// TestEnterpriseErrors tests the open API failures and the messages enterprise robots cannot send.
+func TestEnterpriseErrors(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	app, _ := NewEnterpriseApp(EnterpriseConfig{AppKey: "ding-app", AppSecret: "wrong", BaseURL: stub.URL})
+	bot := NewDingDingBot("", "", WithEnterprise(app, "cid-ops"), withClock(newFakeClock()))
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Code != "invalidClientSecret" || apiErr.StatusCode != http.StatusBadRequest || apiErr.RequestID != "req-1" {
+		t.Fatalf("expected the token failure to be reported, got %v", err)
+	}
+
+	bot = newEnterpriseBot(t, stub, newFakeClock())
+	image, _ := NewImageMessage("aGVsbG8=", "5d41402abc4b2a76b9719d911017c592")
+	if _, err := bot.Send(context.Background(), image); err == nil || !strings.Contains(err.Error(), "image messages are not supported") {
+		t.Errorf("expected image messages to be rejected, got %v", err)
+	}
+	if _, err := bot.SendText(context.Background(), "hello", nil, []string{"manager1234"}, false); err == nil {
+		t.Errorf("expected mentions to be rejected")
+	}
+	if _, err := bot.UploadFile(context.Background(), "report.pdf"); err == nil || !strings.Contains(err.Error(), "webhook access token") {
+		t.Errorf("expected uploads without a webhook key to be rejected, got %v", err)
+	}
+
+	bot = NewDingDingBot("", "", WithEnterprise(app, ""))
+	if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err == nil || !strings.Contains(err.Error(), "open_conversation_id") {
+		t.Errorf("expected a missing group to be reported, got %v", err)
+	}
+	if messages, _ := stub.sent(); len(messages) != 0 {
+		t.Errorf("no message should have been sent, got %+v", messages)
+	}
+
+	throttled := &APIError{Code: "Forbidden.AccessDenied.QpsLimitForApi", ErrMsg: "qps limit", StatusCode: http.StatusForbidden}
+	if !throttled.Retryable() || !errors.Is(throttled, ErrThrottled) || throttled.Hint() == "" {
+		t.Errorf("expected the QPS limit to be a retryable throttling error")
+	}
+}
+
+// TestRobotMessage tests the conversion of webhook messages into open API robot messages.
+func TestRobotMessage(t *testing.T) {
+	link, _ := NewLinkMessage("Release", "v1.2 is out", "https://example.com/release", "")
+	card, _ := NewTemplateCardMessage("Approve", "Deploy v1.2?", "Open", "https://example.com/deploy", "0")
+	buttons, _ := NewActionCardMessage("Approve", "Deploy v1.2?", []ActionCardButton{
+		{Title: "Yes", ActionURL: "https://example.com/yes"},
+		{Title: "No", ActionURL: "https://example.com/no"},
+	}, "1")
+
+	for name, test := range map[string]struct {
+		msg    Message
+		key    string
+		params map[string]string
+	}{
+		"link":        {link, "sampleLink", map[string]string{"title": "Release", "text": "v1.2 is out", "messageUrl": "https://example.com/release", "picUrl": ""}},
+		"single card": {card, "sampleActionCard", map[string]string{"title": "Approve", "text": "Deploy v1.2?", "singleTitle": "Open", "singleURL": "https://example.com/deploy"}},
+		"buttons": {buttons, "sampleActionCard2", map[string]string{"title": "Approve", "text": "Deploy v1.2?",
+			"actionTitle1": "Yes", "actionURL1": "https://example.com/yes", "actionTitle2": "No", "actionURL2": "https://example.com/no"}},
+	} {
+		key, param, err := robotMessage(test.msg)
+		if err != nil {
+			t.Errorf("%s: robotMessage failed: %v", name, err)
+			continue
+		}
+		var params map[string]string
+		json.Unmarshal([]byte(param), &params)
+		if key != test.key || fmt.Sprint(params) != fmt.Sprint(test.params) {
+			t.Errorf("%s: unexpected conversion: %s %v", name, key, params)
+		}
+	}
+
+	tooMany := make([]ActionCardButton, 6)
+	for i := range tooMany {
+		tooMany[i] = ActionCardButton{Title: "Option", ActionURL: "https://example.com"}
+	}
+	msg, _ := NewActionCardMessage("Pick", "Pick one", tooMany, "0")
+	if _, _, err := robotMessage(msg); err == nil {
+		t.Errorf("expected more than 5 buttons to be rejected")
+	}
+	feed, _ := NewFeedCardMessage([]NewsArticle{{Title: "News", MessageURL: "https://example.com", PicURL: "https://example.com/a.png"}})
+	if _, _, err := robotMessage(feed); err == nil {
+		t.Errorf("expected feed cards to be rejected")
+	}
+}
+
+// TestEnterpriseConfig tests the enterprise bots of the config file and the dry run of their requests.
+func TestEnterpriseConfig(t *testing.T) {
+	t.Setenv("OPS_APP_SECRET", "app-secret")
+
+	cfg, err := LoadConfig(writeConfig(t, `{
+		"bots": [
+			{"name": "ops", "enterprise": {"app_key": "ding-app", "app_secret": "${OPS_APP_SECRET}", "open_conversation_id": "cid-ops"}},
+			{"name": "dev", "enterprise": {"app_key": "ding-app", "app_secret": "${OPS_APP_SECRET}", "open_conversation_id": "cid-dev"}}
+		]
+	}`))
+	if err != nil {
+		t.Fatalf("LoadConfig failed: %v", err)
+	}
+	if cfg.Bots[0].Enterprise.AppSecret != "app-secret" {
+		t.Errorf("expected the app secret to be expanded, got %+v", cfg.Bots[0].Enterprise)
+	}
+	if _, err := LoadConfig(writeConfig(t, `{"bots": [{"name": "ops", "enterprise": {"app_key": "ding-app"}}]}`)); err == nil {
+		t.Errorf("LoadConfig should require an app secret")
+	}
+
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(cfg, "", "", WithSender(sender))
+	if err != nil {
+		t.Fatalf("NewBotRegistryFromConfig failed: %v", err)
+	}
+	ops, _ := bots.Get("ops")
+	dev, _ := bots.Get("dev")
+	if ops.app != dev.app || !bots.List()[0].Enterprise {
+		t.Errorf("bots of the same app should share it")
+	}
+
+	ctx := context.Background()
+	result, err := ops.SendText(ctx, "hello ops", nil, nil, false)
+	if err != nil || !result.DryRun || result.ProcessQueryKey != "dry-run-process-query-key" {
+		t.Fatalf("unexpected dry run: %+v, %v", result, err)
+	}
+	if _, err := dev.SendText(ctx, "hello dev", nil, nil, false); err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+
+	records := sender.Records()
+	if len(records) != 3 || !strings.HasSuffix(records[0].URL, accessTokenPath) || !strings.Contains(records[2].Body, "cid-dev") {
+		t.Fatalf("expected a single token request and two messages, got %+v", records)
+	}
+	if strings.Contains(records[0].Body, "app-secret") || !strings.Contains(records[0].Body, "REDACTED") {
+		t.Errorf("the app secret should be redacted: %s", records[0].Body)
+	}
+}
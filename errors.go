@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Sentinel errors for the known DingDing failures, matched with errors.Is against an *APIError
+var (
+	// ErrInvalidToken means the webhook access token does not exist or the access token of the enterprise app was rejected
+	ErrInvalidToken = errors.New("invalid access token")
+
+	// ErrKeywordMismatch means the message lacks a custom keyword required by the robot security settings
+	ErrKeywordMismatch = errors.New("message does not contain a required keyword")
+
+	// ErrSignatureMismatch means the signature or its timestamp was rejected
+	ErrSignatureMismatch = errors.New("signature mismatch")
+
+	// ErrIPNotAllowed means the server IP is not in the robot IP whitelist
+	ErrIPNotAllowed = errors.New("IP address not in whitelist")
+
+	// ErrThrottled means the robot exceeded the DingDing send rate
+	ErrThrottled = errors.New("robot is sending too fast")
+
+	// ErrSystemBusy means DingDing is temporarily unable to handle the request
+	ErrSystemBusy = errors.New("DingDing system busy")
+
+	// ErrUserNotFound means no user of the organization has the given mobile number
+	ErrUserNotFound = errors.New("user not found")
+)
+
+// knownError describes a DingDing errcode or open API error code in the error catalog.
+type knownError struct {
+	// code is the DingDing errcode
+	code int
+
+	// apiCode is a prefix of the open API error code, empty for robot webhook errcodes
+	apiCode string
+
+	// match lists lowercase substrings of errmsg, in English and Chinese, telling apart failures sharing an errcode.
+	// An errmsg containing any of them matches, an empty list matches any errmsg.
+	match []string
+
+	// sentinel is the error matched by errors.Is
+	sentinel error
+
+	// retryable reports whether the failure is transient
+	retryable bool
+
+	// hint tells the user how to fix the failure
+	hint string
+}
+
+// errorCatalog lists the known DingDing errcodes, more specific entries first.
+var errorCatalog = []knownError{
+	{
+		code:     300001,
+		sentinel: ErrInvalidToken,
+		hint:     "Check that the webhook access token is correct and that the robot has not been removed from the group.",
+	},
+	{
+		code:     310000,
+		match:    []string{"keyword", "关键词"},
+		sentinel: ErrKeywordMismatch,
+		hint:     "The robot security settings require a custom keyword: include one of the configured keywords in the message.",
+	},
+	{
+		code:     310000,
+		match:    []string{"sign not match", "签名"},
+		sentinel: ErrSignatureMismatch,
+		hint:     "Check that the sign key matches the secret in the robot security settings and that the server clock is accurate.",
+	},
+	{
+		code:     310000,
+		match:    []string{"timestamp", "时间戳"},
+		sentinel: ErrSignatureMismatch,
+		hint:     "The signature timestamp was rejected: check that the server clock is accurate.",
+	},
+	{
+		code:     310000,
+		match:    []string{"whitelist", "白名单"},
+		sentinel: ErrIPNotAllowed,
+		hint:     "Add the public IP address of this server to the IP whitelist in the robot security settings.",
+	},
+	{
+		code:      130101,
+		sentinel:  ErrThrottled,
+		retryable: true,
+		hint:      "The robot sent more than 20 messages per minute: wait before sending again, DingDing may mute it for 10 minutes.",
+	},
+	{
+		code:      -1,
+		sentinel:  ErrSystemBusy,
+		retryable: true,
+		hint:      "DingDing is busy: retry in a moment.",
+	},
+	{
+		code:     40014,
+		sentinel: ErrInvalidToken,
+		hint:     "The access token of the enterprise app was rejected: check the AppKey and AppSecret and that the app is not disabled.",
+	},
+	{
+		code:     60121,
+		sentinel: ErrUserNotFound,
+		hint:     "No user of the organization has this mobile number: check the number or pass the user ID instead.",
+	},
+	{
+		apiCode:  "InvalidAuthentication",
+		sentinel: ErrInvalidToken,
+		hint:     "The access token of the enterprise app was rejected: check the AppKey and AppSecret and that the app is not disabled.",
+	},
+	{
+		apiCode:   "Forbidden.AccessDenied.QpsLimit",
+		sentinel:  ErrThrottled,
+		retryable: true,
+		hint:      "The enterprise app exceeded the request quota of the DingDing open API: wait before sending again.",
+	},
+}
+
+// APIError is a failure reported by the DingDing API, either as a non-zero errcode or an HTTP error status.
+type APIError struct {
+	// ErrCode is the DingDing errcode, 0 for HTTP errors
+	ErrCode int
+
+	// Code is the error code of the DingDing open API, such as "InvalidAuthentication", empty for robot webhooks
+	Code string
+
+	// ErrMsg is the DingDing errmsg, or the message of the open API error
+	ErrMsg string
+
+	// StatusCode is the HTTP status code of the response
+	StatusCode int
+
+	// RequestID identifies the request in DingDing, when returned
+	RequestID string
+}
+
+func (e *APIError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("DingDing API error %s: %s (HTTP %d)", e.Code, e.ErrMsg, e.StatusCode)
+	}
+	if e.ErrCode == 0 {
+		return fmt.Sprintf("unexpected HTTP status code: %d", e.StatusCode)
+	}
+	return fmt.Sprintf("DingDing API error %d: %s", e.ErrCode, e.ErrMsg)
+}
+
+// Is matches the sentinel error of the catalog entry for the errcode.
+func (e *APIError) Is(target error) bool {
+	known := e.known()
+	return known != nil && known.sentinel == target
+}
+
+// Hint returns a human remediation hint for known failures, empty otherwise.
+func (e *APIError) Hint() string {
+	if known := e.known(); known != nil {
+		return known.hint
+	}
+	return ""
+}
+
+// Retryable reports whether the failure is transient and worth retrying.
+func (e *APIError) Retryable() bool {
+	known := e.known()
+	if e.ErrCode == 0 {
+		return e.StatusCode >= 500 || e.StatusCode == 429 || (known != nil && known.retryable)
+	}
+	return known != nil && known.retryable
+}
+
+// known looks up the errcode or open API error code in the error catalog.
+func (e *APIError) known() *knownError {
+	errmsg := strings.ToLower(e.ErrMsg)
+	for i := range errorCatalog {
+		entry := &errorCatalog[i]
+		if e.Code != "" {
+			if entry.apiCode != "" && strings.HasPrefix(e.Code, entry.apiCode) {
+				return entry
+			}
+			continue
+		}
+		if entry.apiCode == "" && entry.code == e.ErrCode && entry.matches(errmsg) {
+			return entry
+		}
+	}
+	return nil
+}
+
+// matches reports whether a lowercase errmsg contains one of the substrings of the entry.
+func (k *knownError) matches(errmsg string) bool {
+	if len(k.match) == 0 {
+		return true
+	}
+	for _, match := range k.match {
+		if strings.Contains(errmsg, match) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrorHint returns the remediation hint for err, empty when there is none.
+func ErrorHint(err error) string {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.Hint()
+	}
+	var circuitOpen *CircuitOpenError
+	if errors.As(err, &circuitOpen) {
+		return circuitOpen.Hint()
+	}
+	var sessionExpired *SessionExpiredError
+	if errors.As(err, &sessionExpired) {
+		return sessionExpired.Hint()
+	}
+	return ""
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newErrorServer creates a DingDing server always answering with the given errcode and errmsg.
+func newErrorServer(errcode int, errmsg string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Acs-Request-Id", "request-id")
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": errcode, "errmsg": errmsg})
+	}))
+}
+
+// TestAPIErrorCatalog tests that errcodes and errmsgs map to the right sentinel errors.
+func TestAPIErrorCatalog(t *testing.T) {
+	tests := []struct {
+		errcode   int
+		errmsg    string
+		sentinel  error
+		retryable bool
+	}{
+		{300001, "token is not exist", ErrInvalidToken, false},
+		{310000, "keywords not in content", ErrKeywordMismatch, false},
+		{310000, "sign not match", ErrSignatureMismatch, false},
+		{310000, "invalid timestamp", ErrSignatureMismatch, false},
+		{310000, "ip 1.2.3.4 not in whitelist", ErrIPNotAllowed, false},
+		{310000, "description:关键词不匹配;solution:请联系群管理员查看此机器人的关键词，并在发送的信息中包含此关键词;", ErrKeywordMismatch, false},
+		{310000, "description:签名不匹配;solution:请确认签名和生成签名的时间戳是否正确;", ErrSignatureMismatch, false},
+		{310000, "description:ip地址不在白名单;solution:请检查机器人的安全设置;", ErrIPNotAllowed, false},
+		{130101, "send too fast", ErrThrottled, true},
+		{-1, "system busy", ErrSystemBusy, true},
+	}
+
+	for _, tt := range tests {
+		err := &APIError{ErrCode: tt.errcode, ErrMsg: tt.errmsg, StatusCode: http.StatusOK}
+		if !errors.Is(err, tt.sentinel) {
+			t.Errorf("%d %q: expected %v", tt.errcode, tt.errmsg, tt.sentinel)
+		}
+		if err.Retryable() != tt.retryable {
+			t.Errorf("%d %q: expected retryable %v", tt.errcode, tt.errmsg, tt.retryable)
+		}
+		if err.Hint() == "" {
+			t.Errorf("%d %q: expected a hint", tt.errcode, tt.errmsg)
+		}
+	}
+
+	// errmsgs containing "ip" as part of a word are not taken for a whitelist failure
+	if err := (&APIError{ErrCode: 310000, ErrMsg: "description:robot disabled;solution:contact the group owner"}); errors.Is(err, ErrIPNotAllowed) {
+		t.Errorf("an unrelated 310000 errmsg should not match the IP whitelist")
+	}
+
+	unknown := &APIError{ErrCode: 400, ErrMsg: "unknown"}
+	if errors.Is(unknown, ErrInvalidToken) || unknown.Hint() != "" || unknown.Retryable() {
+		t.Errorf("unknown errcodes should not match the catalog")
+	}
+}
+
+// TestSendReturnsAPIError tests that send failures carry the DingDing error details.
+func TestSendReturnsAPIError(t *testing.T) {
+	server := newErrorServer(310000, "keywords not in content")
+	defer server.Close()
+
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL))
+
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected an APIError, got %v", err)
+	}
+	if apiErr.ErrCode != 310000 || apiErr.ErrMsg != "keywords not in content" || apiErr.StatusCode != http.StatusOK || apiErr.RequestID != "request-id" {
+		t.Errorf("unexpected APIError: %+v", apiErr)
+	}
+	if !errors.Is(err, ErrKeywordMismatch) {
+		t.Errorf("expected ErrKeywordMismatch, got %v", err)
+	}
+}
+
+// TestRetriedAPIError tests that the APIError survives retries.
+func TestRetriedAPIError(t *testing.T) {
+	server := newErrorServer(130101, "send too fast")
+	defer server.Close()
+
+	bot, _ := newRetryBot(server)
+
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	if !errors.Is(err, ErrThrottled) || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("expected ErrThrottled after 3 attempts, got %v", err)
+	}
+}
+
+// TestHandlerErrorHint tests that tool errors include the remediation hint.
+func TestHandlerErrorHint(t *testing.T) {
+	server := newErrorServer(310000, "sign not match")
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "SECtoken", WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+
+	result, _ := sendTextHandler(NewDispatcher(bots, nil, nil, nil))(context.Background(), newToolRequest("send_text", map[string]interface{}{
+		"content": "hello",
+	}))
+	if !result.IsError {
+		t.Fatalf("send_text should fail")
+	}
+	text := result.Content[0].(mcp.TextContent).Text
+	if !strings.Contains(text, "310000") || !strings.Contains(text, "Hint: Check that the sign key") {
+		t.Errorf("expected the errcode and hint in the tool error, got %q", text)
+	}
+}
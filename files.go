@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileAccess restricts the local files the file_path arguments of send_image and upload_file may read.
+// Without a directory, any file the server can read is accepted unless the access is disabled,
+// which is the default of the sse and http transports where the tools are called by remote clients.
+type FileAccess struct {
+	// Dir is the directory file paths are confined to, relative paths are resolved against it
+	Dir string
+
+	// Disabled rejects every file path when Dir is empty
+	Disabled bool
+}
+
+// validate checks that the directory of the file access exists.
+func (access FileAccess) validate() error {
+	if access.Dir == "" {
+		return nil
+	}
+
+	info, err := os.Stat(access.Dir)
+	if err != nil {
+		return fmt.Errorf("invalid file directory: %v", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid file directory: %s is not a directory", access.Dir)
+	}
+	return nil
+}
+
+// resolve returns the path a file_path argument is read from.
+// Parameters:
+//   - path: The file_path argument
+//
+// Returns:
+//   - The path to open, with its symlinks resolved when the access is confined to a directory
+//   - An error if reading local files is disabled or the file is outside of the directory, nil otherwise
+func (access FileAccess) resolve(path string) (string, error) {
+	if path == "" {
+		return "", fmt.Errorf("file_path cannot be empty")
+	}
+	if access.Dir == "" {
+		if access.Disabled {
+			return "", fmt.Errorf("file_path is disabled on this transport, set DINGDING_BOT_FILE_DIR to allow files from a directory")
+		}
+		return path, nil
+	}
+
+	// Symlinks are resolved on both sides, so that a link in the directory cannot point outside of it
+	root, err := filepath.Abs(access.Dir)
+	if err == nil {
+		root, err = filepath.EvalSymlinks(root)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the file directory: %v", err)
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(root, path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of the file directory", path)
+	}
+	return resolved, nil
+}
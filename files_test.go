@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestFileAccess tests which paths are accepted with and without a file directory.
+func TestFileAccess(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "files")
+	if err := os.MkdirAll(filepath.Join(root, "reports"), 0o700); err != nil {
+		t.Fatalf("failed to create the file directory: %v", err)
+	}
+	for _, path := range []string{filepath.Join(root, "reports", "daily.txt"), filepath.Join(dir, "secret.txt")} {
+		if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret.txt"), filepath.Join(root, "link.txt")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	confined := FileAccess{Dir: root, Disabled: true}
+	tests := []struct {
+		name   string
+		access FileAccess
+		path   string
+		want   string
+		err    string
+	}{
+		{"any file without a directory", FileAccess{}, filepath.Join(dir, "secret.txt"), filepath.Join(dir, "secret.txt"), ""},
+		{"disabled", FileAccess{Disabled: true}, filepath.Join(root, "reports", "daily.txt"), "", "disabled"},
+		{"relative path", confined, "reports/daily.txt", "reports/daily.txt", ""},
+		{"absolute path", confined, filepath.Join(root, "reports", "daily.txt"), "reports/daily.txt", ""},
+		{"parent directory", confined, "../secret.txt", "", "outside of the file directory"},
+		{"absolute path outside", confined, filepath.Join(dir, "secret.txt"), "", "outside of the file directory"},
+		{"symlink pointing outside", confined, "link.txt", "", "outside of the file directory"},
+		{"missing file", confined, "reports/missing.txt", "", "failed to open file"},
+		{"empty path", confined, "", "", "cannot be empty"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := tt.access.resolve(tt.path)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("expected an error containing %q, got %q, %v", tt.err, path, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("resolve failed: %v", err)
+			}
+			if !strings.HasSuffix(filepath.ToSlash(path), tt.want) {
+				t.Errorf("expected a path ending in %s, got %s", tt.want, path)
+			}
+		})
+	}
+
+	if err := (FileAccess{Dir: filepath.Join(dir, "secret.txt")}).validate(); err == nil {
+		t.Errorf("a file should not be accepted as file directory")
+	}
+}
+
+// TestFileAccessTools tests that send_image and upload_file only read files the access allows.
+func TestFileAccessTools(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "chart.png"), newTestPNG(t, 4, 4), 0o600); err != nil {
+		t.Fatalf("failed to create test image: %v", err)
+	}
+	outside := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(outside, []byte("secret"), 0o600); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	bots := NewBotRegistry(WithSender(NewDryRunSender()))
+	bots.Add(DefaultBotName, "", bots.NewBot("token", ""))
+	confined := FileAccess{Dir: root, Disabled: true}
+
+	sendImage := sendImageHandler(NewDispatcher(bots, nil, nil, nil), confined)
+	result, _ := sendImage(context.Background(), newToolRequest("send_image", map[string]interface{}{
+		"file_path": "chart.png",
+	}))
+	if result.IsError {
+		t.Errorf("send_image should read files from the file directory: %+v", result.Content)
+	}
+	result, _ = sendImage(context.Background(), newToolRequest("send_image", map[string]interface{}{
+		"file_path": outside,
+	}))
+	if !result.IsError {
+		t.Errorf("send_image should reject files outside of the file directory")
+	}
+
+	result, _ = uploadFileHandler(bots, confined)(context.Background(), newToolRequest("upload_file", map[string]interface{}{
+		"file_path": outside,
+	}))
+	if !result.IsError {
+		t.Errorf("upload_file should reject files outside of the file directory")
+	}
+
+	result, _ = uploadFileHandler(bots, FileAccess{Disabled: true})(context.Background(), newToolRequest("upload_file", map[string]interface{}{
+		"file_path": outside,
+	}))
+	if !result.IsError {
+		t.Errorf("upload_file should reject every file when the access is disabled")
+	}
+}
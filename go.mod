@@ -2,6 +2,7 @@ module mcp-dingdingbot-server
 
 go 1.23
 
-require github.com/mark3labs/mcp-go v0.8.2
-
-require github.com/google/uuid v1.6.0 // indirect
+require (
+	github.com/google/uuid v1.6.0
+	github.com/mark3labs/mcp-go v0.8.2
+)
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultHTTPTimeout bounds a single HTTP request, including reading the response body
+const DefaultHTTPTimeout = 10 * time.Second
+
+// nonPublicPrefixes are the ranges refused by download clients besides the loopback, private,
+// link-local, multicast and unspecified addresses recognized by netip
+var nonPublicPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+}
+
+// tlsVersions maps the accepted TLS min versions to their crypto/tls constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// HTTPClientConfig configures the HTTP client requests to DingDing and image downloads are made with.
+type HTTPClientConfig struct {
+	// Timeout bounds a single HTTP request, each retry gets the full timeout again
+	Timeout Duration `json:"timeout"`
+
+	// ProxyURL is the proxy requests are routed through, such as "http://proxy.corp:3128";
+	// the HTTPS_PROXY and NO_PROXY environment variables are used when empty
+	ProxyURL string `json:"proxy_url,omitempty"`
+
+	// CAFiles lists PEM files of root certificates trusted in addition to the system ones
+	CAFiles []string `json:"ca_files,omitempty"`
+
+	// TLSMinVersion is the lowest accepted TLS version, such as "1.2"; the Go default when empty
+	TLSMinVersion string `json:"tls_min_version,omitempty"`
+}
+
+// merge returns the config with the fields set in override replaced, override may be nil.
+func (c HTTPClientConfig) merge(override *HTTPClientConfig) HTTPClientConfig {
+	if override == nil {
+		return c
+	}
+
+	if override.Timeout != 0 {
+		c.Timeout = override.Timeout
+	}
+	if override.ProxyURL != "" {
+		c.ProxyURL = override.ProxyURL
+	}
+	if len(override.CAFiles) > 0 {
+		c.CAFiles = override.CAFiles
+	}
+	if override.TLSMinVersion != "" {
+		c.TLSMinVersion = override.TLSMinVersion
+	}
+	return c
+}
+
+// NewHTTPClient creates an HTTP client from its configuration.
+// Parameters:
+//   - cfg: The timeout, proxy and TLS settings of the client
+//
+// Returns:
+//   - The HTTP client
+//   - An error if the proxy URL, a CA file or the TLS version is invalid
+func NewHTTPClient(cfg HTTPClientConfig) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if cfg.ProxyURL != "" {
+		proxyURL, err := url.Parse(cfg.ProxyURL)
+		if err != nil || proxyURL.Scheme == "" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("invalid proxy URL %q: must be an absolute URL such as http://proxy:3128", cfg.ProxyURL)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	tlsConfig := &tls.Config{}
+	if cfg.TLSMinVersion != "" {
+		version, ok := tlsVersions[cfg.TLSMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS min version %q: must be 1.0, 1.1, 1.2 or 1.3", cfg.TLSMinVersion)
+		}
+		tlsConfig.MinVersion = version
+	}
+
+	if len(cfg.CAFiles) > 0 {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		for _, file := range cfg.CAFiles {
+			pem, err := os.ReadFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read CA file: %v", err)
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no PEM certificate found in CA file %s", file)
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	return &http.Client{Transport: transport, Timeout: time.Duration(cfg.Timeout)}, nil
+}
+
+// NewDownloadClient derives the client that downloads the URLs given by MCP clients, such as image_url,
+// from client. Its connections to loopback, private, link-local and other non-public addresses are refused,
+// so that a tool call cannot reach the server itself, its network or a cloud metadata endpoint.
+// Through a proxy, the destination is checked before the request is handed to the proxy.
+// Parameters:
+//   - client: The client whose timeout, proxy and TLS settings are kept
+//
+// Returns:
+//   - The download client
+func NewDownloadClient(client *http.Client) *http.Client {
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+
+	// The proxies themselves may be on the private network, their addresses are let through
+	var proxies sync.Map
+	if proxy := transport.Proxy; proxy != nil {
+		transport.Proxy = func(req *http.Request) (*url.URL, error) {
+			proxyURL, err := proxy(req)
+			if err != nil || proxyURL == nil {
+				return proxyURL, err
+			}
+			if err := checkPublicHost(req.Context(), req.URL.Hostname()); err != nil {
+				return nil, err
+			}
+			proxies.Store(proxyAddr(proxyURL), true)
+			return proxyURL, nil
+		}
+	}
+
+	dialer := &net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second}
+	guarded := &net.Dialer{
+		Timeout:   dialer.Timeout,
+		KeepAlive: dialer.KeepAlive,
+		// The address is checked after name resolution, so that a host resolving to a private address is refused too
+		Control: func(network, address string, _ syscall.RawConn) error {
+			addr, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return fmt.Errorf("refusing to connect to %s: %v", address, err)
+			}
+			if !isPublicAddr(addr.Addr()) {
+				return fmt.Errorf("refusing to connect to %s: not a public address", address)
+			}
+			return nil
+		},
+	}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		if _, ok := proxies.Load(address); ok {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guarded.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{Transport: transport, Timeout: client.Timeout}
+}
+
+// checkPublicHost checks that every address of a host is public.
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", host, err)
+	}
+	for _, addr := range addrs {
+		if !isPublicAddr(addr) {
+			return fmt.Errorf("refusing to connect to %s: %s is not a public address", host, addr)
+		}
+	}
+	return nil
+}
+
+// isPublicAddr reports whether addr is a public unicast address.
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range nonPublicPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// proxyAddr returns the host:port a proxy URL is dialed at, with the default port of its scheme.
+func proxyAddr(proxyURL *url.URL) string {
+	if port := proxyURL.Port(); port != "" {
+		return net.JoinHostPort(proxyURL.Hostname(), port)
+	}
+
+	port := "80"
+	switch proxyURL.Scheme {
+	case "https":
+		port = "443"
+	case "socks5", "socks5h":
+		port = "1080"
+	}
+	return net.JoinHostPort(proxyURL.Hostname(), port)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestHTTPClientProxy tests that the bot sends its requests through the configured proxy.
+func TestHTTPClientProxy(t *testing.T) {
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok"})
+	}))
+	defer proxy.Close()
+
+	client, err := NewHTTPClient(HTTPClientConfig{Timeout: Duration(time.Second), ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %v", err)
+	}
+	if client.Timeout != time.Second {
+		t.Errorf("unexpected timeout: %v", client.Timeout)
+	}
+
+	bot := NewDingDingBot("token", "", WithBaseURL("http://oapi.dingtalk.test/robot"), WithHTTPClient(client))
+	if bot.HTTPClient() != client {
+		t.Errorf("the bot should use the given client")
+	}
+	if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "oapi.dingtalk.test" {
+		t.Errorf("expected the request to go through the proxy, got %v", proxied)
+	}
+
+	// A custom sender is left alone
+	dryRun := NewDryRunSender()
+	bot = NewDingDingBot("token", "", WithSender(dryRun), WithHTTPClient(client))
+	if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err != nil || len(dryRun.Records()) != 1 {
+		t.Errorf("expected the dry-run sender to capture the request, got %v", err)
+	}
+}
+
+// TestHTTPClientCAFiles tests that extra root certificates are trusted and the TLS min version is enforced.
+func TestHTTPClientCAFiles(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok"})
+	}))
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, certPEM, 0o600); err != nil {
+		t.Fatalf("failed to write CA file: %v", err)
+	}
+
+	send := func(cfg HTTPClientConfig) error {
+		client, err := NewHTTPClient(cfg)
+		if err != nil {
+			t.Fatalf("NewHTTPClient failed: %v", err)
+		}
+		bot := NewDingDingBot("token", "", WithBaseURL(server.URL), WithHTTPClient(client), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+		_, err = bot.SendText(context.Background(), "hello", nil, nil, false)
+		return err
+	}
+
+	if err := send(HTTPClientConfig{}); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Errorf("expected the self-signed certificate to be rejected, got %v", err)
+	}
+	if err := send(HTTPClientConfig{CAFiles: []string{caFile}}); err != nil {
+		t.Errorf("expected the CA file to be trusted, got %v", err)
+	}
+	if err := send(HTTPClientConfig{CAFiles: []string{caFile}, TLSMinVersion: "1.3"}); err == nil {
+		t.Errorf("expected a TLS 1.2 server to be rejected with TLS min version 1.3")
+	}
+}
+
+// TestHTTPClientConfig tests the validation of the client settings and the config file overrides.
+func TestHTTPClientConfig(t *testing.T) {
+	notPEM := filepath.Join(t.TempDir(), "ca.txt")
+	if err := os.WriteFile(notPEM, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+
+	for name, cfg := range map[string]HTTPClientConfig{
+		"relative proxy URL":  {ProxyURL: "proxy:3128"},
+		"missing CA file":     {CAFiles: []string{filepath.Join(t.TempDir(), "missing.pem")}},
+		"CA file without PEM": {CAFiles: []string{notPEM}},
+		"unknown TLS version": {TLSMinVersion: "2.0"},
+	} {
+		if _, err := NewHTTPClient(cfg); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+
+	base := HTTPClientConfig{Timeout: Duration(time.Second), ProxyURL: "http://env-proxy:3128", TLSMinVersion: "1.2"}
+	merged := base.merge(&HTTPClientConfig{Timeout: Duration(time.Minute), CAFiles: []string{"corp.pem"}})
+	if merged.Timeout != Duration(time.Minute) || merged.ProxyURL != base.ProxyURL || len(merged.CAFiles) != 1 || merged.TLSMinVersion != "1.2" {
+		t.Errorf("unexpected merged config: %+v", merged)
+	}
+	if base.merge(nil).ProxyURL != base.ProxyURL {
+		t.Errorf("a missing override should keep the config")
+	}
+}
+
+// TestDownloadClient tests that downloads from non-public addresses are refused, directly and through a proxy.
+func TestDownloadClient(t *testing.T) {
+	for addr, public := range map[string]bool{
+		"203.0.113.7":     true,
+		"2001:4860::8888": true,
+		"127.0.0.1":       false,
+		"::1":             false,
+		"10.1.2.3":        false,
+		"172.16.0.1":      false,
+		"192.168.1.1":     false,
+		"169.254.169.254": false,
+		"100.100.100.200": false,
+		"0.0.0.0":         false,
+		"fd00::1":         false,
+		"fe80::1":         false,
+		"::ffff:10.0.0.1": false,
+		"224.0.0.1":       false,
+	} {
+		if got := isPublicAddr(netip.MustParseAddr(addr)); got != public {
+			t.Errorf("isPublicAddr(%s) = %v, expected %v", addr, got, public)
+		}
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("image"))
+	}))
+	defer server.Close()
+
+	client := NewDownloadClient(server.Client())
+	if _, err := client.Get(server.URL); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the loopback download to be refused, got %v", err)
+	}
+	if _, err := client.Get("http://169.254.169.254/latest/meta-data/"); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the metadata download to be refused, got %v", err)
+	}
+
+	// A proxy on loopback is reached, but only for public destinations
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = append(proxied, r.URL.Host)
+		w.Write([]byte("image"))
+	}))
+	defer proxy.Close()
+
+	proxyClient, err := NewHTTPClient(HTTPClientConfig{Timeout: Duration(time.Second), ProxyURL: proxy.URL})
+	if err != nil {
+		t.Fatalf("NewHTTPClient failed: %v", err)
+	}
+	client = NewDownloadClient(proxyClient)
+	if client.Timeout != time.Second {
+		t.Errorf("the timeout should be kept, got %v", client.Timeout)
+	}
+	resp, err := client.Get("http://203.0.113.7/image.png")
+	if err != nil {
+		t.Fatalf("the download through the proxy failed: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := client.Get("http://10.0.0.1/image.png"); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the private download to be refused, got %v", err)
+	}
+	if len(proxied) != 1 || proxied[0] != "203.0.113.7" {
+		t.Errorf("expected only the public download to reach the proxy, got %v", proxied)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DefaultIdempotency remembers idempotency keys for ten minutes, long enough to cover
+// a caller retrying a tool call after a timeout, and does not deduplicate by content.
+var DefaultIdempotency = Idempotency{TTL: 10 * time.Minute}
+
+// Idempotency configures how a bot suppresses duplicate sends.
+type Idempotency struct {
+	// TTL is how long a key is remembered after a successful send, 0 disables deduplication
+	TTL time.Duration
+
+	// ContentDedup derives a key from the message content when the caller supplies none,
+	// so identical messages are only sent once per TTL
+	ContentDedup bool
+}
+
+// idempotencyCache remembers the results of successful sends by key for a TTL.
+// Concurrent sends with the same key wait for the first one instead of posting twice.
+type idempotencyCache struct {
+	mu      sync.Mutex
+	clock   clock
+	ttl     time.Duration
+	entries map[string]*idempotencyEntry
+}
+
+// idempotencyEntry is a send in flight, or a successful send until it expires.
+type idempotencyEntry struct {
+	// done is closed when the send completes, result is nil if it failed
+	done    chan struct{}
+	result  *SendResult
+	expires time.Time
+}
+
+// newIdempotencyCache creates an empty cache, nil when the TTL disables deduplication.
+func newIdempotencyCache(ttl time.Duration, clk clock) *idempotencyCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &idempotencyCache{
+		clock:   clk,
+		ttl:     ttl,
+		entries: make(map[string]*idempotencyEntry),
+	}
+}
+
+// do calls send unless a send with the same key succeeded within the TTL,
+// in which case it returns a copy of the original result marked as a duplicate.
+// Failed sends are not remembered, so they can be retried with the same key.
+func (c *idempotencyCache) do(ctx context.Context, key string, send func() (*SendResult, error)) (*SendResult, error) {
+	var entry *idempotencyEntry
+	for entry == nil {
+		c.mu.Lock()
+		c.expire()
+		existing, ok := c.entries[key]
+		if !ok {
+			entry = &idempotencyEntry{done: make(chan struct{})}
+			c.entries[key] = entry
+		}
+		c.mu.Unlock()
+
+		if ok {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-existing.done:
+			}
+			if existing.result != nil {
+				duplicate := *existing.result
+				duplicate.Duplicate = true
+				return &duplicate, nil
+			}
+			// The send in flight failed, try again
+		}
+	}
+
+	result, err := send()
+
+	c.mu.Lock()
+	if err != nil {
+		delete(c.entries, key)
+	} else {
+		entry.result = result
+		entry.expires = c.clock.Now().Add(c.ttl)
+	}
+	c.mu.Unlock()
+	close(entry.done)
+
+	return result, err
+}
+
+// expire drops the entries whose TTL elapsed. The caller must hold mu.
+func (c *idempotencyCache) expire() {
+	now := c.clock.Now()
+	for key, entry := range c.entries {
+		if entry.result != nil && !now.Before(entry.expires) {
+			delete(c.entries, key)
+		}
+	}
+}
+
+// contentKey derives an idempotency key from the message content.
+// Messages are maps, which encoding/json writes with sorted keys, so equal messages give equal keys.
+func contentKey(msg Message) string {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return ""
+	}
+
+	sum := sha256.Sum256(data)
+	return "content:" + hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// TestSendOnce tests that a repeated idempotency key returns the original result until the TTL elapses.
+func TestSendOnce(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), withClock(clk), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	msg, _ := NewTextMessage("disk full on db-1", nil, nil, false)
+
+	// Failures are not remembered
+	if _, err := bot.SendOnce(context.Background(), "alert-1", msg); err == nil {
+		t.Fatalf("the first send should fail")
+	}
+
+	first, err := bot.SendOnce(context.Background(), "alert-1", msg)
+	if err != nil || first.Duplicate || first.IdempotencyKey != "alert-1" {
+		t.Fatalf("unexpected first result: %+v (%v)", first, err)
+	}
+
+	second, err := bot.SendOnce(context.Background(), "alert-1", msg)
+	if err != nil || !second.Duplicate || second.MessageID != first.MessageID || calls != 2 {
+		t.Errorf("expected the original result without sending again, got %+v (%d calls)", second, calls)
+	}
+
+	if other, _ := bot.SendOnce(context.Background(), "alert-2", msg); other.Duplicate || calls != 3 {
+		t.Errorf("another key should be sent, got %+v (%d calls)", other, calls)
+	}
+
+	clk.Advance(DefaultIdempotency.TTL)
+	if again, _ := bot.SendOnce(context.Background(), "alert-1", msg); again.Duplicate || calls != 4 {
+		t.Errorf("the key should be forgotten after the TTL, got %+v (%d calls)", again, calls)
+	}
+
+	// Without a key and content dedup, every message is sent
+	bot.SendOnce(context.Background(), "", msg)
+	bot.SendOnce(context.Background(), "", msg)
+	if calls != 6 {
+		t.Errorf("expected messages without a key to be sent, got %d calls", calls)
+	}
+}
+
+// TestSendOnceConcurrent tests that concurrent sends with the same key post the message once.
+func TestSendOnceConcurrent(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls)
+	defer server.Close()
+
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL))
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+
+	var wg sync.WaitGroup
+	var duplicates int64
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := bot.SendOnce(context.Background(), "key", msg)
+			if err != nil {
+				t.Errorf("SendOnce failed: %v", err)
+				return
+			}
+			if result.Duplicate {
+				atomic.AddInt64(&duplicates, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls != 1 || duplicates != 9 {
+		t.Errorf("expected 1 call and 9 duplicates, got %d calls and %d duplicates", calls, duplicates)
+	}
+}
+
+// TestContentDedup tests deduplicating messages without a key by their content.
+func TestContentDedup(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls)
+	defer server.Close()
+
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), WithIdempotency(Idempotency{TTL: time.Minute, ContentDedup: true}))
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	same, _ := NewTextMessage("hello", nil, nil, false)
+	other, _ := NewTextMessage("hello", []string{"13800138000"}, nil, false)
+
+	bot.SendOnce(context.Background(), "", msg)
+	if result, _ := bot.SendOnce(context.Background(), "", same); !result.Duplicate || !strings.HasPrefix(result.IdempotencyKey, "content:") {
+		t.Errorf("identical content should be deduplicated, got %+v", result)
+	}
+	if result, _ := bot.SendOnce(context.Background(), "", other); result.Duplicate {
+		t.Errorf("different content should be sent, got %+v", result)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 calls, got %d", calls)
+	}
+
+	// Disabling the TTL disables deduplication altogether
+	disabled := NewDingDingBot("token", "", WithBaseURL(server.URL), WithIdempotency(Idempotency{ContentDedup: true}))
+	disabled.SendOnce(context.Background(), "key", msg)
+	disabled.SendOnce(context.Background(), "key", msg)
+	if calls != 4 {
+		t.Errorf("expected deduplication to be disabled, got %d calls", calls)
+	}
+}
+
+// TestHandlerIdempotencyKey tests the idempotency_key argument of the send tools.
+func TestHandlerIdempotencyKey(t *testing.T) {
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(sender))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	handler := sendMarkdownHandler(NewDispatcher(bots, nil, nil, nil))
+
+	args := map[string]interface{}{"title": "Alert", "content": "disk full", "idempotency_key": "alert-1"}
+	handler(context.Background(), newToolRequest("send_markdown", args))
+	result, _ := handler(context.Background(), newToolRequest("send_markdown", args))
+
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "not sent again") || len(sender.Records()) != 1 {
+		t.Errorf("expected the repeated call to be suppressed, got %q and %d requests", text, len(sender.Records()))
+	}
+
+	var sent SendResult
+	resultJSON(t, result, &sent)
+	if !sent.Duplicate || sent.IdempotencyKey != "alert-1" {
+		t.Errorf("unexpected structured result: %+v", sent)
+	}
+}
+
+// TestOutboxIdempotencyKey tests that the outbox journal remembers idempotency keys across restarts.
+func TestOutboxIdempotencyKey(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	dir := t.TempDir()
+	outbox, clk := newTestOutbox(t, dir, server.URL)
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+
+	first, duplicate, err := outbox.Enqueue("ops", "alert-1", msg)
+	if err != nil || duplicate {
+		t.Fatalf("unexpected first enqueue: %v %v", duplicate, err)
+	}
+	if second, duplicate, _ := outbox.Enqueue("", "alert-1", msg); !duplicate || second.ID != first.ID {
+		t.Errorf("expected the first entry, got %+v", second)
+	}
+
+	// A dead entry does not block the key
+	outbox.deliverDue(context.Background())
+	retried, duplicate, _ := outbox.Enqueue("ops", "alert-1", msg)
+	if duplicate || retried.ID == first.ID {
+		t.Errorf("a dead entry should not suppress the message")
+	}
+	outbox.Close()
+
+	reopened, _ := newTestOutbox(t, dir, server.URL)
+	reopened.clock = clk
+	if entry, duplicate, _ := reopened.Enqueue("ops", "alert-1", msg); !duplicate || entry.ID != retried.ID {
+		t.Errorf("the key should survive a restart, got %+v", entry)
+	}
+
+	clk.Advance(DefaultIdempotency.TTL)
+	if _, duplicate, _ := reopened.Enqueue("ops", "alert-1", msg); duplicate {
+		t.Errorf("the key should be forgotten after the TTL")
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"math"
+	"net/http"
+	"os"
+
+	// Register the decoders for the formats accepted by DingDing
+	_ "image/gif"
+	_ "image/png"
+)
+
+const (
+	// maxImageSize is the largest image accepted by DingDing for image messages (2MB)
+	maxImageSize = 2 << 20
+
+	// maxImageDownloadSize bounds how much is read from a file or URL before downscaling
+	maxImageDownloadSize = 20 << 20
+
+	// downscaleJPEGQuality is the JPEG quality used when re-encoding a downscaled image
+	downscaleJPEGQuality = 85
+)
+
+// supportedImageTypes lists the MIME types DingDing accepts for image messages
+var supportedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// NewImageMessageFromFile reads an image from the local filesystem and builds an image message from it.
+// Parameters:
+//   - filePath: The path to the image file
+//   - downscale: Whether to shrink images larger than the DingDing size limit instead of failing
+// Returns:
+//   - The image message
+//   - An error if the image cannot be read or is invalid, nil otherwise
+func NewImageMessageFromFile(filePath string, downscale bool) (Message, error) {
+	if filePath == "" {
+		return nil, fmt.Errorf("filePath cannot be empty")
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open image: %v", err)
+	}
+	defer file.Close()
+
+	data, err := readImage(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImageMessageFromData(data, downscale)
+}
+
+// NewImageMessageFromURL downloads an image and builds an image message from it.
+// Parameters:
+//   - ctx: Aborts the download when done
+//   - client: The HTTP client to download with, http.DefaultClient when nil
+//   - imageURL: The HTTP(S) URL of the image
+//   - downscale: Whether to shrink images larger than the DingDing size limit instead of failing
+// Returns:
+//   - The image message
+//   - An error if the image cannot be downloaded or is invalid, nil otherwise
+func NewImageMessageFromURL(ctx context.Context, client *http.Client, imageURL string, downscale bool) (Message, error) {
+	if imageURL == "" {
+		return nil, fmt.Errorf("imageURL cannot be empty")
+	}
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %v", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image: unexpected HTTP status code: %d", resp.StatusCode)
+	}
+
+	data, err := readImage(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return newImageMessageFromData(data, downscale)
+}
+
+// SendImageFromFile reads an image from the local filesystem and sends it to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - filePath: The path to the image file
+//   - downscale: Whether to shrink images larger than the DingDing size limit instead of failing
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendImageFromFile(ctx context.Context, filePath string, downscale bool) (*SendResult, error) {
+	msg, err := NewImageMessageFromFile(filePath, downscale)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// SendImageFromURL downloads an image with the download client of the bot and sends it to the DingDing group.
+// Parameters:
+//   - ctx: Aborts the download and the request when done
+//   - imageURL: The HTTP(S) URL of the image
+//   - downscale: Whether to shrink images larger than the DingDing size limit instead of failing
+// Returns:
+//   - The result of the request
+//   - An error if the request fails, nil otherwise
+func (bot *DingDingBot) SendImageFromURL(ctx context.Context, imageURL string, downscale bool) (*SendResult, error) {
+	msg, err := NewImageMessageFromURL(ctx, bot.downloadClient, imageURL, downscale)
+	if err != nil {
+		return nil, err
+	}
+
+	return bot.Send(ctx, msg)
+}
+
+// newImageMessageFromData validates raw image bytes, encodes them and builds an image message.
+func newImageMessageFromData(data []byte, downscale bool) (Message, error) {
+	base64Data, md5Sum, err := encodeImage(data, downscale)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewImageMessage(base64Data, md5Sum)
+}
+
+// readImage reads image bytes from r, refusing anything beyond maxImageDownloadSize.
+func readImage(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxImageDownloadSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image: %v", err)
+	}
+	if len(data) > maxImageDownloadSize {
+		return nil, fmt.Errorf("image is larger than %d bytes", maxImageDownloadSize)
+	}
+
+	return data, nil
+}
+
+// encodeImage checks the image format and size, optionally downscales it,
+// and returns the Base64 data and hex MD5 expected by the image message.
+func encodeImage(data []byte, downscale bool) (string, string, error) {
+	if len(data) == 0 {
+		return "", "", fmt.Errorf("image is empty")
+	}
+
+	contentType := http.DetectContentType(data)
+	if !supportedImageTypes[contentType] {
+		return "", "", fmt.Errorf("unsupported image format: %s", contentType)
+	}
+
+	if len(data) > maxImageSize {
+		if !downscale {
+			return "", "", fmt.Errorf("image size %d bytes exceeds the %d bytes limit, enable downscale to shrink it", len(data), maxImageSize)
+		}
+
+		var err error
+		data, err = downscaleImage(data, maxImageSize)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	sum := md5.Sum(data)
+
+	return base64.StdEncoding.EncodeToString(data), hex.EncodeToString(sum[:]), nil
+}
+
+// downscaleImage shrinks the image and re-encodes it as JPEG until it fits within limit bytes.
+func downscaleImage(data []byte, limit int) ([]byte, error) {
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %v", err)
+	}
+
+	bounds := src.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+
+	// Start from the ratio suggested by the byte sizes and shrink further until it fits
+	ratio := math.Sqrt(float64(limit) / float64(len(data)))
+	for attempt := 0; attempt < 8; attempt++ {
+		w := int(float64(width) * ratio)
+		h := int(float64(height) * ratio)
+		if w < 1 || h < 1 {
+			break
+		}
+
+		buf := &bytes.Buffer{}
+		if err := jpeg.Encode(buf, scaleImage(src, w, h), &jpeg.Options{Quality: downscaleJPEGQuality}); err != nil {
+			return nil, fmt.Errorf("failed to encode image: %v", err)
+		}
+		if buf.Len() <= limit {
+			return buf.Bytes(), nil
+		}
+
+		ratio *= 0.75
+	}
+
+	return nil, fmt.Errorf("failed to downscale image below %d bytes", limit)
+}
+
+// scaleImage resizes src to w x h by averaging the source pixels covered by each target pixel.
+func scaleImage(src image.Image, w, h int) *image.RGBA {
+	bounds := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	scaleX := float64(bounds.Dx()) / float64(w)
+	scaleY := float64(bounds.Dy()) / float64(h)
+
+	for y := 0; y < h; y++ {
+		y0 := bounds.Min.Y + int(float64(y)*scaleY)
+		y1 := max(bounds.Min.Y+int(float64(y+1)*scaleY), y0+1)
+		for x := 0; x < w; x++ {
+			x0 := bounds.Min.X + int(float64(x)*scaleX)
+			x1 := max(bounds.Min.X+int(float64(x+1)*scaleX), x0+1)
+
+			var r, g, b, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, ca := src.At(sx, sy).RGBA()
+					r, g, b, a = r+uint64(cr), g+uint64(cg), b+uint64(cb), a+uint64(ca)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(b / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"image"
+	"image/color"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestPNG encodes a w x h PNG filled with random pixels so it does not compress well.
+func newTestPNG(t *testing.T, w, h int) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	rng := rand.New(rand.NewSource(1))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(rng.Intn(256)), uint8(rng.Intn(256)), uint8(rng.Intn(256)), 255})
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	if err := png.Encode(buf, img); err != nil {
+		t.Fatalf("failed to encode test image: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// TestEncodeImage tests format detection and the Base64/MD5 computation.
+func TestEncodeImage(t *testing.T) {
+	data := newTestPNG(t, 4, 4)
+
+	base64Data, md5Sum, err := encodeImage(data, false)
+	if err != nil {
+		t.Fatalf("encodeImage failed: %v", err)
+	}
+	if base64Data != base64.StdEncoding.EncodeToString(data) {
+		t.Errorf("unexpected base64 data")
+	}
+	sum := md5.Sum(data)
+	if md5Sum != hex.EncodeToString(sum[:]) {
+		t.Errorf("unexpected md5: %s", md5Sum)
+	}
+
+	if _, _, err := encodeImage([]byte("not an image"), false); err == nil {
+		t.Errorf("encodeImage should reject unsupported formats")
+	}
+}
+
+// TestEncodeImageSizeLimit tests that oversized images are rejected or downscaled.
+func TestEncodeImageSizeLimit(t *testing.T) {
+	data := newTestPNG(t, 1000, 1000)
+	if len(data) <= maxImageSize {
+		t.Fatalf("test image should exceed the size limit, got %d bytes", len(data))
+	}
+
+	if _, _, err := encodeImage(data, false); err == nil {
+		t.Errorf("encodeImage should reject images over the size limit")
+	}
+
+	base64Data, _, err := encodeImage(data, true)
+	if err != nil {
+		t.Fatalf("encodeImage with downscale failed: %v", err)
+	}
+	decoded, _ := base64.StdEncoding.DecodeString(base64Data)
+	if len(decoded) > maxImageSize {
+		t.Errorf("downscaled image is still %d bytes", len(decoded))
+	}
+	if http.DetectContentType(decoded) != "image/jpeg" {
+		t.Errorf("downscaled image should be re-encoded as JPEG")
+	}
+}
+
+// TestSendImageFromFile tests the SendImageFromFile method.
+func TestSendImageFromFile(t *testing.T) {
+	mockServer := NewMockDingDingServer()
+	defer mockServer.Close()
+
+	path := filepath.Join(t.TempDir(), "image.png")
+	if err := os.WriteFile(path, newTestPNG(t, 8, 8), 0o600); err != nil {
+		t.Fatalf("failed to write test image: %v", err)
+	}
+
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	if _, err := bot.SendImageFromFile(context.Background(), path, false); err != nil {
+		t.Errorf("SendImageFromFile failed: %v", err)
+	}
+}
+
+// TestSendImageFromURL tests the SendImageFromURL method.
+func TestSendImageFromURL(t *testing.T) {
+	mockServer := NewMockDingDingServer()
+	defer mockServer.Close()
+
+	data := newTestPNG(t, 8, 8)
+	imageServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer imageServer.Close()
+
+	// The image server listens on loopback, which the default download client refuses
+	bot := NewDingDingBot("", "", WithBaseURL(mockServer.URL))
+	if _, err := bot.SendImageFromURL(context.Background(), imageServer.URL+"/image.png", false); err == nil || !strings.Contains(err.Error(), "not a public address") {
+		t.Errorf("expected the loopback download to be refused, got %v", err)
+	}
+
+	bot = NewDingDingBot("", "", WithBaseURL(mockServer.URL), WithDownloadClient(imageServer.Client()))
+	if _, err := bot.SendImageFromURL(context.Background(), imageServer.URL+"/image.png", false); err != nil {
+		t.Errorf("SendImageFromURL failed: %v", err)
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultCallbackPath is the path outgoing robot callbacks are posted to
+	DefaultCallbackPath = "/dingding/callback"
+
+	// DefaultIncomingBufferSize is the number of incoming messages kept for polling
+	DefaultIncomingBufferSize = 100
+
+	// callbackMaxSkew is how far the timestamp of a callback may be from now, as required by DingDing
+	callbackMaxSkew = time.Hour
+
+	// maxCallbackSize bounds the size of a callback body
+	maxCallbackSize = 1 << 20
+
+	// maxPollWait bounds how long poll_incoming_messages waits for a message
+	maxPollWait = time.Minute
+)
+
+// Conversation types of incoming messages
+const (
+	// ConversationPrivate is a one-to-one chat with the robot
+	ConversationPrivate = "private"
+
+	// ConversationGroup is a group chat the robot was @mentioned in
+	ConversationGroup = "group"
+)
+
+// IncomingAtUser is a user @mentioned in an incoming message.
+type IncomingAtUser struct {
+	// DingtalkID identifies the user across organizations
+	DingtalkID string `json:"dingtalk_id"`
+
+	// StaffID is the user ID within the organization of the robot, when known
+	StaffID string `json:"staff_id,omitempty"`
+}
+
+// IncomingMessage is a message an outgoing robot received, such as when it was @mentioned in a group.
+type IncomingMessage struct {
+	// Seq orders the messages in the buffer and is the cursor of poll_incoming_messages
+	Seq int64 `json:"seq"`
+
+	// ID is the msgId given by DingDing
+	ID string `json:"id"`
+
+	// MsgType is the DingDing message type, such as "text" or "picture"
+	MsgType string `json:"msg_type"`
+
+	// Text is the text of a text message, without the leading @mention
+	Text string `json:"text,omitempty"`
+
+	// Content is the raw content of messages other than text messages
+	Content json.RawMessage `json:"content,omitempty"`
+
+	// ConversationID identifies the chat, ConversationTitle names a group chat
+	ConversationID    string `json:"conversation_id"`
+	ConversationTitle string `json:"conversation_title,omitempty"`
+
+	// ConversationType is ConversationPrivate or ConversationGroup
+	ConversationType string `json:"conversation_type"`
+
+	// SenderID, SenderNick and SenderStaffID identify the sender
+	SenderID      string `json:"sender_id"`
+	SenderNick    string `json:"sender_nick,omitempty"`
+	SenderStaffID string `json:"sender_staff_id,omitempty"`
+
+	// SenderIsAdmin reports whether the sender is an administrator of the organization
+	SenderIsAdmin bool `json:"sender_is_admin,omitempty"`
+
+	// AtUsers lists the users @mentioned in the message, including the robot
+	AtUsers []IncomingAtUser `json:"at_users,omitempty"`
+
+	// RobotCode identifies the robot that received the message
+	RobotCode string `json:"robot_code,omitempty"`
+
+	// SessionWebhook is the URL replies to the conversation are posted to, kept out of results since it grants access to the chat
+	SessionWebhook string `json:"-"`
+
+	// SessionWebhookExpiresAt is when SessionWebhook stops accepting replies
+	SessionWebhookExpiresAt time.Time `json:"session_webhook_expires_at,omitempty"`
+
+	// CreatedAt is when the message was sent, ReceivedAt when the callback arrived
+	CreatedAt  time.Time `json:"created_at"`
+	ReceivedAt time.Time `json:"received_at"`
+}
+
+// callbackPayload is the body of an outgoing robot callback.
+type callbackPayload struct {
+	MsgID   string `json:"msgId"`
+	MsgType string `json:"msgtype"`
+	Text    struct {
+		Content string `json:"content"`
+	} `json:"text"`
+	Content           json.RawMessage `json:"content"`
+	CreateAt          int64           `json:"createAt"`
+	ConversationID    string          `json:"conversationId"`
+	ConversationTitle string          `json:"conversationTitle"`
+	ConversationType  string          `json:"conversationType"`
+	SenderID          string          `json:"senderId"`
+	SenderNick        string          `json:"senderNick"`
+	SenderStaffID     string          `json:"senderStaffId"`
+	IsAdmin           bool            `json:"isAdmin"`
+	AtUsers           []struct {
+		DingtalkID string `json:"dingtalkId"`
+		StaffID    string `json:"staffId"`
+	} `json:"atUsers"`
+	RobotCode                 string `json:"robotCode"`
+	SessionWebhook            string `json:"sessionWebhook"`
+	SessionWebhookExpiredTime int64  `json:"sessionWebhookExpiredTime"`
+}
+
+// message converts the callback into an incoming message received at receivedAt.
+func (p *callbackPayload) message(receivedAt time.Time) IncomingMessage {
+	msg := IncomingMessage{
+		ID:                p.MsgID,
+		MsgType:           p.MsgType,
+		ConversationID:    p.ConversationID,
+		ConversationTitle: p.ConversationTitle,
+		ConversationType:  ConversationGroup,
+		SenderID:          p.SenderID,
+		SenderNick:        p.SenderNick,
+		SenderStaffID:     p.SenderStaffID,
+		SenderIsAdmin:     p.IsAdmin,
+		RobotCode:         p.RobotCode,
+		SessionWebhook:    p.SessionWebhook,
+		CreatedAt:         time.UnixMilli(p.CreateAt).UTC(),
+		ReceivedAt:        receivedAt,
+	}
+
+	if p.ConversationType == "1" {
+		msg.ConversationType = ConversationPrivate
+	}
+	if p.MsgType == "text" {
+		msg.Text = strings.TrimSpace(p.Text.Content)
+	} else {
+		msg.Content = p.Content
+	}
+	if p.CreateAt == 0 {
+		msg.CreatedAt = receivedAt
+	}
+	if p.SessionWebhookExpiredTime > 0 {
+		msg.SessionWebhookExpiresAt = time.UnixMilli(p.SessionWebhookExpiredTime).UTC()
+	}
+	for _, user := range p.AtUsers {
+		msg.AtUsers = append(msg.AtUsers, IncomingAtUser{DingtalkID: user.DingtalkID, StaffID: user.StaffID})
+	}
+
+	return msg
+}
+
+// IncomingPoll is the result of polling the incoming messages.
+type IncomingPoll struct {
+	// Messages are the messages after the cursor, oldest first
+	Messages []IncomingMessage `json:"messages"`
+
+	// Cursor is passed as after to the next poll to get the messages received since
+	Cursor int64 `json:"cursor"`
+
+	// Missed is the number of messages after the cursor that were dropped from the full buffer before being polled
+	Missed int64 `json:"missed,omitempty"`
+}
+
+// IncomingBuffer keeps the latest incoming messages for polling, dropping the oldest ones when full.
+type IncomingBuffer struct {
+	mu       sync.Mutex
+	size     int
+	messages []IncomingMessage
+	seq      int64
+
+	// added is closed and replaced whenever a message is added, waking up waiting polls
+	added chan struct{}
+}
+
+// NewIncomingBuffer creates a buffer keeping the latest size messages.
+// Parameters:
+//   - size: The number of messages kept, DefaultIncomingBufferSize when not positive
+//
+// Returns:
+//   - A pointer to a new IncomingBuffer
+func NewIncomingBuffer(size int) *IncomingBuffer {
+	if size <= 0 {
+		size = DefaultIncomingBufferSize
+	}
+	return &IncomingBuffer{size: size, added: make(chan struct{})}
+}
+
+// Add appends a message to the buffer, numbering it with the next sequence number.
+// A message whose ID is already in the buffer, such as a callback redelivered by DingDing, is not added again.
+// Returns the message as stored and whether it was a duplicate.
+func (b *IncomingBuffer) Add(msg IncomingMessage) (IncomingMessage, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if msg.ID != "" {
+		for _, existing := range b.messages {
+			if existing.ID == msg.ID {
+				return existing, true
+			}
+		}
+	}
+
+	b.seq++
+	msg.Seq = b.seq
+	b.messages = append(b.messages, msg)
+	if len(b.messages) > b.size {
+		b.messages = append([]IncomingMessage(nil), b.messages[len(b.messages)-b.size:]...)
+	}
+
+	close(b.added)
+	b.added = make(chan struct{})
+	return msg, false
+}
+
+// Poll returns up to limit messages received after the cursor after, oldest first.
+// Parameters:
+//   - ctx: Ends the wait when done
+//   - after: The cursor returned by the previous poll, 0 for all buffered messages
+//   - limit: The maximum number of messages returned, all of them when not positive
+//   - conversationID: Only return messages of this conversation, all conversations when empty
+//   - wait: How long to wait for a message when there is none yet
+//
+// Returns:
+//   - The messages and the cursor of the next poll
+func (b *IncomingBuffer) Poll(ctx context.Context, after int64, limit int, conversationID string, wait time.Duration) IncomingPoll {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	var missed int64
+	for {
+		b.mu.Lock()
+		poll := b.poll(after, limit, conversationID)
+		added := b.added
+		b.mu.Unlock()
+
+		missed += poll.Missed
+		poll.Missed = missed
+
+		if len(poll.Messages) > 0 || wait <= 0 {
+			return poll
+		}
+
+		// Wait for a message after the new cursor, the skipped messages belong to other conversations
+		after = poll.Cursor
+		select {
+		case <-added:
+		case <-timer.C:
+			return poll
+		case <-ctx.Done():
+			return poll
+		}
+	}
+}
+
+// poll collects the messages after the cursor. The caller must hold mu.
+func (b *IncomingBuffer) poll(after int64, limit int, conversationID string) IncomingPoll {
+	poll := IncomingPoll{Messages: []IncomingMessage{}, Cursor: max(after, 0)}
+	if len(b.messages) > 0 && after > 0 && b.messages[0].Seq > after+1 {
+		poll.Missed = b.messages[0].Seq - after - 1
+	}
+
+	for _, msg := range b.messages {
+		if msg.Seq <= after {
+			continue
+		}
+		if limit > 0 && len(poll.Messages) == limit {
+			return poll
+		}
+		poll.Cursor = msg.Seq
+		if conversationID == "" || msg.ConversationID == conversationID {
+			poll.Messages = append(poll.Messages, msg)
+		}
+	}
+
+	return poll
+}
+
+// Get returns the buffered message with the given ID.
+func (b *IncomingBuffer) Get(id string) (*IncomingMessage, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i := range b.messages {
+		if b.messages[i].ID == id {
+			msg := b.messages[i]
+			return &msg, nil
+		}
+	}
+	return nil, fmt.Errorf("incoming message %s not found, only the latest %d messages are kept", id, b.size)
+}
+
+// List returns the buffered messages, oldest first.
+func (b *IncomingBuffer) List() []IncomingMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]IncomingMessage{}, b.messages...)
+}
+
+// CallbackHandler receives the callbacks of DingDing outgoing robots and stores their messages in a buffer.
+// Callbacks are authenticated with the timestamp and sign headers, signed with the app secret of the robot.
+// As the signature does not cover the body, a signature and a msgId are accepted once while the timestamp
+// is valid, so that a captured callback cannot be replayed with another body.
+type CallbackHandler struct {
+	secret string
+	buffer *IncomingBuffer
+	clock  clock
+
+	// mu guards seen and lastPrune
+	mu sync.Mutex
+
+	// seen maps the signatures and msgIds of the accepted callbacks to when they can be forgotten
+	seen      map[string]time.Time
+	lastPrune time.Time
+}
+
+// NewCallbackHandler creates the handler of outgoing robot callbacks.
+// Parameters:
+//   - secret: The app secret the callbacks are signed with
+//   - buffer: The buffer received messages are stored in
+//
+// Returns:
+//   - A pointer to a new CallbackHandler
+func NewCallbackHandler(secret string, buffer *IncomingBuffer) *CallbackHandler {
+	return &CallbackHandler{secret: secret, buffer: buffer, clock: realClock{}, seen: make(map[string]time.Time)}
+}
+
+// ServeHTTP verifies and stores a callback. The response body is empty, so the robot does not reply on its own.
+func (h *CallbackHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	timestamp, signature := r.Header.Get("timestamp"), r.Header.Get("sign")
+	if err := h.verify(timestamp, signature); err != nil {
+		log.Printf("Rejected outgoing robot callback from %s: %v\n", r.RemoteAddr, err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackSize+1))
+	if err != nil || len(body) > maxCallbackSize {
+		http.Error(w, "Invalid callback body", http.StatusBadRequest)
+		return
+	}
+
+	var payload callbackPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid callback body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// A repeated callback is acknowledged, so that DingDing stops delivering it, but not stored again
+	if !h.firstSeen("sign:"+timestamp+":"+signature) || (payload.MsgID != "" && !h.firstSeen("msg:"+payload.MsgID)) {
+		log.Printf("Ignored repeated outgoing robot callback from %s\n", r.RemoteAddr)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	h.buffer.Add(payload.message(h.clock.Now().UTC()))
+	w.WriteHeader(http.StatusOK)
+}
+
+// firstSeen records key and reports whether it was not seen within the last 2*callbackMaxSkew,
+// the longest a timestamp stays valid.
+func (h *CallbackHandler) firstSeen(key string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := h.clock.Now()
+	if now.Sub(h.lastPrune) > time.Minute {
+		for seen, forgetAt := range h.seen {
+			if !now.Before(forgetAt) {
+				delete(h.seen, seen)
+			}
+		}
+		h.lastPrune = now
+	}
+
+	if forgetAt, ok := h.seen[key]; ok && now.Before(forgetAt) {
+		return false
+	}
+	h.seen[key] = now.Add(2 * callbackMaxSkew)
+	return true
+}
+
+// verify checks the timestamp and sign headers of a callback.
+func (h *CallbackHandler) verify(timestamp string, signature string) error {
+	if timestamp == "" || signature == "" {
+		return fmt.Errorf("missing timestamp or sign header")
+	}
+
+	millis, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", timestamp)
+	}
+	if skew := h.clock.Now().Sub(time.UnixMilli(millis)); skew > callbackMaxSkew || skew < -callbackMaxSkew {
+		return fmt.Errorf("timestamp is %v away from now", skew.Round(time.Second))
+	}
+
+	expected, err := sign(h.secret, millis)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return fmt.Errorf("invalid signature")
+	}
+
+	return nil
+}
+
+// ServeCallbacks serves the callback handler on addr until ctx is done, then shuts down gracefully.
+// Parameters:
+//   - ctx: Stops the listener when done
+//   - addr: The listen address, such as ":8081"
+//   - path: The path callbacks are posted to, DefaultCallbackPath when empty
+//   - handler: The callback handler
+//
+// Returns:
+//   - An error if the listener cannot start or stops abnormally, nil otherwise
+func ServeCallbacks(ctx context.Context, addr string, path string, handler http.Handler) error {
+	if path == "" {
+		path = DefaultCallbackPath
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(path, handler)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+	log.Printf("Receiving outgoing robot callbacks on %s%s\n", listener.Addr(), path)
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down the callback listener: %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
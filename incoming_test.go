@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// postCallback posts an outgoing robot callback signed with secret at the given time.
+func postCallback(t *testing.T, url string, secret string, at time.Time, body string) *http.Response {
+	t.Helper()
+
+	timestamp := at.UnixMilli()
+	signature, err := sign(secret, timestamp)
+	if err != nil {
+		t.Fatalf("failed to sign callback: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewBufferString(body))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("sign", signature)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to post callback: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// callbackBody builds the body of a text message callback.
+func callbackBody(id string, conversationID string, text string) string {
+	return fmt.Sprintf(`{
+		"msgtype": "text",
+		"text": {"content": " %s"},
+		"msgId": %q,
+		"createAt": 1704099600000,
+		"conversationType": "2",
+		"conversationId": %q,
+		"conversationTitle": "Ops",
+		"senderId": "$:LWCP_v1:$sender",
+		"senderNick": "Alice",
+		"senderStaffId": "manager1234",
+		"chatbotUserId": "$:LWCP_v1:$bot",
+		"atUsers": [{"dingtalkId": "$:LWCP_v1:$bot"}],
+		"isAdmin": true,
+		"isInAtList": true,
+		"sessionWebhook": "https://oapi.dingtalk.com/robot/sendBySession?session=secret",
+		"sessionWebhookExpiredTime": 1704105000000,
+		"robotCode": "dingrobot"
+	}`, text, id, conversationID)
+}
+
+// TestCallbackHandler tests that signed callbacks are stored and forged or stale ones are rejected.
+func TestCallbackHandler(t *testing.T) {
+	clk := newFakeClock()
+	buffer := NewIncomingBuffer(10)
+	handler := NewCallbackHandler("app-secret", buffer)
+	handler.clock = clk
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	if resp := postCallback(t, server.URL, "app-secret", clk.Now(), callbackBody("msg-1", "cid-ops", "deploy status?")); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected the callback to be accepted, got %d", resp.StatusCode)
+	}
+	// DingDing may deliver a callback again
+	postCallback(t, server.URL, "app-secret", clk.Now(), callbackBody("msg-1", "cid-ops", "deploy status?"))
+
+	messages := buffer.List()
+	if len(messages) != 1 {
+		t.Fatalf("expected a single message, got %+v", messages)
+	}
+	msg := messages[0]
+	if msg.Seq != 1 || msg.Text != "deploy status?" || msg.ConversationType != ConversationGroup || msg.SenderNick != "Alice" ||
+		!msg.SenderIsAdmin || len(msg.AtUsers) != 1 || !strings.Contains(msg.SessionWebhook, "sendBySession") ||
+		!msg.CreatedAt.Equal(time.Date(2024, 1, 1, 9, 0, 0, 0, time.UTC)) || !msg.ReceivedAt.Equal(clk.Now()) {
+		t.Errorf("unexpected message: %+v", msg)
+	}
+
+	// A captured signature replayed with another body is not stored
+	if resp := postCallback(t, server.URL, "app-secret", clk.Now(), callbackBody("msg-5", "cid-ops", "forged")); resp.StatusCode != http.StatusOK || len(buffer.List()) != 1 {
+		t.Errorf("a replayed callback should be acknowledged and ignored, got %d with %d messages", resp.StatusCode, len(buffer.List()))
+	}
+
+	for name, resp := range map[string]*http.Response{
+		"wrong secret":    postCallback(t, server.URL, "other-secret", clk.Now(), callbackBody("msg-2", "cid-ops", "hi")),
+		"stale timestamp": postCallback(t, server.URL, "app-secret", clk.Now().Add(-2*time.Hour), callbackBody("msg-3", "cid-ops", "hi")),
+	} {
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("%s: expected 401, got %d", name, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(server.URL, "application/json", strings.NewReader(callbackBody("msg-4", "cid-ops", "hi")))
+	if err != nil {
+		t.Fatalf("failed to post callback: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || len(buffer.List()) != 1 {
+		t.Errorf("an unsigned callback should be rejected, got %d", resp.StatusCode)
+	}
+}
+
+// TestCallbackHandlerRedelivery tests that a msgId is stored once, even after it left the buffer.
+func TestCallbackHandlerRedelivery(t *testing.T) {
+	clk := newFakeClock()
+	buffer := NewIncomingBuffer(1)
+	handler := NewCallbackHandler("app-secret", buffer)
+	handler.clock = clk
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	for _, id := range []string{"msg-1", "msg-2", "msg-1"} {
+		clk.Advance(time.Second)
+		if resp := postCallback(t, server.URL, "app-secret", clk.Now(), callbackBody(id, "cid-ops", "hi")); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected the callback to be acknowledged, got %d", resp.StatusCode)
+		}
+	}
+	if messages := buffer.List(); len(messages) != 1 || messages[0].ID != "msg-2" {
+		t.Errorf("expected msg-1 not to be stored again, got %+v", messages)
+	}
+
+	// Signatures and msgIds are forgotten once their timestamp cannot be valid anymore
+	clk.Advance(2*callbackMaxSkew + time.Minute)
+	postCallback(t, server.URL, "app-secret", clk.Now(), callbackBody("msg-1", "cid-ops", "hi"))
+	if messages := buffer.List(); len(messages) != 1 || messages[0].ID != "msg-1" || len(handler.seen) != 2 {
+		t.Errorf("expected msg-1 to be stored again, got %+v with %d keys", messages, len(handler.seen))
+	}
+}
+
+// TestIncomingBufferPoll tests cursors, filtering, eviction and waiting for a message.
+func TestIncomingBufferPoll(t *testing.T) {
+	buffer := NewIncomingBuffer(3)
+	ctx := context.Background()
+	for i := 1; i <= 4; i++ {
+		conversation := "cid-ops"
+		if i%2 == 0 {
+			conversation = "cid-dev"
+		}
+		buffer.Add(IncomingMessage{ID: fmt.Sprintf("msg-%d", i), ConversationID: conversation})
+	}
+
+	// The oldest message was dropped
+	poll := buffer.Poll(ctx, 0, 0, "", 0)
+	if len(poll.Messages) != 3 || poll.Messages[0].Seq != 2 || poll.Cursor != 4 || poll.Missed != 0 {
+		t.Errorf("unexpected poll: %+v", poll)
+	}
+	if poll := buffer.Poll(ctx, 0, 2, "", 0); len(poll.Messages) != 2 || poll.Cursor != 3 {
+		t.Errorf("expected the limit to hold the cursor back, got %+v", poll)
+	}
+	if poll := buffer.Poll(ctx, 0, 0, "cid-dev", 0); len(poll.Messages) != 2 || poll.Messages[1].ID != "msg-4" || poll.Cursor != 4 {
+		t.Errorf("unexpected filtered poll: %+v", poll)
+	}
+	buffer.Add(IncomingMessage{ID: "msg-5"})
+	buffer.Add(IncomingMessage{ID: "msg-6"})
+	if poll := buffer.Poll(ctx, 1, 0, "", 0); poll.Missed != 2 || poll.Messages[0].Seq != 4 {
+		t.Errorf("expected the dropped messages to be reported, got %+v", poll)
+	}
+	if _, err := buffer.Get("msg-1"); err == nil {
+		t.Errorf("a dropped message should not be found")
+	}
+
+	// A poll waits for the next message
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		buffer.Add(IncomingMessage{ID: "msg-7", ConversationID: "cid-ops"})
+	}()
+	start := time.Now()
+	poll = buffer.Poll(ctx, 6, 0, "cid-ops", 5*time.Second)
+	if len(poll.Messages) != 1 || poll.Messages[0].ID != "msg-7" || time.Since(start) > 4*time.Second {
+		t.Errorf("expected the poll to return the new message, got %+v", poll)
+	}
+	if poll := buffer.Poll(ctx, 7, 0, "", 10*time.Millisecond); len(poll.Messages) != 0 || poll.Cursor != 7 {
+		t.Errorf("expected the poll to time out empty, got %+v", poll)
+	}
+}
+
+// TestPollIncomingMessagesTool tests the poll_incoming_messages tool and the incoming resources.
+func TestPollIncomingMessagesTool(t *testing.T) {
+	buffer := NewIncomingBuffer(10)
+	handler := NewCallbackHandler("app-secret", buffer)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	postCallback(t, server.URL, "app-secret", time.Now(), callbackBody("msg-1", "cid-ops", "deploy status?"))
+
+	ctx := context.Background()
+	result, _ := pollIncomingMessagesHandler(buffer)(ctx, newToolRequest("poll_incoming_messages", nil))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, `#1 Alice in group "Ops" (message msg-1): deploy status?`) || !strings.Contains(text, "after=1") {
+		t.Errorf("unexpected result: %q", text)
+	}
+
+	var poll IncomingPoll
+	resultJSON(t, result, &poll)
+	if len(poll.Messages) != 1 || poll.Cursor != 1 || poll.Messages[0].SessionWebhook != "" {
+		t.Errorf("unexpected structured result: %+v", poll)
+	}
+	if data := result.Content[1].(embeddedTextResource).Resource.Text; strings.Contains(data, "sendBySession") {
+		t.Errorf("the session webhook should not be exposed: %s", data)
+	}
+
+	if result, _ := pollIncomingMessagesHandler(buffer)(ctx, newToolRequest("poll_incoming_messages", map[string]interface{}{"wait_seconds": 3600})); !result.IsError {
+		t.Errorf("a wait longer than the maximum should be rejected")
+	}
+
+	var request mcp.ReadResourceRequest
+	request.Params.URI = "dingding://incoming/msg-1"
+	contents, err := incomingResourceHandler(buffer)(ctx, request)
+	if err != nil || len(contents) != 1 || !strings.Contains(contents[0].(mcp.TextResourceContents).Text, `"text": "deploy status?"`) {
+		t.Errorf("unexpected resource: %+v, %v", contents, err)
+	}
+	request.Params.URI = "dingding://incoming/unknown"
+	if _, err := incomingResourceHandler(buffer)(ctx, request); err == nil {
+		t.Errorf("an unknown message should not be found")
+	}
+}
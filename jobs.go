@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Catch-up policies for the runs of a job missed while the server was down
+const (
+	// CatchUpSkip drops missed runs, the job runs again at its next scheduled time
+	CatchUpSkip = "skip"
+
+	// CatchUpOnce makes a single run for all missed runs, rendered for the latest of them
+	CatchUpOnce = "once"
+
+	// CatchUpAll makes every missed run, up to maxCatchUpRuns
+	CatchUpAll = "all"
+)
+
+// Job sources
+const (
+	// JobSourceConfig marks jobs defined in the config file, which cannot be deleted through the tools
+	JobSourceConfig = "config"
+
+	// JobSourceTool marks jobs created with the create_job tool
+	JobSourceTool = "tool"
+)
+
+const (
+	// jobsJournalName is the name of the jobs journal file in the schedule directory
+	jobsJournalName = "jobs.jsonl"
+
+	// maxCatchUpRuns is the number of missed runs made at most by the CatchUpAll policy
+	maxCatchUpRuns = 20
+
+	// missedRunGrace is how late a run may start before it counts as missed
+	missedRunGrace = time.Minute
+
+	// cronIdleWait is how long the worker sleeps when no job is active
+	cronIdleWait = time.Minute
+)
+
+// JobConfig defines a recurring message, in the config file or through the create_job tool.
+type JobConfig struct {
+	// Name identifies the job in the job tools
+	Name string `json:"name"`
+
+	// Schedule is a cron expression such as "30 9 * * 1-5" or a descriptor such as "@daily"
+	Schedule string `json:"schedule"`
+
+	// Timezone is the IANA time zone the schedule is evaluated in, the scheduler's when empty
+	Timezone string `json:"timezone,omitempty"`
+
+	// Bot is the name of the bot the message is sent with, the default bot when empty
+	Bot string `json:"bot,omitempty"`
+
+	// MsgType is the message type, as in the broadcast tool
+	MsgType string `json:"msg_type"`
+
+	// Template holds the message fields, as in the broadcast tool. Strings are Go templates
+	// rendered at every run with {{.Name}}, {{.Time}} and {{.Date}}, such as "Standup {{.Date}}"
+	Template map[string]interface{} `json:"template"`
+
+	// CatchUp is the policy for runs missed while the server was down, CatchUpSkip when empty
+	CatchUp string `json:"catch_up,omitempty"`
+}
+
+// Job is a recurring message run by the CronScheduler.
+type Job struct {
+	JobConfig
+
+	// Source is JobSourceConfig or JobSourceTool
+	Source string `json:"source"`
+
+	// Paused reports whether the job is paused, paused jobs do not catch up when resumed
+	Paused bool `json:"paused"`
+
+	// CreatedAt is when the job was created
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is when the job last changed
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// NextRun is when the job runs next, zero when paused
+	NextRun time.Time `json:"next_run,omitempty"`
+
+	// RetryRun is the scheduled time of a run failing transiently, which is tried again at NextRun
+	RetryRun time.Time `json:"retry_run,omitempty"`
+
+	// Attempts is the number of failed attempts of RetryRun
+	Attempts int `json:"attempts,omitempty"`
+
+	// LastRun is the scheduled time of the last run
+	LastRun time.Time `json:"last_run,omitempty"`
+
+	// Runs is the number of runs made
+	Runs int `json:"runs"`
+
+	// LastError describes why the last run failed
+	LastError string `json:"last_error,omitempty"`
+
+	// LastResult describes the message sent by the last run, when no outbox is configured
+	LastResult *SendResult `json:"last_result,omitempty"`
+
+	// LastOutboxID is the outbox entry the last run was queued as, when an outbox is configured
+	LastOutboxID string `json:"last_outbox_id,omitempty"`
+
+	// Deleted marks a deleted job in the journal
+	Deleted bool `json:"deleted,omitempty"`
+
+	// schedule and location are parsed from Schedule and Timezone
+	schedule *cronSchedule
+	location *time.Location
+}
+
+// jobRun is the data job templates are rendered with.
+type jobRun struct {
+	// Name is the name of the job
+	Name string
+
+	// Time is the scheduled time of the run, in the time zone of the job
+	Time time.Time
+
+	// Date is Time formatted as 2006-01-02
+	Date string
+}
+
+// CronScheduler runs recurring jobs on cron schedules. Jobs come from the config file
+// or the job tools; their definitions and state are appended to a journal in the schedule
+// directory, so they survive restarts and runs missed during downtime can be caught up.
+type CronScheduler struct {
+	bots     *BotRegistry
+	outbox   *Outbox
+	location *time.Location
+	clock    clock
+
+	// mu guards jobs and the journal
+	mu      sync.Mutex
+	jobs    map[string]*Job
+	journal journal
+
+	// wake interrupts the worker wait when the jobs change
+	wake chan struct{}
+}
+
+// OpenCronScheduler opens the jobs stored in dir, creating it when needed, and merges them with the config jobs.
+// Config jobs keep their state, such as being paused, across restarts; jobs removed from the config are dropped.
+// Parameters:
+//   - dir: The directory holding the journal
+//   - bots: The bots messages are sent with, looked up by name at every run
+//   - outbox: The outbox messages are queued in, nil to send them right away
+//   - location: The default time zone of the schedules
+//   - configJobs: The jobs defined in the config file
+// Returns:
+//   - The scheduler, whose worker must be started with Run
+//   - An error if a config job is invalid or the directory or journal cannot be used
+func OpenCronScheduler(dir string, bots *BotRegistry, outbox *Outbox, location *time.Location, configJobs []JobConfig) (*CronScheduler, error) {
+	return openCronScheduler(dir, bots, outbox, location, configJobs, realClock{})
+}
+
+// openCronScheduler is OpenCronScheduler with a clock, replaced in tests.
+func openCronScheduler(dir string, bots *BotRegistry, outbox *Outbox, location *time.Location, configJobs []JobConfig, clk clock) (*CronScheduler, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create schedule directory: %v", err)
+	}
+
+	c := &CronScheduler{
+		bots:     bots,
+		outbox:   outbox,
+		location: location,
+		clock:    clk,
+		jobs:     make(map[string]*Job),
+		journal:  journal{path: filepath.Join(dir, jobsJournalName), what: "jobs journal"},
+		wake:     make(chan struct{}, 1),
+	}
+
+	persisted := make(map[string]*Job)
+	err := replayJournal(c.journal.path, c.journal.what, func(job *Job) {
+		if job.Deleted {
+			delete(persisted, job.Name)
+		} else {
+			persisted[job.Name] = job
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := c.clock.Now()
+	for _, cfg := range configJobs {
+		if _, ok := c.jobs[cfg.Name]; ok {
+			return nil, fmt.Errorf("job %s is defined twice in the config file", cfg.Name)
+		}
+
+		job, err := c.newJob(cfg, JobSourceConfig)
+		if err != nil {
+			return nil, err
+		}
+		job.CreatedAt = now
+		job.UpdatedAt = now
+
+		// Keep the state of the job, and its next run unless the schedule changed
+		if previous, ok := persisted[cfg.Name]; ok && previous.Source == JobSourceConfig {
+			job.Paused = previous.Paused
+			job.CreatedAt = previous.CreatedAt
+			job.LastRun = previous.LastRun
+			job.Runs = previous.Runs
+			job.LastError = previous.LastError
+			job.LastResult = previous.LastResult
+			job.LastOutboxID = previous.LastOutboxID
+			if previous.Schedule == cfg.Schedule && previous.Timezone == cfg.Timezone {
+				job.NextRun = previous.NextRun
+				job.RetryRun = previous.RetryRun
+				job.Attempts = previous.Attempts
+			}
+		}
+		c.jobs[job.Name] = job
+	}
+
+	for name, job := range persisted {
+		if job.Source != JobSourceTool {
+			continue
+		}
+		if _, ok := c.jobs[name]; ok {
+			log.Printf("Ignoring job %s created with create_job, the config file defines a job with the same name\n", name)
+			continue
+		}
+		if job.schedule, job.location, err = c.parseSchedule(job.JobConfig); err != nil {
+			log.Printf("Ignoring job %s: %v\n", name, err)
+			continue
+		}
+		c.jobs[name] = job
+	}
+
+	for _, job := range c.jobs {
+		if !job.Paused && job.NextRun.IsZero() {
+			job.NextRun = job.schedule.next(now.In(job.location))
+		}
+	}
+
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Close closes the journal. The worker must be stopped first.
+func (c *CronScheduler) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.journal.close()
+}
+
+// Location returns the default time zone of the schedules.
+func (c *CronScheduler) Location() *time.Location {
+	return c.location
+}
+
+// parseSchedule parses the schedule and time zone of a job.
+func (c *CronScheduler) parseSchedule(cfg JobConfig) (*cronSchedule, *time.Location, error) {
+	schedule, err := parseCron(cfg.Schedule)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	location := c.location
+	if cfg.Timezone != "" {
+		if location, err = time.LoadLocation(cfg.Timezone); err != nil {
+			return nil, nil, fmt.Errorf("invalid timezone %q: %v", cfg.Timezone, err)
+		}
+	}
+
+	return schedule, location, nil
+}
+
+// newJob validates a job definition: its schedule, time zone, catch-up policy, bot and template.
+func (c *CronScheduler) newJob(cfg JobConfig, source string) (*Job, error) {
+	if strings.TrimSpace(cfg.Name) == "" {
+		return nil, fmt.Errorf("job name cannot be empty")
+	}
+
+	switch cfg.CatchUp {
+	case "":
+		cfg.CatchUp = CatchUpSkip
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return nil, fmt.Errorf("job %s: invalid catch_up %q, expected %s, %s or %s", cfg.Name, cfg.CatchUp, CatchUpSkip, CatchUpOnce, CatchUpAll)
+	}
+
+	job := &Job{JobConfig: cfg, Source: source}
+
+	var err error
+	if job.schedule, job.location, err = c.parseSchedule(cfg); err != nil {
+		return nil, fmt.Errorf("job %s: %v", cfg.Name, err)
+	}
+
+	now := c.clock.Now().In(job.location)
+	if job.schedule.next(now).IsZero() {
+		return nil, fmt.Errorf("job %s: schedule %q never matches", cfg.Name, cfg.Schedule)
+	}
+	if _, err := c.bots.Get(cfg.Bot); err != nil {
+		return nil, fmt.Errorf("job %s: %v", cfg.Name, err)
+	}
+	if _, err := job.message(now); err != nil {
+		return nil, fmt.Errorf("job %s: invalid message: %v", cfg.Name, err)
+	}
+
+	return job, nil
+}
+
+// message renders the template of the job for a run at the given time and builds the message.
+func (j *Job) message(at time.Time) (Message, error) {
+	at = at.In(j.location)
+	fields, err := renderTemplate(j.Template, jobRun{Name: j.Name, Time: at, Date: at.Format("2006-01-02")})
+	if err != nil {
+		return nil, err
+	}
+
+	arguments, _ := fields.(map[string]interface{})
+	return messageFromArguments(j.MsgType, arguments)
+}
+
+// renderTemplate renders the strings found in a decoded JSON value as Go templates.
+func renderTemplate(value interface{}, data jobRun) (interface{}, error) {
+	switch v := value.(type) {
+	case string:
+		tmpl, err := template.New("").Option("missingkey=error").Parse(v)
+		if err != nil {
+			return nil, err
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, data); err != nil {
+			return nil, err
+		}
+		return b.String(), nil
+
+	case []interface{}:
+		rendered := make([]interface{}, len(v))
+		for i, item := range v {
+			var err error
+			if rendered[i], err = renderTemplate(item, data); err != nil {
+				return nil, err
+			}
+		}
+		return rendered, nil
+
+	case map[string]interface{}:
+		rendered := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			var err error
+			if rendered[key], err = renderTemplate(item, data); err != nil {
+				return nil, fmt.Errorf("%s: %v", key, err)
+			}
+		}
+		return rendered, nil
+
+	default:
+		return v, nil
+	}
+}
+
+// dueRuns returns the scheduled times of the runs to make for a job due at now, following its catch-up policy,
+// and the number of scheduled runs that are skipped.
+func (j *Job) dueRuns(now time.Time) ([]time.Time, int) {
+	var missed []time.Time
+	var onTime time.Time
+	scheduled := 0
+	for at := j.NextRun; !at.IsZero() && !at.After(now); at = j.schedule.next(at.In(j.location)) {
+		scheduled++
+		if now.Sub(at) <= missedRunGrace {
+			onTime = at
+			continue
+		}
+
+		missed = append(missed, at)
+		if len(missed) > maxCatchUpRuns {
+			missed = missed[1:]
+		}
+	}
+
+	var runs []time.Time
+	switch j.CatchUp {
+	case CatchUpAll:
+		runs = missed
+	case CatchUpOnce:
+		if len(missed) > 0 && onTime.IsZero() {
+			runs = missed[len(missed)-1:]
+		}
+	}
+	if !onTime.IsZero() {
+		runs = append(runs, onTime)
+	}
+
+	return runs, scheduled - len(runs)
+}
+
+// retryDeadline returns until when a run failing transiently is retried: its next scheduled run,
+// at most scheduleRetryWindow after its time.
+func (j *Job) retryDeadline(at time.Time) time.Time {
+	deadline := at.Add(scheduleRetryWindow)
+	if next := j.schedule.next(at.In(j.location)); next.Before(deadline) {
+		deadline = next
+	}
+	return deadline
+}
+
+// CreateJob adds a job created through the job tools.
+// Returns a copy of the job, or an error if it is invalid, its name is taken or it cannot be journaled.
+func (c *CronScheduler) CreateJob(cfg JobConfig) (*Job, error) {
+	job, err := c.newJob(cfg, JobSourceTool)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.jobs[job.Name]; ok {
+		return nil, fmt.Errorf("job %s already exists", job.Name)
+	}
+
+	now := c.clock.Now()
+	job.CreatedAt = now
+	job.UpdatedAt = now
+	job.NextRun = job.schedule.next(now.In(job.location))
+	if err := c.update(job); err != nil {
+		return nil, err
+	}
+
+	copied := *job
+	return &copied, nil
+}
+
+// DeleteJob removes a job created through the job tools. Config jobs can only be paused.
+func (c *CronScheduler) DeleteJob(name string) (*Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	job, ok := c.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("job %s not found", name)
+	}
+	if job.Source == JobSourceConfig {
+		return nil, fmt.Errorf("job %s is defined in the config file, remove it there or pause it", name)
+	}
+
+	if err := c.journal.append(&Job{JobConfig: JobConfig{Name: name}, Deleted: true, UpdatedAt: c.clock.Now()}); err != nil {
+		return nil, err
+	}
+	delete(c.jobs, name)
+	c.compactIfNeeded()
+
+	copied := *job
+	return &copied, nil
+}
+
+// SetPaused pauses or resumes a job. A resumed job runs at its next scheduled time,
+// the runs missed while it was paused are not caught up.
+func (c *CronScheduler) SetPaused(name string, paused bool) (*Job, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	job, ok := c.jobs[name]
+	if !ok {
+		return nil, fmt.Errorf("job %s not found", name)
+	}
+
+	updated := *job
+	updated.Paused = paused
+	updated.UpdatedAt = c.clock.Now()
+	updated.NextRun = time.Time{}
+	updated.RetryRun = time.Time{}
+	updated.Attempts = 0
+	if !paused {
+		updated.NextRun = updated.schedule.next(updated.UpdatedAt.In(updated.location))
+	}
+	if err := c.update(&updated); err != nil {
+		return nil, err
+	}
+
+	copied := updated
+	return &copied, nil
+}
+
+// List returns copies of the jobs sorted by name.
+func (c *CronScheduler) List() []Job {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	jobs := make([]Job, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		jobs = append(jobs, *job)
+	}
+
+	sort.Slice(jobs, func(i, j int) bool {
+		return jobs[i].Name < jobs[j].Name
+	})
+
+	return jobs
+}
+
+// Run runs due jobs until ctx is done. Runs interrupted by ctx are made again on the next start.
+func (c *CronScheduler) Run(ctx context.Context) {
+	for {
+		wait := cronIdleWait
+		if next := c.runDue(ctx); !next.IsZero() {
+			wait = min(max(next.Sub(c.clock.Now()), 0), cronIdleWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-c.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// runDue runs every due job and returns when the next job is due, zero when no job is active.
+func (c *CronScheduler) runDue(ctx context.Context) time.Time {
+	now := c.clock.Now()
+	for _, job := range c.List() {
+		if ctx.Err() != nil {
+			break
+		}
+		if !job.Paused && !job.NextRun.IsZero() && !job.NextRun.After(now) {
+			c.run(ctx, job, now)
+		}
+	}
+
+	var next time.Time
+	for _, job := range c.List() {
+		if !job.NextRun.IsZero() && (next.IsZero() || job.NextRun.Before(next)) {
+			next = job.NextRun
+		}
+	}
+
+	return next
+}
+
+// run makes the due runs of a copy of a job and records the outcome.
+// Each run is sent with an idempotency key derived from the job name and the run time,
+// so that a run is not sent twice when it is retried. Without an outbox, a last run failing
+// transiently is retried until the next scheduled run, at most scheduleRetryWindow after its time.
+func (c *CronScheduler) run(ctx context.Context, job Job, now time.Time) {
+	due := job
+	if !job.RetryRun.IsZero() {
+		// NextRun is the retry, the schedule resumes after the retried run
+		due.NextRun = job.schedule.next(job.RetryRun.In(job.location))
+	}
+	runs, skipped := due.dueRuns(now)
+	if !job.RetryRun.IsZero() {
+		if now.Before(job.retryDeadline(job.RetryRun)) {
+			runs = append([]time.Time{job.RetryRun}, runs...)
+		} else {
+			log.Printf("Job %s gives up the run at %s, its retry window has passed\n", job.Name, job.RetryRun.Format(time.RFC3339))
+		}
+	}
+	if skipped > 0 {
+		log.Printf("Job %s skips %d runs missed while the server was down\n", job.Name, skipped)
+	}
+
+	updated := job
+	updated.RetryRun = time.Time{}
+	updated.Attempts = 0
+	updated.NextRun = job.schedule.next(now.In(job.location))
+	for i, at := range runs {
+		msg, err := job.message(at)
+		var result *SendResult
+		var entry *OutboxEntry
+		if err == nil {
+			key := fmt.Sprintf("job:%s:%s", job.Name, at.UTC().Format(time.RFC3339))
+			result, entry, err = sendOrQueue(ctx, c.bots, c.outbox, job.Bot, key, msg)
+		}
+		if err != nil && ctx.Err() != nil {
+			// Interrupted by shutdown, the job is left as it was
+			return
+		}
+
+		if !at.Equal(job.RetryRun) {
+			updated.Runs++
+		}
+		updated.LastRun = at
+		updated.LastResult = result
+		updated.LastOutboxID = ""
+		if entry != nil {
+			updated.LastOutboxID = entry.ID
+		}
+		updated.LastError = ""
+		if err == nil {
+			continue
+		}
+
+		updated.LastError = err.Error()
+		attempts := 1
+		if at.Equal(job.RetryRun) {
+			attempts = job.Attempts + 1
+		}
+		retryAt := now.Add(scheduleRetryPolicy.backoff(attempts))
+		if i == len(runs)-1 && transient(err) && retryAt.Before(job.retryDeadline(at)) {
+			updated.RetryRun = at
+			updated.Attempts = attempts
+			updated.NextRun = retryAt
+			log.Printf("Job %s run at %s failed, retrying at %s: %v\n", job.Name, at.Format(time.RFC3339), retryAt.Format(time.RFC3339), err)
+		} else {
+			log.Printf("Job %s run at %s failed: %v\n", job.Name, at.Format(time.RFC3339), err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// The job may have been deleted, paused or resumed during the runs
+	current, ok := c.jobs[job.Name]
+	if !ok || !current.UpdatedAt.Equal(job.UpdatedAt) {
+		return
+	}
+
+	updated.UpdatedAt = c.clock.Now()
+	if err := c.update(&updated); err != nil {
+		log.Printf("Failed to journal job %s: %v\n", job.Name, err)
+	}
+}
+
+// update journals a job and makes it current. The caller must hold mu.
+func (c *CronScheduler) update(job *Job) error {
+	if err := c.journal.append(job); err != nil {
+		return err
+	}
+	c.jobs[job.Name] = job
+	c.compactIfNeeded()
+	c.notify()
+
+	return nil
+}
+
+// notify wakes the worker up without blocking.
+func (c *CronScheduler) notify() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+// compactIfNeeded compacts the journal once it holds much more records than jobs. The caller must hold mu.
+func (c *CronScheduler) compactIfNeeded() {
+	if !c.journal.needsRewrite(len(c.jobs)) {
+		return
+	}
+	if err := c.compact(); err != nil {
+		log.Printf("Failed to compact the jobs journal: %v\n", err)
+	}
+}
+
+// compact rewrites the journal with one record per job. The caller must hold mu or own c.
+func (c *CronScheduler) compact() error {
+	records := make([]interface{}, 0, len(c.jobs))
+	for _, job := range c.jobs {
+		records = append(records, job)
+	}
+
+	return c.journal.rewrite(records)
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newTestCron opens a cron scheduler in dir with a fake clock, evaluating schedules in Asia/Shanghai by default.
+func newTestCron(t *testing.T, dir string, bots *BotRegistry, configJobs []JobConfig) (*CronScheduler, *fakeClock) {
+	location, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+
+	clk := newFakeClock()
+	cron, err := openCronScheduler(dir, bots, nil, location, configJobs, clk)
+	if err != nil {
+		t.Fatalf("OpenCronScheduler failed: %v", err)
+	}
+	t.Cleanup(func() { cron.Close() })
+
+	return cron, clk
+}
+
+// hourlyJob returns a tool job sending the time of its run every hour.
+func hourlyJob(name string, catchUp string) JobConfig {
+	return JobConfig{
+		Name:     name,
+		Schedule: "@hourly",
+		Timezone: "UTC",
+		MsgType:  "text",
+		Template: map[string]interface{}{"content": `Run at {{.Time.Format "15:04"}}`},
+		CatchUp:  catchUp,
+	}
+}
+
+// TestCronJobRuns tests that a job renders its template and sends it at its scheduled times.
+func TestCronJobRuns(t *testing.T) {
+	bots, sender := newDryRunBots(t)
+	cron, clk := newTestCron(t, t.TempDir(), bots, nil)
+
+	job, err := cron.CreateJob(JobConfig{
+		Name:     "standup",
+		Schedule: "0 18 * * *",
+		MsgType:  "markdown",
+		Template: map[string]interface{}{
+			"title":   "Standup {{.Date}}",
+			"content": `{{.Name}} at {{.Time.Format "15:04"}}`,
+		},
+	})
+	if err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	if expected := time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC); !job.NextRun.Equal(expected) || job.CatchUp != CatchUpSkip {
+		t.Fatalf("unexpected job: %+v", job)
+	}
+
+	if next := cron.runDue(context.Background()); !next.Equal(job.NextRun) || len(sender.Records()) != 0 {
+		t.Fatalf("nothing should be sent yet, next run at %v", next)
+	}
+
+	clk.Advance(time.Hour)
+	next := cron.runDue(context.Background())
+	records := sender.Records()
+	if len(records) != 1 || !strings.Contains(records[0].Body, "Standup 2024-01-01") || !strings.Contains(records[0].Body, "standup at 18:00") {
+		t.Fatalf("unexpected requests: %+v", records)
+	}
+	if !next.Equal(job.NextRun.AddDate(0, 0, 1)) {
+		t.Errorf("expected the next run on the next day, got %v", next)
+	}
+
+	jobs := cron.List()
+	if len(jobs) != 1 || jobs[0].Runs != 1 || !jobs[0].LastRun.Equal(job.NextRun) || jobs[0].LastResult == nil {
+		t.Errorf("unexpected job state: %+v", jobs)
+	}
+
+	invalid := []struct {
+		cfg      JobConfig
+		expected string
+	}{
+		{JobConfig{Name: "standup", Schedule: "@daily", MsgType: "text", Template: map[string]interface{}{"content": "hi"}}, "already exists"},
+		{JobConfig{Name: " ", Schedule: "@daily", MsgType: "text"}, "name cannot be empty"},
+		{JobConfig{Name: "bad", Schedule: "every day", MsgType: "text"}, "invalid cron expression"},
+		{JobConfig{Name: "bad", Schedule: "0 0 30 2 *", MsgType: "text"}, "never matches"},
+		{JobConfig{Name: "bad", Schedule: "@daily", Timezone: "Mars/Olympus", MsgType: "text"}, "invalid timezone"},
+		{JobConfig{Name: "bad", Schedule: "@daily", CatchUp: "sometimes", MsgType: "text"}, "invalid catch_up"},
+		{JobConfig{Name: "bad", Schedule: "@daily", Bot: "release", MsgType: "text"}, "release"},
+		{JobConfig{Name: "bad", Schedule: "@daily", MsgType: "text", Template: map[string]interface{}{"content": "{{.Missing}}"}}, "invalid message"},
+		{JobConfig{Name: "bad", Schedule: "@daily", MsgType: "text"}, "invalid message"},
+	}
+	for _, tt := range invalid {
+		if _, err := cron.CreateJob(tt.cfg); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%+v: expected %q, got %v", tt.cfg, tt.expected, err)
+		}
+	}
+}
+
+// TestCronJobCatchUp tests the catch-up policies for runs missed while the server was down.
+func TestCronJobCatchUp(t *testing.T) {
+	tests := []struct {
+		catchUp  string
+		expected []string
+	}{
+		{CatchUpSkip, nil},
+		{CatchUpOnce, []string{"14:00"}},
+		{CatchUpAll, []string{"10:00", "11:00", "12:00", "13:00", "14:00"}},
+	}
+
+	for _, tt := range tests {
+		bots, sender := newDryRunBots(t)
+		dir := t.TempDir()
+		cron, _ := newTestCron(t, dir, bots, nil)
+		if _, err := cron.CreateJob(hourlyJob("ping", tt.catchUp)); err != nil {
+			t.Fatalf("CreateJob failed: %v", err)
+		}
+		cron.Close()
+
+		// The server comes back at 14:30, the runs from 10:00 to 14:00 were missed
+		reopened, clk := newTestCron(t, dir, bots, nil)
+		clk.Advance(5*time.Hour + 30*time.Minute)
+		next := reopened.runDue(context.Background())
+
+		records := sender.Records()
+		if len(records) != len(tt.expected) {
+			t.Errorf("%s: expected %d runs, got %d", tt.catchUp, len(tt.expected), len(records))
+			continue
+		}
+		for i, run := range tt.expected {
+			if !strings.Contains(records[i].Body, "Run at "+run) {
+				t.Errorf("%s: expected the run at %s, got %s", tt.catchUp, run, records[i].Body)
+			}
+		}
+		if !next.Equal(time.Date(2024, 1, 1, 15, 0, 0, 0, time.UTC)) {
+			t.Errorf("%s: expected the next run at 15:00, got %v", tt.catchUp, next)
+		}
+	}
+}
+
+// TestCronJobRetry tests that a run failing transiently is retried before the next scheduled run.
+func TestCronJobRetry(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	cron, clk := newTestCron(t, t.TempDir(), bots, nil)
+	if _, err := cron.CreateJob(hourlyJob("ping", CatchUpSkip)); err != nil {
+		t.Fatalf("CreateJob failed: %v", err)
+	}
+	ctx := context.Background()
+
+	clk.Advance(time.Hour)
+	next := cron.runDue(ctx)
+	job := cron.List()[0]
+	if job.RetryRun.IsZero() || job.Attempts != 1 || job.LastError == "" || !next.Equal(job.NextRun) || next.Sub(clk.Now()) > time.Minute {
+		t.Fatalf("expected the run to be retried, got %+v", job)
+	}
+
+	clk.Advance(next.Sub(clk.Now()))
+	next = cron.runDue(ctx)
+	job = cron.List()[0]
+	if calls != 2 || job.Runs != 1 || job.LastError != "" || !job.RetryRun.IsZero() || !job.LastRun.Equal(time.Date(2024, 1, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the retry to send the run, got %+v after %d calls", job, calls)
+	}
+	if !next.Equal(time.Date(2024, 1, 1, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the next run at 11:00, got %v", next)
+	}
+}
+
+// TestCronJobRetryAfterRestart tests that a retry pending over a restart is given up once its window
+// has passed, and that the runs missed meanwhile follow the catch-up policy.
+func TestCronJobRetryAfterRestart(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	dir := t.TempDir()
+	cron, clk := newTestCron(t, dir, bots, nil)
+	cron.CreateJob(hourlyJob("ping", CatchUpAll))
+
+	clk.Advance(time.Hour)
+	cron.runDue(context.Background())
+	if job := cron.List()[0]; job.RetryRun.IsZero() {
+		t.Fatalf("expected the run to be retried, got %+v", job)
+	}
+	cron.Close()
+
+	// The server is down until 12:30, after the runs of 11:00 and 12:00
+	clk.Advance(150 * time.Minute)
+	reopened, err := openCronScheduler(dir, bots, nil, time.UTC, nil, clk)
+	if err != nil {
+		t.Fatalf("openCronScheduler failed: %v", err)
+	}
+	defer reopened.Close()
+
+	next := reopened.runDue(context.Background())
+	job := reopened.List()[0]
+	if calls != 3 || job.Runs != 3 || !job.RetryRun.IsZero() || job.LastError != "" || !job.LastRun.Equal(time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the missed runs to be made instead of the stale retry, got %+v after %d calls", job, calls)
+	}
+	if !next.Equal(time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the next run at 13:00, got %v", next)
+	}
+}
+
+// TestCronJobPause tests that paused jobs do not run and do not catch up when resumed.
+func TestCronJobPause(t *testing.T) {
+	bots, sender := newDryRunBots(t)
+	cron, clk := newTestCron(t, t.TempDir(), bots, nil)
+	cron.CreateJob(hourlyJob("ping", CatchUpAll))
+
+	paused, err := cron.SetPaused("ping", true)
+	if err != nil || !paused.Paused || !paused.NextRun.IsZero() {
+		t.Fatalf("unexpected paused job: %+v (%v)", paused, err)
+	}
+
+	clk.Advance(3 * time.Hour)
+	if next := cron.runDue(context.Background()); !next.IsZero() || len(sender.Records()) != 0 {
+		t.Errorf("a paused job should not run, next run at %v", next)
+	}
+
+	resumed, err := cron.SetPaused("ping", false)
+	if err != nil || resumed.Paused || !resumed.NextRun.Equal(time.Date(2024, 1, 1, 13, 0, 0, 0, time.UTC)) {
+		t.Fatalf("unexpected resumed job: %+v (%v)", resumed, err)
+	}
+	cron.runDue(context.Background())
+	if len(sender.Records()) != 0 {
+		t.Errorf("runs missed while paused should not be made")
+	}
+
+	if _, err := cron.SetPaused("unknown", true); err == nil {
+		t.Errorf("expected an error for an unknown job")
+	}
+}
+
+// TestCronConfigJobs tests that config jobs cannot be deleted and keep their state across restarts.
+func TestCronConfigJobs(t *testing.T) {
+	bots, _ := newDryRunBots(t)
+	dir := t.TempDir()
+	report := JobConfig{
+		Name:     "report",
+		Schedule: "0 9 * * mon",
+		MsgType:  "text",
+		Template: map[string]interface{}{"content": "Weekly report"},
+	}
+
+	cron, _ := newTestCron(t, dir, bots, []JobConfig{report})
+	if _, err := cron.DeleteJob("report"); err == nil || !strings.Contains(err.Error(), "config file") {
+		t.Errorf("config jobs should not be deleted, got %v", err)
+	}
+	cron.SetPaused("report", true)
+	cron.CreateJob(hourlyJob("ping", ""))
+	cron.CreateJob(hourlyJob("deleted", ""))
+	if _, err := cron.DeleteJob("deleted"); err != nil {
+		t.Fatalf("DeleteJob failed: %v", err)
+	}
+	cron.Close()
+
+	reopened, _ := newTestCron(t, dir, bots, []JobConfig{report})
+	jobs := reopened.List()
+	if len(jobs) != 2 || jobs[0].Name != "ping" || jobs[0].Source != JobSourceTool || jobs[1].Name != "report" || !jobs[1].Paused {
+		t.Fatalf("unexpected jobs after restart: %+v", jobs)
+	}
+	reopened.Close()
+
+	// A config job takes over a tool job with the same name, removed config jobs are dropped
+	ping := hourlyJob("ping", "")
+	ping.Schedule = "@daily"
+	reopened, _ = newTestCron(t, dir, bots, []JobConfig{ping})
+	jobs = reopened.List()
+	if len(jobs) != 1 || jobs[0].Source != JobSourceConfig || jobs[0].Schedule != "@daily" {
+		t.Errorf("unexpected jobs after the config changed: %+v", jobs)
+	}
+	reopened.Close()
+
+	location, _ := time.LoadLocation("Asia/Shanghai")
+	if _, err := OpenCronScheduler(t.TempDir(), bots, nil, location, []JobConfig{ping, ping}); err == nil || !strings.Contains(err.Error(), "defined twice") {
+		t.Errorf("expected duplicated config jobs to be rejected, got %v", err)
+	}
+}
+
+// TestJobTools tests managing jobs with the job tools.
+func TestJobTools(t *testing.T) {
+	bots, _ := newDryRunBots(t)
+	cron, _ := newTestCron(t, t.TempDir(), bots, nil)
+	ctx := context.Background()
+
+	result, _ := createJobHandler(cron)(ctx, newToolRequest("create_job", map[string]interface{}{
+		"name":       "standup",
+		"schedule":   "30 9 * * 1-5",
+		"msg_type":   "text",
+		"content":    "Standup {{.Date}}",
+		"at_mobiles": []interface{}{"13800138000"},
+	}))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "next run at 2024-01-02T09:30:00+08:00") {
+		t.Fatalf("unexpected result: %q", text)
+	}
+	var created []Job
+	resultJSON(t, result, &created)
+	if len(created) != 1 || created[0].Template["content"] != "Standup {{.Date}}" || created[0].Template["at_mobiles"] == nil {
+		t.Errorf("expected the message fields to be stored as the template, got %+v", created)
+	}
+
+	result, _ = createJobHandler(cron)(ctx, newToolRequest("create_job", map[string]interface{}{
+		"name": "broken", "schedule": "@daily", "msg_type": "text",
+	}))
+	if !result.IsError {
+		t.Errorf("a job without content should be rejected")
+	}
+
+	result, _ = setJobPausedHandler(cron, true)(ctx, newToolRequest("pause_job", map[string]interface{}{"name": "standup"}))
+	if result.IsError || !cron.List()[0].Paused {
+		t.Errorf("pause_job failed: %+v", result.Content)
+	}
+
+	result, _ = listJobsHandler(cron)(ctx, newToolRequest("list_jobs", nil))
+	if text := result.Content[0].(mcp.TextContent).Text; !strings.Contains(text, "standup: text message on \"30 9 * * 1-5\", paused") {
+		t.Errorf("unexpected list: %q", text)
+	}
+
+	result, _ = setJobPausedHandler(cron, false)(ctx, newToolRequest("resume_job", map[string]interface{}{"name": "standup"}))
+	if result.IsError || cron.List()[0].Paused {
+		t.Errorf("resume_job failed: %+v", result.Content)
+	}
+
+	result, _ = deleteJobHandler(cron)(ctx, newToolRequest("delete_job", map[string]interface{}{"name": "standup"}))
+	if result.IsError || len(cron.List()) != 0 {
+		t.Errorf("delete_job failed: %+v", result.Content)
+	}
+	result, _ = deleteJobHandler(cron)(ctx, newToolRequest("delete_job", map[string]interface{}{"name": "standup"}))
+	if !result.IsError {
+		t.Errorf("deleting an unknown job should fail")
+	}
+}
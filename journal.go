@@ -0,0 +1,119 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// journal is an append-only file of JSON records, one per line, synced to disk on every write.
+// Its owner replays it on startup and rewrites it from its current state once it holds
+// much more records than live entries.
+type journal struct {
+	// path is the location of the journal file
+	path string
+
+	// what names the journal in errors, such as "outbox journal"
+	what string
+
+	file    *os.File
+	records int
+}
+
+// replayJournal decodes the records of the journal at path in order and passes them to apply.
+// A missing journal has no records. A truncated last record, left by a crash during a write, is ignored.
+func replayJournal[T any](path string, what string, apply func(record *T)) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", what, err)
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var record T
+		if err := decoder.Decode(&record); err != nil {
+			if err != io.EOF {
+				log.Printf("Ignoring the end of the %s: %v\n", what, err)
+			}
+			return nil
+		}
+
+		apply(&record)
+	}
+}
+
+// append writes a record at the end of the journal and syncs it to disk.
+func (j *journal) append(record interface{}) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s record: %v", j.what, err)
+	}
+
+	if _, err := j.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write %s: %v", j.what, err)
+	}
+	if err := j.file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %v", j.what, err)
+	}
+
+	j.records++
+	return nil
+}
+
+// needsRewrite reports whether the journal holds much more records than the given number of live entries.
+func (j *journal) needsRewrite(live int) bool {
+	return j.records > 2*live+100
+}
+
+// rewrite atomically replaces the journal with the given records and reopens it for appending.
+func (j *journal) rewrite(records []interface{}) error {
+	tmp, err := os.OpenFile(j.path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to compact %s: %v", j.what, err)
+	}
+
+	encoder := json.NewEncoder(tmp)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to compact %s: %v", j.what, err)
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to compact %s: %v", j.what, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to compact %s: %v", j.what, err)
+	}
+	if err := os.Rename(j.path+".tmp", j.path); err != nil {
+		return fmt.Errorf("failed to compact %s: %v", j.what, err)
+	}
+
+	file, err := os.OpenFile(j.path, os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", j.what, err)
+	}
+	if j.file != nil {
+		j.file.Close()
+	}
+	j.file = file
+	j.records = len(records)
+
+	return nil
+}
+
+// close closes the journal file.
+func (j *journal) close() error {
+	if j.file == nil {
+		return nil
+	}
+	return j.file.Close()
+}
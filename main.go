@@ -2,26 +2,308 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+	_ "time/tzdata"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
 )
 
 func main() {
+	sendMode := flag.String("send-mode", os.Getenv("DINGDING_BOT_SEND_MODE"), "How requests are delivered: http, dry-run or file")
+	configPath := flag.String("config", os.Getenv("DINGDING_BOT_CONFIG"), "Path to a JSON config file listing named bots")
+	captureFile := flag.String("capture-file", os.Getenv("DINGDING_BOT_CAPTURE_FILE"), "File that requests are appended to in file send mode")
+	retryMaxAttempts := flag.Int("retry-max-attempts", envInt("DINGDING_BOT_RETRY_MAX_ATTEMPTS", DefaultRetryPolicy.MaxAttempts), "Total attempts per request including retries, 1 disables retries")
+	retryBaseDelay := flag.Duration("retry-base-delay", envDuration("DINGDING_BOT_RETRY_BASE_DELAY", DefaultRetryPolicy.BaseDelay), "Delay before the first retry, doubled for every further retry")
+	retryMaxDelay := flag.Duration("retry-max-delay", envDuration("DINGDING_BOT_RETRY_MAX_DELAY", DefaultRetryPolicy.MaxDelay), "Maximum delay between two attempts")
+	rateLimit := flag.Int("rate-limit", envInt("DINGDING_BOT_RATE_LIMIT", DefaultRateLimit.PerMinute), "Messages allowed per minute and bot, 0 disables the rate limiter")
+	rateLimitMaxWait := flag.Duration("rate-limit-max-wait", envDuration("DINGDING_BOT_RATE_LIMIT_MAX_WAIT", 0), "How long a message may wait for rate limit budget before it is rejected")
+	transport := flag.String("transport", envString("DINGDING_BOT_TRANSPORT", TransportStdio), "How clients connect: stdio, sse or http")
+	listenAddr := flag.String("listen", envString("DINGDING_BOT_LISTEN_ADDR", DefaultListenAddr), "Listen address of the sse and http transports")
+	authToken := flag.String("auth-token", os.Getenv("DINGDING_BOT_AUTH_TOKEN"), "Bearer token required by the sse and http transports")
+	allowPrivateURLs := flag.Bool("allow-private-image-urls", envBool("DINGDING_BOT_ALLOW_PRIVATE_IMAGE_URLS", false), "Let image_url download from loopback, private and link-local addresses, such as an intranet image server")
+	fileDir := flag.String("file-dir", os.Getenv("DINGDING_BOT_FILE_DIR"), "Directory the file_path arguments are confined to, file_path is disabled on the sse and http transports when empty")
+	idempotencyTTL := flag.Duration("idempotency-ttl", envDuration("DINGDING_BOT_IDEMPOTENCY_TTL", DefaultIdempotency.TTL), "How long idempotency keys are remembered, 0 disables deduplication")
+	dedupContent := flag.Bool("dedup-content", envBool("DINGDING_BOT_DEDUP_CONTENT", DefaultIdempotency.ContentDedup), "Deduplicate identical messages sent without an idempotency key")
+	scheduleDir := flag.String("schedule-dir", os.Getenv("DINGDING_BOT_SCHEDULE_DIR"), "Directory of the schedule journal, enables send_at and the schedule tools when set")
+	timezone := flag.String("timezone", envString("DINGDING_BOT_TIMEZONE", "UTC"), "IANA time zone of send times given without a UTC offset, such as Asia/Shanghai")
+	breakerFailures := flag.Int("breaker-failures", envInt("DINGDING_BOT_BREAKER_FAILURES", DefaultBreakerPolicy.Failures), "Consecutive failed requests opening the circuit breaker of a bot, 0 disables the breaker")
+	breakerCooldown := flag.Duration("breaker-cooldown", envDuration("DINGDING_BOT_BREAKER_COOLDOWN", time.Duration(DefaultBreakerPolicy.Cooldown)), "How long an open circuit fails requests fast before a probe request is let through")
+	digestWindow := flag.Duration("digest-window", envDuration("DINGDING_BOT_DIGEST_WINDOW", time.Duration(DefaultDigestPolicy.Window)), "How long text and markdown messages are collected into one digest per bot and group_key, 0 disables aggregation")
+	digestMaxItems := flag.Int("digest-max-items", envInt("DINGDING_BOT_DIGEST_MAX_ITEMS", DefaultDigestPolicy.MaxItems), "Number of distinct messages listed in a digest")
+	digestFlushSeverity := flag.String("digest-flush-severity", envString("DINGDING_BOT_DIGEST_FLUSH_SEVERITY", DefaultDigestPolicy.FlushSeverity), "Severity from which messages bypass the digest and flush it: info, warning or critical")
+	httpTimeout := flag.Duration("http-timeout", envDuration("DINGDING_BOT_HTTP_TIMEOUT", DefaultHTTPTimeout), "Timeout of a single HTTP request, 0 disables the timeout")
+	proxyURL := flag.String("proxy-url", os.Getenv("DINGDING_BOT_PROXY_URL"), "Proxy requests are routed through, HTTPS_PROXY is used when empty")
+	caFiles := flag.String("ca-file", os.Getenv("DINGDING_BOT_CA_FILE"), "Comma-separated PEM files of root certificates trusted in addition to the system ones")
+	tlsMinVersion := flag.String("tls-min-version", os.Getenv("DINGDING_BOT_TLS_MIN_VERSION"), "Lowest accepted TLS version: 1.0, 1.1, 1.2 or 1.3")
+	callbackAddr := flag.String("callback-addr", os.Getenv("DINGDING_BOT_CALLBACK_ADDR"), "Listen address of the outgoing robot callbacks, such as :8081, enables poll_incoming_messages when set")
+	callbackPath := flag.String("callback-path", envString("DINGDING_BOT_CALLBACK_PATH", DefaultCallbackPath), "Path outgoing robot callbacks are posted to")
+	sessionWebhookHosts := flag.String("session-webhook-hosts", envString("DINGDING_BOT_SESSION_WEBHOOK_HOSTS", strings.Join(DefaultSessionWebhookHosts, ",")), "Comma-separated hosts reply_to_message may post to, exact names or *.domain")
+	callbackSecret := flag.String("callback-secret", os.Getenv("DINGDING_BOT_CALLBACK_SECRET"), "App secret outgoing robot callbacks are signed with")
+	incomingBufferSize := flag.Int("incoming-buffer", envInt("DINGDING_BOT_INCOMING_BUFFER", DefaultIncomingBufferSize), "Number of incoming messages kept for polling")
+	messageLogSize := flag.Int("message-log-size", envInt("DINGDING_BOT_MESSAGE_LOG_SIZE", DefaultMessageLogSize), "Number of sent messages remembered for recall_message, 0 disables the tool")
+	messageLogMaxAge := flag.Duration("message-log-max-age", envDuration("DINGDING_BOT_MESSAGE_LOG_MAX_AGE", DefaultMessageLogMaxAge), "How long sent messages are remembered for recall_message")
+	apiBaseURL := flag.String("api-base-url", envString("DINGDING_BOT_API_BASE_URL", DINGDING_API_BASE_URL), "Base URL of the DingDing open API used in enterprise mode, such as a local stub server")
+	outboxDir := flag.String("outbox-dir", os.Getenv("DINGDING_BOT_OUTBOX_DIR"), "Directory of the outbox journal, messages are queued and delivered in the background when set")
+	stateDir := flag.String("state-dir", os.Getenv("DINGDING_BOT_STATE_DIR"), "Directory of the digest and message log journals, pending digests and the messages remembered for recall_message survive restarts when set")
+	flag.Parse()
+
+	// The webhook key is optional when the bots are listed in a config file
 	webhookKey := os.Getenv("DINGDING_BOT_WEBHOOK_KEY")
-	if webhookKey == "" {
-		log.Println("DINGDING_BOT_WEBHOOK_KEY environment variable is required")
-		return
-	}
 
 	// Get the sign key for signature verification (optional)
 	signKey := os.Getenv("DINGDING_BOT_SIGN_KEY")
 
-	bot := NewDingDingBot(DINGDING_BOT_SEND_URL, webhookKey, signKey)
+	var cfg *Config
+	if *configPath != "" {
+		var err error
+		cfg, err = LoadConfig(*configPath)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+
+		for _, botConfig := range cfg.Bots {
+			if botConfig.Enterprise != nil && botConfig.Enterprise.BaseURL == "" {
+				botConfig.Enterprise.BaseURL = *apiBaseURL
+			}
+		}
+	}
+
+	// With the credentials of an enterprise internal app, the environment bot sends through the app
+	// and keeps the webhook key for uploads
+	if appKey := os.Getenv("DINGDING_BOT_APP_KEY"); appKey != "" {
+		enterprise := &EnterpriseConfig{
+			AppKey:             appKey,
+			AppSecret:          os.Getenv("DINGDING_BOT_APP_SECRET"),
+			RobotCode:          os.Getenv("DINGDING_BOT_ROBOT_CODE"),
+			OpenConversationID: os.Getenv("DINGDING_BOT_OPEN_CONVERSATION_ID"),
+			BaseURL:            *apiBaseURL,
+		}
+		if err := enterprise.validate(); err != nil {
+			log.Printf("Invalid enterprise app settings: %v\n", err)
+			return
+		}
+		if cfg == nil {
+			cfg = &Config{}
+		}
+		envBot := BotConfig{Name: DefaultBotName, WebhookKey: webhookKey, SignKey: signKey, Enterprise: enterprise}
+		cfg.Bots = append([]BotConfig{envBot}, cfg.Bots...)
+		webhookKey = ""
+	}
+
+	// Remote clients may only read local files from the configured directory
+	files := FileAccess{
+		Dir:      *fileDir,
+		Disabled: *transport != "" && *transport != TransportStdio,
+	}
+	if err := files.validate(); err != nil {
+		log.Println(err)
+		return
+	}
+
+	if err := validSeverity(*digestFlushSeverity); err != nil {
+		log.Printf("Invalid digest flush severity: %v\n", err)
+		return
+	}
+
+	location, err := time.LoadLocation(*timezone)
+	if err != nil {
+		log.Printf("Invalid timezone %q: %v\n", *timezone, err)
+		return
+	}
+
+	sender, err := NewSender(*sendMode, *captureFile)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// The settings of the config file override the flags and environment
+	httpConfig := HTTPClientConfig{
+		Timeout:       Duration(*httpTimeout),
+		ProxyURL:      *proxyURL,
+		CAFiles:       splitList(*caFiles),
+		TLSMinVersion: *tlsMinVersion,
+	}
+	if cfg != nil {
+		httpConfig = httpConfig.merge(cfg.HTTP)
+	}
+	httpClient, err := NewHTTPClient(httpConfig)
+	if err != nil {
+		log.Printf("Invalid HTTP client settings: %v\n", err)
+		return
+	}
+
+	// Images given by URL are only downloaded from public addresses unless allowed explicitly
+	downloadClient := NewDownloadClient(httpClient)
+	if *allowPrivateURLs {
+		downloadClient = httpClient
+	}
+
+	retryPolicy := RetryPolicy{
+		MaxAttempts: *retryMaxAttempts,
+		BaseDelay:   *retryBaseDelay,
+		MaxDelay:    *retryMaxDelay,
+	}
+
+	var messageLog *MessageLog
+	var logOpts []BotOption
+	if *messageLogSize > 0 {
+		if *stateDir != "" {
+			messageLog, err = OpenMessageLog(*stateDir, *messageLogSize, *messageLogMaxAge)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			defer messageLog.Close()
+		} else {
+			messageLog = NewMessageLog(*messageLogSize, *messageLogMaxAge)
+		}
+		logOpts = append(logOpts, WithMessageLog(messageLog))
+	}
+
+	bots, err := NewBotRegistryFromConfig(cfg, webhookKey, signKey, append(logOpts, WithSender(sender), WithHTTPClient(httpClient), WithDownloadClient(downloadClient), WithRetryPolicy(retryPolicy), WithRateLimit(RateLimit{
+		PerMinute: *rateLimit,
+		MaxWait:   Duration(*rateLimitMaxWait),
+	}), WithIdempotency(Idempotency{
+		TTL:          *idempotencyTTL,
+		ContentDedup: *dedupContent,
+	}), WithCircuitBreaker(BreakerPolicy{
+		Failures: *breakerFailures,
+		Cooldown: Duration(*breakerCooldown),
+	}), WithDigest(DigestPolicy{
+		Window:        Duration(*digestWindow),
+		MaxItems:      *digestMaxItems,
+		FlushSeverity: *digestFlushSeverity,
+	}), WithSessionWebhookHosts(splitList(*sessionWebhookHosts)))...)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	// The bot health is published with expvar, served on /debug/vars by the sse and http transports
+	expvar.Publish("dingding_bots", expvar.Func(func() any {
+		return bots.Status()
+	}))
+
+	var outbox *Outbox
+	if *outboxDir != "" {
+		outbox, err = OpenOutbox(*outboxDir, bots, DefaultOutboxPolicy)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer outbox.Close()
+
+		// On shutdown a delivery in flight is interrupted, and the worker stopped before the journal is closed
+		ctx, stop := context.WithCancel(context.Background())
+		stopped := make(chan struct{})
+		go func() {
+			outbox.Run(ctx)
+			close(stopped)
+		}()
+		defer func() {
+			stop()
+			<-stopped
+		}()
+	}
+
+	var scheduler *Scheduler
+	var cron *CronScheduler
+	if *scheduleDir != "" {
+		scheduler, err = OpenScheduler(*scheduleDir, bots, outbox, location)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer scheduler.Close()
+
+		var configJobs []JobConfig
+		if cfg != nil {
+			configJobs = cfg.Jobs
+		}
+		cron, err = OpenCronScheduler(*scheduleDir, bots, outbox, location, configJobs)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer cron.Close()
+
+		// On shutdown the sends in flight are interrupted, and the workers stopped before the journals are closed
+		ctx, stop := context.WithCancel(context.Background())
+		var workers sync.WaitGroup
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			scheduler.Run(ctx)
+		}()
+		go func() {
+			defer workers.Done()
+			cron.Run(ctx)
+		}()
+		defer func() {
+			stop()
+			workers.Wait()
+		}()
+	} else if cfg != nil && len(cfg.Jobs) > 0 {
+		log.Println("The config file defines jobs, set DINGDING_BOT_SCHEDULE_DIR to run them")
+		return
+	}
+
+	// Journaled digests stay pending over a restart, digests kept in memory are flushed on shutdown,
+	// before the outbox is closed
+	var digester *Digester
+	if *stateDir != "" {
+		digester, err = OpenDigester(*stateDir, bots, outbox, location)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		defer digester.Close()
+	} else {
+		digester = NewDigester(bots, outbox, location)
+		defer digester.FlushAll(context.Background())
+	}
+	digestCtx, stopDigester := context.WithCancel(context.Background())
+	digestStopped := make(chan struct{})
+	go func() {
+		digester.Run(digestCtx)
+		close(digestStopped)
+	}()
+	defer func() {
+		stopDigester()
+		<-digestStopped
+	}()
+
+	dispatcher := NewDispatcher(bots, outbox, scheduler, digester)
+
+	var incoming *IncomingBuffer
+	if *callbackAddr != "" {
+		if *callbackSecret == "" {
+			log.Println("An app secret is required to verify outgoing robot callbacks, set DINGDING_BOT_CALLBACK_SECRET")
+			return
+		}
+		incoming = NewIncomingBuffer(*incomingBufferSize)
+
+		ctx, stop := context.WithCancel(context.Background())
+		defer stop()
+		go func() {
+			if err := ServeCallbacks(ctx, *callbackAddr, *callbackPath, NewCallbackHandler(*callbackSecret, incoming)); err != nil {
+				log.Printf("Callback listener error: %v\n", err)
+			}
+		}()
+	}
 
 	s := server.NewMCPServer(
 		"mcp-dingdingbot-server",
@@ -32,24 +314,30 @@ func main() {
 
 	sendTextTool := mcp.NewTool("send_text",
 		mcp.WithDescription("Send a text message to DingDing group"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
+		withDigestArguments(digester),
 		mcp.WithString("content",
 			mcp.Required(),
 			mcp.Description("Text content to send"),
 		),
-		mcp.WithString("at_mobiles",
-			mcp.Description("List of mobile numbers to mention, multiple numbers use commas to separate, such as 13800138000,13800138001"),
+		withStringList("at_mobiles",
+			mcp.Description("List of mobile numbers to mention, as an array or separated by commas, such as 13800138000,13800138001"),
 		),
-		mcp.WithString("at_user_ids",
-			mcp.Description("List of user IDs to mention, multiple IDs use commas to separate"),
+		withStringList("at_user_ids",
+			mcp.Description("List of user IDs to mention, as an array or separated by commas"),
 		),
 		mcp.WithBoolean("is_at_all",
 			mcp.Description("Whether to mention all users in the group"),
 		),
 	)
-	s.AddTool(sendTextTool, sendTextHandler(bot))
+	s.AddTool(sendTextTool, sendTextHandler(dispatcher))
 
 	sendMarkdownTool := mcp.NewTool("send_markdown",
 		mcp.WithDescription("Send a markdown message to DingDing group"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
+		withDigestArguments(digester),
 		mcp.WithString("title",
 			mcp.Required(),
 			mcp.Description("Title of the markdown message"),
@@ -58,33 +346,44 @@ func main() {
 			mcp.Required(),
 			mcp.Description("Markdown content to send"),
 		),
-		mcp.WithString("at_mobiles",
-			mcp.Description("List of mobile numbers to mention, multiple numbers use commas to separate"),
+		withStringList("at_mobiles",
+			mcp.Description("List of mobile numbers to mention, as an array or separated by commas"),
 		),
-		mcp.WithString("at_user_ids",
-			mcp.Description("List of user IDs to mention, multiple IDs use commas to separate"),
+		withStringList("at_user_ids",
+			mcp.Description("List of user IDs to mention, as an array or separated by commas"),
 		),
 		mcp.WithBoolean("is_at_all",
 			mcp.Description("Whether to mention all users in the group"),
 		),
 	)
-	s.AddTool(sendMarkdownTool, sendMarkdownHandler(bot))
+	s.AddTool(sendMarkdownTool, sendMarkdownHandler(dispatcher))
 
 	sendImageTool := mcp.NewTool("send_image",
-		mcp.WithDescription("Send an image message to DingDing group"),
+		mcp.WithDescription("Send an image message to DingDing group. Provide exactly one of file_path, image_url, or base64_data with md5"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
+		mcp.WithString("file_path",
+			mcp.Description("Path to a local image file (JPEG, PNG or GIF), relative to the file directory of the server when one is configured"),
+		),
+		mcp.WithString("image_url",
+			mcp.Description("HTTP(S) URL of the image to download and send"),
+		),
+		mcp.WithBoolean("downscale",
+			mcp.Description("Shrink images from file_path or image_url that exceed the 2MB limit instead of failing"),
+		),
 		mcp.WithString("base64_data",
-			mcp.Required(),
-			mcp.Description("Base64 encoded image data"),
+			mcp.Description("Base64 encoded image data, requires md5"),
 		),
 		mcp.WithString("md5",
-			mcp.Required(),
-			mcp.Description("MD5 hash of the image"),
+			mcp.Description("MD5 hash of the image, required with base64_data"),
 		),
 	)
-	s.AddTool(sendImageTool, sendImageHandler(bot))
+	s.AddTool(sendImageTool, sendImageHandler(dispatcher, files))
 
 	sendNewsTool := mcp.NewTool("send_news",
 		mcp.WithDescription("Send a link message to DingDing group"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
 		mcp.WithString("title", 
 			mcp.Required(), 
 			mcp.Description("Title of the link message")),
@@ -97,10 +396,12 @@ func main() {
 		mcp.WithString("pic_url", 
 			mcp.Description("Picture URL of the link message")),
 	)
-	s.AddTool(sendNewsTool, sendNewsHandler(bot))
+	s.AddTool(sendNewsTool, sendNewsHandler(dispatcher))
 
 	sendTemplateCardTool := mcp.NewTool("send_template_card",
 		mcp.WithDescription("Send an action card message to DingDing group"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
 		mcp.WithString("title",
 			mcp.Required(),
 			mcp.Description("Title of the action card"),
@@ -110,182 +411,1626 @@ func main() {
 			mcp.Description("Text content of the action card"),
 		),
 		mcp.WithString("single_title",
-			mcp.Required(),
-			mcp.Description("Title of the single button"),
+			mcp.Description("Title of the single button, used together with single_url"),
 		),
 		mcp.WithString("single_url",
-			mcp.Required(),
-			mcp.Description("URL for the single button"),
+			mcp.Description("URL for the single button, used together with single_title"),
+		),
+		withArray("buttons",
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"title": map[string]interface{}{
+						"type":        "string",
+						"description": "Title of the button",
+					},
+					"actionURL": map[string]interface{}{
+						"type":        "string",
+						"description": "URL to open when clicking the button",
+					},
+				},
+				"required": []string{"title", "actionURL"},
+			},
+			mcp.Description("Independent buttons, each with its own URL. Cannot be combined with single_title/single_url"),
 		),
 		mcp.WithString("btn_orientation",
 			mcp.Description("Button orientation, 0: vertical, 1: horizontal"),
 		),
 	)
-	s.AddTool(sendTemplateCardTool, sendTemplateCardHandler(bot))
+	s.AddTool(sendTemplateCardTool, sendTemplateCardHandler(dispatcher))
+
+	sendFeedCardTool := mcp.NewTool("send_feed_card",
+		mcp.WithDescription("Send a feed card message with several links to DingDing group"),
+		withBotArgument(),
+		withDeliveryArguments(scheduler),
+		withArray("links",
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"title": map[string]interface{}{
+						"type":        "string",
+						"description": "Title of the link",
+					},
+					"messageURL": map[string]interface{}{
+						"type":        "string",
+						"description": "URL to open when clicking the link",
+					},
+					"picURL": map[string]interface{}{
+						"type":        "string",
+						"description": "Picture URL of the link",
+					},
+				},
+				"required": []string{"title", "messageURL", "picURL"},
+			},
+			mcp.Required(),
+			mcp.Description(fmt.Sprintf("Links to display in the feed card, 1 to %d items", maxFeedCardLinks)),
+		),
+	)
+	s.AddTool(sendFeedCardTool, sendFeedCardHandler(dispatcher))
 
 	uploadFileTool := mcp.NewTool("upload_file",
 		mcp.WithDescription("Upload a file to DingDing"),
+		withBotArgument(),
 		mcp.WithString("file_path",
 			mcp.Required(),
-			mcp.Description("Path to the file to upload"),
+			mcp.Description("Path to the file to upload, relative to the file directory of the server when one is configured"),
+		),
+	)
+	s.AddTool(uploadFileTool, uploadFileHandler(bots, files))
+
+	broadcastTool := mcp.NewTool("broadcast",
+		mcp.WithDescription("Send the same message to several DingDing groups at once and report the outcome per group"),
+		mcp.WithString("msg_type",
+			mcp.Required(),
+			mcp.Enum("text", "markdown", "image", "link", "action_card", "feed_card"),
+			mcp.Description("Type of the message to broadcast"),
+		),
+		withArray("bots",
+			map[string]interface{}{"type": "string"},
+			mcp.Description("Names of configured bots to send to, see list_bots"),
+		),
+		withArray("webhooks",
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"webhook_key": map[string]interface{}{
+						"type":        "string",
+						"description": "Access token of the robot webhook",
+					},
+					"sign_key": map[string]interface{}{
+						"type":        "string",
+						"description": "Sign key of the robot (optional)",
+					},
+				},
+				"required": []string{"webhook_key"},
+			},
+			mcp.Description("Additional robot webhooks to send to"),
+		),
+		mcp.WithNumber("max_parallel",
+			mcp.Description(fmt.Sprintf("Maximum number of groups sent to at the same time, defaults to %d", defaultBroadcastConcurrency)),
+		),
+		withMessageArguments(),
+	)
+	s.AddTool(broadcastTool, broadcastHandler(bots))
+
+	sendDirectMessageTool := mcp.NewTool("send_direct_message",
+		mcp.WithDescription("Send a message to users in one-to-one chats with the robot of an enterprise app, such as paging the on-call engineer, "+
+			"and report the outcome per recipient. Needs a bot configured with an enterprise app"),
+		withStringList("user_ids",
+			mcp.Description("User IDs of the recipients, as an array or separated by commas"),
+		),
+		withStringList("mobiles",
+			mcp.Description("Mobile numbers of the recipients, resolved to user IDs, as an array or separated by commas"),
+		),
+		mcp.WithString("msg_type",
+			mcp.Required(),
+			mcp.Enum("text", "markdown", "action_card"),
+			mcp.Description("Type of the message"),
+		),
+		withBotArgument(),
+		withMessageArguments(),
+	)
+	s.AddTool(sendDirectMessageTool, sendDirectMessageHandler(bots))
+
+	if messageLog != nil {
+		recallMessageTool := mcp.NewTool("recall_message",
+			mcp.WithDescription("Take back a message sent by mistake, such as to the wrong group or with a leaked value. "+
+				"Only messages sent through the robot of an enterprise app can be recalled, not those sent through a webhook"),
+			mcp.WithString("message_id",
+				mcp.Required(),
+				mcp.Description("The message_id returned by the send tool"),
+			),
+		)
+		s.AddTool(recallMessageTool, recallMessageHandler(bots, messageLog))
+	}
+
+	listBotsTool := mcp.NewTool("list_bots",
+		mcp.WithDescription("List the DingDing bots (groups) that messages can be sent to"),
+	)
+	s.AddTool(listBotsTool, listBotsHandler(bots))
+
+	botStatusTool := mcp.NewTool("bot_status",
+		mcp.WithDescription("Report the health of the DingDing bots: the state of their circuit breaker, which fails sends fast after repeated failures, and their request counters"),
+		mcp.WithString("bot",
+			mcp.Description("Name of the configured bot to report on, all bots when omitted"),
 		),
 	)
-	s.AddTool(uploadFileTool, uploadFileHandler(bot))
+	s.AddTool(botStatusTool, botStatusHandler(bots))
+
+	if outbox != nil {
+		listOutboxTool := mcp.NewTool("list_outbox",
+			mcp.WithDescription("List the messages in the outbox with their delivery status"),
+			mcp.WithString("status",
+				mcp.Enum(OutboxPending, OutboxSent, OutboxDead),
+				mcp.Description("Only list messages with this status, all messages when omitted"),
+			),
+		)
+		s.AddTool(listOutboxTool, listOutboxHandler(outbox))
+
+		retryMessageTool := mcp.NewTool("retry_message",
+			mcp.WithDescription("Deliver a dead or pending outbox message again right away, with a fresh retry budget"),
+			mcp.WithString("id",
+				mcp.Required(),
+				mcp.Description("Outbox ID of the message, see list_outbox"),
+			),
+		)
+		s.AddTool(retryMessageTool, retryMessageHandler(outbox))
+
+		purgeOutboxTool := mcp.NewTool("purge_outbox",
+			mcp.WithDescription("Remove messages from the outbox. Removing a pending message cancels its delivery"),
+			mcp.WithString("id",
+				mcp.Description("Outbox ID of a single message to remove"),
+			),
+			mcp.WithString("status",
+				mcp.Enum(OutboxPending, OutboxSent, OutboxDead),
+				mcp.Description("Remove all messages with this status when id is omitted, sent and dead messages by default"),
+			),
+		)
+		s.AddTool(purgeOutboxTool, purgeOutboxHandler(outbox))
+	}
+
+	if scheduler != nil {
+		listScheduledTool := mcp.NewTool("list_scheduled",
+			mcp.WithDescription("List the messages scheduled with send_at, in the order they are sent. "+
+				"Transient failures are retried for an hour after the send time, failed messages have to be sent again by hand"),
+			mcp.WithString("status",
+				mcp.Enum(ScheduledPending, ScheduledSending, ScheduledSent, ScheduledFailed),
+				mcp.Description("Only list messages with this status, scheduled messages by default"),
+			),
+		)
+		s.AddTool(listScheduledTool, listScheduledHandler(scheduler))
+
+		cancelScheduledTool := mcp.NewTool("cancel_scheduled",
+			mcp.WithDescription("Cancel a scheduled message so that it is not sent"),
+			mcp.WithString("id",
+				mcp.Required(),
+				mcp.Description("Schedule ID of the message, see list_scheduled"),
+			),
+		)
+		s.AddTool(cancelScheduledTool, cancelScheduledHandler(scheduler))
+
+		rescheduleTool := mcp.NewTool("reschedule",
+			mcp.WithDescription("Change when a scheduled message is sent"),
+			mcp.WithString("id",
+				mcp.Required(),
+				mcp.Description("Schedule ID of the message, see list_scheduled"),
+			),
+			mcp.WithString("send_at",
+				mcp.Required(),
+				mcp.Description("The new send time, in the same formats as the send_at argument of the send tools"),
+			),
+			mcp.WithString("timezone",
+				mcp.Description(fmt.Sprintf("IANA time zone of a send_at time without UTC offset. Defaults to %s", scheduler.Location())),
+			),
+		)
+		s.AddTool(rescheduleTool, rescheduleHandler(scheduler))
+
+		createJobTool := mcp.NewTool("create_job",
+			mcp.WithDescription("Create a job sending a message on a cron schedule. String fields are Go templates rendered at every run "+
+				"with {{.Name}}, {{.Time}} and {{.Date}}, such as \"Standup {{.Date}}\""),
+			mcp.WithString("name",
+				mcp.Required(),
+				mcp.Description("Name identifying the job"),
+			),
+			mcp.WithString("schedule",
+				mcp.Required(),
+				mcp.Description("Cron expression with minute, hour, day of month, month and day of week, such as \"30 9 * * 1-5\", or @hourly, @daily, @weekly, @monthly or @yearly"),
+			),
+			mcp.WithString("timezone",
+				mcp.Description(fmt.Sprintf("IANA time zone the schedule is evaluated in. Defaults to %s", cron.Location())),
+			),
+			mcp.WithString("catch_up",
+				mcp.Enum(CatchUpSkip, CatchUpOnce, CatchUpAll),
+				mcp.Description("What to do with runs missed while the server was down: skip them, run once, or run all of them. Defaults to skip"),
+			),
+			mcp.WithString("msg_type",
+				mcp.Required(),
+				mcp.Enum("text", "markdown", "image", "link", "action_card", "feed_card"),
+				mcp.Description("Type of the message to send"),
+			),
+			mcp.WithString("bot",
+				mcp.Description("Name of the bot to send with, see list_bots. Defaults to the default bot"),
+			),
+			withMessageArguments(),
+		)
+		s.AddTool(createJobTool, createJobHandler(cron))
+
+		listJobsTool := mcp.NewTool("list_jobs",
+			mcp.WithDescription("List the recurring jobs with their schedule, next run and last outcome"),
+		)
+		s.AddTool(listJobsTool, listJobsHandler(cron))
+
+		deleteJobTool := mcp.NewTool("delete_job",
+			mcp.WithDescription("Delete a job created with create_job. Jobs from the config file can only be paused"),
+			mcp.WithString("name",
+				mcp.Required(),
+				mcp.Description("Name of the job, see list_jobs"),
+			),
+		)
+		s.AddTool(deleteJobTool, deleteJobHandler(cron))
+
+		pauseJobTool := mcp.NewTool("pause_job",
+			mcp.WithDescription("Pause a job so that it does not run until resumed"),
+			mcp.WithString("name",
+				mcp.Required(),
+				mcp.Description("Name of the job, see list_jobs"),
+			),
+		)
+		s.AddTool(pauseJobTool, setJobPausedHandler(cron, true))
+
+		resumeJobTool := mcp.NewTool("resume_job",
+			mcp.WithDescription("Resume a paused job. It runs again at its next scheduled time, runs missed while paused are not made"),
+			mcp.WithString("name",
+				mcp.Required(),
+				mcp.Description("Name of the job, see list_jobs"),
+			),
+		)
+		s.AddTool(resumeJobTool, setJobPausedHandler(cron, false))
+	}
+
+	if incoming != nil {
+		pollIncomingMessagesTool := mcp.NewTool("poll_incoming_messages",
+			mcp.WithDescription("Get the messages the outgoing robot received, such as when someone @mentions it in a group. "+
+				"Pass the returned cursor as after to only get newer messages"),
+			mcp.WithNumber("after",
+				mcp.Description("Cursor returned by the previous poll, all buffered messages when omitted"),
+			),
+			mcp.WithNumber("limit",
+				mcp.Description("Maximum number of messages returned. Defaults to 20"),
+			),
+			mcp.WithString("conversation_id",
+				mcp.Description("Only return the messages of this conversation"),
+			),
+			mcp.WithNumber("wait_seconds",
+				mcp.Description(fmt.Sprintf("How long to wait for a message when there is none yet, at most %d. Defaults to 0, returning right away", int(maxPollWait.Seconds()))),
+			),
+		)
+		s.AddTool(pollIncomingMessagesTool, pollIncomingMessagesHandler(incoming))
+
+		replyToMessageTool := mcp.NewTool("reply_to_message",
+			mcp.WithDescription("Reply in the conversation of a received message, including one-to-one chats, through its short-lived session webhook. "+
+				"Mention the sender by passing its sender_staff_id in at_user_ids"),
+			mcp.WithString("message_id",
+				mcp.Required(),
+				mcp.Description("ID of the received message, see poll_incoming_messages"),
+			),
+			mcp.WithString("msg_type",
+				mcp.Required(),
+				mcp.Enum("text", "markdown", "action_card"),
+				mcp.Description("Type of the reply"),
+			),
+			withBotArgument(),
+			withMessageArguments(),
+		)
+		s.AddTool(replyToMessageTool, replyToMessageHandler(bots, incoming))
+
+		s.AddResource(mcp.NewResource("dingding://incoming", "Incoming messages",
+			mcp.WithResourceDescription("The latest messages received by the outgoing robot, oldest first"),
+			mcp.WithMIMEType("application/json"),
+		), incomingResourceHandler(incoming))
+		s.AddResourceTemplate(mcp.NewResourceTemplate("dingding://incoming/{id}", "Incoming message",
+			mcp.WithTemplateDescription("A message received by the outgoing robot, by its DingDing msgId"),
+			mcp.WithTemplateMIMEType("application/json"),
+		), incomingResourceHandler(incoming))
+	}
 
-	if err := server.ServeStdio(s); err != nil {
+	if err := Serve(s, *transport, *listenAddr, *authToken); err != nil {
 		log.Printf("Server error: %v\n", err)
 	}
 }
 
-func sendTextHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// botArguments selects the bot a tool call sends with, embedded in the arguments of every send tool.
+type botArguments struct {
+	Bot string `arg:"bot"`
+}
+
+// deliveryArguments control when and how often a message is delivered, embedded in the arguments of every send_* tool.
+type deliveryArguments struct {
+	IdempotencyKey string `arg:"idempotency_key"`
+	SendAt         string `arg:"send_at"`
+	Timezone       string `arg:"timezone"`
+}
+
+// digestArguments control the aggregation of text and markdown messages, embedded in the arguments of send_text and send_markdown.
+type digestArguments struct {
+	GroupKey string `arg:"group_key"`
+	Severity string `arg:"severity"`
+}
+
+// mentionArguments lists who text and markdown messages mention.
+type mentionArguments struct {
+	AtMobiles []string `arg:"at_mobiles"`
+	AtUserIds []string `arg:"at_user_ids"`
+	IsAtAll   bool     `arg:"is_at_all"`
+}
+
+// textArguments are the arguments of send_text.
+type textArguments struct {
+	botArguments
+	deliveryArguments
+	digestArguments
+	mentionArguments
+	Content string `arg:"content,required"`
+}
+
+func sendTextHandler(dispatcher *Dispatcher) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args textArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		msg, err := NewTextMessage(args.Content, args.AtMobiles, args.AtUserIds, args.IsAtAll)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send text message: %v", err)), nil
+		}
+
+		return dispatcher.dispatchDigest(ctx, args.Bot, args.deliveryArguments, args.digestArguments, msg, "text message"), nil
+	}
+}
+
+// markdownArguments are the arguments of send_markdown.
+type markdownArguments struct {
+	botArguments
+	deliveryArguments
+	digestArguments
+	mentionArguments
+	Title   string `arg:"title,required"`
+	Content string `arg:"content,required"`
+}
+
+func sendMarkdownHandler(dispatcher *Dispatcher) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		var atMobilesStr string
-		var atUserIdsStr string
-		var atMobiles []string
-		var atUserIds []string
-		var isAtAll bool
+		var args markdownArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 
-		content := request.Params.Arguments["content"].(string)
+		msg, err := NewMarkdownMessage(args.Title, args.Content, args.AtMobiles, args.AtUserIds, args.IsAtAll)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send markdown message: %v", err)), nil
+		}
 
-		if request.Params.Arguments["at_mobiles"] != nil {
-			atMobilesStr = request.Params.Arguments["at_mobiles"].(string)
-			atMobiles = strings.Split(atMobilesStr, ",")
-		} else {
-			atMobiles = []string{}
+		return dispatcher.dispatchDigest(ctx, args.Bot, args.deliveryArguments, args.digestArguments, msg, "markdown message"), nil
+	}
+}
+
+// imageArguments are the arguments of send_image.
+type imageArguments struct {
+	botArguments
+	deliveryArguments
+	FilePath   string `arg:"file_path"`
+	ImageURL   string `arg:"image_url"`
+	Downscale  bool   `arg:"downscale"`
+	Base64Data string `arg:"base64_data"`
+	MD5        string `arg:"md5"`
+}
+
+func sendImageHandler(dispatcher *Dispatcher, files FileAccess) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args imageArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		if request.Params.Arguments["at_user_ids"] != nil {
-			atUserIdsStr = request.Params.Arguments["at_user_ids"].(string)
-			atUserIds = strings.Split(atUserIdsStr, ",")
-		} else {
-			atUserIds = []string{}
+		// Exactly one image source must be given
+		sources := 0
+		for _, source := range []string{args.FilePath, args.ImageURL, args.Base64Data} {
+			if source != "" {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return mcp.NewToolResultError("exactly one of file_path, image_url or base64_data is required"), nil
 		}
 
-		if request.Params.Arguments["is_at_all"] != nil {
-			isAtAll = request.Params.Arguments["is_at_all"].(bool)
-		} else {
-			isAtAll = false
+		var msg Message
+		var err error
+		switch {
+		case args.FilePath != "":
+			var path string
+			if path, err = files.resolve(args.FilePath); err == nil {
+				msg, err = NewImageMessageFromFile(path, args.Downscale)
+			}
+		case args.ImageURL != "":
+			// Download with the client of the bot, which goes through the configured proxy and refuses private addresses
+			var bot *DingDingBot
+			if bot, err = dispatcher.bots.Get(args.Bot); err == nil {
+				msg, err = NewImageMessageFromURL(ctx, bot.DownloadClient(), args.ImageURL, args.Downscale)
+			}
+		default:
+			msg, err = NewImageMessage(args.Base64Data, args.MD5)
+		}
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send image message: %v", err)), nil
+		}
+
+		return dispatcher.dispatch(ctx, args.Bot, args.deliveryArguments, msg, "image message"), nil
+	}
+}
+
+// newsArguments are the arguments of send_news.
+type newsArguments struct {
+	botArguments
+	deliveryArguments
+	Title      string `arg:"title,required"`
+	Text       string `arg:"text,required"`
+	MessageURL string `arg:"message_url,required"`
+	PicURL     string `arg:"pic_url"`
+}
+
+func sendNewsHandler(dispatcher *Dispatcher) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args newsArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		err := bot.SendText(content, atMobiles, atUserIds, isAtAll)
+		// Build the news article
+		msg, err := NewLinkMessage(args.Title, args.Text, args.MessageURL, args.PicURL)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to send text message: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send news message: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText("Text message sent successfully"), nil
+		return dispatcher.dispatch(ctx, args.Bot, args.deliveryArguments, msg, "news message"), nil
 	}
 }
 
-func sendMarkdownHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// templateCardArguments are the arguments of send_template_card.
+type templateCardArguments struct {
+	botArguments
+	deliveryArguments
+	Title          string             `arg:"title,required"`
+	Text           string             `arg:"text,required"`
+	SingleTitle    string             `arg:"single_title"`
+	SingleURL      string             `arg:"single_url"`
+	Buttons        []ActionCardButton `arg:"buttons"`
+	BtnOrientation string             `arg:"btn_orientation"`
+}
+
+func sendTemplateCardHandler(dispatcher *Dispatcher) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		title := request.Params.Arguments["title"].(string)
-		content := request.Params.Arguments["content"].(string)
-		
-		var atMobiles []string
-		var atUserIds []string
-		var isAtAll bool
-
-		if request.Params.Arguments["at_mobiles"] != nil {
-			atMobilesStr := request.Params.Arguments["at_mobiles"].(string)
-			atMobiles = strings.Split(atMobilesStr, ",")
-		} else {
-			atMobiles = []string{}
+		args := templateCardArguments{BtnOrientation: "0"}
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		if request.Params.Arguments["at_user_ids"] != nil {
-			atUserIdsStr := request.Params.Arguments["at_user_ids"].(string)
-			atUserIds = strings.Split(atUserIdsStr, ",")
-		} else {
-			atUserIds = []string{}
+		// The single button and independent buttons are two distinct card layouts
+		hasSingle := args.SingleTitle != "" || args.SingleURL != ""
+		if hasSingle && len(args.Buttons) > 0 {
+			return mcp.NewToolResultError("single_title/single_url and buttons are mutually exclusive"), nil
+		}
+		if !hasSingle && len(args.Buttons) == 0 {
+			return mcp.NewToolResultError("either single_title/single_url or buttons is required"), nil
 		}
 
-		if request.Params.Arguments["is_at_all"] != nil {
-			isAtAll = request.Params.Arguments["is_at_all"].(bool)
+		var msg Message
+		var err error
+		if len(args.Buttons) > 0 {
+			msg, err = NewActionCardMessage(args.Title, args.Text, args.Buttons, args.BtnOrientation)
 		} else {
-			isAtAll = false
+			msg, err = NewTemplateCardMessage(args.Title, args.Text, args.SingleTitle, args.SingleURL, args.BtnOrientation)
+		}
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send template card message: %v", err)), nil
+		}
+
+		return dispatcher.dispatch(ctx, args.Bot, args.deliveryArguments, msg, "template card message"), nil
+	}
+}
+
+// feedCardArguments are the arguments of send_feed_card.
+type feedCardArguments struct {
+	botArguments
+	deliveryArguments
+	Links []NewsArticle `arg:"links,required"`
+}
+
+func sendFeedCardHandler(dispatcher *Dispatcher) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args feedCardArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		bot.WebhookURL = DINGDING_BOT_SEND_URL
-		err := bot.SendMarkdown(title, content, atMobiles, atUserIds, isAtAll)
+		msg, err := NewFeedCardMessage(args.Links)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to send markdown message: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to send feed card message: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText("Markdown message sent successfully"), nil
+		return dispatcher.dispatch(ctx, args.Bot, args.deliveryArguments, msg, "feed card message"), nil
 	}
 }
 
-func sendImageHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// uploadFileArguments are the arguments of upload_file.
+type uploadFileArguments struct {
+	botArguments
+	FilePath string `arg:"file_path,required"`
+}
+
+func uploadFileHandler(bots *BotRegistry, files FileAccess) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		base64Data := request.Params.Arguments["base64_data"].(string)
-		md5 := request.Params.Arguments["md5"].(string)
+		var args uploadFileArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 
-		bot.WebhookURL = DINGDING_BOT_SEND_URL
-		err := bot.SendImage(base64Data, md5)
+		bot, err := bots.Get(args.Bot)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to send image message: %v", err)), nil
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		path, err := files.resolve(args.FilePath)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to upload file: %v", err)), nil
+		}
+
+		result, err := bot.UploadFile(ctx, path)
+		if err != nil {
+			return sendErrorResult("Failed to upload file", bot, err), nil
 		}
 
-		return mcp.NewToolResultText("Image message sent successfully"), nil
+		return sendToolResult(fmt.Sprintf("File uploaded successfully, media ID: %s", result.MediaID), result), nil
 	}
 }
 
-func sendNewsHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// broadcastArguments are the arguments of broadcast besides the message fields.
+type broadcastArguments struct {
+	MsgType     string      `arg:"msg_type,required"`
+	Bots        []string    `arg:"bots"`
+	Webhooks    []BotConfig `arg:"webhooks"`
+	MaxParallel int         `arg:"max_parallel"`
+}
+
+func broadcastHandler(bots *BotRegistry) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		// Extract the parameters from the request
-		title := request.Params.Arguments["title"].(string)
-		text := request.Params.Arguments["text"].(string)
-		messageUrl := request.Params.Arguments["message_url"].(string)
-		picUrl := ""
-		
-		if request.Params.Arguments["pic_url"] != nil {
-			picUrl = request.Params.Arguments["pic_url"].(string)
+		var args broadcastArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
 		}
 
-		// Send the news article
-		bot.WebhookURL = DINGDING_BOT_SEND_URL
-		err := bot.SendNews(title, text, messageUrl, picUrl)
+		msg, err := messageFromArguments(args.MsgType, request.Params.Arguments)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to send news message: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid message: %v", err)), nil
+		}
+
+		var targets []BroadcastTarget
+
+		for _, name := range args.Bots {
+			bot, err := bots.Get(name)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			targets = append(targets, BroadcastTarget{Name: name, Bot: bot})
+		}
+
+		for i, webhook := range args.Webhooks {
+			if webhook.WebhookKey == "" {
+				return mcp.NewToolResultError(fmt.Sprintf("webhook %d: webhook_key cannot be empty", i)), nil
+			}
+			name := maskToken(webhook.WebhookKey)
+			targets = append(targets, BroadcastTarget{
+				Name: name,
+				Bot:  bots.NewBot(webhook.WebhookKey, webhook.SignKey, WithName(name)),
+			})
+		}
+
+		if len(targets) == 0 {
+			return mcp.NewToolResultError("at least one of bots or webhooks is required"), nil
+		}
+
+		results := Broadcast(ctx, msg, targets, args.MaxParallel)
+
+		succeeded := 0
+		for _, result := range results {
+			if result.Success {
+				succeeded++
+			}
+		}
+
+		details, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode broadcast results: %v", err)), nil
+		}
+
+		text := fmt.Sprintf("Broadcast to %d groups: %d succeeded, %d failed\n%s", len(results), succeeded, len(results)-succeeded, details)
+		if succeeded == 0 {
+			return mcp.NewToolResultError(text), nil
 		}
 
-		// Return success result
-		return mcp.NewToolResultText("News message sent successfully"), nil
+		return mcp.NewToolResultText(text), nil
 	}
 }
 
-func sendTemplateCardHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// sendDirectMessageArguments are the arguments of send_direct_message, besides the message fields.
+type sendDirectMessageArguments struct {
+	botArguments
+	UserIDs []string `arg:"user_ids"`
+	Mobiles []string `arg:"mobiles"`
+	MsgType string   `arg:"msg_type,required"`
+}
+
+func sendDirectMessageHandler(bots *BotRegistry) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		title := request.Params.Arguments["title"].(string)
-		text := request.Params.Arguments["text"].(string)
-		singleTitle := request.Params.Arguments["single_title"].(string)
-		singleURL := request.Params.Arguments["single_url"].(string)
-		btnOrientation := "0"
-		
-		if request.Params.Arguments["btn_orientation"] != nil {
-			btnOrientation = request.Params.Arguments["btn_orientation"].(string)
+		var args sendDirectMessageArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if args.MsgType != "text" && args.MsgType != "markdown" && args.MsgType != "action_card" {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid argument msg_type: direct messages are text, markdown or action_card messages, got %q", args.MsgType)), nil
 		}
 
-		bot.WebhookURL = DINGDING_BOT_SEND_URL
-		err := bot.SendTemplateCard(title, text, singleTitle, singleURL, btnOrientation)
+		msg, err := messageFromArguments(args.MsgType, request.Params.Arguments)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to send template card message: %v", err)), nil
+			return mcp.NewToolResultError(fmt.Sprintf("Invalid message: %v", err)), nil
+		}
+
+		bot, err := bots.Get(args.Bot)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		result, err := bot.SendDirectMessage(ctx, args.UserIDs, args.Mobiles, msg)
+		if err != nil {
+			return sendErrorResult("Failed to send direct message", bot, err), nil
+		}
+
+		lines := []string{fmt.Sprintf("Direct message sent to %d of %d recipients", result.Sent, len(result.Recipients))}
+		if result.DryRun {
+			lines[0] += " (dry run)"
+		}
+		for _, recipient := range result.Recipients {
+			if recipient.Success {
+				continue
+			}
+			who := recipient.UserID
+			if recipient.Mobile != "" {
+				who = recipient.Mobile
+			}
+			line := fmt.Sprintf("- %s: %s", who, recipient.Error)
+			if recipient.Hint != "" {
+				line += " (Hint: " + recipient.Hint + ")"
+			}
+			lines = append(lines, line)
+		}
+
+		data, err := marshalJSON(result, "  ")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode direct message result: %v", err)), nil
 		}
 
-		return mcp.NewToolResultText("Template card message sent successfully"), nil
+		return &mcp.CallToolResult{
+			Content: []interface{}{
+				mcp.NewTextContent(strings.Join(lines, "\n")),
+				jsonResource("dingding://messages/"+result.MessageID, data),
+			},
+			IsError: result.Sent == 0,
+		}, nil
 	}
 }
 
-func uploadFileHandler(bot *DingDingBot) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+// recallMessageArguments are the arguments of recall_message.
+type recallMessageArguments struct {
+	MessageID string `arg:"message_id,required"`
+}
+
+func recallMessageHandler(bots *BotRegistry, messageLog *MessageLog) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
 	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		filePath := request.Params.Arguments["file_path"].(string)
+		var args recallMessageArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
 
-		bot.WebhookURL = DINGDING_BOT_UPLOAD_URL
-		mediaID, err := bot.UploadFile(filePath)
+		sent, err := messageLog.Get(args.MessageID)
 		if err != nil {
-			return mcp.NewToolResultError(fmt.Sprintf("Failed to upload file: %v", err)), nil
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		// Messages of ad-hoc webhooks are not in the registry, report why they cannot be recalled first
+		if err := sent.recallable(); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		bot, err := bots.Get(sent.Bot)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		result, err := bot.Recall(ctx, sent.MessageID)
+		if err != nil {
+			return sendErrorResult("Failed to recall message "+sent.MessageID, bot, err), nil
+		}
+
+		text := fmt.Sprintf("Message %s recalled", sent.MessageID)
+		if len(result.Failed) > 0 {
+			text = fmt.Sprintf("Message %s recalled for %d of %d batches", sent.MessageID, len(result.Recalled), len(result.Recalled)+len(result.Failed))
+			for key, reason := range result.Failed {
+				text += fmt.Sprintf("\n- %s: %s", key, reason)
+			}
+		}
+		if result.DryRun {
+			text += " (dry run)"
+		}
+
+		data, err := marshalJSON(result, "  ")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode recall result: %v", err)), nil
+		}
+
+		return &mcp.CallToolResult{
+			Content: []interface{}{
+				mcp.NewTextContent(text),
+				jsonResource("dingding://messages/"+sent.MessageID, data),
+			},
+			IsError: len(result.Recalled) == 0,
+		}, nil
+	}
+}
+
+func listBotsHandler(bots *BotRegistry) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var lines []string
+		for _, info := range bots.List() {
+			line := "- " + info.Name
+			if info.Default {
+				line += " (default)"
+			}
+			if info.Enterprise {
+				line += " (enterprise app)"
+			}
+			if info.Description != "" {
+				line += ": " + info.Description
+			}
+			lines = append(lines, line)
 		}
 
-		return mcp.NewToolResultText(fmt.Sprintf("File uploaded successfully, media ID: %s", mediaID)), nil
+		return mcp.NewToolResultText("Configured bots:\n" + strings.Join(lines, "\n")), nil
+	}
+}
+
+func botStatusHandler(bots *BotRegistry) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args botArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		statuses := bots.Status()
+		if args.Bot != "" {
+			bot, err := bots.Get(args.Bot)
+			if err != nil {
+				return mcp.NewToolResultError(err.Error()), nil
+			}
+			statuses = []BotStatus{{Name: args.Bot, CircuitBreaker: bot.BreakerStatus()}}
+		}
+
+		lines := make([]string, 0, len(statuses))
+		for _, status := range statuses {
+			breaker := status.CircuitBreaker
+			line := fmt.Sprintf("- %s: circuit %s, %d requests succeeded, %d failed, %d rejected",
+				status.Name, breaker.State, breaker.Successes, breaker.Failures, breaker.Rejected)
+			if breaker.State == BreakerOpen {
+				line += fmt.Sprintf(", open until %s", breaker.RetryAt.Format(time.RFC3339))
+			}
+			if breaker.ConsecutiveFailures > 0 {
+				line += fmt.Sprintf(", %d consecutive failures, last error: %s", breaker.ConsecutiveFailures, breaker.LastError)
+			}
+			lines = append(lines, line)
+		}
+
+		data, err := marshalJSON(statuses, "  ")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode bot status: %v", err)), nil
+		}
+
+		return &mcp.CallToolResult{
+			Content: []interface{}{
+				mcp.NewTextContent("Bot status:\n" + strings.Join(lines, "\n")),
+				jsonResource("dingding://bots/status", data),
+			},
+		}, nil
+	}
+}
+
+// listOutboxArguments are the arguments of list_outbox.
+type listOutboxArguments struct {
+	Status string `arg:"status"`
+}
+
+func listOutboxHandler(outbox *Outbox) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args listOutboxArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		entries := outbox.List(args.Status)
+		counts := map[string]int{}
+		for _, entry := range entries {
+			counts[entry.Status]++
+		}
+
+		text := fmt.Sprintf("%d messages in the outbox: %d pending, %d sent, %d dead", len(entries), counts[OutboxPending], counts[OutboxSent], counts[OutboxDead])
+		return outboxToolResult(text, entries), nil
+	}
+}
+
+// retryMessageArguments are the arguments of retry_message.
+type retryMessageArguments struct {
+	ID string `arg:"id,required"`
+}
+
+func retryMessageHandler(outbox *Outbox) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args retryMessageArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		entry, err := outbox.RetryMessage(args.ID)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to retry message: %v", err)), nil
+		}
+
+		return outboxToolResult(fmt.Sprintf("Message %s queued for delivery again", entry.ID), []OutboxEntry{*entry}), nil
+	}
+}
+
+// purgeOutboxArguments are the arguments of purge_outbox.
+type purgeOutboxArguments struct {
+	ID     string `arg:"id"`
+	Status string `arg:"status"`
+}
+
+func purgeOutboxHandler(outbox *Outbox) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args purgeOutboxArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		purged, err := outbox.Purge(args.ID, args.Status)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to purge outbox: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Removed %d messages from the outbox", purged)), nil
+	}
+}
+
+// pollIncomingMessagesArguments are the arguments of poll_incoming_messages.
+type pollIncomingMessagesArguments struct {
+	After          int64  `arg:"after"`
+	Limit          int    `arg:"limit"`
+	ConversationID string `arg:"conversation_id"`
+	WaitSeconds    int    `arg:"wait_seconds"`
+}
+
+func pollIncomingMessagesHandler(incoming *IncomingBuffer) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		args := pollIncomingMessagesArguments{Limit: 20}
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if args.Limit <= 0 || args.Limit > DefaultIncomingBufferSize {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid argument limit: must be between 1 and %d", DefaultIncomingBufferSize)), nil
+		}
+		wait := time.Duration(args.WaitSeconds) * time.Second
+		if wait < 0 || wait > maxPollWait {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid argument wait_seconds: must be between 0 and %d", int(maxPollWait.Seconds()))), nil
+		}
+
+		poll := incoming.Poll(ctx, args.After, args.Limit, args.ConversationID, wait)
+
+		lines := []string{fmt.Sprintf("%d new incoming messages, pass after=%d to get newer ones", len(poll.Messages), poll.Cursor)}
+		if poll.Missed > 0 {
+			lines = append(lines, fmt.Sprintf("%d messages were dropped from the full buffer before being polled", poll.Missed))
+		}
+		for _, msg := range poll.Messages {
+			where := "a private chat"
+			if msg.ConversationType == ConversationGroup {
+				where = fmt.Sprintf("group %q", msg.ConversationTitle)
+			}
+			text := msg.Text
+			if msg.MsgType != "text" {
+				text = fmt.Sprintf("[%s message]", msg.MsgType)
+			}
+			lines = append(lines, fmt.Sprintf("- #%d %s in %s (message %s): %s", msg.Seq, msg.SenderNick, where, msg.ID, text))
+		}
+
+		data, err := marshalJSON(poll, "  ")
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode incoming messages: %v", err)), nil
+		}
+
+		return &mcp.CallToolResult{
+			Content: []interface{}{
+				mcp.NewTextContent(strings.Join(lines, "\n")),
+				jsonResource("dingding://incoming", data),
+			},
+		}, nil
+	}
+}
+
+// replyToMessageArguments are the arguments of reply_to_message, besides the message fields.
+type replyToMessageArguments struct {
+	botArguments
+	MessageID string `arg:"message_id,required"`
+	MsgType   string `arg:"msg_type,required"`
+}
+
+func replyToMessageHandler(bots *BotRegistry, incoming *IncomingBuffer) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args replyToMessageArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if args.MsgType != "text" && args.MsgType != "markdown" && args.MsgType != "action_card" {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid argument msg_type: replies are text, markdown or action_card messages, got %q", args.MsgType)), nil
+		}
+
+		received, err := incoming.Get(args.MessageID)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		if received.SessionWebhook == "" {
+			return mcp.NewToolResultError(fmt.Sprintf("message %s has no session webhook to reply to", received.ID)), nil
+		}
+
+		msg, err := messageFromArguments(args.MsgType, request.Params.Arguments)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to build reply: %v", err)), nil
+		}
+
+		bot, err := bots.Get(args.Bot)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		result, err := bot.Reply(ctx, received.SessionWebhook, received.SessionWebhookExpiresAt, msg)
+		if err != nil {
+			return sendErrorResult("Failed to reply to message "+received.ID, bot, err), nil
+		}
+
+		where := "the private chat with " + received.SenderNick
+		if received.ConversationType == ConversationGroup {
+			where = fmt.Sprintf("group %q", received.ConversationTitle)
+		}
+		return sendToolResult("Reply sent to "+where, result), nil
+	}
+}
+
+// incomingResourceHandler reads the dingding://incoming resource listing the buffered messages,
+// or the dingding://incoming/{id} resource of a single message.
+func incomingResourceHandler(incoming *IncomingBuffer) func(ctx context.Context, request mcp.ReadResourceRequest) ([]interface{}, error) {
+	return func(ctx context.Context, request mcp.ReadResourceRequest) ([]interface{}, error) {
+		uri := request.Params.URI
+
+		var value interface{} = incoming.List()
+		if id, ok := strings.CutPrefix(uri, "dingding://incoming/"); ok {
+			msg, err := incoming.Get(id)
+			if err != nil {
+				return nil, err
+			}
+			value = msg
+		}
+
+		data, err := marshalJSON(value, "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode incoming messages: %v", err)
+		}
+
+		return []interface{}{jsonResource(uri, data).Resource}, nil
+	}
+}
+
+// outboxListItem is an outbox entry in tool results, with the image data of its message summarized.
+type outboxListItem struct {
+	*OutboxEntry
+	Message json.RawMessage `json:"message"`
+}
+
+// outboxToolResult builds a tool result describing outbox entries as an application/json resource.
+func outboxToolResult(text string, entries []OutboxEntry) *mcp.CallToolResult {
+	items := make([]outboxListItem, 0, len(entries))
+	for i := range entries {
+		payload, err := json.Marshal(entries[i].Message)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode outbox entry: %v", err))
+		}
+		items = append(items, outboxListItem{OutboxEntry: &entries[i], Message: redactPayload(payload)})
+	}
+
+	data, err := marshalJSON(items, "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to encode outbox entries: %v", err))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(text),
+			jsonResource("dingding://outbox", data),
+		},
+	}
+}
+
+// listScheduledArguments are the arguments of list_scheduled.
+type listScheduledArguments struct {
+	Status string `arg:"status"`
+}
+
+func listScheduledHandler(scheduler *Scheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		args := listScheduledArguments{Status: ScheduledPending}
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		messages := scheduler.List(args.Status)
+		lines := make([]string, 0, len(messages))
+		for _, msg := range messages {
+			line := fmt.Sprintf("- %s: %s message with bot %s at %s (%s)", msg.ID, msg.Message.MsgType(), msg.Bot, msg.SendAt.Format(time.RFC3339), msg.Status)
+			switch {
+			case msg.Status == ScheduledFailed:
+				line += fmt.Sprintf(", not sent: %s. Send it again by hand", msg.LastError)
+			case !msg.NextAttempt.IsZero():
+				line += fmt.Sprintf(", retrying at %s after %d failed attempts: %s", msg.NextAttempt.Format(time.RFC3339), msg.Attempts, msg.LastError)
+			}
+			lines = append(lines, line)
+		}
+
+		text := fmt.Sprintf("%d %s messages", len(messages), args.Status)
+		if len(lines) > 0 {
+			text += ":\n" + strings.Join(lines, "\n")
+		}
+		return scheduleToolResult(text, messages), nil
+	}
+}
+
+// scheduledIDArguments are the arguments of cancel_scheduled.
+type scheduledIDArguments struct {
+	ID string `arg:"id,required"`
+}
+
+func cancelScheduledHandler(scheduler *Scheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args scheduledIDArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		msg, err := scheduler.Cancel(args.ID)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to cancel scheduled message: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Canceled the %s message scheduled for %s", msg.Message.MsgType(), msg.SendAt.Format(time.RFC3339))), nil
+	}
+}
+
+// rescheduleArguments are the arguments of reschedule.
+type rescheduleArguments struct {
+	ID       string `arg:"id,required"`
+	SendAt   string `arg:"send_at,required"`
+	Timezone string `arg:"timezone"`
+}
+
+func rescheduleHandler(scheduler *Scheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args rescheduleArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		sendAt, err := scheduler.ParseSendAt(args.SendAt, args.Timezone)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("invalid argument send_at: %v", err)), nil
+		}
+
+		msg, err := scheduler.Reschedule(args.ID, sendAt)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to reschedule message: %v", err)), nil
+		}
+
+		return scheduleToolResult(fmt.Sprintf("Message %s rescheduled for %s", msg.ID, msg.SendAt.Format(time.RFC3339)), []ScheduledMessage{*msg}), nil
+	}
+}
+
+// scheduledListItem is a scheduled message in tool results, with the image data of its message summarized.
+type scheduledListItem struct {
+	*ScheduledMessage
+	Message json.RawMessage `json:"message"`
+}
+
+// scheduleToolResult builds a tool result describing scheduled messages as an application/json resource.
+func scheduleToolResult(text string, messages []ScheduledMessage) *mcp.CallToolResult {
+	items := make([]scheduledListItem, 0, len(messages))
+	for i := range messages {
+		payload, err := json.Marshal(messages[i].Message)
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to encode scheduled message: %v", err))
+		}
+		items = append(items, scheduledListItem{ScheduledMessage: &messages[i], Message: redactPayload(payload)})
+	}
+
+	data, err := marshalJSON(items, "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to encode scheduled messages: %v", err))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(text),
+			jsonResource("dingding://scheduled", data),
+		},
+	}
+}
+
+// createJobArguments are the arguments of create_job besides the message fields.
+type createJobArguments struct {
+	botArguments
+	Name     string `arg:"name,required"`
+	Schedule string `arg:"schedule,required"`
+	Timezone string `arg:"timezone"`
+	CatchUp  string `arg:"catch_up"`
+	MsgType  string `arg:"msg_type,required"`
+}
+
+func createJobHandler(cron *CronScheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args createJobArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		// The message fields are stored as given, they are rendered at every run
+		template := make(map[string]interface{})
+		for _, name := range argumentNames(&messageArguments{}) {
+			if value, ok := request.Params.Arguments[name]; ok {
+				template[name] = value
+			}
+		}
+
+		job, err := cron.CreateJob(JobConfig{
+			Name:     args.Name,
+			Schedule: args.Schedule,
+			Timezone: args.Timezone,
+			Bot:      args.Bot,
+			MsgType:  args.MsgType,
+			Template: template,
+			CatchUp:  args.CatchUp,
+		})
+		if err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to create job: %v", err)), nil
+		}
+
+		return jobsToolResult(fmt.Sprintf("Job %s created, next run at %s", job.Name, job.NextRun.In(job.location).Format(time.RFC3339)), []Job{*job}), nil
+	}
+}
+
+func listJobsHandler(cron *CronScheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		jobs := cron.List()
+		lines := make([]string, 0, len(jobs))
+		for _, job := range jobs {
+			state := "next run at " + job.NextRun.In(job.location).Format(time.RFC3339)
+			if job.Paused {
+				state = "paused"
+			}
+			line := fmt.Sprintf("- %s: %s message on %q, %s", job.Name, job.MsgType, job.Schedule, state)
+			switch {
+			case !job.RetryRun.IsZero():
+				line += fmt.Sprintf(", retrying the run at %s after %d failed attempts: %s", job.RetryRun.In(job.location).Format(time.RFC3339), job.Attempts, job.LastError)
+			case job.LastError != "":
+				line += ", last run failed and was not sent: " + job.LastError
+			}
+			lines = append(lines, line)
+		}
+
+		text := fmt.Sprintf("%d jobs", len(jobs))
+		if len(lines) > 0 {
+			text += ":\n" + strings.Join(lines, "\n")
+		}
+		return jobsToolResult(text, jobs), nil
+	}
+}
+
+// jobNameArguments are the arguments of delete_job, pause_job and resume_job.
+type jobNameArguments struct {
+	Name string `arg:"name,required"`
+}
+
+func deleteJobHandler(cron *CronScheduler) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args jobNameArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		if _, err := cron.DeleteJob(args.Name); err != nil {
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to delete job: %v", err)), nil
+		}
+
+		return mcp.NewToolResultText(fmt.Sprintf("Job %s deleted", args.Name)), nil
+	}
+}
+
+// setJobPausedHandler backs pause_job and resume_job.
+func setJobPausedHandler(cron *CronScheduler, paused bool) func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+	return func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		var args jobNameArguments
+		if err := bindArguments(request.Params.Arguments, &args); err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+
+		job, err := cron.SetPaused(args.Name, paused)
+		if err != nil {
+			action := "resume"
+			if paused {
+				action = "pause"
+			}
+			return mcp.NewToolResultError(fmt.Sprintf("Failed to %s job: %v", action, err)), nil
+		}
+
+		text := fmt.Sprintf("Job %s paused", job.Name)
+		if !paused {
+			text = fmt.Sprintf("Job %s resumed, next run at %s", job.Name, job.NextRun.In(job.location).Format(time.RFC3339))
+		}
+		return jobsToolResult(text, []Job{*job}), nil
+	}
+}
+
+// jobsToolResult builds a tool result describing jobs as an application/json resource.
+func jobsToolResult(text string, jobs []Job) *mcp.CallToolResult {
+	data, err := marshalJSON(jobs, "  ")
+	if err != nil {
+		return mcp.NewToolResultError(fmt.Sprintf("Failed to encode jobs: %v", err))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(text),
+			jsonResource("dingding://jobs", data),
+		},
+	}
+}
+
+// messageArguments are the fields of a message of any type.
+type messageArguments struct {
+	mentionArguments
+	Title          string             `arg:"title"`
+	Content        string             `arg:"content"`
+	Base64Data     string             `arg:"base64_data"`
+	MD5            string             `arg:"md5"`
+	MessageURL     string             `arg:"message_url"`
+	PicURL         string             `arg:"pic_url"`
+	SingleTitle    string             `arg:"single_title"`
+	SingleURL      string             `arg:"single_url"`
+	Buttons        []ActionCardButton `arg:"buttons"`
+	BtnOrientation string             `arg:"btn_orientation"`
+	Links          []NewsArticle      `arg:"links"`
+}
+
+// messageFromArguments builds a message of the given type from tool arguments.
+// It backs the tools that accept any message type, such as broadcast.
+func messageFromArguments(msgType string, arguments map[string]interface{}) (Message, error) {
+	args := messageArguments{BtnOrientation: "0"}
+	if err := bindArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	switch msgType {
+	case "text":
+		return NewTextMessage(args.Content, args.AtMobiles, args.AtUserIds, args.IsAtAll)
+	case "markdown":
+		return NewMarkdownMessage(args.Title, args.Content, args.AtMobiles, args.AtUserIds, args.IsAtAll)
+	case "image":
+		return NewImageMessage(args.Base64Data, args.MD5)
+	case "link":
+		return NewLinkMessage(args.Title, args.Content, args.MessageURL, args.PicURL)
+	case "action_card":
+		if len(args.Buttons) > 0 {
+			return NewActionCardMessage(args.Title, args.Content, args.Buttons, args.BtnOrientation)
+		}
+		return NewTemplateCardMessage(args.Title, args.Content, args.SingleTitle, args.SingleURL, args.BtnOrientation)
+	case "feed_card":
+		return NewFeedCardMessage(args.Links)
+	default:
+		return nil, fmt.Errorf("unsupported message type: %q", msgType)
+	}
+}
+
+// withMessageArguments adds the message fields of the tools that accept any message type, such as broadcast.
+func withMessageArguments() mcp.ToolOption {
+	options := []mcp.ToolOption{
+		mcp.WithString("title",
+			mcp.Description("Title, for markdown, link and action_card messages"),
+		),
+		mcp.WithString("content",
+			mcp.Description("Text content, for text, markdown, link and action_card messages"),
+		),
+		mcp.WithString("message_url",
+			mcp.Description("URL of a link message"),
+		),
+		mcp.WithString("pic_url",
+			mcp.Description("Picture URL of a link message"),
+		),
+		mcp.WithString("base64_data",
+			mcp.Description("Base64 encoded image data of an image message"),
+		),
+		mcp.WithString("md5",
+			mcp.Description("MD5 hash of the image of an image message"),
+		),
+		mcp.WithString("single_title",
+			mcp.Description("Title of the single button of an action_card message"),
+		),
+		mcp.WithString("single_url",
+			mcp.Description("URL for the single button of an action_card message"),
+		),
+		withArray("buttons",
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"title":     map[string]interface{}{"type": "string"},
+					"actionURL": map[string]interface{}{"type": "string"},
+				},
+				"required": []string{"title", "actionURL"},
+			},
+			mcp.Description("Independent buttons of an action_card message"),
+		),
+		mcp.WithString("btn_orientation",
+			mcp.Description("Button orientation of an action_card message, 0: vertical, 1: horizontal"),
+		),
+		withArray("links",
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"title":      map[string]interface{}{"type": "string"},
+					"messageURL": map[string]interface{}{"type": "string"},
+					"picURL":     map[string]interface{}{"type": "string"},
+				},
+				"required": []string{"title", "messageURL", "picURL"},
+			},
+			mcp.Description("Links of a feed_card message"),
+		),
+		withStringList("at_mobiles",
+			mcp.Description("List of mobile numbers to mention in text and markdown messages, as an array or separated by commas"),
+		),
+		withStringList("at_user_ids",
+			mcp.Description("List of user IDs to mention in text and markdown messages, as an array or separated by commas"),
+		),
+		mcp.WithBoolean("is_at_all",
+			mcp.Description("Whether to mention all users in text and markdown messages"),
+		),
+	}
+
+	return func(tool *mcp.Tool) {
+		for _, option := range options {
+			option(tool)
+		}
+	}
+}
+
+// withBotArgument adds the optional bot argument selecting a configured bot.
+func withBotArgument() mcp.ToolOption {
+	return mcp.WithString("bot",
+		mcp.Description("Name of the configured bot (group) to use, see list_bots. The default bot is used when omitted"),
+	)
+}
+
+// withDeliveryArguments adds the optional deliveryArguments of the send_* tools,
+// send_at and timezone only when a scheduler is configured.
+func withDeliveryArguments(scheduler *Scheduler) mcp.ToolOption {
+	return func(tool *mcp.Tool) {
+		mcp.WithString("idempotency_key",
+			mcp.Description("Unique key of the message, such as an alert ID. Repeating a call with the same key within the idempotency window returns the original result without sending the message again"),
+		)(tool)
+
+		if scheduler == nil {
+			return
+		}
+		mcp.WithString("send_at",
+			mcp.Description(fmt.Sprintf("Send the message later instead of now: an RFC3339 time such as 2024-06-01T09:30:00+08:00, "+
+				"a local time such as 2024-06-01 09:30 in the timezone (%s by default), or a delay such as +2h or +1h30m", scheduler.Location())),
+		)(tool)
+		mcp.WithString("timezone",
+			mcp.Description(fmt.Sprintf("IANA time zone of a send_at time without UTC offset, such as Asia/Shanghai. Defaults to %s", scheduler.Location())),
+		)(tool)
+	}
+}
+
+// withDigestArguments adds the optional digestArguments of send_text and send_markdown.
+func withDigestArguments(digester *Digester) mcp.ToolOption {
+	groupKeyDescription := "Group the message is aggregated in when the bot collects messages into digests, such as an incident ID. Messages without a key share the bot-wide digest"
+	if !digester.journaled() {
+		groupKeyDescription += ". Pending digests are kept in memory and lost if the server crashes"
+	}
+
+	return func(tool *mcp.Tool) {
+		mcp.WithString("group_key",
+			mcp.Description(groupKeyDescription),
+		)(tool)
+		mcp.WithString("severity",
+			mcp.Enum(SeverityInfo, SeverityWarning, SeverityCritical),
+			mcp.Description("Severity of the message, info by default. When the bot collects messages into digests, messages from its flush severity (critical by default) are sent right away, after the pending digest of their group"),
+		)(tool)
+	}
+}
+
+// sendResultText formats the text of a successful tool result.
+func sendResultText(message string, result *SendResult) string {
+	if result.Attempts > 1 {
+		message = fmt.Sprintf("%s after %d attempts", message, result.Attempts)
+	}
+	if result.DryRun {
+		message += " (dry run)"
+	}
+
+	return message
+}
+
+// sendToolResult builds the result of a successful send: the human readable text
+// followed by the SendResult as an application/json resource, so the caller can see
+// what was posted and what DingDing answered.
+func sendToolResult(message string, result *SendResult) *mcp.CallToolResult {
+	data, err := marshalJSON(result, "  ")
+	if err != nil {
+		return mcp.NewToolResultText(sendResultText(message, result))
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(sendResultText(message, result)),
+			jsonResource("dingding://messages/"+result.MessageID, data),
+		},
+	}
+}
+
+// sendFailure describes a failed send in the structured tool error.
+type sendFailure struct {
+	Bot        string `json:"bot,omitempty"`
+	Error      string `json:"error"`
+	ErrCode    int    `json:"errcode,omitempty"`
+	Code       string `json:"code,omitempty"`
+	ErrMsg     string `json:"errmsg,omitempty"`
+	StatusCode int    `json:"http_status,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	Hint       string `json:"hint,omitempty"`
+}
+
+// sendErrorResult builds the tool error for a failed send, adding the remediation hint of known DingDing errors
+// and the details of the DingDing answer as an application/json resource.
+func sendErrorResult(message string, bot *DingDingBot, err error) *mcp.CallToolResult {
+	failure := sendFailure{Bot: bot.Name(), Error: err.Error(), Hint: ErrorHint(err)}
+
+	text := fmt.Sprintf("%s: %v", message, err)
+	if failure.Hint != "" {
+		text += "\nHint: " + failure.Hint
+	}
+
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		failure.ErrCode = apiErr.ErrCode
+		failure.Code = apiErr.Code
+		failure.ErrMsg = apiErr.ErrMsg
+		failure.StatusCode = apiErr.StatusCode
+		failure.RequestID = apiErr.RequestID
+	}
+
+	data, marshalErr := marshalJSON(failure, "  ")
+	if marshalErr != nil {
+		return mcp.NewToolResultError(text)
+	}
+
+	return &mcp.CallToolResult{
+		Content: []interface{}{
+			mcp.NewTextContent(text),
+			jsonResource("dingding://errors/"+bot.Name(), data),
+		},
+		IsError: true,
+	}
+}
+
+// embeddedTextResource is a tool result content block embedding a text resource.
+// mcp.EmbeddedResource only carries the URI and MIME type, not the text itself.
+type embeddedTextResource struct {
+	Type     string                   `json:"type"`
+	Resource mcp.TextResourceContents `json:"resource"`
+}
+
+// jsonResource wraps JSON data as an embedded resource of a tool result.
+func jsonResource(uri string, data []byte) embeddedTextResource {
+	return embeddedTextResource{
+		Type: "resource",
+		Resource: mcp.TextResourceContents{
+			ResourceContents: mcp.ResourceContents{
+				URI:      uri,
+				MIMEType: "application/json",
+			},
+			Text: string(data),
+		},
+	}
+}
+
+// envString reads a string environment variable, returning def when it is unset.
+func envString(name string, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+// envInt reads an integer environment variable, returning def when it is unset or invalid.
+func envInt(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %v\n", name, err)
+		return def
+	}
+	return n
+}
+
+// envBool reads a boolean environment variable such as "true", returning def when it is unset or invalid.
+func envBool(name string, def bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %v\n", name, err)
+		return def
+	}
+	return b
+}
+
+// envDuration reads a duration environment variable such as "500ms", returning def when it is unset or invalid.
+func envDuration(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s: %v\n", name, err)
+		return def
+	}
+	return d
+}
+
+// splitList splits a comma-separated list such as "a.pem,b.pem", dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
 }
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newToolRequest builds a tool call request with the given arguments.
+func newToolRequest(name string, arguments map[string]interface{}) mcp.CallToolRequest {
+	request := mcp.CallToolRequest{}
+	request.Params.Name = name
+	request.Params.Arguments = arguments
+	return request
+}
+
+// TestConcurrentSendAndUpload fires mixed send and upload tool calls in parallel
+// and checks that each one reaches its own endpoint. Run it with -race.
+func TestConcurrentSendAndUpload(t *testing.T) {
+	var sends, uploads, misrouted int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		isUpload := strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data")
+		result := map[string]interface{}{"errcode": 0, "errmsg": "ok"}
+
+		switch {
+		case r.URL.Path == "/send" && !isUpload:
+			atomic.AddInt64(&sends, 1)
+		case r.URL.Path == "/upload_media" && isUpload:
+			atomic.AddInt64(&uploads, 1)
+			result["media_id"] = "media-id"
+		default:
+			atomic.AddInt64(&misrouted, 1)
+			result = map[string]interface{}{"errcode": 400, "errmsg": fmt.Sprintf("misrouted to %s", r.URL.Path)}
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(result)
+	}))
+	defer server.Close()
+
+	filePath := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(filePath, []byte("report"), 0o600); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "SECtoken", WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	sendText := sendTextHandler(NewDispatcher(bots, nil, nil, nil))
+	sendMarkdown := sendMarkdownHandler(NewDispatcher(bots, nil, nil, nil))
+	uploadFile := uploadFileHandler(bots, FileAccess{})
+
+	const rounds = 20
+	var wg sync.WaitGroup
+	for i := 0; i < rounds; i++ {
+		wg.Add(3)
+		go func(i int) {
+			defer wg.Done()
+			result, _ := sendText(context.Background(), newToolRequest("send_text", map[string]interface{}{
+				"content": fmt.Sprintf("message %d", i),
+			}))
+			if result.IsError {
+				t.Errorf("send_text failed: %+v", result.Content)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			result, _ := sendMarkdown(context.Background(), newToolRequest("send_markdown", map[string]interface{}{
+				"title":   "title",
+				"content": fmt.Sprintf("## message %d", i),
+			}))
+			if result.IsError {
+				t.Errorf("send_markdown failed: %+v", result.Content)
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			result, _ := uploadFile(context.Background(), newToolRequest("upload_file", map[string]interface{}{
+				"file_path": filePath,
+			}))
+			if result.IsError {
+				t.Errorf("upload_file failed: %+v", result.Content)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if sends != 2*rounds || uploads != rounds || misrouted != 0 {
+		t.Errorf("expected %d sends and %d uploads, got %d sends, %d uploads and %d misrouted", 2*rounds, rounds, sends, uploads, misrouted)
+	}
+}
+
+// resultJSON decodes the application/json resource of a tool result.
+func resultJSON(t *testing.T, result *mcp.CallToolResult, dst interface{}) {
+	t.Helper()
+	if len(result.Content) != 2 {
+		t.Fatalf("expected text and JSON content, got %+v", result.Content)
+	}
+	resource, ok := result.Content[1].(embeddedTextResource)
+	if !ok || resource.Resource.MIMEType != "application/json" {
+		t.Fatalf("expected a JSON resource, got %+v", result.Content[1])
+	}
+	if err := json.Unmarshal([]byte(resource.Resource.Text), dst); err != nil {
+		t.Fatalf("failed to decode JSON result: %v", err)
+	}
+}
+
+// TestStructuredSendResult tests the JSON describing a successful send.
+func TestStructuredSendResult(t *testing.T) {
+	bots := NewBotRegistry(WithSender(NewDryRunSender()))
+	bots.Add("ops", "", bots.NewBot("secret-token", "SECsecret"))
+
+	result, _ := sendImageHandler(NewDispatcher(bots, nil, nil, nil), FileAccess{})(context.Background(), newToolRequest("send_image", map[string]interface{}{
+		"base64_data": strings.Repeat("A", 1000),
+		"md5":         "0123456789abcdef0123456789abcdef",
+	}))
+	if result.IsError {
+		t.Fatalf("send_image failed: %+v", result.Content)
+	}
+
+	var sent SendResult
+	resultJSON(t, result, &sent)
+	if sent.MessageID == "" || sent.Bot != "ops" || sent.ErrCode != 0 || sent.ErrMsg != "ok" || sent.Attempts != 1 || sent.Retries != 0 || !sent.DryRun {
+		t.Errorf("unexpected result: %+v", sent)
+	}
+	if strings.Contains(sent.URL, "secret-token") || !strings.Contains(sent.URL, "access_token=REDACTED") {
+		t.Errorf("the access token should be redacted: %s", sent.URL)
+	}
+	if !strings.Contains(string(sent.Payload), "<1000 bytes of base64>") {
+		t.Errorf("the image data should be summarized: %s", sent.Payload)
+	}
+}
+
+// TestStructuredSendFailure tests the JSON describing a failed send.
+func TestStructuredSendFailure(t *testing.T) {
+	server := newErrorServer(300001, "token is not exist")
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+
+	result, _ := sendTextHandler(NewDispatcher(bots, nil, nil, nil))(context.Background(), newToolRequest("send_text", map[string]interface{}{
+		"content": "hello",
+	}))
+	if !result.IsError {
+		t.Fatalf("send_text should fail")
+	}
+
+	var failure sendFailure
+	resultJSON(t, result, &failure)
+	if failure.Bot != DefaultBotName || failure.ErrCode != 300001 || failure.ErrMsg != "token is not exist" || failure.StatusCode != http.StatusOK || failure.RequestID != "request-id" || failure.Hint == "" {
+		t.Errorf("unexpected failure: %+v", failure)
+	}
+}
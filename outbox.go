@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outbox entry states
+const (
+	// OutboxPending means the message waits for its first or next delivery attempt
+	OutboxPending = "pending"
+
+	// OutboxSent means the message was delivered
+	OutboxSent = "sent"
+
+	// OutboxDead means delivery was given up, the message can be retried with RetryMessage
+	OutboxDead = "dead"
+
+	// outboxPurged marks a purged entry in the journal
+	outboxPurged = "purged"
+)
+
+const (
+	// outboxJournalName is the name of the journal file in the outbox directory
+	outboxJournalName = "outbox.jsonl"
+
+	// maxOutboxSentEntries is the number of sent entries kept for inspection, older ones are dropped on compaction
+	maxOutboxSentEntries = 1000
+
+	// outboxIdleWait is how long the worker sleeps when nothing is due
+	outboxIdleWait = time.Minute
+)
+
+// DefaultOutboxPolicy retries failed deliveries ten times over roughly two hours before dead-lettering them
+var DefaultOutboxPolicy = RetryPolicy{
+	MaxAttempts: 10,
+	BaseDelay:   30 * time.Second,
+	MaxDelay:    30 * time.Minute,
+}
+
+// OutboxEntry is a message queued in the outbox.
+type OutboxEntry struct {
+	// ID identifies the entry in the outbox tools
+	ID string `json:"id"`
+
+	// Bot is the name of the bot the message is sent with
+	Bot string `json:"bot"`
+
+	// Message is the message to send
+	Message Message `json:"message"`
+
+	// IdempotencyKey deduplicates the message, see DingDingBot.SendOnce
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Status is one of OutboxPending, OutboxSent or OutboxDead
+	Status string `json:"status"`
+
+	// Attempts is the number of delivery attempts made so far
+	Attempts int `json:"attempts"`
+
+	// LastError describes the last failed delivery attempt
+	LastError string `json:"last_error,omitempty"`
+
+	// CreatedAt is when the message was queued
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is when the entry last changed
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// NextAttempt is when the next delivery attempt is due, for pending entries
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+
+	// Result describes the successful delivery, for sent entries
+	Result *SendResult `json:"result,omitempty"`
+}
+
+// Outbox is a disk-backed queue of messages delivered by a background worker.
+// Every change is appended to a journal in the outbox directory before it takes effect,
+// so queued messages survive restarts and are delivered at least once.
+type Outbox struct {
+	dir    string
+	bots   *BotRegistry
+	policy RetryPolicy
+	clock  clock
+
+	// mu guards entries and the journal
+	mu      sync.Mutex
+	entries map[string]*OutboxEntry
+	journal journal
+
+	// wake interrupts the worker wait when a message is queued or retried
+	wake chan struct{}
+}
+
+// OpenOutbox opens the outbox stored in dir, creating it when needed, and replays its journal.
+// Parameters:
+//   - dir: The directory holding the journal
+//   - bots: The bots messages are sent with, looked up by name on every attempt
+//   - policy: How failed deliveries are retried before they are dead-lettered
+// Returns:
+//   - The outbox, whose worker must be started with Run
+//   - An error if the directory or journal cannot be used
+func OpenOutbox(dir string, bots *BotRegistry, policy RetryPolicy) (*Outbox, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create outbox directory: %v", err)
+	}
+
+	o := &Outbox{
+		dir:     dir,
+		bots:    bots,
+		policy:  policy,
+		clock:   realClock{},
+		entries: make(map[string]*OutboxEntry),
+		journal: journal{path: filepath.Join(dir, outboxJournalName), what: "outbox journal"},
+		wake:    make(chan struct{}, 1),
+	}
+
+	if err := o.replay(); err != nil {
+		return nil, err
+	}
+	if err := o.compact(); err != nil {
+		return nil, err
+	}
+
+	return o, nil
+}
+
+// Close closes the journal. The worker must be stopped first.
+func (o *Outbox) Close() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.journal.close()
+}
+
+// Enqueue queues a message for delivery with the named bot, the default bot when name is empty.
+// A message whose idempotency key was queued for the same bot within the bot's idempotency TTL
+// is not queued again, the journal remembers the keys across restarts.
+// Parameters:
+//   - botName: The name of a registered bot
+//   - key: The idempotency key, empty to derive one from the content when the bot deduplicates content
+//   - msg: The message built by one of the New*Message functions
+// Returns:
+//   - A copy of the queued entry, or of the entry queued earlier with the same key
+//   - Whether the message is a duplicate of an earlier entry
+//   - An error if the bot is unknown or the entry cannot be journaled
+func (o *Outbox) Enqueue(botName string, key string, msg Message) (*OutboxEntry, bool, error) {
+	bot, err := o.bots.Get(botName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := o.clock.Now()
+	entry := &OutboxEntry{
+		ID:             uuid.New().String(),
+		Bot:            bot.Name(),
+		Message:        msg,
+		IdempotencyKey: bot.idempotencyKey(key, msg),
+		Status:         OutboxPending,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+		NextAttempt:    now,
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if original := o.findDuplicate(entry, bot.idempotency.TTL); original != nil {
+		copied := *original
+		return &copied, true, nil
+	}
+
+	if err := o.write(entry); err != nil {
+		return nil, false, err
+	}
+	o.entries[entry.ID] = entry
+	o.compactIfNeeded()
+	o.notify()
+
+	copied := *entry
+	return &copied, false, nil
+}
+
+// findDuplicate returns the live entry queued within ttl with the same bot and idempotency key as entry,
+// nil when there is none. Dead entries do not count, so a failed message can be queued again.
+// The caller must hold mu.
+func (o *Outbox) findDuplicate(entry *OutboxEntry, ttl time.Duration) *OutboxEntry {
+	if entry.IdempotencyKey == "" || ttl <= 0 {
+		return nil
+	}
+
+	for _, existing := range o.entries {
+		if existing.Bot == entry.Bot && existing.IdempotencyKey == entry.IdempotencyKey &&
+			existing.Status != OutboxDead && entry.CreatedAt.Sub(existing.CreatedAt) < ttl {
+			return existing
+		}
+	}
+
+	return nil
+}
+
+// List returns copies of the entries with the given status, all entries when status is empty, oldest first.
+func (o *Outbox) List(status string) []OutboxEntry {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entries := make([]OutboxEntry, 0, len(o.entries))
+	for _, entry := range o.entries {
+		if status == "" || entry.Status == status {
+			entries = append(entries, *entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].CreatedAt.Before(entries[j].CreatedAt)
+	})
+
+	return entries
+}
+
+// RetryMessage makes a dead or pending entry due immediately with a fresh retry budget.
+func (o *Outbox) RetryMessage(id string) (*OutboxEntry, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	entry, ok := o.entries[id]
+	if !ok {
+		return nil, fmt.Errorf("outbox entry %s not found", id)
+	}
+	if entry.Status == OutboxSent {
+		return nil, fmt.Errorf("outbox entry %s was already sent", id)
+	}
+
+	updated := *entry
+	updated.Status = OutboxPending
+	updated.Attempts = 0
+	updated.UpdatedAt = o.clock.Now()
+	updated.NextAttempt = updated.UpdatedAt
+	if err := o.write(&updated); err != nil {
+		return nil, err
+	}
+	o.entries[id] = &updated
+	o.compactIfNeeded()
+	o.notify()
+
+	copied := updated
+	return &copied, nil
+}
+
+// Purge removes entries from the outbox.
+// Parameters:
+//   - id: The entry to remove, in any status; empty to remove by status
+//   - status: The status of the entries to remove when id is empty, empty for both sent and dead entries
+// Returns:
+//   - The number of removed entries
+//   - An error if the entry is unknown or the journal cannot be written
+func (o *Outbox) Purge(id string, status string) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var purged []*OutboxEntry
+	if id != "" {
+		entry, ok := o.entries[id]
+		if !ok {
+			return 0, fmt.Errorf("outbox entry %s not found", id)
+		}
+		purged = append(purged, entry)
+	} else {
+		for _, entry := range o.entries {
+			if entry.Status == status || (status == "" && entry.Status != OutboxPending) {
+				purged = append(purged, entry)
+			}
+		}
+	}
+
+	for _, entry := range purged {
+		if err := o.write(&OutboxEntry{ID: entry.ID, Status: outboxPurged, UpdatedAt: o.clock.Now()}); err != nil {
+			return 0, err
+		}
+		delete(o.entries, entry.ID)
+	}
+	o.compactIfNeeded()
+
+	return len(purged), nil
+}
+
+// Run delivers due messages until ctx is done. A delivery interrupted by ctx stays pending.
+func (o *Outbox) Run(ctx context.Context) {
+	for {
+		wait := outboxIdleWait
+		if next := o.deliverDue(ctx); !next.IsZero() {
+			wait = min(max(next.Sub(o.clock.Now()), 0), outboxIdleWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-o.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// deliverDue attempts the delivery of every due pending entry, oldest first,
+// and returns when the next pending entry is due, zero when none is pending.
+func (o *Outbox) deliverDue(ctx context.Context) time.Time {
+	now := o.clock.Now()
+
+	var due []OutboxEntry
+	for _, entry := range o.List(OutboxPending) {
+		if !entry.NextAttempt.After(now) {
+			due = append(due, entry)
+		}
+	}
+
+	for _, entry := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		o.deliver(ctx, entry)
+	}
+
+	var next time.Time
+	for _, entry := range o.List(OutboxPending) {
+		if next.IsZero() || entry.NextAttempt.Before(next) {
+			next = entry.NextAttempt
+		}
+	}
+
+	return next
+}
+
+// deliver makes a delivery attempt for a copy of an entry and records its outcome.
+// An attempt interrupted by ctx, such as on shutdown, is not recorded and the entry stays pending.
+func (o *Outbox) deliver(ctx context.Context, entry OutboxEntry) {
+	var result *SendResult
+	bot, err := o.bots.Get(entry.Bot)
+	if err == nil {
+		// Deliveries run in the background, they are not tied to the context of a tool call
+		result, err = bot.SendOnce(ctx, entry.IdempotencyKey, entry.Message)
+	}
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	// The entry may have been purged or retried during the attempt
+	current, ok := o.entries[entry.ID]
+	if !ok || !current.UpdatedAt.Equal(entry.UpdatedAt) {
+		return
+	}
+
+	updated := *current
+	updated.Attempts++
+	updated.UpdatedAt = o.clock.Now()
+
+	switch {
+	case err == nil:
+		updated.Status = OutboxSent
+		updated.Result = result
+		updated.LastError = ""
+		updated.NextAttempt = time.Time{}
+	case transient(err) && updated.Attempts < max(o.policy.MaxAttempts, 1):
+		updated.LastError = err.Error()
+		updated.NextAttempt = updated.UpdatedAt.Add(o.policy.backoff(updated.Attempts))
+	default:
+		updated.Status = OutboxDead
+		updated.LastError = err.Error()
+		updated.NextAttempt = time.Time{}
+		log.Printf("Outbox entry %s is dead after %d attempts: %v\n", updated.ID, updated.Attempts, err)
+	}
+
+	if err := o.write(&updated); err != nil {
+		log.Printf("Failed to journal outbox entry %s: %v\n", updated.ID, err)
+		return
+	}
+	o.entries[entry.ID] = &updated
+	o.compactIfNeeded()
+}
+
+// notify wakes the worker up without blocking.
+func (o *Outbox) notify() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// write appends an entry to the journal and syncs it to disk. The caller must hold mu.
+func (o *Outbox) write(entry *OutboxEntry) error {
+	return o.journal.append(entry)
+}
+
+// compactIfNeeded compacts the journal once it holds much more records than entries.
+// It is called after the entries are updated. The caller must hold mu.
+func (o *Outbox) compactIfNeeded() {
+	if !o.journal.needsRewrite(len(o.entries)) {
+		return
+	}
+	if err := o.compact(); err != nil {
+		log.Printf("Failed to compact the outbox journal: %v\n", err)
+	}
+}
+
+// replay rebuilds the entries from the journal, the last record of an entry wins.
+func (o *Outbox) replay() error {
+	return replayJournal(o.journal.path, o.journal.what, func(entry *OutboxEntry) {
+		if entry.Status == outboxPurged {
+			delete(o.entries, entry.ID)
+		} else {
+			o.entries[entry.ID] = entry
+		}
+	})
+}
+
+// compact rewrites the journal with one record per entry, dropping the oldest sent entries
+// beyond maxOutboxSentEntries, and reopens it for appending. The caller must hold mu or own o.
+func (o *Outbox) compact() error {
+	var sent []*OutboxEntry
+	for _, entry := range o.entries {
+		if entry.Status == OutboxSent {
+			sent = append(sent, entry)
+		}
+	}
+	if len(sent) > maxOutboxSentEntries {
+		sort.Slice(sent, func(i, j int) bool {
+			return sent[i].UpdatedAt.Before(sent[j].UpdatedAt)
+		})
+		for _, entry := range sent[:len(sent)-maxOutboxSentEntries] {
+			delete(o.entries, entry.ID)
+		}
+	}
+
+	records := make([]interface{}, 0, len(o.entries))
+	for _, entry := range o.entries {
+		records = append(records, entry)
+	}
+
+	return o.journal.rewrite(records)
+}
@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestOutbox opens an outbox in a temporary directory sending with a single-attempt bot against server.
+func newTestOutbox(t *testing.T, dir string, baseURL string) (*Outbox, *fakeClock) {
+	clk := newFakeClock()
+	bots := NewBotRegistry(WithBaseURL(baseURL), withClock(clk), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	bots.Add("ops", "", bots.NewBot("token", ""))
+
+	outbox, err := OpenOutbox(dir, bots, RetryPolicy{MaxAttempts: 3, BaseDelay: time.Minute, MaxDelay: time.Hour})
+	if err != nil {
+		t.Fatalf("OpenOutbox failed: %v", err)
+	}
+	outbox.clock = clk
+	t.Cleanup(func() { outbox.Close() })
+
+	return outbox, clk
+}
+
+// TestOutboxRetriesTransientFailures tests that transient failures are retried after a backoff.
+func TestOutboxRetriesTransientFailures(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	outbox, clk := newTestOutbox(t, t.TempDir(), server.URL)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	entry, _, err := outbox.Enqueue("", "", msg)
+	if err != nil {
+		t.Fatalf("Enqueue failed: %v", err)
+	}
+	if entry.Bot != "ops" || entry.Status != OutboxPending {
+		t.Errorf("unexpected entry: %+v", entry)
+	}
+
+	next := outbox.deliverDue(context.Background())
+	entries := outbox.List(OutboxPending)
+	if len(entries) != 1 || entries[0].Attempts != 1 || entries[0].LastError == "" {
+		t.Fatalf("expected a pending entry after the first failure, got %+v", entries)
+	}
+	if delay := next.Sub(clk.Now()); delay < 30*time.Second || delay > time.Minute {
+		t.Errorf("unexpected backoff: %v", delay)
+	}
+
+	// Nothing is due before the backoff elapsed
+	outbox.deliverDue(context.Background())
+	if calls != 1 {
+		t.Errorf("expected 1 call before the backoff elapsed, got %d", calls)
+	}
+
+	clk.Advance(time.Minute)
+	if next := outbox.deliverDue(context.Background()); !next.IsZero() {
+		t.Errorf("nothing should be pending, next attempt at %v", next)
+	}
+	sent := outbox.List(OutboxSent)
+	if len(sent) != 1 || sent[0].Attempts != 2 || sent[0].Result == nil || sent[0].Result.Bot != "ops" {
+		t.Errorf("expected a sent entry, got %+v", sent)
+	}
+}
+
+// TestOutboxDeadLetter tests that permanent failures are dead-lettered and can be retried.
+func TestOutboxDeadLetter(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	entry, _, _ := outbox.Enqueue("ops", "", msg)
+	outbox.deliverDue(context.Background())
+
+	dead := outbox.List(OutboxDead)
+	if len(dead) != 1 || !strings.Contains(dead[0].LastError, "300001") {
+		t.Fatalf("expected a dead entry, got %+v", outbox.List(""))
+	}
+
+	if _, err := outbox.RetryMessage(entry.ID); err != nil {
+		t.Fatalf("RetryMessage failed: %v", err)
+	}
+	outbox.deliverDue(context.Background())
+	if sent := outbox.List(OutboxSent); len(sent) != 1 || sent[0].Attempts != 1 {
+		t.Errorf("expected the retried entry to be sent, got %+v", outbox.List(""))
+	}
+
+	if _, err := outbox.RetryMessage(entry.ID); err == nil {
+		t.Errorf("sent entries should not be retried")
+	}
+	if _, err := outbox.RetryMessage("unknown"); err == nil {
+		t.Errorf("unknown entries should not be retried")
+	}
+}
+
+// TestOutboxGivesUp tests that entries are dead-lettered once the retry budget is spent.
+func TestOutboxGivesUp(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, 500, 500, 500, 500)
+	defer server.Close()
+
+	outbox, clk := newTestOutbox(t, t.TempDir(), server.URL)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	outbox.Enqueue("ops", "", msg)
+	for i := 0; i < 3; i++ {
+		outbox.deliverDue(context.Background())
+		clk.Advance(time.Hour)
+	}
+
+	if dead := outbox.List(OutboxDead); len(dead) != 1 || dead[0].Attempts != 3 || calls != 3 {
+		t.Errorf("expected a dead entry after 3 attempts, got %+v (%d calls)", outbox.List(""), calls)
+	}
+}
+
+// TestOutboxSurvivesRestart tests that pending entries are replayed from the journal.
+func TestOutboxSurvivesRestart(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls)
+	defer server.Close()
+
+	dir := t.TempDir()
+	outbox, clk := newTestOutbox(t, dir, server.URL)
+
+	msg, _ := NewMarkdownMessage("title", "content", nil, nil, false)
+	pending, _, _ := outbox.Enqueue("ops", "", msg)
+	clk.Advance(time.Second)
+	sent, _, _ := outbox.Enqueue("ops", "", msg)
+	purged, _, _ := outbox.Enqueue("ops", "", msg)
+	if _, err := outbox.Purge(purged.ID, ""); err != nil {
+		t.Fatalf("Purge failed: %v", err)
+	}
+
+	// Deliver only the second entry
+	entries := outbox.List(OutboxPending)
+	for _, entry := range entries {
+		if entry.ID == sent.ID {
+			outbox.deliver(context.Background(), entry)
+		}
+	}
+	outbox.Close()
+
+	// Simulate a crash in the middle of a write
+	journal, err := os.OpenFile(filepath.Join(dir, outboxJournalName), os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("failed to open journal: %v", err)
+	}
+	journal.WriteString(`{"id":"truncated","sta`)
+	journal.Close()
+
+	reopened, _ := newTestOutbox(t, dir, server.URL)
+	all := reopened.List("")
+	if len(all) != 2 {
+		t.Fatalf("expected 2 entries after restart, got %+v", all)
+	}
+	if all[0].ID != pending.ID || all[0].Status != OutboxPending || all[1].ID != sent.ID || all[1].Status != OutboxSent {
+		t.Errorf("unexpected entries after restart: %+v", all)
+	}
+
+	reopened.deliverDue(context.Background())
+	if len(reopened.List(OutboxSent)) != 2 || calls != 2 {
+		t.Errorf("expected the pending entry to be delivered after restart, got %+v (%d calls)", reopened.List(""), calls)
+	}
+}
+
+// TestOutboxPurge tests purging entries by status.
+func TestOutboxPurge(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	for i := 0; i < 3; i++ {
+		outbox.Enqueue("ops", "", msg)
+		if i < 2 {
+			outbox.deliverDue(context.Background())
+		}
+	}
+
+	// One dead, one sent and one pending entry
+	if n, err := outbox.Purge("", OutboxDead); err != nil || n != 1 {
+		t.Errorf("expected 1 dead entry purged, got %d (%v)", n, err)
+	}
+	if n, _ := outbox.Purge("", ""); n != 1 {
+		t.Errorf("expected 1 sent entry purged, got %d", n)
+	}
+	if pending := outbox.List(""); len(pending) != 1 || pending[0].Status != OutboxPending {
+		t.Errorf("the pending entry should be kept, got %+v", pending)
+	}
+	if _, err := outbox.Purge("unknown", ""); err == nil {
+		t.Errorf("purging an unknown entry should fail")
+	}
+}
+
+// TestOutboxTools tests queuing through a send tool and managing the outbox with the outbox tools.
+func TestOutboxTools(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(310000))
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+	ctx := context.Background()
+
+	result, _ := sendTextHandler(NewDispatcher(outbox.bots, outbox, nil, nil))(ctx, newToolRequest("send_text", map[string]interface{}{
+		"content": "hello",
+	}))
+	if result.IsError || calls != 0 {
+		t.Fatalf("send_text should queue the message, got %+v", result.Content)
+	}
+	var queued []OutboxEntry
+	resultJSON(t, result, &queued)
+	if len(queued) != 1 || queued[0].Status != OutboxPending {
+		t.Fatalf("unexpected queued entries: %+v", queued)
+	}
+
+	outbox.deliverDue(context.Background())
+
+	result, _ = listOutboxHandler(outbox)(ctx, newToolRequest("list_outbox", map[string]interface{}{"status": OutboxDead}))
+	var dead []OutboxEntry
+	resultJSON(t, result, &dead)
+	if len(dead) != 1 || dead[0].ID != queued[0].ID {
+		t.Errorf("expected the dead entry, got %+v", dead)
+	}
+
+	result, _ = retryMessageHandler(outbox)(ctx, newToolRequest("retry_message", map[string]interface{}{"id": queued[0].ID}))
+	if result.IsError {
+		t.Errorf("retry_message failed: %+v", result.Content)
+	}
+
+	result, _ = purgeOutboxHandler(outbox)(ctx, newToolRequest("purge_outbox", map[string]interface{}{"id": queued[0].ID}))
+	if result.IsError || len(outbox.List("")) != 0 {
+		t.Errorf("purge_outbox failed: %+v", result.Content)
+	}
+}
+
+// TestOutboxRun tests that the worker delivers queued messages in the background.
+func TestOutboxRun(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls)
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(done)
+	}()
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	outbox.Enqueue("ops", "", msg)
+
+	for i := 0; i < 100 && len(outbox.List(OutboxSent)) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cancel()
+	<-done
+
+	if len(outbox.List(OutboxSent)) != 1 {
+		t.Errorf("expected the worker to deliver the message, got %+v", outbox.List(""))
+	}
+}
+
+// TestOutboxRunShutdown tests that stopping the worker interrupts a delivery in flight and leaves the entry pending.
+func TestOutboxRunShutdown(t *testing.T) {
+	received := make(chan struct{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		outbox.Run(ctx)
+		close(done)
+	}()
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	outbox.Enqueue("ops", "", msg)
+	<-received
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("the worker did not stop during the delivery")
+	}
+	pending := outbox.List(OutboxPending)
+	if len(pending) != 1 || pending[0].Attempts != 0 || pending[0].LastError != "" {
+		t.Errorf("expected the interrupted entry to stay pending, got %+v", outbox.List(""))
+	}
+}
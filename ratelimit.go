@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// DefaultRateLimit matches the DingDing limit of 20 messages per minute per custom robot.
+// Exceeding it mutes the robot for 10 minutes, so sends are rejected rather than risked.
+var DefaultRateLimit = RateLimit{PerMinute: 20}
+
+// RateLimit configures the client-side token bucket limiting the messages sent by a bot.
+// On top of the bucket, no more than PerMinute messages are sent in any 60 seconds.
+type RateLimit struct {
+	// PerMinute is the number of messages allowed in any 60 seconds, 0 disables the limiter
+	PerMinute int `json:"per_minute"`
+
+	// Burst is the number of messages that can be sent at once, PerMinute when 0
+	Burst int `json:"burst,omitempty"`
+
+	// MaxWait is how long a send may be queued for budget before it is rejected, 0 rejects immediately
+	MaxWait Duration `json:"max_wait,omitempty"`
+}
+
+// RateLimitError is returned when a message is rejected by the rate limiter.
+type RateLimitError struct {
+	// RetryAfter is how long until the bot has budget for the message
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("rate limited, retry after %ds", int(math.Ceil(e.RetryAfter.Seconds())))
+}
+
+// rateLimiter is a token bucket refilled continuously at the configured rate,
+// combined with a sliding window admitting perMinute sends in any minute.
+type rateLimiter struct {
+	mu        sync.Mutex
+	clock     clock
+	rate      float64 // tokens per second
+	burst     float64
+	perMinute int
+	maxWait   time.Duration
+	tokens    float64
+	last      time.Time
+
+	// sent lists the times of the latest sends admitted within the last minute, including the queued ones, in order
+	sent []time.Time
+}
+
+// newRateLimiter creates a full token bucket for limit, nil when the limit is disabled.
+func newRateLimiter(limit RateLimit, clk clock) *rateLimiter {
+	if limit.PerMinute <= 0 {
+		return nil
+	}
+
+	burst := limit.Burst
+	if burst <= 0 {
+		burst = limit.PerMinute
+	}
+
+	return &rateLimiter{
+		clock:     clk,
+		rate:      float64(limit.PerMinute) / 60,
+		burst:     float64(burst),
+		perMinute: limit.PerMinute,
+		maxWait:   time.Duration(limit.MaxWait),
+		tokens:    float64(burst),
+		last:      clk.Now(),
+	}
+}
+
+// wait takes a token from the bucket, queueing for at most maxWait until one is available.
+// Returns a *RateLimitError when the wait would be longer than maxWait, or the error of ctx when it is done first.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	l.mu.Lock()
+
+	now := l.clock.Now()
+	l.tokens = math.Min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	for len(l.sent) > l.perMinute || (len(l.sent) > 0 && !l.sent[0].After(now.Add(-time.Minute))) {
+		l.sent = l.sent[1:]
+	}
+
+	// Reserve the token and the send time up front so that concurrent callers queue behind each other
+	l.tokens--
+	at := now
+	if l.tokens < 0 {
+		at = now.Add(time.Duration(-l.tokens / l.rate * float64(time.Second)))
+	}
+	if len(l.sent) == l.perMinute {
+		// The send waits until the oldest send of the window is a minute old
+		if windowAt := l.sent[0].Add(time.Minute); windowAt.After(at) {
+			at = windowAt
+		}
+	}
+	delay := at.Sub(now)
+	if delay > l.maxWait {
+		l.tokens++
+		l.mu.Unlock()
+		return &RateLimitError{RetryAfter: delay}
+	}
+	l.sent = append(l.sent, at)
+
+	l.mu.Unlock()
+
+	if delay > 0 {
+		if err := l.clock.Sleep(ctx, delay); err != nil {
+			// Give the reserved token and send time back
+			l.mu.Lock()
+			l.tokens++
+			for i := len(l.sent) - 1; i >= 0; i-- {
+				if l.sent[i].Equal(at) {
+					l.sent = append(l.sent[:i], l.sent[i+1:]...)
+					break
+				}
+			}
+			l.mu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRateLimiterRejects tests that sends beyond the budget are rejected with the time to wait.
+func TestRateLimiterRejects(t *testing.T) {
+	clk := newFakeClock()
+	limiter := newRateLimiter(RateLimit{PerMinute: 20}, clk)
+
+	for i := 0; i < 20; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("send %d should be allowed: %v", i, err)
+		}
+	}
+
+	err := limiter.wait(context.Background())
+	var rateLimitErr *RateLimitError
+	if !errors.As(err, &rateLimitErr) {
+		t.Fatalf("expected a RateLimitError, got %v", err)
+	}
+	if rateLimitErr.RetryAfter != time.Minute || err.Error() != "rate limited, retry after 60s" {
+		t.Errorf("unexpected rate limit error: %v (%v)", err, rateLimitErr.RetryAfter)
+	}
+
+	// The bucket refills a message worth of budget every 3 seconds, but the window
+	// admits no send until the first ones are a minute old
+	clk.Advance(3 * time.Second)
+	if err := limiter.wait(context.Background()); !errors.As(err, &rateLimitErr) || rateLimitErr.RetryAfter != 57*time.Second {
+		t.Errorf("send should be rejected until the window moves on, got %v", err)
+	}
+	clk.Advance(57 * time.Second)
+	for i := 0; i < 20; i++ {
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("send %d should be allowed a minute later: %v", i, err)
+		}
+	}
+	if err := limiter.wait(context.Background()); err == nil {
+		t.Errorf("send beyond the window should be rejected")
+	}
+
+	// The bucket never holds more than the burst
+	clk.Advance(time.Hour)
+	for i := 0; i < 20; i++ {
+		limiter.wait(context.Background())
+	}
+	if err := limiter.wait(context.Background()); err == nil {
+		t.Errorf("send beyond the burst should be rejected")
+	}
+}
+
+// TestRateLimiterQueues tests that sends wait for budget up to MaxWait.
+func TestRateLimiterQueues(t *testing.T) {
+	clk := newFakeClock()
+	limiter := newRateLimiter(RateLimit{PerMinute: 20, Burst: 1, MaxWait: Duration(5 * time.Second)}, clk)
+
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatalf("first send should be allowed: %v", err)
+	}
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatalf("second send should be queued: %v", err)
+	}
+	if sleeps := clk.Sleeps(); len(sleeps) != 1 || sleeps[0] != 3*time.Second {
+		t.Errorf("expected a single 3s wait, got %v", sleeps)
+	}
+
+	// The next token is 3 seconds away again, within MaxWait, but two queued sends are not
+	if err := limiter.wait(context.Background()); err != nil {
+		t.Fatalf("third send should be queued: %v", err)
+	}
+	if newRateLimiter(RateLimit{}, clk) != nil {
+		t.Errorf("a zero rate limit should disable the limiter")
+	}
+}
+
+// TestRateLimiterWindow tests that no more than PerMinute sends are admitted in any 60 seconds.
+func TestRateLimiterWindow(t *testing.T) {
+	clk := newFakeClock()
+	limiter := newRateLimiter(RateLimit{PerMinute: 20, MaxWait: Duration(time.Hour)}, clk)
+
+	var sent []time.Time
+	for i := 0; i < 200; i++ {
+		clk.Advance(time.Duration(i%7) * time.Second)
+		if err := limiter.wait(context.Background()); err != nil {
+			t.Fatalf("send %d should be queued: %v", i, err)
+		}
+		sent = append(sent, clk.Now())
+	}
+
+	for i := 20; i < len(sent); i++ {
+		if span := sent[i].Sub(sent[i-20]); span < time.Minute {
+			t.Fatalf("sends %d to %d were admitted within %v", i-20, i, span)
+		}
+	}
+}
+
+// TestBotRateLimit tests that the bot applies the limiter to messages but not uploads.
+func TestBotRateLimit(t *testing.T) {
+	dryRun := NewDryRunSender()
+	bot := NewDingDingBot("token", "", WithSender(dryRun), withClock(newFakeClock()), WithRateLimit(RateLimit{PerMinute: 2}))
+
+	for i := 0; i < 2; i++ {
+		if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err != nil {
+			t.Fatalf("send %d should be allowed: %v", i, err)
+		}
+	}
+	if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err == nil {
+		t.Errorf("third send should be rate limited")
+	}
+	if len(dryRun.Records()) != 2 {
+		t.Errorf("rate limited messages should not be sent, got %d", len(dryRun.Records()))
+	}
+}
+
+// TestBotRateLimitRetries tests that retries take budget from the limiter like the first attempt.
+func TestBotRateLimitRetries(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(130101), int64(130101), int64(130101))
+	defer server.Close()
+
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), withClock(newFakeClock()),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 5, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}),
+		WithRateLimit(RateLimit{PerMinute: 2}))
+
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	var rateLimitErr *RateLimitError
+	if !errors.Is(err, ErrThrottled) || errors.As(err, &rateLimitErr) || !strings.Contains(err.Error(), "retry not sent: rate limited") {
+		t.Errorf("expected the throttled send to stop once out of budget, got %v", err)
+	}
+	if calls != 2 {
+		t.Errorf("expected 2 attempts within the budget, got %d", calls)
+	}
+}
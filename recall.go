@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMessageLogSize is the number of sent messages remembered for recall
+	DefaultMessageLogSize = 1000
+
+	// DefaultMessageLogMaxAge is how long sent messages are remembered for recall,
+	// DingDing does not recall older messages
+	DefaultMessageLogMaxAge = 24 * time.Hour
+
+	// messageLogJournalName is the name of the message log journal in the state directory
+	messageLogJournalName = "messages.jsonl"
+)
+
+// Paths of the DingDing open API recalling robot messages, relative to the API base URL
+const (
+	// groupRecallPath is the endpoint for recalling robot messages sent to a group
+	groupRecallPath = "/v1.0/robot/groupMessages/recall"
+
+	// directRecallPath is the endpoint for recalling robot messages sent in one-to-one chats
+	directRecallPath = "/v1.0/robot/otoMessages/batchRecall"
+)
+
+// Channels a message can be sent through, recorded in the message log
+const (
+	// ChannelWebhook is the robot webhook of a group
+	ChannelWebhook = "webhook"
+
+	// ChannelSession is the session webhook of a received message, see Reply
+	ChannelSession = "session"
+
+	// ChannelGroup is the robot of an enterprise app posting to a group
+	ChannelGroup = "group"
+
+	// ChannelDirect is the robot of an enterprise app posting in one-to-one chats
+	ChannelDirect = "direct"
+)
+
+// ErrRecallNotSupported means the message was sent through a webhook, which cannot recall its messages
+var ErrRecallNotSupported = errors.New("message cannot be recalled")
+
+// SentMessage is a message recorded in the MessageLog.
+type SentMessage struct {
+	// MessageID is the client generated ID of the message, as returned by the send tools
+	MessageID string `json:"message_id"`
+
+	// Bot is the name of the bot the message was sent with
+	Bot string `json:"bot"`
+
+	// Channel is how the message was sent, one of the Channel* constants
+	Channel string `json:"channel"`
+
+	// OpenConversationID is the group of a message sent through ChannelGroup
+	OpenConversationID string `json:"open_conversation_id,omitempty"`
+
+	// ProcessQueryKeys identify the message in DingDing, one per batch for direct messages
+	ProcessQueryKeys []string `json:"process_query_keys,omitempty"`
+
+	// DryRun reports whether the message was captured instead of delivered
+	DryRun bool `json:"dry_run"`
+
+	// SentAt is when the message was sent
+	SentAt time.Time `json:"sent_at"`
+
+	// Recalled reports whether the message was recalled
+	Recalled bool `json:"recalled"`
+}
+
+// MessageLog remembers the latest sent messages so that they can be recalled,
+// up to a number of messages and for a maximum age.
+// Opened with OpenMessageLog, it is journaled in the state directory and survives restarts.
+// Created with NewMessageLog, it is kept in memory, so messages sent before a restart cannot be recalled.
+// It is safe for concurrent use.
+type MessageLog struct {
+	mu       sync.Mutex
+	size     int
+	maxAge   time.Duration
+	clock    clock
+	messages map[string]*SentMessage
+
+	// order lists the message IDs oldest first, to forget the oldest message when the log is full
+	order []string
+
+	// journal records the sent messages, nil when they are kept in memory
+	journal *journal
+}
+
+// NewMessageLog creates a MessageLog kept in memory.
+// Parameters:
+//   - size: The number of messages remembered, DefaultMessageLogSize when not positive
+//   - maxAge: How long messages are remembered, DefaultMessageLogMaxAge when not positive
+// Returns:
+//   - A pointer to a new MessageLog
+func NewMessageLog(size int, maxAge time.Duration) *MessageLog {
+	if size <= 0 {
+		size = DefaultMessageLogSize
+	}
+	if maxAge <= 0 {
+		maxAge = DefaultMessageLogMaxAge
+	}
+	return &MessageLog{size: size, maxAge: maxAge, clock: realClock{}, messages: make(map[string]*SentMessage)}
+}
+
+// OpenMessageLog opens the message log stored in dir, creating it when needed, and replays its journal.
+// Parameters:
+//   - dir: The state directory holding the journal
+//   - size: The number of messages remembered, DefaultMessageLogSize when not positive
+//   - maxAge: How long messages are remembered, DefaultMessageLogMaxAge when not positive
+// Returns:
+//   - A pointer to a MessageLog holding the messages of the journal
+//   - An error if the directory or journal cannot be used
+func OpenMessageLog(dir string, size int, maxAge time.Duration) (*MessageLog, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	l := NewMessageLog(size, maxAge)
+	l.journal = &journal{path: filepath.Join(dir, messageLogJournalName), what: "message log journal"}
+
+	err := replayJournal(l.journal.path, l.journal.what, func(msg *SentMessage) {
+		l.put(msg)
+	})
+	if err != nil {
+		return nil, err
+	}
+	l.prune()
+	if err := l.journal.rewrite(l.records()); err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Close closes the journal.
+func (l *MessageLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.journal == nil {
+		return nil
+	}
+	return l.journal.close()
+}
+
+// add records a sent message, forgetting the oldest one when the log is full.
+func (l *MessageLog) add(msg SentMessage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.put(&msg)
+	l.prune()
+	l.record(&msg)
+}
+
+// Get returns the message sent with the given message ID.
+func (l *MessageLog) Get(messageID string) (SentMessage, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.prune()
+	msg, ok := l.messages[messageID]
+	if !ok {
+		return SentMessage{}, fmt.Errorf("unknown message %s, the message log only keeps the last %d messages sent within %s", messageID, l.size, l.maxAge)
+	}
+	return *msg, nil
+}
+
+// markRecalled records that a message was recalled.
+func (l *MessageLog) markRecalled(messageID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if msg, ok := l.messages[messageID]; ok {
+		msg.Recalled = true
+		l.record(msg)
+	}
+}
+
+// put makes msg the current state of its message, keeping its place in the log. The caller must hold mu.
+func (l *MessageLog) put(msg *SentMessage) {
+	if _, ok := l.messages[msg.MessageID]; !ok {
+		l.order = append(l.order, msg.MessageID)
+	}
+	l.messages[msg.MessageID] = msg
+}
+
+// prune forgets the oldest messages beyond the size of the log and the messages older than maxAge.
+// The caller must hold mu.
+func (l *MessageLog) prune() {
+	oldest := l.clock.Now().Add(-l.maxAge)
+	for len(l.order) > 0 {
+		if msg := l.messages[l.order[0]]; len(l.order) <= l.size && !msg.SentAt.Before(oldest) {
+			break
+		}
+		delete(l.messages, l.order[0])
+		l.order = l.order[1:]
+	}
+}
+
+// record appends a message to the journal, compacting it once it holds much more records than messages.
+// The caller must hold mu.
+func (l *MessageLog) record(msg *SentMessage) {
+	if l.journal == nil {
+		return
+	}
+
+	if err := l.journal.append(msg); err != nil {
+		log.Printf("Failed to journal message %s: %v\n", msg.MessageID, err)
+		return
+	}
+	if l.journal.needsRewrite(len(l.messages)) {
+		if err := l.journal.rewrite(l.records()); err != nil {
+			log.Printf("Failed to compact the message log journal: %v\n", err)
+		}
+	}
+}
+
+// records returns the messages of the log oldest first, as journal records. The caller must hold mu.
+func (l *MessageLog) records() []interface{} {
+	records := make([]interface{}, 0, len(l.order))
+	for _, id := range l.order {
+		records = append(records, l.messages[id])
+	}
+	return records
+}
+
+// recallable checks that the message was sent through the robot of an enterprise app and is not recalled yet.
+func (msg SentMessage) recallable() error {
+	if msg.Channel != ChannelGroup && msg.Channel != ChannelDirect {
+		return fmt.Errorf("%w: message %s was sent through a %s webhook, only messages sent through an enterprise app robot can be recalled",
+			ErrRecallNotSupported, msg.MessageID, msg.Channel)
+	}
+	if msg.Recalled {
+		return fmt.Errorf("message %s was already recalled", msg.MessageID)
+	}
+	return nil
+}
+
+// RecallResult describes the recall of a message.
+type RecallResult struct {
+	// MessageID is the client generated ID of the recalled message
+	MessageID string `json:"message_id"`
+
+	// Bot is the name of the bot the message was sent and recalled with
+	Bot string `json:"bot"`
+
+	// DryRun reports whether the request was captured instead of delivered
+	DryRun bool `json:"dry_run"`
+
+	// Recalled lists the process query keys DingDing recalled
+	Recalled []string `json:"recalled"`
+
+	// Failed maps the process query keys DingDing could not recall to the reason
+	Failed map[string]string `json:"failed,omitempty"`
+}
+
+// Recall takes back a message sent with the bot through the robot of its enterprise app.
+// Messages sent through a webhook cannot be recalled.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - messageID: The MessageID of the result of the send
+// Returns:
+//   - The outcome per process query key, the message is marked recalled when none failed
+//   - An error wrapping ErrRecallNotSupported for webhook messages, or an error if the message is unknown or the request fails, nil otherwise
+func (bot *DingDingBot) Recall(ctx context.Context, messageID string) (*RecallResult, error) {
+	if bot.messageLog == nil {
+		return nil, fmt.Errorf("bot %s does not keep a message log", bot.name)
+	}
+
+	msg, err := bot.messageLog.Get(messageID)
+	if err != nil {
+		return nil, err
+	}
+	if msg.Bot != bot.name {
+		return nil, fmt.Errorf("message %s was sent with bot %s, not %s", messageID, msg.Bot, bot.name)
+	}
+	if err := msg.recallable(); err != nil {
+		return nil, err
+	}
+
+	if bot.app == nil {
+		return nil, fmt.Errorf("bot %s has no enterprise app to recall message %s with", bot.name, messageID)
+	}
+
+	endpoint := directRecallPath
+	request := map[string]interface{}{"robotCode": bot.app.robotCode, "processQueryKeys": msg.ProcessQueryKeys}
+	if msg.Channel == ChannelGroup {
+		endpoint = groupRecallPath
+		request["openConversationId"] = msg.OpenConversationID
+	}
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	resp, err := bot.post(ctx, bot.app.baseURL+endpoint, authAccessToken, "application/json", body)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &RecallResult{MessageID: messageID, Bot: bot.name, DryRun: resp.dryRun, Recalled: []string{}}
+	failed, _ := resp.result["failedResult"].(map[string]interface{})
+	for _, key := range msg.ProcessQueryKeys {
+		if reason, ok := failed[key]; ok {
+			if result.Failed == nil {
+				result.Failed = make(map[string]string)
+			}
+			result.Failed[key] = fmt.Sprint(reason)
+			continue
+		}
+		result.Recalled = append(result.Recalled, key)
+	}
+
+	if len(result.Failed) == 0 {
+		bot.messageLog.markRecalled(messageID)
+	}
+	return result, nil
+}
+
+// logMessage records a message sent with the bot in its message log, if any.
+func (bot *DingDingBot) logMessage(messageID string, channel string, processQueryKeys []string, dryRun bool) {
+	if bot.messageLog == nil {
+		return
+	}
+
+	msg := SentMessage{
+		MessageID:        messageID,
+		Bot:              bot.name,
+		Channel:          channel,
+		ProcessQueryKeys: processQueryKeys,
+		DryRun:           dryRun,
+		SentAt:           bot.clock.Now(),
+	}
+	if channel == ChannelGroup {
+		msg.OpenConversationID = bot.openConversationID
+	}
+	bot.messageLog.add(msg)
+}
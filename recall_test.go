@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// TestRecall tests recalling group and direct messages and the messages that cannot be recalled.
+func TestRecall(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	clk := newFakeClock()
+	messageLog := NewMessageLog(10, 0)
+	messageLog.clock = clk
+	bot := newEnterpriseBot(t, stub, clk, WithMessageLog(messageLog))
+	ctx := context.Background()
+
+	sent, err := bot.SendText(ctx, "wrong group", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	result, err := bot.Recall(ctx, sent.MessageID)
+	if err != nil {
+		t.Fatalf("Recall failed: %v", err)
+	}
+	if len(result.Recalled) != 1 || result.Recalled[0] != "key-1" || len(result.Failed) != 0 {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	recall := stub.recalls[0]
+	if recall.path != groupRecallPath || recall.OpenConversationID != "cid-ops" || recall.RobotCode != "ding-app" {
+		t.Errorf("unexpected group recall: %+v", recall)
+	}
+	if _, err := bot.Recall(ctx, sent.MessageID); err == nil || !strings.Contains(err.Error(), "already recalled") {
+		t.Errorf("expected a second recall to be rejected, got %v", err)
+	}
+
+	users := make([]string, directMessageBatchSize+1)
+	for i := range users {
+		users[i] = fmt.Sprintf("user%d", i)
+	}
+	direct, err := bot.SendDirectMessage(ctx, users, nil, mustTextMessage(t, "leaked token"))
+	if err != nil {
+		t.Fatalf("SendDirectMessage failed: %v", err)
+	}
+	if _, err := bot.Recall(ctx, direct.MessageID); err != nil {
+		t.Fatalf("Recall failed: %v", err)
+	}
+	recall = stub.recalls[1]
+	if recall.path != directRecallPath || strings.Join(recall.ProcessQueryKeys, ",") != "batch-1,batch-2" || recall.OpenConversationID != "" {
+		t.Errorf("unexpected direct recall: %+v", recall)
+	}
+
+	// DingDing reports the keys it could not recall, the message stays recallable
+	messageLog.add(SentMessage{MessageID: "old", Bot: "ops", Channel: ChannelDirect, ProcessQueryKeys: []string{"batch-9", "expired-1"}})
+	result, err = bot.Recall(ctx, "old")
+	if err != nil || len(result.Recalled) != 1 || result.Failed["expired-1"] == "" {
+		t.Errorf("expected a partial recall, got %+v, %v", result, err)
+	}
+	if entry, _ := messageLog.Get("old"); entry.Recalled {
+		t.Errorf("a partially recalled message should not be marked recalled")
+	}
+
+	webhookBot := NewDingDingBot("token", "", WithSender(NewDryRunSender()), WithName("ops"), WithMessageLog(messageLog))
+	webhook, err := webhookBot.SendText(ctx, "wrong group", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	if _, err := bot.Recall(ctx, webhook.MessageID); !errors.Is(err, ErrRecallNotSupported) {
+		t.Errorf("expected webhook messages to be rejected, got %v", err)
+	}
+	if _, err := bot.Recall(ctx, "unknown"); err == nil || !strings.Contains(err.Error(), "last 10 messages") {
+		t.Errorf("expected an unknown message to be rejected, got %v", err)
+	}
+	if len(stub.recalls) != 3 {
+		t.Errorf("expected 3 recall requests, got %d", len(stub.recalls))
+	}
+}
+
+// TestMessageLog tests that the message log forgets the oldest messages and the messages older than its maximum age.
+func TestMessageLog(t *testing.T) {
+	clk := newFakeClock()
+	messageLog := NewMessageLog(2, time.Hour)
+	messageLog.clock = clk
+	for _, id := range []string{"a", "b", "c"} {
+		messageLog.add(SentMessage{MessageID: id, Channel: ChannelGroup, SentAt: clk.Now()})
+		clk.Advance(time.Minute)
+	}
+
+	if _, err := messageLog.Get("a"); err == nil {
+		t.Errorf("the oldest message should be forgotten")
+	}
+	for _, id := range []string{"b", "c"} {
+		if _, err := messageLog.Get(id); err != nil {
+			t.Errorf("message %s should be kept: %v", id, err)
+		}
+	}
+
+	clk.Advance(time.Hour - time.Minute)
+	if _, err := messageLog.Get("b"); err == nil || !strings.Contains(err.Error(), "within 1h0m0s") {
+		t.Errorf("a message older than the maximum age should be forgotten, got %v", err)
+	}
+	if _, err := messageLog.Get("c"); err != nil {
+		t.Errorf("message c should be kept: %v", err)
+	}
+}
+
+// TestMessageLogJournal tests that sent and recalled messages survive a restart within the bounds of the log.
+func TestMessageLogJournal(t *testing.T) {
+	dir := t.TempDir()
+	messageLog, err := OpenMessageLog(dir, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenMessageLog failed: %v", err)
+	}
+
+	now := time.Now()
+	messageLog.add(SentMessage{MessageID: "expired", Channel: ChannelGroup, SentAt: now.Add(-2 * time.Hour)})
+	for i, id := range []string{"a", "b", "c"} {
+		messageLog.add(SentMessage{MessageID: id, Bot: "ops", Channel: ChannelGroup, ProcessQueryKeys: []string{"key-" + id}, SentAt: now.Add(time.Duration(i) * time.Second)})
+	}
+	messageLog.markRecalled("b")
+	messageLog.Close()
+
+	reopened, err := OpenMessageLog(dir, 2, time.Hour)
+	if err != nil {
+		t.Fatalf("OpenMessageLog failed: %v", err)
+	}
+	defer reopened.Close()
+	for _, id := range []string{"expired", "a"} {
+		if _, err := reopened.Get(id); err == nil {
+			t.Errorf("message %s should be forgotten", id)
+		}
+	}
+	if msg, err := reopened.Get("b"); err != nil || !msg.Recalled {
+		t.Errorf("expected b to be replayed as recalled, got %+v (%v)", msg, err)
+	}
+	if msg, err := reopened.Get("c"); err != nil || msg.Bot != "ops" || msg.ProcessQueryKeys[0] != "key-c" || msg.Recalled {
+		t.Errorf("expected c to be replayed, got %+v (%v)", msg, err)
+	}
+}
+
+// TestRecallMessageTool tests the recall_message tool.
+func TestRecallMessageTool(t *testing.T) {
+	stub := newEnterpriseStub(t)
+	defer stub.Close()
+
+	clk := newFakeClock()
+	messageLog := NewMessageLog(10, 0)
+	messageLog.clock = clk
+	bots := NewBotRegistry()
+	bots.Add("ops", "", newEnterpriseBot(t, stub, clk, WithMessageLog(messageLog)))
+	bots.Add("release", "", NewDingDingBot("token", "", WithSender(NewDryRunSender()), WithMessageLog(messageLog)))
+	handler := recallMessageHandler(bots, messageLog)
+	ctx := context.Background()
+
+	ops, _ := bots.Get("ops")
+	sent, err := ops.SendText(ctx, "wrong group", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	result, _ := handler(ctx, newToolRequest("recall_message", map[string]interface{}{"message_id": sent.MessageID}))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || text != "Message "+sent.MessageID+" recalled" {
+		t.Errorf("unexpected result: %q", text)
+	}
+	var details RecallResult
+	resultJSON(t, result, &details)
+	if details.Bot != "ops" || len(details.Recalled) != 1 {
+		t.Errorf("unexpected structured result: %+v", details)
+	}
+
+	release, _ := bots.Get("release")
+	webhook, _ := release.SendText(ctx, "wrong group", nil, nil, false)
+	result, _ = handler(ctx, newToolRequest("recall_message", map[string]interface{}{"message_id": webhook.MessageID}))
+	text = result.Content[0].(mcp.TextContent).Text
+	if !result.IsError || !strings.Contains(text, "webhook") {
+		t.Errorf("expected webhook messages to be rejected, got %q", text)
+	}
+
+	for name, arguments := range map[string]map[string]interface{}{
+		"unknown message":  {"message_id": "unknown"},
+		"recalled message": {"message_id": sent.MessageID},
+		"missing id":       {},
+	} {
+		if result, _ := handler(ctx, newToolRequest("recall_message", arguments)); !result.IsError {
+			t.Errorf("%s: expected a tool error", name)
+		}
+	}
+}
+
+// mustTextMessage builds a text message without mentions.
+func mustTextMessage(t *testing.T, content string) Message {
+	msg, err := NewTextMessage(content, nil, nil, false)
+	if err != nil {
+		t.Fatalf("NewTextMessage failed: %v", err)
+	}
+	return msg
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultSessionWebhookHosts are the hosts of the session webhooks issued by DingDing
+var DefaultSessionWebhookHosts = []string{"*.dingtalk.com"}
+
+// WithSessionWebhookHosts sets the hosts the session webhooks replied to may point to,
+// exact host names or *.domain for the subdomains of domain. Session webhooks come from
+// callbacks whose body is not signed, so they are never trusted beyond these hosts.
+func WithSessionWebhookHosts(hosts []string) BotOption {
+	return func(bot *DingDingBot) {
+		if len(hosts) > 0 {
+			bot.sessionWebhookHosts = hosts
+		}
+	}
+}
+
+// checkSessionWebhook checks that a session webhook is an https URL on one of the allowed hosts.
+func (bot *DingDingBot) checkSessionWebhook(sessionWebhook string) error {
+	u, err := url.Parse(sessionWebhook)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" {
+		return fmt.Errorf("invalid session webhook, an https URL is expected")
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range bot.sessionWebhookHosts {
+		allowed = strings.ToLower(allowed)
+		if domain, ok := strings.CutPrefix(allowed, "*."); (ok && strings.HasSuffix(host, "."+domain)) || host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid session webhook, host %s is not one of %s", host, strings.Join(bot.sessionWebhookHosts, ", "))
+}
+
+// SessionExpiredError is returned by Reply when the session webhook of a received message has lapsed.
+type SessionExpiredError struct {
+	// ExpiredAt is when the session webhook stopped accepting replies
+	ExpiredAt time.Time
+}
+
+func (e *SessionExpiredError) Error() string {
+	return fmt.Sprintf("the session webhook expired at %s, the conversation can no longer be replied to", e.ExpiredAt.Format(time.RFC3339))
+}
+
+// Hint tells the user how to reach the conversation anyway.
+func (e *SessionExpiredError) Hint() string {
+	return "Session webhooks are only valid for a short time after a message was received. " +
+		"Reply to a newer message of the conversation, or send to the group with a send_* tool instead."
+}
+
+// Reply sends a message to the conversation of a received message through its session webhook,
+// which also reaches one-to-one chats and needs no access token. The request is not signed
+// and does not count against the circuit breaker of the bot, as it does not use its webhook.
+// Parameters:
+//   - ctx: Aborts the request when done
+//   - sessionWebhook: The session webhook of the received message
+//   - expiresAt: When the session webhook expires, zero when unknown
+//   - msg: The message built by NewTextMessage, NewMarkdownMessage, NewActionCardMessage or NewTemplateCardMessage
+// Returns:
+//   - The result of the request
+//   - A *SessionExpiredError if the session webhook has expired, or an error if the request fails, nil otherwise
+func (bot *DingDingBot) Reply(ctx context.Context, sessionWebhook string, expiresAt time.Time, msg Message) (*SendResult, error) {
+	if sessionWebhook == "" {
+		return nil, fmt.Errorf("sessionWebhook cannot be empty")
+	}
+	if err := bot.checkSessionWebhook(sessionWebhook); err != nil {
+		return nil, err
+	}
+	if msg.MsgType() == "" {
+		return nil, fmt.Errorf("message type cannot be empty")
+	}
+	if !expiresAt.IsZero() && !bot.clock.Now().Before(expiresAt) {
+		return nil, &SessionExpiredError{ExpiredAt: expiresAt}
+	}
+
+	jsonPayload, err := json.Marshal(msg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal JSON payload: %v", err)
+	}
+
+	// Replies count against the rate limit of the robot like any other message
+	if bot.limiter != nil {
+		if err := bot.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := bot.postWithRetries(ctx, true, sessionWebhook, authNone, "application/json", jsonPayload)
+	if err != nil {
+		return nil, err
+	}
+
+	result := bot.newSendResult(sessionWebhook, resp)
+	result.Payload = redactPayload(jsonPayload)
+	bot.logMessage(result.MessageID, ChannelSession, nil, result.DryRun)
+	return result, nil
+}
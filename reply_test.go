@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newSessionServer creates an https session webhook server recording the requests it answers successfully.
+func newSessionServer() (*httptest.Server, func() []*http.Request, func() []Message) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var messages []Message
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg Message
+		json.NewDecoder(r.Body).Decode(&msg)
+
+		mu.Lock()
+		requests = append(requests, r)
+		messages = append(messages, msg)
+		mu.Unlock()
+
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok"})
+	}))
+
+	return server, func() []*http.Request {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]*http.Request(nil), requests...)
+		}, func() []Message {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]Message(nil), messages...)
+		}
+}
+
+// withSessionServer lets a bot reply to the session webhooks of a server created by newSessionServer.
+func withSessionServer(server *httptest.Server) BotOption {
+	return func(bot *DingDingBot) {
+		WithHTTPClient(server.Client())(bot)
+		WithSessionWebhookHosts([]string{"127.0.0.1"})(bot)
+	}
+}
+
+// TestReply tests replying through a session webhook and the expiry check.
+func TestReply(t *testing.T) {
+	server, requests, _ := newSessionServer()
+	defer server.Close()
+
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "SECtoken", withClock(clk), withSessionServer(server), WithCircuitBreaker(BreakerPolicy{Failures: 1, Cooldown: Duration(time.Minute)}))
+	sessionWebhook := server.URL + "/robot/sendBySession?session=session-secret"
+	msg, _ := NewTextMessage("on it", nil, []string{"manager1234"}, false)
+
+	result, err := bot.Reply(context.Background(), sessionWebhook, clk.Now().Add(time.Minute), msg)
+	if err != nil {
+		t.Fatalf("Reply failed: %v", err)
+	}
+	if strings.Contains(result.URL, "session-secret") || !strings.Contains(string(result.Payload), "on it") {
+		t.Errorf("unexpected result: %+v", result)
+	}
+	if got := requests(); len(got) != 1 || got[0].URL.Query().Get("session") != "session-secret" || got[0].URL.Query().Has("sign") {
+		t.Errorf("expected an unsigned request to the session webhook, got %v", got)
+	}
+
+	clk.Advance(time.Minute)
+	_, err = bot.Reply(context.Background(), sessionWebhook, clk.Now(), msg)
+	var expired *SessionExpiredError
+	if !errors.As(err, &expired) || len(requests()) != 1 {
+		t.Fatalf("expected the expired session to be rejected without a request, got %v", err)
+	}
+	if hint := ErrorHint(err); !strings.Contains(hint, "newer message") {
+		t.Errorf("unexpected hint: %q", hint)
+	}
+	if status := bot.BreakerStatus(); status.State != BreakerClosed || status.Successes != 0 {
+		t.Errorf("replies should not count against the circuit breaker, got %+v", status)
+	}
+
+	if _, err := bot.Reply(context.Background(), "", time.Time{}, msg); err == nil {
+		t.Errorf("an empty session webhook should be rejected")
+	}
+}
+
+// TestReplySessionWebhookHosts tests that replies are only posted over https to the allowed hosts.
+func TestReplySessionWebhookHosts(t *testing.T) {
+	bot := NewDingDingBot("token", "", WithSender(NewDryRunSender()))
+	msg, _ := NewTextMessage("on it", nil, nil, false)
+
+	for _, sessionWebhook := range []string{
+		"https://oapi.dingtalk.com/robot/sendBySession?session=secret",
+		"https://api.DingTalk.com/robot/sendBySession?session=secret",
+	} {
+		if _, err := bot.Reply(context.Background(), sessionWebhook, time.Time{}, msg); err != nil {
+			t.Errorf("%s should be allowed: %v", sessionWebhook, err)
+		}
+	}
+
+	for _, sessionWebhook := range []string{
+		"https://attacker.example.com/robot/sendBySession",
+		"https://oapi.dingtalk.com.attacker.example.com/robot/sendBySession",
+		"https://dingtalk.com/robot/sendBySession",
+		"https://169.254.169.254/latest/meta-data",
+		"http://oapi.dingtalk.com/robot/sendBySession",
+		"oapi.dingtalk.com/robot/sendBySession",
+	} {
+		if _, err := bot.Reply(context.Background(), sessionWebhook, time.Time{}, msg); err == nil || !strings.Contains(err.Error(), "invalid session webhook") {
+			t.Errorf("%s should be rejected, got %v", sessionWebhook, err)
+		}
+	}
+	if _, err := bot.Reply(context.Background(), "https://attacker.example.com/hook", time.Time{}, msg); err == nil || !strings.Contains(err.Error(), "*.dingtalk.com") {
+		t.Errorf("expected the allowed hosts in the error, got %v", err)
+	}
+}
+
+// TestReplyToMessageTool tests the reply_to_message tool with a received message.
+func TestReplyToMessageTool(t *testing.T) {
+	server, _, messages := newSessionServer()
+	defer server.Close()
+
+	clk := newFakeClock()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", withClock(clk), withSessionServer(server))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	incoming := NewIncomingBuffer(10)
+	incoming.Add(IncomingMessage{
+		ID:                      "msg-1",
+		Text:                    "deploy status?",
+		ConversationType:        ConversationGroup,
+		ConversationTitle:       "Ops",
+		SenderStaffID:           "manager1234",
+		SessionWebhook:          server.URL + "/robot/sendBySession?session=session-secret",
+		SessionWebhookExpiresAt: clk.Now().Add(time.Hour),
+	})
+	handler := replyToMessageHandler(bots, incoming)
+	ctx := context.Background()
+
+	result, _ := handler(ctx, newToolRequest("reply_to_message", map[string]interface{}{
+		"message_id":  "msg-1",
+		"msg_type":    "markdown",
+		"title":       "Deploy",
+		"content":     "### Deploy\n\nAll green @manager1234",
+		"at_user_ids": "manager1234",
+	}))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, `Reply sent to group "Ops"`) {
+		t.Fatalf("unexpected result: %q", text)
+	}
+	sent := messages()
+	if len(sent) != 1 || sent[0].MsgType() != "markdown" || !strings.Contains(sent[0]["at"].(map[string]interface{})["atUserIds"].([]interface{})[0].(string), "manager1234") {
+		t.Errorf("unexpected reply: %+v", sent)
+	}
+
+	for name, arguments := range map[string]map[string]interface{}{
+		"unknown message":  {"message_id": "msg-2", "msg_type": "text", "content": "hi"},
+		"unsupported type": {"message_id": "msg-1", "msg_type": "feed_card"},
+		"invalid message":  {"message_id": "msg-1", "msg_type": "text"},
+	} {
+		if result, _ := handler(ctx, newToolRequest("reply_to_message", arguments)); !result.IsError {
+			t.Errorf("%s: expected a tool error", name)
+		}
+	}
+
+	clk.Advance(time.Hour)
+	result, _ = handler(ctx, newToolRequest("reply_to_message", map[string]interface{}{"message_id": "msg-1", "msg_type": "text", "content": "late"}))
+	text = result.Content[0].(mcp.TextContent).Text
+	if !result.IsError || !strings.Contains(text, "session webhook expired") || !strings.Contains(text, "Hint:") || len(messages()) != 1 {
+		t.Errorf("expected the lapsed session to be reported, got %q", text)
+	}
+}
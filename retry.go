@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// DefaultRetryPolicy retries transient failures twice, waiting about 0.5s and then 1s
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts: 3,
+	BaseDelay:   500 * time.Millisecond,
+	MaxDelay:    10 * time.Second,
+}
+
+// RetryPolicy controls how requests to the DingDing API are retried.
+// Network errors before the request was written, 5xx and 429 responses and the errcodes marked retryable
+// in the error catalog are retried with exponential backoff and jitter, everything else fails immediately.
+// Network errors after the request was written, such as a response timeout, are only retried for sends
+// with an idempotency key, as DingDing may already have posted the message.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, 1 disables retries
+	MaxAttempts int
+
+	// BaseDelay is the delay before the first retry, doubled for every further retry
+	BaseDelay time.Duration
+
+	// MaxDelay caps the delay between two attempts
+	MaxDelay time.Duration
+}
+
+// backoff returns the delay before the given retry, starting at 1.
+// The delay is picked at random in the upper half of the exponential step to spread out retries.
+func (p RetryPolicy) backoff(retry int) time.Duration {
+	delay := p.BaseDelay
+	for i := 1; i < retry && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay <= 0 {
+		return 0
+	}
+
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryableError marks a failed attempt as transient.
+type retryableError struct {
+	err error
+}
+
+func (e *retryableError) Error() string {
+	return e.err.Error()
+}
+
+func (e *retryableError) Unwrap() error {
+	return e.err
+}
+
+// transient reports whether a failed send may succeed when tried again later,
+// such as after a network error, a DingDing overload, a rate limit rejection or while the circuit breaker is open.
+func transient(err error) bool {
+	var retryable *retryableError
+	var rateLimited *RateLimitError
+	var circuitOpen *CircuitOpenError
+	return errors.As(err, &retryable) || errors.As(err, &rateLimited) || errors.As(err, &circuitOpen)
+}
+
+// apiResponse is a successful and decoded DingDing API response.
+type apiResponse struct {
+	// result is the decoded JSON response body
+	result map[string]interface{}
+
+	// dryRun reports whether the request was captured instead of delivered
+	dryRun bool
+
+	// attempts is the number of HTTP requests made
+	attempts int
+
+	// latency is the time spent on all attempts, including backoff
+	latency time.Duration
+}
+
+// requestAuth selects how the attempts of a request authenticate with DingDing.
+type requestAuth int
+
+const (
+	// authNone sends the request as is, its URL carries the credentials, such as a session webhook
+	authNone requestAuth = iota
+
+	// authSignature adds the signature of the sign key to the URL, when a sign key is configured
+	authSignature
+
+	// authAccessToken sends the access token of the enterprise app in a header
+	authAccessToken
+
+	// authAccessTokenQuery adds the access token of the enterprise app to the URL, as the legacy oapi endpoints expect
+	authAccessTokenQuery
+)
+
+// post sends a request to the DingDing API, retrying transient failures according to the retry policy.
+// Parameters:
+//   - ctx: Aborts the request and the retries when done
+//   - endpoint: The request URL, including the webhook access token for robot webhooks
+//   - auth: How every attempt is authenticated
+//   - contentType: The value of the Content-Type header
+//   - body: The request body
+// Returns:
+//   - The decoded response
+//   - An error if the last attempt failed or the circuit breaker is open, nil otherwise
+func (bot *DingDingBot) post(ctx context.Context, endpoint string, auth requestAuth, contentType string, body []byte) (*apiResponse, error) {
+	return bot.postGuarded(ctx, false, endpoint, auth, contentType, body)
+}
+
+// postMessage is post for messages, which also wait for budget from the rate limiter.
+func (bot *DingDingBot) postMessage(ctx context.Context, endpoint string, auth requestAuth, contentType string, body []byte) (*apiResponse, error) {
+	return bot.postGuarded(ctx, true, endpoint, auth, contentType, body)
+}
+
+// postGuarded makes the request of post through the circuit breaker, and the rate limiter when limited.
+func (bot *DingDingBot) postGuarded(ctx context.Context, limited bool, endpoint string, auth requestAuth, contentType string, body []byte) (*apiResponse, error) {
+	if err := bot.breaker.allow(bot.name); err != nil {
+		return nil, err
+	}
+
+	// Wait for budget only once the breaker allowed the request, so that rejected requests do not use it up
+	if limited && bot.limiter != nil {
+		if err := bot.limiter.wait(ctx); err != nil {
+			bot.breaker.release()
+			return nil, err
+		}
+	}
+
+	resp, err := bot.postWithRetries(ctx, limited, endpoint, auth, contentType, body)
+	if err != nil && ctx.Err() != nil {
+		// A canceled request says nothing about the health of the webhook
+		bot.breaker.release()
+		return nil, err
+	}
+	bot.breaker.record(err)
+	return resp, err
+}
+
+// postWithRetries makes the attempts of post, authenticating every attempt according to auth.
+// When limited, the retries wait for budget from the rate limiter like the first attempt, which the caller waits for.
+func (bot *DingDingBot) postWithRetries(ctx context.Context, limited bool, endpoint string, auth requestAuth, contentType string, body []byte) (*apiResponse, error) {
+	maxAttempts := max(bot.retryPolicy.MaxAttempts, 1)
+	start := bot.clock.Now()
+
+	for attempt := 1; ; attempt++ {
+		resp, err := bot.attempt(ctx, endpoint, auth, contentType, body)
+		if err == nil {
+			resp.attempts = attempt
+			resp.latency = bot.clock.Now().Sub(start)
+			return resp, nil
+		}
+
+		var retryable *retryableError
+		if !errors.As(err, &retryable) || attempt >= maxAttempts {
+			if attempt > 1 {
+				return nil, fmt.Errorf("%w (after %d attempts)", err, attempt)
+			}
+			return nil, err
+		}
+
+		if sleepErr := bot.clock.Sleep(ctx, bot.retryPolicy.backoff(attempt)); sleepErr != nil {
+			return nil, fmt.Errorf("%v, retry canceled: %w", err, sleepErr)
+		}
+
+		// A retry is a message like any other, so that a throttled robot is not sent more than its budget
+		if limited && bot.limiter != nil {
+			if waitErr := bot.limiter.wait(ctx); waitErr != nil {
+				return nil, fmt.Errorf("%w, retry not sent: %v", err, waitErr)
+			}
+		}
+	}
+}
+
+// attempt makes a single request to the DingDing API and classifies its failure.
+func (bot *DingDingBot) attempt(ctx context.Context, endpoint string, auth requestAuth, contentType string, body []byte) (*apiResponse, error) {
+	req := &OutgoingRequest{
+		URL:         endpoint,
+		ContentType: contentType,
+		Body:        body,
+	}
+
+	var token string
+	switch auth {
+	case authSignature:
+		// Sign every attempt so that retries carry a fresh timestamp
+		var err error
+		if req.URL, err = bot.signURL(endpoint); err != nil {
+			return nil, err
+		}
+	case authAccessToken, authAccessTokenQuery:
+		// Look the token up on every attempt so that retries pick up a refreshed token
+		var err error
+		if token, err = bot.app.accessToken(ctx, bot.sender, bot.clock); err != nil {
+			return nil, err
+		}
+		if auth == authAccessToken {
+			req.Header = http.Header{accessTokenHeader: []string{token}}
+		} else {
+			req.URL = endpoint + "?access_token=" + url.QueryEscape(token)
+		}
+	}
+
+	resp, err := bot.sender.Send(ctx, req)
+	if err != nil {
+		err = fmt.Errorf("failed to send HTTP request: %w", err)
+		if errors.Is(err, ErrRequestNotSent) || idempotentSend(ctx) {
+			return nil, &retryableError{err}
+		}
+		return nil, err
+	}
+
+	// Check the HTTP status code
+	if resp.StatusCode != http.StatusOK {
+		return nil, bot.classifyAttempt(openAPIError(resp), auth, token)
+	}
+
+	// Parse the response
+	var result map[string]interface{}
+	if err := json.Unmarshal(resp.Body, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+
+	// Check for API errors
+	if errcode, ok := result["errcode"].(float64); ok && errcode != 0 {
+		errmsg, _ := result["errmsg"].(string)
+		return nil, bot.classifyAttempt(&APIError{
+			ErrCode:    int(errcode),
+			ErrMsg:     errmsg,
+			StatusCode: resp.StatusCode,
+			RequestID:  requestID(resp, result),
+		}, auth, token)
+	}
+
+	return &apiResponse{result: result, dryRun: resp.DryRun}, nil
+}
+
+// classifyAttempt classifies the failure of an attempt authenticated with auth.
+// A rejected access token of the enterprise app was revoked before its expiry,
+// so it is dropped and the attempt retried with a new one.
+func (bot *DingDingBot) classifyAttempt(err *APIError, auth requestAuth, token string) error {
+	if (auth == authAccessToken || auth == authAccessTokenQuery) && errors.Is(err, ErrInvalidToken) {
+		bot.app.tokens.invalidate(token)
+		return &retryableError{err}
+	}
+	return classify(err)
+}
+
+// classify marks transient API errors as retryable.
+func classify(err *APIError) error {
+	if err.Retryable() {
+		return &retryableError{err}
+	}
+	return err
+}
+
+// requestID returns the DingDing request ID from the response body or headers.
+func requestID(resp *OutgoingResponse, result map[string]interface{}) string {
+	if id, ok := result["request_id"].(string); ok && id != "" {
+		return id
+	}
+	if resp.Header != nil {
+		return resp.Header.Get("X-Acs-Request-Id")
+	}
+	return ""
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyServer creates a DingDing server answering with the given responses in turn.
+// A response is either an HTTP status code (int) or a DingDing errcode (int64).
+func newFlakyServer(calls *int64, responses ...interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		call := atomic.AddInt64(calls, 1)
+		result := map[string]interface{}{"errcode": 0, "errmsg": "ok", "media_id": "media-id"}
+
+		if int(call) <= len(responses) {
+			switch response := responses[call-1].(type) {
+			case int:
+				w.WriteHeader(response)
+				return
+			case int64:
+				result = map[string]interface{}{"errcode": response, "errmsg": "failure"}
+			}
+		}
+
+		json.NewEncoder(w).Encode(result)
+	}))
+}
+
+// newRetryBot creates a bot against server using a fake clock that records the delays it waits for.
+func newRetryBot(server *httptest.Server) (*DingDingBot, *fakeClock) {
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "SECtoken", WithBaseURL(server.URL), withClock(clk), WithRetryPolicy(RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    time.Second,
+	}))
+	return bot, clk
+}
+
+// TestRetryTransientFailures tests that 5xx responses and throttling errcodes are retried.
+func TestRetryTransientFailures(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusBadGateway, int64(130101))
+	defer server.Close()
+
+	bot, clk := newRetryBot(server)
+
+	result, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	if err != nil {
+		t.Fatalf("SendText failed: %v", err)
+	}
+	if result.Attempts != 3 || calls != 3 {
+		t.Errorf("expected 3 attempts, got %d (%d calls)", result.Attempts, calls)
+	}
+	delays := clk.Sleeps()
+	if result.Retries != 2 || time.Duration(result.Latency) != delays[0]+delays[1] {
+		t.Errorf("unexpected retries %d and latency %v for delays %v", result.Retries, time.Duration(result.Latency), delays)
+	}
+	if len(delays) != 2 || delays[0] < 50*time.Millisecond || delays[0] > 100*time.Millisecond || delays[1] < 100*time.Millisecond || delays[1] > 200*time.Millisecond {
+		t.Errorf("unexpected backoff delays: %v", delays)
+	}
+}
+
+// TestRetryGivesUp tests that retries stop after MaxAttempts.
+func TestRetryGivesUp(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, 500, 500, 500, 500)
+	defer server.Close()
+
+	bot, _ := newRetryBot(server)
+
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	if err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("expected failure after 3 attempts, got %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+// TestRetryPermanentFailure tests that permanent errors fail fast.
+func TestRetryPermanentFailure(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, int64(300001))
+	defer server.Close()
+
+	bot, clk := newRetryBot(server)
+
+	if _, err := bot.SendText(context.Background(), "hello", nil, nil, false); err == nil {
+		t.Errorf("SendText should fail for an invalid token")
+	}
+	if calls != 1 || len(clk.Sleeps()) != 0 {
+		t.Errorf("permanent errors should not be retried, got %d calls", calls)
+	}
+}
+
+// TestRetryUpload tests that uploads are retried too.
+func TestRetryUpload(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	filePath := filepath.Join(t.TempDir(), "report.txt")
+	if err := os.WriteFile(filePath, []byte("report"), 0o600); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	bot, _ := newRetryBot(server)
+
+	result, err := bot.UploadFile(context.Background(), filePath)
+	if err != nil {
+		t.Fatalf("UploadFile failed: %v", err)
+	}
+	if result.Attempts != 2 || result.MediaID != "media-id" {
+		t.Errorf("unexpected upload result: %+v", result)
+	}
+}
+
+// TestRetryBackoff tests the exponential growth and cap of the backoff delay.
+func TestRetryBackoff(t *testing.T) {
+	policy := RetryPolicy{MaxAttempts: 10, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	for retry, max := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 8: 5 * time.Second} {
+		delay := policy.backoff(retry)
+		if delay < max/2 || delay > max {
+			t.Errorf("retry %d: delay %v outside [%v, %v]", retry, delay, max/2, max)
+		}
+	}
+}
+
+// TestRetryCanceled tests that canceling the context aborts the request in flight and the retries,
+// without counting a failure against the circuit breaker.
+func TestRetryCanceled(t *testing.T) {
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		// Read the body so the server notices when the client goes away
+		io.Copy(io.Discard, r.Body)
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), WithCircuitBreaker(BreakerPolicy{Failures: 1, Cooldown: Duration(time.Minute)}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := bot.SendText(ctx, "hello", nil, nil, false)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the deadline to abort the request, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second || atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("expected a single aborted attempt, got %d calls in %v", calls, elapsed)
+	}
+	if status := bot.BreakerStatus(); status.State != BreakerClosed || status.Failures != 0 {
+		t.Errorf("a canceled request should not count as a failure, got %+v", status)
+	}
+
+	// A canceled context stops the retries of a transient failure
+	flaky := newFlakyServer(&calls, http.StatusBadGateway)
+	defer flaky.Close()
+	retryBot, clk := newRetryBot(flaky)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	if _, err := retryBot.SendText(ctx, "hello", nil, nil, false); !errors.Is(err, context.Canceled) || len(clk.Sleeps()) != 0 {
+		t.Errorf("expected the retries to stop, got %v after %d sleeps", err, len(clk.Sleeps()))
+	}
+}
+
+// TestRetryAfterWrite tests that a timeout after the request was written is only retried for sends
+// with an idempotency key, while a request that never reached the server is always retried.
+func TestRetryAfterWrite(t *testing.T) {
+	var calls int64
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		io.Copy(io.Discard, r.Body)
+		// DingDing got the message but the response never arrives in time
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	clk := newFakeClock()
+	bot := NewDingDingBot("token", "", WithBaseURL(server.URL), withClock(clk), WithHTTPClient(&http.Client{Timeout: 50 * time.Millisecond}),
+		WithRetryPolicy(RetryPolicy{MaxAttempts: 3, BaseDelay: 100 * time.Millisecond}))
+
+	_, err := bot.SendText(context.Background(), "hello", nil, nil, false)
+	if err == nil || errors.Is(err, ErrRequestNotSent) || transient(err) {
+		t.Errorf("expected a permanent failure, got %v", err)
+	}
+	if atomic.LoadInt64(&calls) != 1 || len(clk.Sleeps()) != 0 {
+		t.Errorf("a request that reached the server should not be retried, got %d calls", calls)
+	}
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	if _, err := bot.SendOnce(context.Background(), "alert-1", msg); err == nil || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("expected a send with an idempotency key to be retried, got %v", err)
+	}
+	if atomic.LoadInt64(&calls) != 4 {
+		t.Errorf("expected 4 calls, got %d", calls)
+	}
+
+	// Nothing listens on the address of a closed server, the connection is refused
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	refusedBot, _ := newRetryBot(closed)
+	if _, err := refusedBot.SendText(context.Background(), "hello", nil, nil, false); !errors.Is(err, ErrRequestNotSent) || !strings.Contains(err.Error(), "after 3 attempts") {
+		t.Errorf("expected a refused connection to be retried, got %v", err)
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Scheduled message states
+const (
+	// ScheduledPending means the message waits for its send time, or for the next attempt after a transient failure
+	ScheduledPending = "scheduled"
+
+	// ScheduledSending means the message is being sent, it can no longer be canceled or rescheduled
+	ScheduledSending = "sending"
+
+	// ScheduledSent means the message was sent, or queued in the outbox, at its send time
+	ScheduledSent = "sent"
+
+	// ScheduledFailed means sending the message failed for good, it has to be sent again by hand
+	ScheduledFailed = "failed"
+
+	// scheduledCanceled marks a canceled message in the journal
+	scheduledCanceled = "canceled"
+)
+
+const (
+	// scheduleJournalName is the name of the journal file in the schedule directory
+	scheduleJournalName = "schedule.jsonl"
+
+	// maxScheduledFinished is the number of sent and failed messages kept for inspection
+	maxScheduledFinished = 1000
+
+	// scheduleIdleWait is how long the worker sleeps when nothing is due
+	scheduleIdleWait = time.Minute
+
+	// scheduleRetryWindow is how long after its send time a message failing transiently is retried,
+	// when no outbox is configured
+	scheduleRetryWindow = time.Hour
+)
+
+// scheduleRetryPolicy spaces the attempts of a message failing transiently within scheduleRetryWindow
+var scheduleRetryPolicy = RetryPolicy{
+	BaseDelay: 30 * time.Second,
+	MaxDelay:  10 * time.Minute,
+}
+
+// sendAtLayouts are the accepted send times without a UTC offset, interpreted in a time zone.
+var sendAtLayouts = []string{
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+}
+
+// ScheduledMessage is a message waiting in the Scheduler for its send time.
+type ScheduledMessage struct {
+	// ID identifies the message in the schedule tools
+	ID string `json:"id"`
+
+	// Bot is the name of the bot the message is sent with
+	Bot string `json:"bot"`
+
+	// Message is the message to send
+	Message Message `json:"message"`
+
+	// IdempotencyKey deduplicates the message, see DingDingBot.SendOnce
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// SendAt is when the message is sent, in the time zone it was scheduled in
+	SendAt time.Time `json:"send_at"`
+
+	// Status is one of ScheduledPending, ScheduledSending, ScheduledSent or ScheduledFailed
+	Status string `json:"status"`
+
+	// Attempts is the number of failed send attempts
+	Attempts int `json:"attempts,omitempty"`
+
+	// NextAttempt is when a message failing transiently is tried again
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+
+	// CreatedAt is when the message was scheduled
+	CreatedAt time.Time `json:"created_at"`
+
+	// UpdatedAt is when the message last changed
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// OutboxID is the outbox entry the message was queued as, when an outbox is configured
+	OutboxID string `json:"outbox_id,omitempty"`
+
+	// Result describes the send, when no outbox is configured
+	Result *SendResult `json:"result,omitempty"`
+
+	// LastError describes why sending failed
+	LastError string `json:"last_error,omitempty"`
+}
+
+// Scheduler holds messages to send at a later time and sends them when they are due.
+// Every change is appended to a journal in the schedule directory, so scheduled messages
+// survive restarts. Messages that became due while the server was down are sent late on startup.
+type Scheduler struct {
+	dir      string
+	bots     *BotRegistry
+	outbox   *Outbox
+	location *time.Location
+	clock    clock
+
+	// mu guards messages and the journal
+	mu       sync.Mutex
+	messages map[string]*ScheduledMessage
+	journal  journal
+
+	// wake interrupts the worker wait when the schedule changes
+	wake chan struct{}
+}
+
+// OpenScheduler opens the schedule stored in dir, creating it when needed, and replays its journal.
+// Parameters:
+//   - dir: The directory holding the journal
+//   - bots: The bots messages are sent with, looked up by name at send time
+//   - outbox: The outbox due messages are queued in, nil to send them right away
+//   - location: The time zone of send times given without a UTC offset
+// Returns:
+//   - The scheduler, whose worker must be started with Run
+//   - An error if the directory or journal cannot be used
+func OpenScheduler(dir string, bots *BotRegistry, outbox *Outbox, location *time.Location) (*Scheduler, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create schedule directory: %v", err)
+	}
+
+	s := &Scheduler{
+		dir:      dir,
+		bots:     bots,
+		outbox:   outbox,
+		location: location,
+		clock:    realClock{},
+		messages: make(map[string]*ScheduledMessage),
+		journal:  journal{path: filepath.Join(dir, scheduleJournalName), what: "schedule journal"},
+		wake:     make(chan struct{}, 1),
+	}
+
+	err := replayJournal(s.journal.path, s.journal.what, func(msg *ScheduledMessage) {
+		switch msg.Status {
+		case scheduledCanceled:
+			delete(s.messages, msg.ID)
+		case ScheduledSending:
+			// The server stopped during the send, the message is sent again
+			msg.Status = ScheduledPending
+			s.messages[msg.ID] = msg
+		default:
+			s.messages[msg.ID] = msg
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// Close closes the journal. The worker must be stopped first.
+func (s *Scheduler) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.journal.close()
+}
+
+// Location returns the time zone of send times given without a UTC offset.
+func (s *Scheduler) Location() *time.Location {
+	return s.location
+}
+
+// ParseSendAt parses a send time, which must be in the future.
+// Parameters:
+//   - value: An RFC3339 time such as "2024-06-01T09:30:00+08:00", a time without offset such as
+//     "2024-06-01 09:30" or a delay from now such as "+2h" or "+1h30m"
+//   - timezone: The IANA time zone of times without offset, such as "Asia/Shanghai", empty for the scheduler's
+// Returns:
+//   - The send time, in the given time zone for times without offset
+//   - An error if the value or time zone is invalid or the time is not in the future
+func (s *Scheduler) ParseSendAt(value string, timezone string) (time.Time, error) {
+	location := s.location
+	if timezone != "" {
+		var err error
+		if location, err = time.LoadLocation(timezone); err != nil {
+			return time.Time{}, fmt.Errorf("invalid timezone %q: %v", timezone, err)
+		}
+	}
+
+	now := s.clock.Now()
+	at, err := parseTime(strings.TrimSpace(value), now, location)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if !at.After(now) {
+		return time.Time{}, fmt.Errorf("send time %s is not in the future", at.Format(time.RFC3339))
+	}
+
+	return at, nil
+}
+
+// parseTime parses an RFC3339 time, a time without offset in location or a delay from now such as "+2h".
+func parseTime(value string, now time.Time, location *time.Location) (time.Time, error) {
+	if delay, ok := strings.CutPrefix(value, "+"); ok {
+		d, err := time.ParseDuration(delay)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("invalid relative time %q, expected a delay such as +2h or +1h30m", value)
+		}
+		return now.Add(d).In(location), nil
+	}
+
+	if at, err := time.Parse(time.RFC3339, value); err == nil {
+		return at, nil
+	}
+	for _, layout := range sendAtLayouts {
+		if at, err := time.ParseInLocation(layout, value, location); err == nil {
+			return at, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 such as 2024-06-01T09:30:00+08:00, a local time such as 2024-06-01 09:30 or a delay such as +2h", value)
+}
+
+// Schedule adds a message to send with the named bot, the default bot when name is empty.
+// A pending message with the same bot and idempotency key is not scheduled again.
+// Parameters:
+//   - botName: The name of a registered bot
+//   - key: The idempotency key, empty to derive one from the content when the bot deduplicates content
+//   - msg: The message built by one of the New*Message functions
+//   - sendAt: When to send the message, see ParseSendAt
+// Returns:
+//   - A copy of the scheduled message, or of the pending message scheduled earlier with the same key
+//   - Whether the message is a duplicate of a pending message
+//   - An error if the bot is unknown or the message cannot be journaled
+func (s *Scheduler) Schedule(botName string, key string, msg Message, sendAt time.Time) (*ScheduledMessage, bool, error) {
+	bot, err := s.bots.Get(botName)
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := s.clock.Now()
+	scheduled := &ScheduledMessage{
+		ID:             uuid.New().String(),
+		Bot:            bot.Name(),
+		Message:        msg,
+		IdempotencyKey: bot.idempotencyKey(key, msg),
+		SendAt:         sendAt,
+		Status:         ScheduledPending,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if scheduled.IdempotencyKey != "" {
+		for _, existing := range s.messages {
+			if (existing.Status == ScheduledPending || existing.Status == ScheduledSending) && existing.Bot == scheduled.Bot && existing.IdempotencyKey == scheduled.IdempotencyKey {
+				copied := *existing
+				return &copied, true, nil
+			}
+		}
+	}
+
+	if err := s.update(scheduled); err != nil {
+		return nil, false, err
+	}
+
+	copied := *scheduled
+	return &copied, false, nil
+}
+
+// List returns copies of the messages with the given status, all messages when status is empty,
+// in the order they are sent.
+func (s *Scheduler) List(status string) []ScheduledMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	messages := make([]ScheduledMessage, 0, len(s.messages))
+	for _, msg := range s.messages {
+		if status == "" || msg.Status == status {
+			messages = append(messages, *msg)
+		}
+	}
+
+	sort.Slice(messages, func(i, j int) bool {
+		return messages[i].SendAt.Before(messages[j].SendAt)
+	})
+
+	return messages
+}
+
+// Cancel removes a pending message so that it is not sent. A message being sent cannot be canceled.
+func (s *Scheduler) Cancel(id string) (*ScheduledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, err := s.pending(id)
+	if err != nil {
+		return nil, err
+	}
+
+	canceled := ScheduledMessage{ID: id, Status: scheduledCanceled, UpdatedAt: s.clock.Now()}
+	if err := s.journal.append(&canceled); err != nil {
+		return nil, err
+	}
+	delete(s.messages, id)
+	s.compactIfNeeded()
+
+	copied := *msg
+	return &copied, nil
+}
+
+// Reschedule changes the send time of a pending message, with a fresh retry budget.
+func (s *Scheduler) Reschedule(id string, sendAt time.Time) (*ScheduledMessage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	msg, err := s.pending(id)
+	if err != nil {
+		return nil, err
+	}
+
+	updated := *msg
+	updated.SendAt = sendAt
+	updated.Attempts = 0
+	updated.NextAttempt = time.Time{}
+	updated.LastError = ""
+	updated.UpdatedAt = s.clock.Now()
+	if err := s.update(&updated); err != nil {
+		return nil, err
+	}
+
+	copied := updated
+	return &copied, nil
+}
+
+// pending returns the pending message with the given ID. The caller must hold mu.
+func (s *Scheduler) pending(id string) (*ScheduledMessage, error) {
+	msg, ok := s.messages[id]
+	if !ok {
+		return nil, fmt.Errorf("scheduled message %s not found", id)
+	}
+	if msg.Status == ScheduledSending {
+		return nil, fmt.Errorf("scheduled message %s is being sent", id)
+	}
+	if msg.Status != ScheduledPending {
+		return nil, fmt.Errorf("scheduled message %s was already %s", id, msg.Status)
+	}
+	return msg, nil
+}
+
+// dueAt returns when the message is sent: its send time, or the next attempt after a transient failure.
+func (msg *ScheduledMessage) dueAt() time.Time {
+	if !msg.NextAttempt.IsZero() {
+		return msg.NextAttempt
+	}
+	return msg.SendAt
+}
+
+// Run sends due messages until ctx is done. A send interrupted by ctx is tried again on the next run.
+func (s *Scheduler) Run(ctx context.Context) {
+	for {
+		wait := scheduleIdleWait
+		if next := s.sendDue(ctx); !next.IsZero() {
+			wait = min(max(next.Sub(s.clock.Now()), 0), scheduleIdleWait)
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// sendDue sends every due pending message, earliest first,
+// and returns when the next pending message is due, zero when none is pending.
+func (s *Scheduler) sendDue(ctx context.Context) time.Time {
+	now := s.clock.Now()
+
+	for _, msg := range s.List(ScheduledPending) {
+		if ctx.Err() != nil {
+			break
+		}
+		if !msg.dueAt().After(now) {
+			s.send(ctx, msg)
+		}
+	}
+
+	var next time.Time
+	for _, msg := range s.List(ScheduledPending) {
+		if next.IsZero() || msg.dueAt().Before(next) {
+			next = msg.dueAt()
+		}
+	}
+
+	return next
+}
+
+// send claims a copy of a due message, sends it or queues it in the outbox, and records the outcome.
+// Without an outbox, transient failures are retried until scheduleRetryWindow after the send time.
+func (s *Scheduler) send(ctx context.Context, msg ScheduledMessage) {
+	if !s.claim(msg) {
+		return
+	}
+
+	result, entry, err := sendOrQueue(ctx, s.bots, s.outbox, msg.Bot, msg.IdempotencyKey, msg.Message)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.messages[msg.ID]
+	if !ok {
+		return
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown, the claim was never journaled
+		current.Status = ScheduledPending
+		return
+	}
+
+	updated := *current
+	updated.UpdatedAt = s.clock.Now()
+	updated.Result = result
+	if entry != nil {
+		updated.OutboxID = entry.ID
+	}
+	if err == nil {
+		updated.Status = ScheduledSent
+		updated.LastError = ""
+		updated.NextAttempt = time.Time{}
+	} else {
+		updated.Attempts++
+		updated.LastError = err.Error()
+		retryAt := updated.UpdatedAt.Add(scheduleRetryPolicy.backoff(updated.Attempts))
+		if transient(err) && retryAt.Before(updated.SendAt.Add(scheduleRetryWindow)) {
+			updated.Status = ScheduledPending
+			updated.NextAttempt = retryAt
+			log.Printf("Scheduled message %s failed, retrying at %s: %v\n", updated.ID, retryAt.Format(time.RFC3339), err)
+		} else {
+			updated.Status = ScheduledFailed
+			updated.NextAttempt = time.Time{}
+			log.Printf("Scheduled message %s failed, it has to be sent again by hand: %v\n", updated.ID, err)
+		}
+	}
+
+	if err := s.update(&updated); err != nil {
+		// Keep the outcome in memory so that the message is not sent twice
+		s.messages[msg.ID] = &updated
+		log.Printf("Failed to journal scheduled message %s: %v\n", updated.ID, err)
+	}
+}
+
+// claim marks a due message as being sent, unless it was canceled or rescheduled since it was listed.
+// The claim is not journaled: a message found sending on startup is sent again.
+func (s *Scheduler) claim(msg ScheduledMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	current, ok := s.messages[msg.ID]
+	if !ok || current.Status != ScheduledPending || !current.UpdatedAt.Equal(msg.UpdatedAt) {
+		return false
+	}
+	current.Status = ScheduledSending
+	return true
+}
+
+// update journals a message and makes it current. The caller must hold mu.
+func (s *Scheduler) update(msg *ScheduledMessage) error {
+	if err := s.journal.append(msg); err != nil {
+		return err
+	}
+	s.messages[msg.ID] = msg
+	s.compactIfNeeded()
+	s.notify()
+
+	return nil
+}
+
+// notify wakes the worker up without blocking.
+func (s *Scheduler) notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+// compactIfNeeded compacts the journal once it holds much more records than messages. The caller must hold mu.
+func (s *Scheduler) compactIfNeeded() {
+	if !s.journal.needsRewrite(len(s.messages)) {
+		return
+	}
+	if err := s.compact(); err != nil {
+		log.Printf("Failed to compact the schedule journal: %v\n", err)
+	}
+}
+
+// compact rewrites the journal with one record per message, dropping the oldest sent and failed
+// messages beyond maxScheduledFinished. The caller must hold mu or own s.
+func (s *Scheduler) compact() error {
+	var finished []*ScheduledMessage
+	for _, msg := range s.messages {
+		if msg.Status == ScheduledSent || msg.Status == ScheduledFailed {
+			finished = append(finished, msg)
+		}
+	}
+	if len(finished) > maxScheduledFinished {
+		sort.Slice(finished, func(i, j int) bool {
+			return finished[i].UpdatedAt.Before(finished[j].UpdatedAt)
+		})
+		for _, msg := range finished[:len(finished)-maxScheduledFinished] {
+			delete(s.messages, msg.ID)
+		}
+	}
+
+	records := make([]interface{}, 0, len(s.messages))
+	for _, msg := range s.messages {
+		records = append(records, msg)
+	}
+
+	return s.journal.rewrite(records)
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// newTestScheduler opens a scheduler in dir with a fake clock, interpreting times without offset in Asia/Shanghai.
+func newTestScheduler(t *testing.T, dir string, bots *BotRegistry, outbox *Outbox) (*Scheduler, *fakeClock) {
+	location, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Fatalf("failed to load time zone: %v", err)
+	}
+
+	scheduler, err := OpenScheduler(dir, bots, outbox, location)
+	if err != nil {
+		t.Fatalf("OpenScheduler failed: %v", err)
+	}
+	clk := newFakeClock()
+	scheduler.clock = clk
+	t.Cleanup(func() { scheduler.Close() })
+
+	return scheduler, clk
+}
+
+// newDryRunBots creates a registry with a default bot recording its requests.
+func newDryRunBots(t *testing.T) (*BotRegistry, *DryRunSender) {
+	sender := NewDryRunSender()
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(sender))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	return bots, sender
+}
+
+// TestParseSendAt tests the accepted send time formats and their time zones.
+func TestParseSendAt(t *testing.T) {
+	bots, _ := newDryRunBots(t)
+	scheduler, clk := newTestScheduler(t, t.TempDir(), bots, nil)
+	now := clk.Now()
+
+	tests := []struct {
+		value    string
+		timezone string
+		expected time.Time
+	}{
+		{"+2h", "", now.Add(2 * time.Hour)},
+		{" +1h30m ", "", now.Add(90 * time.Minute)},
+		{"2024-01-02T09:30:00+08:00", "", time.Date(2024, 1, 2, 1, 30, 0, 0, time.UTC)},
+		{"2024-01-02T09:30:00Z", "Asia/Shanghai", time.Date(2024, 1, 2, 9, 30, 0, 0, time.UTC)},
+		{"2024-01-01 18:30", "", time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)},
+		{"2024-01-01T18:30:15", "", time.Date(2024, 1, 1, 10, 30, 15, 0, time.UTC)},
+		{"2024-01-01 09:30", "America/New_York", time.Date(2024, 1, 1, 14, 30, 0, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		at, err := scheduler.ParseSendAt(tt.value, tt.timezone)
+		if err != nil || !at.Equal(tt.expected) {
+			t.Errorf("%q %q: expected %v, got %v (%v)", tt.value, tt.timezone, tt.expected, at, err)
+		}
+	}
+
+	// Relative times are expressed in the time zone used for display
+	if at, _ := scheduler.ParseSendAt("+2h", ""); at.Format(time.RFC3339) != "2024-01-01T19:00:00+08:00" {
+		t.Errorf("unexpected relative time: %s", at.Format(time.RFC3339))
+	}
+
+	invalid := []struct {
+		value    string
+		timezone string
+		expected string
+	}{
+		{"+soon", "", "invalid relative time"},
+		{"tomorrow", "", "invalid time"},
+		{"2024-01-01 16:00", "", "is not in the future"},
+		{"+0s", "", "is not in the future"},
+		{"2024-01-02 09:30", "Mars/Olympus", "invalid timezone"},
+	}
+	for _, tt := range invalid {
+		if _, err := scheduler.ParseSendAt(tt.value, tt.timezone); err == nil || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%q %q: expected %q, got %v", tt.value, tt.timezone, tt.expected, err)
+		}
+	}
+}
+
+// TestSchedulerSendsDueMessages tests that messages are sent once their send time is reached.
+func TestSchedulerSendsDueMessages(t *testing.T) {
+	bots, sender := newDryRunBots(t)
+	scheduler, clk := newTestScheduler(t, t.TempDir(), bots, nil)
+
+	msg, _ := NewTextMessage("release reminder", nil, nil, false)
+	later, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(2*time.Hour))
+	sooner, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(time.Hour))
+
+	if next := scheduler.sendDue(context.Background()); !next.Equal(sooner.SendAt) || len(sender.Records()) != 0 {
+		t.Fatalf("nothing should be sent yet, next send at %v", next)
+	}
+	if pending := scheduler.List(ScheduledPending); len(pending) != 2 || pending[0].ID != sooner.ID {
+		t.Errorf("expected the messages in send order, got %+v", pending)
+	}
+
+	clk.Advance(time.Hour)
+	if next := scheduler.sendDue(context.Background()); !next.Equal(later.SendAt) || len(sender.Records()) != 1 {
+		t.Errorf("expected the first message to be sent, next send at %v", next)
+	}
+
+	clk.Advance(time.Hour)
+	if next := scheduler.sendDue(context.Background()); !next.IsZero() || len(sender.Records()) != 2 {
+		t.Errorf("expected both messages to be sent, next send at %v", next)
+	}
+
+	sent := scheduler.List(ScheduledSent)
+	if len(sent) != 2 || sent[0].Result == nil || sent[0].Result.Bot != DefaultBotName {
+		t.Errorf("unexpected sent messages: %+v", sent)
+	}
+	if _, err := scheduler.Cancel(sooner.ID); err == nil || !strings.Contains(err.Error(), "already sent") {
+		t.Errorf("sent messages should not be canceled, got %v", err)
+	}
+}
+
+// TestSchedulerFailure tests that failed sends are recorded.
+func TestSchedulerFailure(t *testing.T) {
+	server := newErrorServer(300001, "token is not exist")
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	scheduler, clk := newTestScheduler(t, t.TempDir(), bots, nil)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	scheduler.Schedule("", "", msg, clk.Now().Add(time.Minute))
+	clk.Advance(time.Minute)
+	scheduler.sendDue(context.Background())
+
+	if failed := scheduler.List(ScheduledFailed); len(failed) != 1 || !strings.Contains(failed[0].LastError, "300001") {
+		t.Errorf("expected a failed message, got %+v", scheduler.List(""))
+	}
+}
+
+// TestSchedulerRetriesTransientFailures tests that transient failures are retried within the retry window.
+func TestSchedulerRetriesTransientFailures(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls, http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL), WithRetryPolicy(RetryPolicy{MaxAttempts: 1}))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	scheduler, clk := newTestScheduler(t, t.TempDir(), bots, nil)
+	ctx := context.Background()
+
+	msg, _ := NewTextMessage("standup in 5 minutes", nil, nil, false)
+	scheduled, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(time.Minute))
+	clk.Advance(time.Minute)
+	next := scheduler.sendDue(ctx)
+	pending := scheduler.List(ScheduledPending)
+	if len(pending) != 1 || pending[0].Attempts != 1 || pending[0].LastError == "" || !next.Equal(pending[0].NextAttempt) || !next.After(clk.Now()) {
+		t.Fatalf("expected the message to be retried, got %+v", scheduler.List(""))
+	}
+
+	clk.Advance(next.Sub(clk.Now()))
+	scheduler.sendDue(ctx)
+	if sent := scheduler.List(ScheduledSent); len(sent) != 0 || calls != 2 {
+		t.Fatalf("expected a second failure, got %+v after %d calls", sent, calls)
+	}
+
+	// The retry window closes an hour after the send time
+	clk.Advance(time.Hour)
+	scheduler.sendDue(ctx)
+	failed := scheduler.List(ScheduledFailed)
+	if len(failed) != 1 || failed[0].ID != scheduled.ID || failed[0].Attempts != 3 || calls != 3 {
+		t.Errorf("expected the message to fail for good, got %+v after %d calls", scheduler.List(""), calls)
+	}
+}
+
+// TestSchedulerRescheduleDuringSend tests that a message being sent can be neither rescheduled nor canceled,
+// so that it is sent once and recorded as sent.
+func TestSchedulerRescheduleDuringSend(t *testing.T) {
+	var calls int64
+	received := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt64(&calls, 1)
+		received <- struct{}{}
+		<-release
+		json.NewEncoder(w).Encode(map[string]interface{}{"errcode": 0, "errmsg": "ok"})
+	}))
+	defer server.Close()
+
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithBaseURL(server.URL))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+	scheduler, clk := newTestScheduler(t, t.TempDir(), bots, nil)
+
+	msg, _ := NewTextMessage("release reminder", nil, nil, false)
+	scheduled, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(time.Minute))
+	clk.Advance(time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		scheduler.sendDue(context.Background())
+		close(done)
+	}()
+	<-received
+
+	if _, err := scheduler.Reschedule(scheduled.ID, clk.Now().Add(time.Hour)); err == nil || !strings.Contains(err.Error(), "being sent") {
+		t.Errorf("a message being sent should not be rescheduled, got %v", err)
+	}
+	if _, err := scheduler.Cancel(scheduled.ID); err == nil || !strings.Contains(err.Error(), "being sent") {
+		t.Errorf("a message being sent should not be canceled, got %v", err)
+	}
+	close(release)
+	<-done
+
+	clk.Advance(2 * time.Hour)
+	scheduler.sendDue(context.Background())
+	if sent := scheduler.List(ScheduledSent); len(sent) != 1 || atomic.LoadInt64(&calls) != 1 {
+		t.Errorf("expected the message to be sent once, got %+v after %d calls", scheduler.List(""), calls)
+	}
+}
+
+// TestSchedulerSurvivesRestart tests that pending messages, cancellations and new send times are replayed from the journal.
+func TestSchedulerSurvivesRestart(t *testing.T) {
+	bots, sender := newDryRunBots(t)
+	dir := t.TempDir()
+	scheduler, clk := newTestScheduler(t, dir, bots, nil)
+
+	msg, _ := NewMarkdownMessage("Release", "v1.2 ships today", nil, nil, false)
+	kept, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(time.Hour))
+	canceled, _, _ := scheduler.Schedule("", "", msg, clk.Now().Add(time.Hour))
+	if _, err := scheduler.Cancel(canceled.ID); err != nil {
+		t.Fatalf("Cancel failed: %v", err)
+	}
+	if _, err := scheduler.Reschedule(kept.ID, clk.Now().Add(3*time.Hour)); err != nil {
+		t.Fatalf("Reschedule failed: %v", err)
+	}
+	scheduler.Close()
+
+	// The server was down when the message was due, it is sent late
+	reopened, clk := newTestScheduler(t, dir, bots, nil)
+	pending := reopened.List("")
+	if len(pending) != 1 || pending[0].ID != kept.ID || !pending[0].SendAt.Equal(kept.SendAt.Add(2*time.Hour)) {
+		t.Fatalf("unexpected messages after restart: %+v", pending)
+	}
+
+	clk.Advance(4 * time.Hour)
+	reopened.sendDue(context.Background())
+	if len(sender.Records()) != 1 || len(reopened.List(ScheduledSent)) != 1 {
+		t.Errorf("expected the message to be sent after restart, got %+v", reopened.List(""))
+	}
+}
+
+// TestSchedulerOutbox tests that due messages are queued in the outbox when one is configured,
+// and that a repeated idempotency key is only scheduled once.
+func TestSchedulerOutbox(t *testing.T) {
+	var calls int64
+	server := newFlakyServer(&calls)
+	defer server.Close()
+
+	outbox, _ := newTestOutbox(t, t.TempDir(), server.URL)
+	scheduler, clk := newTestScheduler(t, t.TempDir(), outbox.bots, outbox)
+
+	msg, _ := NewTextMessage("hello", nil, nil, false)
+	first, _, _ := scheduler.Schedule("ops", "standup", msg, clk.Now().Add(time.Hour))
+	if second, duplicate, _ := scheduler.Schedule("", "standup", msg, clk.Now().Add(2*time.Hour)); !duplicate || second.ID != first.ID {
+		t.Errorf("expected the first scheduled message, got %+v", second)
+	}
+
+	clk.Advance(time.Hour)
+	scheduler.sendDue(context.Background())
+
+	sent := scheduler.List(ScheduledSent)
+	entries := outbox.List(OutboxPending)
+	if len(sent) != 1 || len(entries) != 1 || sent[0].OutboxID != entries[0].ID || entries[0].IdempotencyKey != "standup" {
+		t.Errorf("expected the message to be queued in the outbox, got %+v and %+v", sent, entries)
+	}
+	if calls != 0 {
+		t.Errorf("the outbox worker delivers the message, got %d calls", calls)
+	}
+}
+
+// TestScheduleTools tests scheduling through a send tool and managing the schedule with the schedule tools.
+func TestScheduleTools(t *testing.T) {
+	bots, sender := newDryRunBots(t)
+	scheduler, _ := newTestScheduler(t, t.TempDir(), bots, nil)
+	ctx := context.Background()
+
+	args := map[string]interface{}{"content": "release reminder", "send_at": "2024-01-02 09:30"}
+	result, _ := sendTextHandler(NewDispatcher(bots, nil, nil, nil))(ctx, newToolRequest("send_text", args))
+	if !result.IsError || !strings.Contains(result.Content[0].(mcp.TextContent).Text, "DINGDING_BOT_SCHEDULE_DIR") {
+		t.Errorf("send_at should be rejected without a scheduler, got %+v", result.Content)
+	}
+
+	result, _ = sendTextHandler(NewDispatcher(bots, nil, scheduler, nil))(ctx, newToolRequest("send_text", args))
+	text := result.Content[0].(mcp.TextContent).Text
+	if result.IsError || !strings.Contains(text, "scheduled for 2024-01-02T09:30:00+08:00") || len(sender.Records()) != 0 {
+		t.Fatalf("unexpected result: %q", text)
+	}
+	var scheduled []ScheduledMessage
+	resultJSON(t, result, &scheduled)
+
+	result, _ = rescheduleHandler(scheduler)(ctx, newToolRequest("reschedule", map[string]interface{}{
+		"id": scheduled[0].ID, "send_at": "2024-01-02 10:00", "timezone": "UTC",
+	}))
+	if text := result.Content[0].(mcp.TextContent).Text; result.IsError || !strings.Contains(text, "2024-01-02T10:00:00Z") {
+		t.Errorf("unexpected reschedule result: %q", text)
+	}
+
+	result, _ = listScheduledHandler(scheduler)(ctx, newToolRequest("list_scheduled", nil))
+	var listed []ScheduledMessage
+	resultJSON(t, result, &listed)
+	if len(listed) != 1 || listed[0].SendAt.Format(time.RFC3339) != "2024-01-02T10:00:00Z" {
+		t.Errorf("unexpected scheduled messages: %+v", listed)
+	}
+
+	result, _ = cancelScheduledHandler(scheduler)(ctx, newToolRequest("cancel_scheduled", map[string]interface{}{"id": scheduled[0].ID}))
+	if result.IsError || len(scheduler.List("")) != 0 {
+		t.Errorf("cancel_scheduled failed: %+v", result.Content)
+	}
+
+	result, _ = sendTextHandler(NewDispatcher(bots, nil, scheduler, nil))(ctx, newToolRequest("send_text", map[string]interface{}{
+		"content": "hello", "timezone": "UTC",
+	}))
+	if !result.IsError {
+		t.Errorf("timezone without send_at should be rejected")
+	}
+}
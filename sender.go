@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Send modes selectable through DINGDING_BOT_SEND_MODE or the -send-mode flag
+const (
+	// SendModeHTTP delivers requests to the DingDing API
+	SendModeHTTP = "http"
+
+	// SendModeDryRun records requests in memory without delivering them
+	SendModeDryRun = "dry-run"
+
+	// SendModeFile appends requests to a capture file without delivering them
+	SendModeFile = "file"
+)
+
+// maxDryRunRecords bounds how many requests the dry-run sender keeps in memory
+const maxDryRunRecords = 100
+
+// OutgoingRequest is an HTTP POST request to the DingDing API.
+type OutgoingRequest struct {
+	// URL is the full request URL, including access token and signature
+	URL string
+
+	// ContentType is the value of the Content-Type header
+	ContentType string
+
+	// Header holds additional request headers
+	Header http.Header
+
+	// Body is the request body
+	Body []byte
+}
+
+// OutgoingResponse is the response to an OutgoingRequest.
+type OutgoingResponse struct {
+	// StatusCode is the HTTP status code
+	StatusCode int
+
+	// Body is the response body
+	Body []byte
+
+	// Header holds the response headers, nil for captured requests
+	Header http.Header
+
+	// DryRun reports whether the request was captured instead of delivered
+	DryRun bool
+}
+
+// Sender delivers requests to the DingDing API.
+// Implementations must be safe for concurrent use.
+// Errors wrapping ErrRequestNotSent are retried, other errors only when the send has an idempotency key.
+type Sender interface {
+	Send(ctx context.Context, req *OutgoingRequest) (*OutgoingResponse, error)
+}
+
+// ErrRequestNotSent marks a Sender error that happened before the request was written, such as a refused
+// connection or a failed TLS handshake, so DingDing cannot have posted the message
+var ErrRequestNotSent = errors.New("request not sent")
+
+// notSentError is a transport error of a request that was never written.
+type notSentError struct {
+	err error
+}
+
+func (e *notSentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *notSentError) Unwrap() []error {
+	return []error{e.err, ErrRequestNotSent}
+}
+
+// NewSender creates the Sender for the given send mode.
+// Parameters:
+//   - mode: One of SendModeHTTP, SendModeDryRun or SendModeFile; empty means SendModeHTTP
+//   - captureFile: The file requests are appended to in SendModeFile
+// Returns:
+//   - The Sender for the mode
+//   - An error if the mode is unknown or the capture file is missing
+func NewSender(mode string, captureFile string) (Sender, error) {
+	switch mode {
+	case "", SendModeHTTP:
+		return &HTTPSender{}, nil
+	case SendModeDryRun:
+		return NewDryRunSender(), nil
+	case SendModeFile:
+		if captureFile == "" {
+			return nil, fmt.Errorf("a capture file is required in %s mode", SendModeFile)
+		}
+		return NewFileSender(captureFile), nil
+	default:
+		return nil, fmt.Errorf("unknown send mode: %s", mode)
+	}
+}
+
+// HTTPSender delivers requests to the DingDing API over HTTP.
+type HTTPSender struct {
+	// Client is the HTTP client used for requests, http.DefaultClient when nil
+	Client *http.Client
+}
+
+// Send posts the request and reads the whole response body.
+func (s *HTTPSender) Send(ctx context.Context, req *OutgoingRequest) (*OutgoingResponse, error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, req.URL, bytes.NewReader(req.Body))
+	if err != nil {
+		return nil, err
+	}
+	for key, values := range req.Header {
+		for _, value := range values {
+			httpReq.Header.Add(key, value)
+		}
+	}
+	httpReq.Header.Set("Content-Type", req.ContentType)
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	// Track whether the whole request was written, after that DingDing may have acted on it
+	var wrote atomic.Bool
+	httpReq = httpReq.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		WroteRequest: func(info httptrace.WroteRequestInfo) {
+			if info.Err == nil {
+				wrote.Store(true)
+			}
+		},
+	}))
+
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		if !wrote.Load() {
+			return nil, &notSentError{err}
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OutgoingResponse{StatusCode: resp.StatusCode, Body: body, Header: resp.Header}, nil
+}
+
+// CapturedRequest is a request recorded by the dry-run and file senders.
+// Secrets in the URL are redacted and binary bodies are summarized.
+type CapturedRequest struct {
+	// Time is when the request was captured
+	Time time.Time `json:"time"`
+
+	// URL is the request URL with the access token and signature redacted
+	URL string `json:"url"`
+
+	// ContentType is the value of the Content-Type header
+	ContentType string `json:"content_type"`
+
+	// Body is the JSON request body, or a summary for non-JSON bodies
+	Body string `json:"body"`
+}
+
+// DryRunSender records requests in memory instead of delivering them.
+type DryRunSender struct {
+	mu      sync.Mutex
+	records []CapturedRequest
+}
+
+// NewDryRunSender creates a new DryRunSender.
+func NewDryRunSender() *DryRunSender {
+	return &DryRunSender{}
+}
+
+// Send records the request and returns a successful DingDing response.
+func (s *DryRunSender) Send(ctx context.Context, req *OutgoingRequest) (*OutgoingResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.records = append(s.records, captureRequest(req))
+	if len(s.records) > maxDryRunRecords {
+		s.records = s.records[len(s.records)-maxDryRunRecords:]
+	}
+
+	return cannedResponse(req), nil
+}
+
+// Records returns a copy of the recorded requests, oldest first.
+func (s *DryRunSender) Records() []CapturedRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]CapturedRequest(nil), s.records...)
+}
+
+// FileSender appends requests as JSON lines to a capture file instead of delivering them.
+type FileSender struct {
+	mu   sync.Mutex
+	path string
+}
+
+// NewFileSender creates a new FileSender writing to path.
+func NewFileSender(path string) *FileSender {
+	return &FileSender{path: path}
+}
+
+// Send appends the request to the capture file and returns a successful DingDing response.
+func (s *FileSender) Send(ctx context.Context, req *OutgoingRequest) (*OutgoingResponse, error) {
+	line, err := json.Marshal(captureRequest(req))
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open capture file: %v", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return nil, fmt.Errorf("failed to write capture file: %v", err)
+	}
+
+	return cannedResponse(req), nil
+}
+
+// captureRequest converts a request into its recorded form.
+func captureRequest(req *OutgoingRequest) CapturedRequest {
+	body := string(req.Body)
+	if !strings.HasPrefix(req.ContentType, "application/json") {
+		body = fmt.Sprintf("<%d bytes of %s>", len(req.Body), req.ContentType)
+	} else if strings.HasSuffix(req.URL, accessTokenPath) {
+		body = redactAppSecret(req.Body)
+	}
+
+	return CapturedRequest{
+		Time:        time.Now(),
+		URL:         redactURL(req.URL),
+		ContentType: req.ContentType,
+		Body:        body,
+	}
+}
+
+// cannedResponse builds the successful DingDing response returned for captured requests.
+func cannedResponse(req *OutgoingRequest) *OutgoingResponse {
+	result := map[string]interface{}{
+		"errcode": 0,
+		"errmsg":  "ok",
+	}
+
+	// Uploads are expected to return a media ID
+	if strings.Contains(req.URL, "/upload_media") {
+		result["media_id"] = "dry-run-media-id"
+	}
+
+	// Enterprise apps expect an access token, the key of the sent message, the recall outcome and the user ID of a mobile
+	if strings.HasSuffix(req.URL, accessTokenPath) {
+		result = map[string]interface{}{"accessToken": "dry-run-access-token", "expireIn": 7200}
+	}
+	if strings.HasSuffix(req.URL, groupMessagePath) || strings.HasSuffix(req.URL, directMessagePath) {
+		result = map[string]interface{}{"processQueryKey": "dry-run-process-query-key"}
+	}
+	if strings.HasSuffix(req.URL, groupRecallPath) || strings.HasSuffix(req.URL, directRecallPath) {
+		result = map[string]interface{}{"successResult": []string{}, "failedResult": map[string]string{}}
+	}
+	if strings.Contains(req.URL, userByMobilePath) {
+		result["result"] = map[string]interface{}{"userid": "dry-run-user-id"}
+	}
+
+	body, _ := json.Marshal(result)
+
+	return &OutgoingResponse{StatusCode: http.StatusOK, Body: body, DryRun: true}
+}
+
+// redactURL hides the access token, signature and session in a request URL.
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "<invalid url>"
+	}
+
+	query := u.Query()
+	for _, key := range []string{"access_token", "sign", "session"} {
+		if query.Has(key) {
+			query.Set(key, "REDACTED")
+		}
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// redactAppSecret hides the AppSecret in the body of an access token request.
+func redactAppSecret(body []byte) string {
+	var credentials map[string]interface{}
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		return "<invalid JSON>"
+	}
+	if _, ok := credentials["appSecret"]; ok {
+		credentials["appSecret"] = "REDACTED"
+	}
+
+	redacted, err := marshalJSON(credentials, "")
+	if err != nil {
+		return "<invalid JSON>"
+	}
+	return string(redacted)
+}
+
+// redactPayload summarizes the Base64 data of image messages, which is too large to echo back.
+// Other payloads are returned unchanged.
+func redactPayload(payload []byte) json.RawMessage {
+	var msg struct {
+		MsgType string `json:"msgtype"`
+		Image   struct {
+			Base64 string `json:"base64"`
+			MD5    string `json:"md5"`
+		} `json:"image"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.MsgType != "image" {
+		return payload
+	}
+
+	redacted, err := marshalJSON(map[string]interface{}{
+		"msgtype": msg.MsgType,
+		"image": map[string]string{
+			"base64": fmt.Sprintf("<%d bytes of base64>", len(msg.Image.Base64)),
+			"md5":    msg.Image.MD5,
+		},
+	}, "")
+	if err != nil {
+		return payload
+	}
+
+	return redacted
+}
+
+// marshalJSON encodes v without escaping HTML characters, which are common in messages and summaries.
+// A non-empty indent indents the output.
+func marshalJSON(v interface{}, indent string) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", indent)
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+// Transports the MCP server can be served over
+const (
+	// TransportStdio serves a single client over stdin and stdout
+	TransportStdio = "stdio"
+
+	// TransportSSE serves clients over Server-Sent Events on /sse and /message
+	TransportSSE = "sse"
+
+	// TransportHTTP serves clients over the streamable HTTP transport on /mcp
+	TransportHTTP = "http"
+)
+
+const (
+	// DefaultListenAddr is the address the SSE and HTTP transports listen on by default
+	DefaultListenAddr = ":8080"
+
+	// shutdownTimeout bounds how long in-flight tool calls may take to finish on shutdown
+	shutdownTimeout = 30 * time.Second
+
+	// maxMessageSize bounds the size of a JSON-RPC message, large enough for Base64 images
+	maxMessageSize = 8 << 20
+
+	// sseSessionBuffer is the number of responses queued for a slow SSE client
+	sseSessionBuffer = 16
+
+	// httpSessionIdleTimeout is how long a streamable HTTP session is kept without requests
+	httpSessionIdleTimeout = 24 * time.Hour
+)
+
+// Serve runs the MCP server over the given transport until it is interrupted by SIGINT or SIGTERM.
+// Parameters:
+//   - s: The MCP server with its tools registered
+//   - transport: One of TransportStdio, TransportSSE or TransportHTTP; empty means TransportStdio
+//   - addr: The listen address of the SSE and HTTP transports
+//   - authToken: The bearer token required by the SSE and HTTP transports
+// Returns:
+//   - An error if the server cannot start or stops abnormally, nil otherwise
+func Serve(s *server.MCPServer, transport string, addr string, authToken string) error {
+	if transport == "" || transport == TransportStdio {
+		return server.ServeStdio(s)
+	}
+
+	httpServer, err := NewHTTPServer(s, transport, authToken)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	return httpServer.ListenAndServe(ctx, addr)
+}
+
+// HTTPServer serves an MCP server over the SSE or streamable HTTP transport.
+// Every endpoint except /healthz requires the bearer token, including the expvar metrics on /debug/vars.
+type HTTPServer struct {
+	mcp       *server.MCPServer
+	transport string
+	authToken string
+
+	// sessions maps SSE session IDs to their *sseSession
+	sessions sync.Map
+
+	// mu guards the fields below
+	mu sync.Mutex
+
+	// httpSessions maps the session IDs issued by the streamable HTTP transport to when they were last used
+	httpSessions map[string]time.Time
+	lastPrune    time.Time
+
+	// closing is set on shutdown, SSE messages posted afterwards are rejected
+	closing bool
+
+	// calls tracks the SSE messages handled in the background
+	calls sync.WaitGroup
+
+	// done is closed on shutdown to end the SSE streams
+	done      chan struct{}
+	closeDone sync.Once
+}
+
+// sseSession is an open SSE stream waiting for the responses to its messages.
+type sseSession struct {
+	events chan []byte
+	done   chan struct{}
+
+	// ctx is canceled when the stream ends, aborting the messages still handled for it
+	ctx context.Context
+}
+
+// NewHTTPServer creates the HTTP server for the SSE or streamable HTTP transport.
+// Parameters:
+//   - s: The MCP server with its tools registered
+//   - transport: TransportSSE or TransportHTTP
+//   - authToken: The bearer token clients must send in the Authorization header
+// Returns:
+//   - The HTTP server
+//   - An error if the transport is unknown or the token is missing
+func NewHTTPServer(s *server.MCPServer, transport string, authToken string) (*HTTPServer, error) {
+	if transport != TransportSSE && transport != TransportHTTP {
+		return nil, fmt.Errorf("unknown transport %q, expected %s, %s or %s", transport, TransportStdio, TransportSSE, TransportHTTP)
+	}
+	if authToken == "" {
+		return nil, fmt.Errorf("an auth token is required for the %s transport, set DINGDING_BOT_AUTH_TOKEN", transport)
+	}
+
+	return &HTTPServer{
+		mcp:          s,
+		transport:    transport,
+		authToken:    authToken,
+		httpSessions: make(map[string]time.Time),
+		done:         make(chan struct{}),
+	}, nil
+}
+
+// Handler returns the HTTP handler serving the transport endpoints.
+func (h *HTTPServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	mux.Handle("/debug/vars", h.authenticate(expvar.Handler()))
+
+	switch h.transport {
+	case TransportSSE:
+		mux.Handle("/sse", h.authenticate(http.HandlerFunc(h.handleSSE)))
+		mux.Handle("/message", h.authenticate(http.HandlerFunc(h.handleSSEMessage)))
+	case TransportHTTP:
+		mux.Handle("/mcp", h.authenticate(http.HandlerFunc(h.handleHTTP)))
+	}
+
+	return mux
+}
+
+// ListenAndServe serves the transport on addr until ctx is done, then shuts down gracefully.
+// In-flight tool calls are given shutdownTimeout to finish, the results of SSE messages are
+// delivered before the streams end.
+func (h *HTTPServer) ListenAndServe(ctx context.Context, addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+
+	srv := &http.Server{
+		Handler:           h.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.Serve(listener)
+	}()
+	log.Printf("Serving MCP over %s on %s\n", h.transport, listener.Addr())
+
+	select {
+	case err := <-serveErr:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+
+	h.mu.Lock()
+	h.closing = true
+	h.mu.Unlock()
+
+	called := make(chan struct{})
+	go func() {
+		h.calls.Wait()
+		close(called)
+	}()
+	select {
+	case <-called:
+	case <-shutdownCtx.Done():
+	}
+	h.closeDone.Do(func() { close(h.done) })
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("failed to shut down: %v", err)
+	}
+	if err := <-serveErr; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
+
+// authenticate rejects requests without the bearer token.
+func (h *HTTPServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.authToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mcp-dingdingbot-server"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleSSE opens an SSE stream, announces the message endpoint of the session
+// and writes the responses to the messages posted to it.
+func (h *HTTPServer) handleSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	sessionID := uuid.New().String()
+	session := &sseSession{
+		events: make(chan []byte, sseSessionBuffer),
+		done:   make(chan struct{}),
+		ctx:    ctx,
+	}
+	h.sessions.Store(sessionID, session)
+	defer func() {
+		h.sessions.Delete(sessionID)
+		close(session.done)
+		cancel()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+
+	fmt.Fprintf(w, "event: endpoint\ndata: /message?sessionId=%s\n\n", sessionID)
+	flusher.Flush()
+
+	for {
+		select {
+		case event := <-session.events:
+			fmt.Fprintf(w, "event: message\ndata: %s\n\n", event)
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// handleSSEMessage accepts a JSON-RPC message posted to an SSE session right away and handles it
+// in the background, the response is delivered on the SSE stream.
+func (h *HTTPServer) handleSSEMessage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := r.URL.Query().Get("sessionId")
+	value, ok := h.sessions.Load(sessionID)
+	if !ok {
+		writeJSONRPCError(w, http.StatusNotFound, mcp.INVALID_PARAMS, "Invalid session ID")
+		return
+	}
+	session := value.(*sseSession)
+
+	message, err := readMessage(r)
+	if err != nil {
+		writeJSONRPCError(w, http.StatusBadRequest, mcp.PARSE_ERROR, err.Error())
+		return
+	}
+
+	h.mu.Lock()
+	if h.closing {
+		h.mu.Unlock()
+		http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	h.calls.Add(1)
+	h.mu.Unlock()
+
+	w.WriteHeader(http.StatusAccepted)
+
+	go func() {
+		defer h.calls.Done()
+		h.deliverSSEMessage(sessionID, session, message)
+	}()
+}
+
+// deliverSSEMessage handles a message posted to an SSE session and writes its response to the stream.
+func (h *HTTPServer) deliverSSEMessage(sessionID string, session *sseSession, message json.RawMessage) {
+	response := h.handleMessage(session.ctx, sessionID, message)
+	if response == nil {
+		return
+	}
+
+	event, err := json.Marshal(response)
+	if err != nil {
+		log.Printf("Failed to encode the response for SSE session %s: %v\n", sessionID, err)
+		return
+	}
+
+	select {
+	case session.events <- event:
+	case <-session.done:
+	}
+}
+
+// handleHTTP handles the streamable HTTP transport. Every POST carries a JSON-RPC message
+// or batch, answered with a JSON body; the server does not push messages on its own.
+func (h *HTTPServer) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sessionID := r.Header.Get("Mcp-Session-Id")
+	if sessionID != "" && !h.touchSession(sessionID) {
+		// The client starts a new session when its session is unknown
+		writeJSONRPCError(w, http.StatusNotFound, mcp.INVALID_PARAMS, "Invalid session ID")
+		return
+	}
+
+	message, err := readMessage(r)
+	if err != nil {
+		writeJSONRPCError(w, http.StatusBadRequest, mcp.PARSE_ERROR, err.Error())
+		return
+	}
+
+	if sessionID == "" {
+		sessionID = h.issueSession()
+		w.Header().Set("Mcp-Session-Id", sessionID)
+	}
+
+	var response interface{}
+	if bytes.HasPrefix(bytes.TrimSpace(message), []byte("[")) {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(message, &batch); err != nil {
+			writeJSONRPCError(w, http.StatusBadRequest, mcp.PARSE_ERROR, "Parse error")
+			return
+		}
+
+		responses := make([]mcp.JSONRPCMessage, 0, len(batch))
+		for _, item := range batch {
+			if itemResponse := h.handleMessage(r.Context(), sessionID, item); itemResponse != nil {
+				responses = append(responses, itemResponse)
+			}
+		}
+		if len(responses) > 0 {
+			response = responses
+		}
+	} else if itemResponse := h.handleMessage(r.Context(), sessionID, message); itemResponse != nil {
+		response = itemResponse
+	}
+
+	if response == nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// issueSession starts a streamable HTTP session, forgetting the sessions idle for longer than httpSessionIdleTimeout.
+func (h *HTTPServer) issueSession() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(h.lastPrune) > time.Minute {
+		for id, lastUsed := range h.httpSessions {
+			if now.Sub(lastUsed) > httpSessionIdleTimeout {
+				delete(h.httpSessions, id)
+			}
+		}
+		h.lastPrune = now
+	}
+
+	sessionID := uuid.New().String()
+	h.httpSessions[sessionID] = now
+	return sessionID
+}
+
+// touchSession reports whether a streamable HTTP session was issued and is not expired, marking it used.
+func (h *HTTPServer) touchSession(sessionID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lastUsed, ok := h.httpSessions[sessionID]
+	if !ok || time.Since(lastUsed) > httpSessionIdleTimeout {
+		delete(h.httpSessions, sessionID)
+		return false
+	}
+	h.httpSessions[sessionID] = time.Now()
+	return true
+}
+
+// handleMessage passes a JSON-RPC message to the MCP server on behalf of a session.
+func (h *HTTPServer) handleMessage(ctx context.Context, sessionID string, message json.RawMessage) mcp.JSONRPCMessage {
+	ctx = h.mcp.WithContext(ctx, server.NotificationContext{
+		ClientID:  sessionID,
+		SessionID: sessionID,
+	})
+
+	return h.mcp.HandleMessage(ctx, message)
+}
+
+// readMessage reads a JSON-RPC message from the request body.
+func readMessage(r *http.Request) (json.RawMessage, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read message: %v", err)
+	}
+	if len(body) > maxMessageSize {
+		return nil, fmt.Errorf("message is larger than %d bytes", maxMessageSize)
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("parse error")
+	}
+
+	return body, nil
+}
+
+// writeJSONRPCError writes a JSON-RPC error response without request ID.
+func writeJSONRPCError(w http.ResponseWriter, status int, code int, message string) {
+	response := mcp.JSONRPCError{
+		JSONRPC: mcp.JSONRPC_VERSION,
+	}
+	response.Error.Code = code
+	response.Error.Message = message
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
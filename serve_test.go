@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+)
+
+const testAuthToken = "secret-token"
+
+// newTestMCPServer creates an MCP server with the send_text tool against a dry-run bot.
+func newTestMCPServer(t *testing.T) *server.MCPServer {
+	bots, err := NewBotRegistryFromConfig(nil, "token", "", WithSender(NewDryRunSender()))
+	if err != nil {
+		t.Fatalf("failed to create bots: %v", err)
+	}
+
+	s := server.NewMCPServer("test", "1.0.0")
+	s.AddTool(mcp.NewTool("send_text", mcp.WithString("content", mcp.Required())), sendTextHandler(NewDispatcher(bots, nil, nil, nil)))
+	return s
+}
+
+// postMessage posts a JSON-RPC message with the given bearer token.
+func postMessage(t *testing.T, url string, token string, message string) *http.Response {
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(message))
+	if err != nil {
+		t.Fatalf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	return resp
+}
+
+// TestNewHTTPServer tests the transport and token validation.
+func TestNewHTTPServer(t *testing.T) {
+	s := server.NewMCPServer("test", "1.0.0")
+	if _, err := NewHTTPServer(s, "websocket", testAuthToken); err == nil {
+		t.Errorf("unknown transports should be rejected")
+	}
+	if _, err := NewHTTPServer(s, TransportHTTP, ""); err == nil {
+		t.Errorf("a missing auth token should be rejected")
+	}
+}
+
+// TestHTTPTransportAuth tests that requests without the bearer token are rejected.
+func TestHTTPTransportAuth(t *testing.T) {
+	httpServer, err := NewHTTPServer(newTestMCPServer(t), TransportHTTP, testAuthToken)
+	if err != nil {
+		t.Fatalf("NewHTTPServer failed: %v", err)
+	}
+	ts := httptest.NewServer(httpServer.Handler())
+	defer ts.Close()
+
+	ping := `{"jsonrpc":"2.0","id":1,"method":"ping"}`
+	for _, token := range []string{"", "wrong-token"} {
+		resp := postMessage(t, ts.URL+"/mcp", token, ping)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: expected 401, got %d", token, resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Get(ts.URL + "/healthz")
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Errorf("/healthz should not require the token: %v", err)
+	}
+
+	resp, err = http.Get(ts.URL + "/debug/vars")
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("/debug/vars should require the token: %v", err)
+	}
+}
+
+// TestHTTPTransport tests tool calls, batches and notifications over the streamable HTTP transport.
+func TestHTTPTransport(t *testing.T) {
+	httpServer, err := NewHTTPServer(newTestMCPServer(t), TransportHTTP, testAuthToken)
+	if err != nil {
+		t.Fatalf("NewHTTPServer failed: %v", err)
+	}
+	ts := httptest.NewServer(httpServer.Handler())
+	defer ts.Close()
+
+	resp := postMessage(t, ts.URL+"/mcp", testAuthToken, `{"jsonrpc":"2.0","id":1,"method":"tools/call","params":{"name":"send_text","arguments":{"content":"hello"}}}`)
+	defer resp.Body.Close()
+
+	var result struct {
+		ID     int                `json:"id"`
+		Result mcp.CallToolResult `json:"result"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode response: %v", err)
+	}
+	if result.ID != 1 || result.Result.IsError || resp.Header.Get("Mcp-Session-Id") == "" {
+		t.Errorf("unexpected tool call response: %+v", result)
+	}
+
+	batch := postMessage(t, ts.URL+"/mcp", testAuthToken, `[{"jsonrpc":"2.0","id":1,"method":"ping"},{"jsonrpc":"2.0","method":"notifications/initialized"},{"jsonrpc":"2.0","id":2,"method":"ping"}]`)
+	defer batch.Body.Close()
+	var responses []json.RawMessage
+	if err := json.NewDecoder(batch.Body).Decode(&responses); err != nil || len(responses) != 2 {
+		t.Errorf("expected 2 batch responses, got %d (%v)", len(responses), err)
+	}
+
+	notification := postMessage(t, ts.URL+"/mcp", testAuthToken, `{"jsonrpc":"2.0","method":"notifications/initialized"}`)
+	notification.Body.Close()
+	if notification.StatusCode != http.StatusAccepted {
+		t.Errorf("expected 202 for a notification, got %d", notification.StatusCode)
+	}
+
+	// Requests carry the issued session ID, unknown IDs are rejected
+	for sessionID, status := range map[string]int{resp.Header.Get("Mcp-Session-Id"): http.StatusOK, "forged-session": http.StatusNotFound} {
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/mcp", strings.NewReader(`{"jsonrpc":"2.0","id":3,"method":"ping"}`))
+		req.Header.Set("Authorization", "Bearer "+testAuthToken)
+		req.Header.Set("Mcp-Session-Id", sessionID)
+		sessionResp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("request failed: %v", err)
+		}
+		sessionResp.Body.Close()
+		if sessionResp.StatusCode != status {
+			t.Errorf("session %s: expected %d, got %d", sessionID, status, sessionResp.StatusCode)
+		}
+	}
+}
+
+// TestSSETransport tests that posted messages are accepted right away and their responses delivered on the SSE stream.
+func TestSSETransport(t *testing.T) {
+	s := newTestMCPServer(t)
+	release := make(chan struct{})
+	s.AddTool(mcp.NewTool("slow_send"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		<-release
+		return mcp.NewToolResultText("sent"), nil
+	})
+	httpServer, err := NewHTTPServer(s, TransportSSE, testAuthToken)
+	if err != nil {
+		t.Fatalf("NewHTTPServer failed: %v", err)
+	}
+	ts := httptest.NewServer(httpServer.Handler())
+	defer ts.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/sse", nil)
+	req.Header.Set("Authorization", "Bearer "+testAuthToken)
+	stream, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("failed to open SSE stream: %v", err)
+	}
+	defer stream.Body.Close()
+
+	reader := bufio.NewReader(stream.Body)
+	readEvent := func() (string, string) {
+		var event, data string
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				t.Fatalf("failed to read SSE stream: %v", err)
+			}
+			line = strings.TrimRight(line, "\r\n")
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = strings.TrimPrefix(line, "data: ")
+			case line == "":
+				return event, data
+			}
+		}
+	}
+
+	event, endpoint := readEvent()
+	if event != "endpoint" || !strings.HasPrefix(endpoint, "/message?sessionId=") {
+		t.Fatalf("unexpected endpoint event: %s %s", event, endpoint)
+	}
+
+	resp := postMessage(t, ts.URL+endpoint, testAuthToken, `{"jsonrpc":"2.0","id":7,"method":"ping"}`)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+
+	event, data := readEvent()
+	if event != "message" || !strings.Contains(data, `"id":7`) {
+		t.Errorf("unexpected message event: %s %s", event, data)
+	}
+
+	// The post of a slow tool call is acknowledged before the call completes
+	slow := postMessage(t, ts.URL+endpoint, testAuthToken, `{"jsonrpc":"2.0","id":9,"method":"tools/call","params":{"name":"slow_send","arguments":{}}}`)
+	slow.Body.Close()
+	if slow.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", slow.StatusCode)
+	}
+	close(release)
+	event, data = readEvent()
+	if event != "message" || !strings.Contains(data, `"id":9`) || !strings.Contains(data, "sent") {
+		t.Errorf("unexpected message event: %s %s", event, data)
+	}
+
+	unknown := postMessage(t, ts.URL+"/message?sessionId=unknown", testAuthToken, `{"jsonrpc":"2.0","id":8,"method":"ping"}`)
+	unknown.Body.Close()
+	if unknown.StatusCode != http.StatusNotFound {
+		t.Errorf("expected 404 for an unknown session, got %d", unknown.StatusCode)
+	}
+}
+
+// TestGracefulShutdown tests that open SSE streams end and ListenAndServe returns when the context is done.
+func TestGracefulShutdown(t *testing.T) {
+	httpServer, err := NewHTTPServer(newTestMCPServer(t), TransportSSE, testAuthToken)
+	if err != nil {
+		t.Fatalf("NewHTTPServer failed: %v", err)
+	}
+
+	// Reserve a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to reserve a port: %v", err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- httpServer.ListenAndServe(ctx, addr)
+	}()
+
+	var stream *http.Response
+	for i := 0; i < 50; i++ {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/sse", nil)
+		req.Header.Set("Authorization", "Bearer "+testAuthToken)
+		if stream, err = http.DefaultClient.Do(req); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("failed to open SSE stream: %v", err)
+	}
+	defer stream.Body.Close()
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Errorf("ListenAndServe failed: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("ListenAndServe did not return after shutdown")
+	}
+}
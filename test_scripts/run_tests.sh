@@ -1,7 +1,8 @@
 #!/bin/bash
 
-# Start the server in the background with a test webhook key
+# Start the server in the background in dry-run mode
 export DINGDING_BOT_WEBHOOK_KEY="test-webhook-key"
+export DINGDING_BOT_SEND_MODE="dry-run"
 cd ..
 ./dist/mcp-dingdingbot-server &
 SERVER_PID=$!
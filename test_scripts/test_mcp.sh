@@ -4,6 +4,7 @@
 # This script sends test commands to the MCP server via stdin and captures the output
 
 export DINGDING_BOT_WEBHOOK_KEY="test-webhook-key"
+export DINGDING_BOT_SEND_MODE="dry-run"
 cd ..
 
 echo "Starting MCP server in test mode..."